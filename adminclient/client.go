@@ -0,0 +1,94 @@
+// Package adminclient talks to the load balancer's admin and status API.
+// The types and methods in generated.go come from the OpenAPI document the
+// load balancer serves at /lb-admin/openapi.json.
+package adminclient
+
+//go:generate go run ./gen ../pkg/loadbalancer/openapi.json generated.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Client struct {
+	// Admin listener, e.g. http://localhost:9091
+	AdminURL string
+	// Public listener serving /lb-status, e.g. http://localhost:9080
+	StatusURL string
+	// ADMIN_TOKEN, or ADMIN_READ_TOKEN for read-only use
+	Token      string
+	HTTPClient *http.Client
+}
+
+// An error response; the load balancer answers errors in plain text
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func New(adminURL, token string) *Client {
+	return &Client{
+		AdminURL:   strings.TrimSuffix(adminURL, "/"),
+		StatusURL:  "http://localhost:9080",
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Sends body as JSON and decodes a JSON response into result
+func (c *Client) do(ctx context.Context, method string, public bool, path string, query url.Values, body, result any) error {
+	base := c.AdminURL
+	if public {
+		base = c.StatusURL
+	}
+	target := base + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
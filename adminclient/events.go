@@ -0,0 +1,47 @@
+package adminclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Follows the admin WebSocket feed, calling handle for each event until
+// ctx is done or the load balancer closes the feed
+func (c *Client) WatchEvents(ctx context.Context, handle func(Event)) error {
+	target := "ws" + strings.TrimPrefix(c.AdminURL, "http") + "/lb-admin/events"
+	header := http.Header{}
+	if c.Token != "" {
+		header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, target, header)
+	if err != nil {
+		if resp != nil {
+			message, _ := io.ReadAll(resp.Body)
+			return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+		}
+		return err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	for {
+		var event Event
+		if err := conn.ReadJSON(&event); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				return nil
+			}
+			return err
+		}
+		handle(event)
+	}
+}
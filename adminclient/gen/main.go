@@ -0,0 +1,311 @@
+// Command gen writes the adminclient types and methods from the load
+// balancer's OpenAPI document. Run it with go generate in adminclient.
+// With -types, it writes only the types of a document's schemas, into the
+// package -package names, e.g. those of cmd/api's user API.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+type document struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type schema struct {
+	Ref         string             `json:"$ref"`
+	Type        string             `json:"type"`
+	Format      string             `json:"format"`
+	Description string             `json:"description"`
+	Properties  map[string]*schema `json:"properties"`
+	Required    []string           `json:"required"`
+	Items       *schema            `json:"items"`
+	AllOf       []*schema          `json:"allOf"`
+}
+
+type operation struct {
+	OperationID string      `json:"operationId"`
+	Summary     string      `json:"summary"`
+	Parameters  []parameter `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema *schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]struct {
+		Content map[string]struct {
+			Schema *schema `json:"schema"`
+		} `json:"content"`
+	} `json:"responses"`
+	Skip bool `json:"x-go-skip"`
+}
+
+type parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description"`
+	Schema      *schema `json:"schema"`
+	Skip        bool    `json:"x-go-skip"`
+	// Argument name, for parameters whose own name is taken, e.g. url by
+	// the package
+	GoName string `json:"x-go-name"`
+}
+
+func (p parameter) arg() string {
+	if p.GoName != "" {
+		return p.GoName
+	}
+	return p.Name
+}
+
+// Operations are generated in this order within a path
+var methods = []string{"get", "post", "put", "patch", "delete"}
+
+// Spelled in capitals in Go names
+var initialisms = map[string]string{"Id": "ID", "Url": "URL", "Ttl": "TTL", "Rps": "RPS", "Api": "API", "Ip": "IP", "Ms": "Ms"}
+
+func main() {
+	packageName := flag.String("package", "adminclient", "package of the generated code")
+	typesOnly := flag.Bool("types", false, "write the schemas' types without client methods")
+	flag.Parse()
+	if flag.NArg() != 2 {
+		log.Fatal("usage: gen [-package name] [-types] <openapi.json> <output.go>")
+	}
+	input, output := flag.Arg(0), flag.Arg(1)
+
+	data, err := os.ReadFile(input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var doc document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		log.Fatal(err)
+	}
+
+	var code bytes.Buffer
+	writeTypes(&code, doc.Components.Schemas)
+	if !*typesOnly {
+		if err := writeMethods(&code, doc.Paths); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by adminclient/gen from %s; DO NOT EDIT.\n\n", input)
+	fmt.Fprintf(&out, "package %s\n\nimport (\n", *packageName)
+	for _, pkg := range []string{"context", "net/http", "net/url", "strconv", "time"} {
+		if bytes.Contains(code.Bytes(), []byte(pkg[strings.LastIndex(pkg, "/")+1:]+".")) {
+			fmt.Fprintf(&out, "\t%q\n", pkg)
+		}
+	}
+	out.WriteString(")\n\n")
+	out.Write(code.Bytes())
+
+	source, err := format.Source(out.Bytes())
+	if err != nil {
+		log.Fatalf("formatting generated code: %v\n%s", err, out.Bytes())
+	}
+	if err := os.WriteFile(output, source, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func writeTypes(out *bytes.Buffer, schemas map[string]*schema) {
+	for _, name := range sortedKeys(schemas) {
+		s := schemas[name]
+		if s.Description != "" {
+			fmt.Fprintf(out, "// %s\n", s.Description)
+		}
+		fmt.Fprintf(out, "type %s struct {\n", name)
+		for _, part := range s.AllOf {
+			if part.Ref != "" {
+				fmt.Fprintf(out, "\t%s\n", refName(part.Ref))
+				continue
+			}
+			writeFields(out, part)
+		}
+		writeFields(out, s)
+		out.WriteString("}\n\n")
+	}
+}
+
+func writeFields(out *bytes.Buffer, s *schema) {
+	required := map[string]bool{}
+	for _, name := range s.Required {
+		required[name] = true
+	}
+
+	for _, name := range sortedKeys(s.Properties) {
+		property := s.Properties[name]
+		tag := name
+		if !required[name] {
+			tag += ",omitempty"
+		}
+		if property.Description != "" {
+			fmt.Fprintf(out, "\t// %s\n", property.Description)
+		}
+		fmt.Fprintf(out, "\t%s %s `json:\"%s\"`\n", goName(name), goType(property, required[name]), tag)
+	}
+}
+
+// Optional objects and times are pointers, so omitempty can leave them out
+func goType(s *schema, required bool) string {
+	pointer := ""
+	if !required {
+		pointer = "*"
+	}
+
+	switch {
+	case s.Ref != "":
+		return pointer + refName(s.Ref)
+	case s.Type == "array":
+		return "[]" + goType(s.Items, true)
+	case s.Type == "string" && s.Format == "date-time":
+		return pointer + "time.Time"
+	case s.Type == "string":
+		return "string"
+	case s.Type == "integer":
+		return "int64"
+	case s.Type == "number":
+		return "float64"
+	case s.Type == "boolean":
+		return "bool"
+	}
+	return "any"
+}
+
+func writeMethods(out *bytes.Buffer, paths map[string]map[string]json.RawMessage) error {
+	for _, path := range sortedKeys(paths) {
+		item := paths[path]
+		// Paths with their own servers are on the public listener
+		_, public := item["servers"]
+
+		for _, method := range methods {
+			raw, ok := item[method]
+			if !ok {
+				continue
+			}
+			var op operation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				return fmt.Errorf("%s %s: %w", method, path, err)
+			}
+			if !op.Skip {
+				writeMethod(out, path, method, public, op)
+			}
+		}
+	}
+	return nil
+}
+
+func writeMethod(out *bytes.Buffer, path, method string, public bool, op operation) {
+	args := []string{"ctx context.Context"}
+	pathExpr := fmt.Sprintf("%q", path)
+	var query []parameter
+
+	for _, p := range op.Parameters {
+		switch {
+		case p.Skip:
+		case p.In == "path":
+			args = append(args, p.Name+" string")
+			pathExpr = strings.Replace(pathExpr, "{"+p.Name+"}", `" + url.PathEscape(`+p.Name+`) + "`, 1)
+		case p.In == "query":
+			args = append(args, p.arg()+" "+goType(p.Schema, true))
+			query = append(query, p)
+		}
+	}
+	pathExpr = strings.TrimSuffix(pathExpr, ` + ""`)
+
+	body := "nil"
+	if op.RequestBody != nil {
+		args = append(args, "body "+goType(op.RequestBody.Content["application/json"].Schema, true))
+		body = "body"
+	}
+
+	result := ""
+	for _, code := range []string{"200", "201"} {
+		if content, ok := op.Responses[code].Content["application/json"]; ok {
+			result = goType(content.Schema, true)
+		}
+	}
+
+	fmt.Fprintf(out, "// %s calls %s %s: %s\n", goName(op.OperationID), strings.ToUpper(method), path, lowerFirst(op.Summary))
+	for _, p := range query {
+		fmt.Fprintf(out, "// %s: %s, left out when zero\n", p.arg(), lowerFirst(p.Description))
+	}
+
+	returns := "error"
+	if result != "" {
+		returns = fmt.Sprintf("(%s, error)", result)
+	}
+	fmt.Fprintf(out, "func (c *Client) %s(%s) %s {\n", goName(op.OperationID), strings.Join(args, ", "), returns)
+
+	out.WriteString("\tquery := url.Values{}\n")
+	for _, p := range query {
+		switch goType(p.Schema, true) {
+		case "bool":
+			fmt.Fprintf(out, "\tif %s {\n\t\tquery.Set(%q, \"true\")\n\t}\n", p.arg(), p.Name)
+		case "int64":
+			fmt.Fprintf(out, "\tif %s != 0 {\n\t\tquery.Set(%q, strconv.FormatInt(%s, 10))\n\t}\n", p.arg(), p.Name, p.arg())
+		default:
+			fmt.Fprintf(out, "\tif %s != \"\" {\n\t\tquery.Set(%q, %s)\n\t}\n", p.arg(), p.Name, p.arg())
+		}
+	}
+
+	call := fmt.Sprintf("c.do(ctx, http.Method%s, %t, %s, query, %s", goName(method), public, pathExpr, body)
+	if result == "" {
+		fmt.Fprintf(out, "\treturn %s, nil)\n}\n\n", call)
+		return
+	}
+	fmt.Fprintf(out, "\tvar result %s\n\terr := %s, &result)\n\treturn result, err\n}\n\n", result, call)
+}
+
+func refName(ref string) string {
+	return strings.TrimPrefix(ref, "#/components/schemas/")
+}
+
+// Exported Go name of a camelCase JSON name, e.g. latencyP95Ms -> LatencyP95Ms
+func goName(name string) string {
+	var words []string
+	start := 0
+	for i := 1; i <= len(name); i++ {
+		if i == len(name) || (name[i] >= 'A' && name[i] <= 'Z') {
+			words = append(words, name[start:i])
+			start = i
+		}
+	}
+	for i, word := range words {
+		word = strings.ToUpper(word[:1]) + word[1:]
+		if initialism, ok := initialisms[word]; ok {
+			word = initialism
+		}
+		words[i] = word
+	}
+	return strings.Join(words, "")
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,42 @@
+package adminclient
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Copies a pprof profile of the running load balancer to w, e.g. "profile"
+// with seconds=10 for CPU or "heap". Only the operator token may fetch them.
+func (c *Client) Profile(ctx context.Context, name string, query url.Values, w io.Writer) error {
+	target := c.AdminURL + "/lb-admin/debug/pprof/" + url.PathEscape(name)
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	// CPU profiles take as long as they sample, so ctx bounds the request
+	// instead of the client's timeout
+	client := *c.HTTPClient
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"load-balancer-demo/requestid"
+)
+
+// Failures the instance injects on purpose, so the load balancer's retries,
+// retry penalties and health checks can be watched at work. Set from the
+// CHAOS_* settings at startup and with PUT /chaos later.
+type ChaosSettings struct {
+	// Fractions of /api requests answered with 500, and never answered
+	// until the client gives up
+	ErrorRate float64 `json:"errorRate"`
+	HangRate  float64 `json:"hangRate"`
+	// Fails /health and /readyz
+	Unhealthy bool `json:"unhealthy"`
+	// Exits the process on the /api request after this many, 0 for never
+	CrashAfter int64 `json:"crashAfter"`
+}
+
+// What GET /chaos answers with
+type ChaosStatus struct {
+	ChaosSettings
+	// /api requests since the settings were last set
+	Requests  int64  `json:"requests"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+type chaos struct {
+	logger   *slog.Logger
+	mutex    sync.Mutex
+	settings ChaosSettings
+	requests int64
+}
+
+// CHAOS_ERROR_RATE, CHAOS_HANG_RATE, CHAOS_UNHEALTHY and CHAOS_CRASH_AFTER
+func chaosEnv(logger *slog.Logger) *chaos {
+	settings := ChaosSettings{
+		ErrorRate:  floatEnv("CHAOS_ERROR_RATE", 0),
+		HangRate:   floatEnv("CHAOS_HANG_RATE", 0),
+		Unhealthy:  boolEnv("CHAOS_UNHEALTHY", false),
+		CrashAfter: int64(intEnv("CHAOS_CRASH_AFTER", 0)),
+	}
+	if fields := settings.validate(); len(fields) > 0 {
+		settingNames := map[string]string{
+			"errorRate":  "CHAOS_ERROR_RATE",
+			"hangRate":   "CHAOS_HANG_RATE",
+			"crashAfter": "CHAOS_CRASH_AFTER",
+		}
+		log.Fatalf("invalid %s: %s", settingNames[fields[0].Field], fields[0].Message)
+	}
+	if settings != (ChaosSettings{}) {
+		logger.Warn("💥 Injecting failures", "settings", settings)
+	}
+	return &chaos{logger: logger, settings: settings}
+}
+
+func (s ChaosSettings) validate() []FieldError {
+	var fields []FieldError
+	if s.ErrorRate < 0 || s.ErrorRate > 1 {
+		fields = append(fields, FieldError{"errorRate", "must be from 0 to 1"})
+	}
+	if s.HangRate < 0 || s.HangRate > 1 {
+		fields = append(fields, FieldError{"hangRate", "must be from 0 to 1"})
+	}
+	if len(fields) == 0 && s.ErrorRate+s.HangRate > 1 {
+		fields = append(fields, FieldError{"hangRate", "plus errorRate can't be more than 1"})
+	}
+	if s.CrashAfter < 0 {
+		fields = append(fields, FieldError{"crashAfter", "can't be negative"})
+	}
+	return fields
+}
+
+func (c *chaos) unhealthy() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.settings.Unhealthy
+}
+
+// Injects the failures into /api requests; the other endpoints, e.g. /chaos
+// itself, are left alone
+func (c *chaos) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, "/api/") {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		c.mutex.Lock()
+		c.requests++
+		settings, requests := c.settings, c.requests
+		c.mutex.Unlock()
+
+		if settings.CrashAfter > 0 && requests > settings.CrashAfter {
+			c.logger.Error("💥 Crashing on purpose", "requests", requests-1)
+			os.Exit(1)
+		}
+		roll := rand.Float64()
+		switch {
+		case roll < settings.ErrorRate:
+			writeError(w, req, http.StatusInternalServerError, APIError{Code: "chaos", Message: "failed on purpose"})
+		case roll < settings.ErrorRate+settings.HangRate:
+			<-req.Context().Done()
+		default:
+			next.ServeHTTP(w, req)
+		}
+	})
+}
+
+// GET /chaos answers with the settings, PUT /chaos replaces them and DELETE
+// /chaos turns every failure off. Either restarts the request count.
+func (c *chaos) handle(w http.ResponseWriter, req *http.Request) {
+	var settings ChaosSettings
+	if req.Method == http.MethodPut {
+		decoder := json.NewDecoder(req.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&settings); err != nil {
+			writeError(w, req, http.StatusBadRequest, APIError{Code: "invalid_json", Message: err.Error()})
+			return
+		}
+		if fields := settings.validate(); len(fields) > 0 {
+			writeError(w, req, http.StatusUnprocessableEntity, APIError{
+				Code:    "validation_failed",
+				Message: "the chaos settings are invalid",
+				Fields:  fields,
+			})
+			return
+		}
+	}
+
+	c.mutex.Lock()
+	if req.Method != http.MethodGet {
+		c.settings, c.requests = settings, 0
+		c.logger.Warn("💥 Chaos settings changed", "settings", settings)
+	}
+	status := ChaosStatus{
+		ChaosSettings: c.settings,
+		Requests:      c.requests,
+		RequestID:     requestid.FromContext(req.Context()),
+	}
+	c.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+
+	"load-balancer-demo/internal/config"
+)
+
+// Guards the endpoints that change how the instance behaves, /chaos and
+// /rate-limit: they only exist with CONTROL_ENDPOINTS on, and only answer
+// requests carrying CONTROL_TOKEN as a bearer token, so a demo instance
+// reachable by others can't be made to fail, crash or refuse requests by
+// them
+type controlGate struct {
+	token string
+}
+
+// CONTROL_ENDPOINTS and CONTROL_TOKEN; nil when the endpoints are off
+func controlEnv() *controlGate {
+	if !boolEnv("CONTROL_ENDPOINTS", false) {
+		return nil
+	}
+	token := config.Get("CONTROL_TOKEN", "")
+	if token == "" {
+		log.Fatal("CONTROL_ENDPOINTS needs CONTROL_TOKEN")
+	}
+	return &controlGate{token: token}
+}
+
+// Answers 401 unless the request has the token
+func (g *controlGate) protect(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(g.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="control"`)
+			writeError(w, req, http.StatusUnauthorized, APIError{Code: "unauthorized", Message: "a valid CONTROL_TOKEN is required"})
+			return
+		}
+		next(w, req)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"load-balancer-demo/requestid"
+)
+
+func writeError(w http.ResponseWriter, req *http.Request, status int, apiError APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Error:     apiError,
+		RequestID: requestid.FromContext(req.Context()),
+	})
+}
+
+// Answers 404 or 409 for the user store's errors about the request, 500
+// for failures of the store itself
+func writeUserError(w http.ResponseWriter, req *http.Request, logger *slog.Logger, err error) {
+	switch {
+	case errors.Is(err, errUserNotFound):
+		writeError(w, req, http.StatusNotFound, APIError{Code: "not_found", Message: err.Error()})
+	case errors.Is(err, errUserExists):
+		writeError(w, req, http.StatusConflict, APIError{
+			Code:    "conflict",
+			Message: err.Error(),
+			Fields:  []FieldError{{"name", "is taken"}},
+		})
+	default:
+		logger.Error("User store failed", "error", err)
+		writeError(w, req, http.StatusInternalServerError, APIError{Code: "internal", Message: "user store failed"})
+	}
+}
+
+// Decodes the request's JSON body into user and validates it. Bodies that
+// aren't a single JSON object get 400, and ones with unknown fields, fields
+// of the wrong type or failing validation 422; false means the response was
+// written.
+func decodeUser(w http.ResponseWriter, req *http.Request, user *UserInput) bool {
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(user)
+	if err == nil && decoder.More() {
+		err = errors.New("body must hold a single JSON object")
+	}
+
+	var fields []FieldError
+	var typeError *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		fields = user.validate()
+	case errors.As(err, &typeError) && typeError.Field != "":
+		kind := "a number"
+		if typeError.Type.Kind() == reflect.String {
+			kind = "a string"
+		}
+		fields = []FieldError{{typeError.Field, "must be " + kind}}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		fields = []FieldError{{field, "is not a user field"}}
+	case errors.Is(err, io.EOF):
+		writeError(w, req, http.StatusBadRequest, APIError{Code: "invalid_json", Message: "body is empty"})
+		return false
+	default:
+		writeError(w, req, http.StatusBadRequest, APIError{Code: "invalid_json", Message: err.Error()})
+		return false
+	}
+
+	if len(fields) > 0 {
+		writeError(w, req, http.StatusUnprocessableEntity, APIError{
+			Code:    "validation_failed",
+			Message: "the user is invalid",
+			Fields:  fields,
+		})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Sets a weak ETag for the users a response holds, and answers 304 Not
+// Modified instead when the request's If-None-Match has it; true means the
+// response was written. The ETag is weak as the rest of the body, e.g. its
+// timestamp and servedBy, changes from response to response.
+func notModified(w http.ResponseWriter, req *http.Request, users any) bool {
+	content, err := json.Marshal(users)
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256(content)
+	etag := `W/"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+
+	if !etagMatches(req.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// Whether an If-None-Match header lists etag, compared weakly as RFC 9110
+// has it for If-None-Match
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	"load-balancer-demo/requestid"
+	"load-balancer-demo/userpb"
+)
+
+// The user API over gRPC, on the same store as the HTTP handlers
+type userService struct {
+	userpb.UnimplementedUserServiceServer
+	logger       *slog.Logger
+	users        *userStore
+	instanceName string
+}
+
+func (s *userService) List(ctx context.Context, req *userpb.ListRequest) (*userpb.ListResponse, error) {
+	page, limit := int(req.Page), int(req.Limit)
+	if page == 0 {
+		page = 1
+	}
+	if limit == 0 {
+		limit = defaultUsersLimit
+	}
+	if page < 1 || limit < 1 || limit > maxUsersLimit {
+		return nil, status.Errorf(codes.InvalidArgument, "page must be at least 1 and limit from 1 to %d", maxUsersLimit)
+	}
+	users, total, err := s.users.Find(req.Query, (page-1)*limit, limit)
+	if err != nil {
+		return nil, s.status(err)
+	}
+
+	response := &userpb.ListResponse{
+		Total:    int32(total),
+		Page:     int32(page),
+		Limit:    int32(limit),
+		ServedBy: s.instanceName,
+	}
+	for _, user := range users {
+		response.Users = append(response.Users, userMessage(user))
+	}
+	return response, nil
+}
+
+func (s *userService) Create(ctx context.Context, req *userpb.CreateRequest) (*userpb.UserResponse, error) {
+	input := UserInput{Name: req.Name, Email: req.Email}
+	if fields := input.validate(); len(fields) > 0 {
+		messages := make([]string, 0, len(fields))
+		for _, field := range fields {
+			messages = append(messages, field.Field+" "+field.Message)
+		}
+		return nil, status.Error(codes.InvalidArgument, strings.Join(messages, ", "))
+	}
+	user, err := s.users.Create(User{Name: input.Name, Email: input.Email})
+	if err != nil {
+		return nil, s.status(err)
+	}
+	return &userpb.UserResponse{User: userMessage(user), ServedBy: s.instanceName}, nil
+}
+
+func (s *userService) Get(ctx context.Context, req *userpb.GetRequest) (*userpb.UserResponse, error) {
+	user, err := s.users.Get(req.Id)
+	if err != nil {
+		return nil, s.status(err)
+	}
+	return &userpb.UserResponse{User: userMessage(user), ServedBy: s.instanceName}, nil
+}
+
+func userMessage(user User) *userpb.User {
+	return &userpb.User{Id: user.ID, Name: user.Name, Email: user.Email}
+}
+
+// The gRPC codes of writeUserError's statuses
+func (s *userService) status(err error) error {
+	switch {
+	case errors.Is(err, errUserNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errUserExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	default:
+		s.logger.Error("User store failed", "error", err)
+		return status.Error(codes.Internal, "user store failed")
+	}
+}
+
+// Serves the user service on GRPC_PORT, with the gRPC health service the
+// load balancer's grpc probe checks, and reflection for tools like grpcurl
+func serveGRPC(logger *slog.Logger, port string, users *userStore, instanceName string) (*grpc.Server, *health.Server) {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatalf("invalid GRPC_PORT: %v", err)
+	}
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(logUnary(logger)))
+	userpb.RegisterUserServiceServer(server, &userService{logger: logger, users: users, instanceName: instanceName})
+	healthServer := health.NewServer()
+	grpc_health_v1.RegisterHealthServer(server, healthServer)
+	reflection.Register(server)
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logger.Error("gRPC server stopped", "error", err)
+		}
+	}()
+	logger.Info("🚀 gRPC service starting", "port", port)
+	return server, healthServer
+}
+
+// Logs calls like RequestLog does requests, with the request ID the load
+// balancer sends as x-request-id metadata
+func logUnary(logger *slog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		startTime := time.Now()
+		id := requestid.New()
+		if values := metadata.ValueFromIncomingContext(ctx, requestid.Header); len(values) > 0 {
+			id = values[0]
+		}
+		ctx = requestid.NewContext(ctx, id)
+		grpc.SetHeader(ctx, metadata.Pairs(requestid.Header, id))
+
+		res, err := handler(ctx, req)
+		code := status.Code(err)
+		level := slog.LevelInfo
+		if code == codes.Internal || code == codes.Unknown {
+			level = slog.LevelError
+		}
+		logger.Log(ctx, level, "call",
+			"requestId", id,
+			"method", info.FullMethod,
+			"code", code.String(),
+			"duration", time.Since(startTime))
+		return res, err
+	}
+}
+
+// Stops the server once its calls are done, or cuts them off after timeout
+func stopGRPC(server *grpc.Server, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		server.Stop()
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"load-balancer-demo/internal/config"
+	"load-balancer-demo/internal/logging"
+	"load-balancer-demo/internal/middleware"
+	"load-balancer-demo/mdns"
+	"load-balancer-demo/requestid"
+)
+
+type Response struct {
+	Status         string    `json:"status,omitempty"`
+	Instance       string    `json:"instance,omitempty"`
+	Port           string    `json:"port,omitempty"`
+	Timestamp      time.Time `json:"timestamp,omitempty"`
+	ServedBy       string    `json:"servedBy,omitempty"`
+	Message        string    `json:"message,omitempty"`
+	ProcessingTime int64     `json:"processingTimeMs,omitempty"`
+	QueueDepth     *int64    `json:"queueDepth,omitempty"`
+	RequestID      string    `json:"requestId,omitempty"`
+
+	// Of /readyz, by dependency
+	Checks map[string]string `json:"checks,omitempty"`
+
+	// Of /api/cpu-task: how many times it hashed, and the final hash
+	Iterations int    `json:"iterations,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+}
+
+// Page size of GET /api/users without a limit, and the largest one allowed
+const (
+	defaultUsersLimit = 20
+	maxUsersLimit     = 1000
+)
+
+// Requests currently being handled, reported to the load balancer as this
+// instance's queue depth
+var inFlight int64
+
+func main() {
+	port := config.Get("PORT", "8080")
+	hostname, _ := os.Hostname()
+	instanceName := config.Get("INSTANCE_NAME", hostname)
+	if instanceName == "" {
+		instanceName = "Go-Unknown-Name"
+	}
+	level, err := logging.ParseLevel(config.Get("LOG_LEVEL", "info"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger := logging.New(os.Stderr, config.Get("LOG_FORMAT", "text"), level).With("instance", instanceName)
+
+	users, err := openUserStore(config.Get("USERS_DB", "data/users.db"))
+	if err != nil {
+		log.Fatalf("invalid USERS_DB: %v", err)
+	}
+	warmedAt := time.Now().Add(durationEnv("WARMUP_DELAY", 0))
+	chaos := chaosEnv(logger)
+	control := controlEnv()
+	rateLimit := rateLimitEnv(logger)
+
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, req, http.StatusNotFound, APIError{Code: "not_found", Message: "no such endpoint"})
+	})
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, req, http.StatusMethodNotAllowed, APIError{Code: "method_not_allowed", Message: req.Method + " isn't allowed here"})
+	})
+
+	router.Use(middleware.QueueDepth(&inFlight))
+	metrics := middleware.NewMetrics(instanceName, &inFlight)
+	router.Use(metrics.Middleware)
+	router.Use(rateLimit.Middleware)
+	router.Use(chaos.Middleware)
+
+	router.HandleFunc("/health", func(w http.ResponseWriter, req *http.Request) {
+		queueDepth := atomic.LoadInt64(&inFlight) - 1
+		status, code := "healthy", http.StatusOK
+		if shuttingDown.Load() {
+			status, code = "shutting down", http.StatusServiceUnavailable
+		} else if chaos.unhealthy() {
+			status, code = "unhealthy on purpose", http.StatusServiceUnavailable
+		}
+		response := Response{
+			Status:     status,
+			Instance:   instanceName,
+			Port:       port,
+			QueueDepth: &queueDepth,
+			Timestamp:  time.Now().UTC(),
+			RequestID:  requestid.FromContext(req.Context()),
+		}
+
+		w.Header().Set("Content-type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(response)
+	}).Methods("GET")
+
+	// Unlike /health, which only tells the instance is up, fails until its
+	// dependencies are ready
+	router.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		queueDepth := atomic.LoadInt64(&inFlight) - 1
+		checks := readinessChecks(users, warmedAt)
+		if chaos.unhealthy() {
+			checks["chaos"] = "unhealthy on purpose"
+		}
+		status, code := "ready", http.StatusOK
+		for _, result := range checks {
+			if result != checkOK {
+				status, code = "not ready", http.StatusServiceUnavailable
+			}
+		}
+		response := Response{
+			Status:     status,
+			Instance:   instanceName,
+			Port:       port,
+			QueueDepth: &queueDepth,
+			Checks:     checks,
+			Timestamp:  time.Now().UTC(),
+			RequestID:  requestid.FromContext(req.Context()),
+		}
+
+		w.Header().Set("Content-type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(response)
+	}).Methods("GET")
+
+	// Which instance answers a user API request, and when
+	served := func(req *http.Request) Served {
+		return Served{
+			ServedBy:  instanceName,
+			Port:      port,
+			Timestamp: time.Now().UTC(),
+			RequestID: requestid.FromContext(req.Context()),
+		}
+	}
+	router.HandleFunc("/openapi.json", handleOpenAPI).Methods("GET")
+	router.HandleFunc("/docs", handleDocs).Methods("GET")
+	router.HandleFunc(`/docs/{file:swagger-ui\.css|swagger-ui-bundle\.js}`, handleDocsAsset).Methods("GET")
+
+	router.HandleFunc("/api/users", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			query := req.URL.Query()
+			page, err := queryInt(query, "page", 1, 1, math.MaxInt32)
+			if err != nil {
+				writeError(w, req, http.StatusBadRequest, APIError{Code: "invalid_query", Message: err.Error()})
+				return
+			}
+			limit, err := queryInt(query, "limit", defaultUsersLimit, 1, maxUsersLimit)
+			if err != nil {
+				writeError(w, req, http.StatusBadRequest, APIError{Code: "invalid_query", Message: err.Error()})
+				return
+			}
+			list, total, err := users.Find(query.Get("q"), (page-1)*limit, limit)
+			if err != nil {
+				writeUserError(w, req, logger, err)
+				return
+			}
+			if list == nil {
+				list = []User{}
+			}
+			// The ETag is of the page alone, before it says who served it
+			response := UserListResponse{Users: list, Total: int64(total), Page: int64(page), Limit: int64(limit)}
+			if notModified(w, req, response) {
+				return
+			}
+			response.Served = served(req)
+
+			w.Header().Set("Content-type", "application/json")
+			json.NewEncoder(w).Encode(response)
+		case "POST":
+			var input UserInput
+			if !decodeUser(w, req, &input) {
+				return
+			}
+			user, err := users.Create(User{Name: input.Name, Email: input.Email})
+			if err != nil {
+				writeUserError(w, req, logger, err)
+				return
+			}
+
+			response := UserResponse{
+				Served:  served(req),
+				Message: "User created successfully",
+				User:    user,
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(response)
+		}
+	}).Methods("GET", "POST")
+
+	router.HandleFunc("/api/users/{id:[0-9]+}", func(w http.ResponseWriter, req *http.Request) {
+		id, err := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+		if err != nil {
+			writeUserError(w, req, logger, errUserNotFound)
+			return
+		}
+
+		var user User
+		var message string
+		switch req.Method {
+		case "GET":
+			user, err = users.Get(id)
+		case "PUT":
+			var input UserInput
+			if !decodeUser(w, req, &input) {
+				return
+			}
+			user, err = users.Update(User{ID: id, Name: input.Name, Email: input.Email})
+			message = "User updated successfully"
+		case "DELETE":
+			user, err = users.Delete(id)
+			message = "User deleted successfully"
+		}
+		if err != nil {
+			writeUserError(w, req, logger, err)
+			return
+		}
+		if req.Method == "GET" && notModified(w, req, user) {
+			return
+		}
+
+		response := UserResponse{Served: served(req), Message: message, User: user}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}).Methods("GET", "PUT", "DELETE")
+
+	router.Handle("/metrics", metrics).Methods("GET")
+	router.HandleFunc("/version", func(w http.ResponseWriter, req *http.Request) {
+		info := buildInfo()
+		info.ServedBy = instanceName
+		info.Timestamp = time.Now().UTC()
+		info.RequestID = requestid.FromContext(req.Context())
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	}).Methods("GET")
+	echo := newEchoServer(instanceName)
+	router.Handle("/ws/echo", echo).Methods("GET")
+	if control != nil {
+		router.HandleFunc("/chaos", control.protect(chaos.handle)).Methods("GET", "PUT", "DELETE")
+		router.HandleFunc("/rate-limit", control.protect(rateLimit.handle)).Methods("GET", "PUT", "DELETE")
+	}
+
+	// Takes delayMs plus up to jitterMs at random, together at most
+	// MAX_TASK_DELAY
+	maxDelay := durationEnv("MAX_TASK_DELAY", 30*time.Second)
+	router.HandleFunc("/api/heavy-task", func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+
+		query := r.URL.Query()
+		maxMs := int(maxDelay.Milliseconds())
+		delayMs, err := queryInt(query, "delayMs", min(2000, maxMs), 0, maxMs)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, APIError{Code: "invalid_query", Message: err.Error()})
+			return
+		}
+		jitterMs, err := queryInt(query, "jitterMs", 0, 0, maxMs-delayMs)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, APIError{Code: "invalid_query", Message: err.Error()})
+			return
+		}
+		delay := time.Duration(delayMs+rand.Intn(jitterMs+1)) * time.Millisecond
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			// Nobody is left to answer
+			return
+		}
+
+		response := Response{
+			Message:        "Heavy task completed",
+			ProcessingTime: int64(time.Since(startTime).Milliseconds()),
+			ServedBy:       instanceName,
+			Port:           port,
+			Timestamp:      time.Now().UTC(),
+			RequestID:      requestid.FromContext(r.Context()),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}).Methods("GET")
+
+	// Hashes iterations times, at most MAX_CPU_ITERATIONS, so the time it
+	// takes is spent on the CPU rather than waiting
+	maxIterations := intEnv("MAX_CPU_ITERATIONS", 10_000_000)
+	router.HandleFunc("/api/cpu-task", func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+
+		iterations, err := queryInt(r.URL.Query(), "iterations", min(100_000, maxIterations), 1, maxIterations)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, APIError{Code: "invalid_query", Message: err.Error()})
+			return
+		}
+		digest, err := burnCPU(r.Context(), iterations)
+		if err != nil {
+			// Nobody is left to answer
+			return
+		}
+
+		response := Response{
+			Message:        "CPU task completed",
+			Iterations:     iterations,
+			Digest:         hex.EncodeToString(digest),
+			ProcessingTime: time.Since(startTime).Milliseconds(),
+			ServedBy:       instanceName,
+			Port:           port,
+			Timestamp:      time.Now().UTC(),
+			RequestID:      requestid.FromContext(r.Context()),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}).Methods("GET")
+
+	// MAX_STREAM_DURATION
+	maxStream := durationEnv("MAX_STREAM_DURATION", 5*time.Minute)
+	if maxStream < time.Second {
+		log.Fatalf("invalid MAX_STREAM_DURATION: %v is under a second", maxStream)
+	}
+	router.HandleFunc("/api/stream", streamHandler(instanceName, maxStream)).Methods("GET")
+
+	// MAX_PAYLOAD_KB
+	maxPayloadKb := intEnv("MAX_PAYLOAD_KB", 10240)
+	if maxPayloadKb < 0 {
+		log.Fatalf("invalid MAX_PAYLOAD_KB: %d", maxPayloadKb)
+	}
+	router.HandleFunc("/api/payload", payloadHandler(maxPayloadKb)).Methods("GET")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Announcements to the load balancer, which stop when shutting down
+	var announcing sync.WaitGroup
+	if registerURL := config.Get("LB_REGISTER_URL", ""); registerURL != "" {
+		announcing.Add(1)
+		go func() {
+			defer announcing.Done()
+			registerWithLoadBalancer(ctx, logger, registerURL, port)
+		}()
+	}
+	if service := config.Get("MDNS_SERVICE", ""); service != "" {
+		announcing.Add(1)
+		go func() {
+			defer announcing.Done()
+			advertiseWithMDNS(ctx, logger, service, instanceName, port)
+		}()
+	}
+
+	grpcServer, grpcHealth := serveGRPC(logger, config.Get("GRPC_PORT", "9090"), users, instanceName)
+	go func() {
+		// Like /health, so the load balancer's grpc probe drains it too
+		<-ctx.Done()
+		grpcHealth.Shutdown()
+	}()
+
+	logger.Info("🚀 API Service starting", "port", port, "version", buildInfo().Version, "commit", buildInfo().Commit)
+	// Around the router rather than on it, so requests no route matches are
+	// logged too, with the same request ID as the load balancer's access log
+	handler := requestid.Middleware(middleware.RequestLog(logger)(router))
+	err = serveUntilShutdown(ctx, logger, &http.Server{Addr: ":" + port, Handler: handler})
+	echo.Close()
+	stopGRPC(grpcServer, shutdownTimeoutEnv())
+	users.Close()
+	announcing.Wait()
+	if err != nil {
+		logger.Error("API Service stopped", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("👋 API Service stopped")
+}
+
+// The query parameter called name as a number from low to high, fallback
+// when it is missing
+func queryInt(query url.Values, name string, fallback, low, high int) (int, error) {
+	value := query.Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < low || number > high {
+		return 0, fmt.Errorf("%s must be a number from %d to %d", name, low, high)
+	}
+	return number, nil
+}
+
+// SHA-256 of the previous hash, iterations times over, starting from an
+// empty input. Gives up once ctx is done.
+func burnCPU(ctx context.Context, iterations int) ([]byte, error) {
+	digest := sha256.Sum256(nil)
+	for i := 0; i < iterations; i++ {
+		if i%10_000 == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		digest = sha256.Sum256(digest[:])
+	}
+	return digest[:], nil
+}
+
+// Announces this instance to the load balancer's POST /lb-admin/register,
+// then keeps repeating it as a heartbeat at a third of the TTL it answers
+// with, so the load balancer drops the instance soon after it goes away.
+// Once ctx is done, the instance deregisters so it is dropped right away.
+func registerWithLoadBalancer(ctx context.Context, logger *slog.Logger, registerURL, port string) {
+	hostname, _ := os.Hostname()
+	advertiseURL := config.Get("LB_ADVERTISE_URL", "http://"+hostname+":"+port)
+	body, _ := json.Marshal(map[string]string{
+		"url":     advertiseURL,
+		"options": config.Get("LB_REGISTER_OPTIONS", ""),
+	})
+
+	for {
+		interval := 5 * time.Second
+		req, _ := http.NewRequest(http.MethodPost, registerURL, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+config.Get("LB_REGISTER_SECRET", ""))
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			logger.Warn("Registering with the load balancer failed", "error", err)
+		} else {
+			var answer struct {
+				TTL string `json:"ttl"`
+			}
+			if resp.StatusCode != http.StatusOK {
+				logger.Warn("Registering with the load balancer failed", "status", resp.Status)
+			} else if json.NewDecoder(resp.Body).Decode(&answer) == nil {
+				if ttl, err := time.ParseDuration(answer.TTL); err == nil && ttl > 0 {
+					interval = ttl / 3
+				}
+			}
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			deregisterFromLoadBalancer(logger, registerURL, advertiseURL)
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func deregisterFromLoadBalancer(logger *slog.Logger, registerURL, advertiseURL string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodDelete, registerURL+"?url="+url.QueryEscape(advertiseURL), nil)
+	req.Header.Set("Authorization", "Bearer "+config.Get("LB_REGISTER_SECRET", ""))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Warn("Deregistering from the load balancer failed", "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		logger.Warn("Deregistering from the load balancer failed", "status", resp.Status)
+	}
+}
+
+// Answers the load balancer's mDNS browses for service with this instance,
+// so it is found on the local network without any configuration, until ctx
+// is done
+func advertiseWithMDNS(ctx context.Context, logger *slog.Logger, service, instanceName, port string) {
+	portNumber, _ := strconv.Atoi(port)
+	instance := mdns.Instance{
+		Name: instanceName,
+		Port: portNumber,
+		Text: map[string]string{"options": config.Get("LB_REGISTER_OPTIONS", "")},
+	}
+	if err := mdns.Advertise(ctx, service, instance); err != nil && ctx.Err() == nil {
+		logger.Warn("Advertising with mDNS failed", "error", err)
+	}
+}
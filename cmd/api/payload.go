@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"strconv"
+)
+
+// What /api/payload bodies repeat: text compresses well, random bytes
+// hardly at all, as the block is larger than gzip's window
+var payloadBlocks = map[string][]byte{
+	"text":   bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog.\n"), 1456),
+	"random": randomBlock(64 << 10),
+}
+
+func randomBlock(size int) []byte {
+	block := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(block)
+	return block
+}
+
+// Answers with a body of sizeKb kibibytes, at most maxKb, of text or random
+// bytes as kind says, for measuring throughput with responses of a known
+// size. The body is written a block at a time, so its size costs no memory.
+func payloadHandler(maxKb int) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		sizeKb, err := queryInt(query, "sizeKb", min(1, maxKb), 0, maxKb)
+		if err != nil {
+			writeError(w, req, http.StatusBadRequest, APIError{Code: "invalid_query", Message: err.Error()})
+			return
+		}
+		kind := query.Get("kind")
+		if kind == "" {
+			kind = "text"
+		}
+		block, ok := payloadBlocks[kind]
+		if !ok {
+			writeError(w, req, http.StatusBadRequest, APIError{Code: "invalid_query", Message: "kind must be text or random"})
+			return
+		}
+
+		remaining := int64(sizeKb) << 10
+		if kind == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(remaining, 10))
+		for remaining > 0 {
+			chunk := block[:min(int64(len(block)), remaining)]
+			if _, err := w.Write(chunk); err != nil {
+				// The client left
+				return
+			}
+			remaining -= int64(len(chunk))
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"load-balancer-demo/requestid"
+)
+
+// How many /api requests a second the instance takes, to compare with the
+// load balancer's own rate limits. Set from RATE_LIMIT_RPS and
+// RATE_LIMIT_BURST at startup and with PUT /rate-limit later.
+type RateLimitSettings struct {
+	// 0 for no limit
+	RPS float64 `json:"rps"`
+	// Requests taken at once after a quiet spell, 0 for one second worth
+	Burst int `json:"burst"`
+}
+
+// What GET /rate-limit answers with
+type RateLimitStatus struct {
+	RateLimitSettings
+	// /api requests answered with 429 since the settings were last set
+	Rejected  int64  `json:"rejected"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// A token bucket shared by every client of the instance, refilled
+// continuously at settings.RPS tokens a second
+type rateLimiter struct {
+	logger   *slog.Logger
+	mutex    sync.Mutex
+	settings RateLimitSettings
+	tokens   float64
+	last     time.Time
+	rejected int64
+}
+
+// RATE_LIMIT_RPS and RATE_LIMIT_BURST
+func rateLimitEnv(logger *slog.Logger) *rateLimiter {
+	settings := RateLimitSettings{
+		RPS:   floatEnv("RATE_LIMIT_RPS", 0),
+		Burst: intEnv("RATE_LIMIT_BURST", 0),
+	}
+	if fields := settings.validate(); len(fields) > 0 {
+		settingNames := map[string]string{"rps": "RATE_LIMIT_RPS", "burst": "RATE_LIMIT_BURST"}
+		log.Fatalf("invalid %s: %s", settingNames[fields[0].Field], fields[0].Message)
+	}
+	limiter := &rateLimiter{logger: logger}
+	limiter.set(settings)
+	if settings.RPS > 0 {
+		logger.Info("🚦 Rate limiting", "rps", settings.RPS, "burst", limiter.settings.Burst)
+	}
+	return limiter
+}
+
+func (s RateLimitSettings) validate() []FieldError {
+	var fields []FieldError
+	if s.RPS < 0 {
+		fields = append(fields, FieldError{"rps", "can't be negative"})
+	}
+	if s.Burst < 0 {
+		fields = append(fields, FieldError{"burst", "can't be negative"})
+	}
+	return fields
+}
+
+// Replaces the settings with a full bucket; call with the mutex held or
+// before the limiter is shared
+func (l *rateLimiter) set(settings RateLimitSettings) {
+	if settings.RPS > 0 && settings.Burst == 0 {
+		settings.Burst = int(math.Ceil(settings.RPS))
+	}
+	l.settings = settings
+	l.tokens = float64(settings.Burst)
+	l.last = time.Now()
+	l.rejected = 0
+}
+
+// Takes a token if one is available, otherwise reports how long until one is
+func (l *rateLimiter) allow() (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.settings.RPS == 0 {
+		return true, 0
+	}
+	now := time.Now()
+	l.tokens = math.Min(float64(l.settings.Burst), l.tokens+now.Sub(l.last).Seconds()*l.settings.RPS)
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	l.rejected++
+	return false, time.Duration((1 - l.tokens) / l.settings.RPS * float64(time.Second))
+}
+
+// Answers /api requests over the limit with 429 and a Retry-After of the
+// whole seconds until one would be taken; the other endpoints, e.g. /health,
+// are never limited
+func (l *rateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, "/api/") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		allowed, retryAfter := l.allow()
+		if !allowed {
+			seconds := max(int(math.Ceil(retryAfter.Seconds())), 1)
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			writeError(w, req, http.StatusTooManyRequests, APIError{Code: "rate_limited", Message: "too many requests, retry later"})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// GET /rate-limit answers with the settings, PUT /rate-limit replaces them
+// and DELETE /rate-limit turns the limit off. Either restarts the count of
+// rejected requests.
+func (l *rateLimiter) handle(w http.ResponseWriter, req *http.Request) {
+	var settings RateLimitSettings
+	if req.Method == http.MethodPut {
+		decoder := json.NewDecoder(req.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&settings); err != nil {
+			writeError(w, req, http.StatusBadRequest, APIError{Code: "invalid_json", Message: err.Error()})
+			return
+		}
+		if fields := settings.validate(); len(fields) > 0 {
+			writeError(w, req, http.StatusUnprocessableEntity, APIError{
+				Code:    "validation_failed",
+				Message: "the rate limit settings are invalid",
+				Fields:  fields,
+			})
+			return
+		}
+	}
+
+	l.mutex.Lock()
+	if req.Method != http.MethodGet {
+		l.set(settings)
+		l.logger.Info("🚦 Rate limit changed", "rps", l.settings.RPS, "burst", l.settings.Burst)
+	}
+	status := RateLimitStatus{
+		RateLimitSettings: l.settings,
+		Rejected:          l.rejected,
+		RequestID:         requestid.FromContext(req.Context()),
+	}
+	l.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,24 @@
+package main
+
+import "time"
+
+// What /readyz reports for a dependency that is fine
+const checkOK = "ok"
+
+// The dependencies /readyz checks, by name, with checkOK or what is wrong
+// with them. The instance is ready once all are ok: its user store can be
+// read and WARMUP_DELAY, standing in for filling caches, has passed since
+// warmedAt was set.
+func readinessChecks(users *userStore, warmedAt time.Time) map[string]string {
+	checks := map[string]string{"users": checkOK, "warmup": checkOK}
+	if err := users.Ping(); err != nil {
+		checks["users"] = err.Error()
+	}
+	if remaining := time.Until(warmedAt); remaining > 0 {
+		checks["warmup"] = "warming up, " + remaining.Round(time.Second).String() + " left"
+	}
+	if shuttingDown.Load() {
+		checks["shutdown"] = "shutting down"
+	}
+	return checks
+}
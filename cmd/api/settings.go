@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"load-balancer-demo/internal/config"
+)
+
+// The service's settings, which exit when they don't parse: a bad setting
+// should stop it from starting
+
+func boolEnv(key string, defaultValue bool) bool {
+	return must(config.Bool(key, defaultValue))
+}
+
+func intEnv(key string, defaultValue int) int {
+	return must(config.Int(key, defaultValue))
+}
+
+func floatEnv(key string, defaultValue float64) float64 {
+	return must(config.Float(key, defaultValue))
+}
+
+func durationEnv(key string, defaultValue time.Duration) time.Duration {
+	return must(config.Duration(key, defaultValue))
+}
+
+func must[T any](value T, err error) T {
+	if err != nil {
+		log.Fatal(err)
+	}
+	return value
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Set once SIGTERM or SIGINT arrive; /health then fails, so the load
+// balancer stops sending requests here before the server closes
+var shuttingDown atomic.Bool
+
+// Serves until ctx is done, then shuts down without failing a request:
+// /health fails for SHUTDOWN_DELAY, long enough for the load balancer's
+// health checks to notice, while requests are still served, then new
+// connections are refused and the ones in flight get up to SHUTDOWN_TIMEOUT
+// to finish
+func serveUntilShutdown(ctx context.Context, logger *slog.Logger, server *http.Server) error {
+	delay := durationEnv("SHUTDOWN_DELAY", 5*time.Second)
+	timeout := shutdownTimeoutEnv()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Info("🛑 Shutting down, failing health checks first", "delay", delay, "timeout", timeout)
+	shuttingDown.Store(true)
+	// Keep-alive connections are closed after their next response, so the
+	// load balancer dials new ones to the instances that stay
+	server.SetKeepAlivesEnabled(false)
+	time.Sleep(delay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// SHUTDOWN_TIMEOUT, how long requests and calls in flight get to finish
+func shutdownTimeoutEnv() time.Duration {
+	return durationEnv("SHUTDOWN_TIMEOUT", 30*time.Second)
+}
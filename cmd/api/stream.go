@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"load-balancer-demo/requestid"
+)
+
+// The data of an /api/stream event
+type StreamEvent struct {
+	Seq       int       `json:"seq"`
+	ServedBy  string    `json:"servedBy"`
+	Timestamp time.Time `json:"timestamp"`
+	RequestID string    `json:"requestId,omitempty"`
+}
+
+// Streams server-sent events for seconds, one every intervalMs, so the load
+// balancer's flushing and timeouts can be watched with a long-lived
+// response: "tick" events, then "done", or "shutdown" when the instance
+// starts shutting down, so the stream doesn't hold up its shutdown
+func streamHandler(instanceName string, maxDuration time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		seconds, err := queryInt(query, "seconds", min(10, int(maxDuration.Seconds())), 1, int(maxDuration.Seconds()))
+		if err != nil {
+			writeError(w, req, http.StatusBadRequest, APIError{Code: "invalid_query", Message: err.Error()})
+			return
+		}
+		intervalMs, err := queryInt(query, "intervalMs", 1000, 10, 60_000)
+		if err != nil {
+			writeError(w, req, http.StatusBadRequest, APIError{Code: "invalid_query", Message: err.Error()})
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		flusher := http.NewResponseController(w)
+		seq := 0
+		send := func(eventType string) error {
+			seq++
+			data, _ := json.Marshal(StreamEvent{
+				Seq:       seq,
+				ServedBy:  instanceName,
+				Timestamp: time.Now().UTC(),
+				RequestID: requestid.FromContext(req.Context()),
+			})
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", seq, eventType, data)
+			return flusher.Flush()
+		}
+
+		end := time.NewTimer(time.Duration(seconds) * time.Second)
+		defer end.Stop()
+		ticker := time.NewTicker(time.Duration(intervalMs) * time.Millisecond)
+		defer ticker.Stop()
+
+		if err := send("tick"); err != nil {
+			return
+		}
+		for {
+			select {
+			case <-ticker.C:
+				if shuttingDown.Load() {
+					send("shutdown")
+					return
+				}
+				if err := send("tick"); err != nil {
+					return
+				}
+			case <-end.C:
+				send("done")
+				return
+			case <-req.Context().Done():
+				return
+			}
+		}
+	}
+}
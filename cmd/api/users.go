@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const maxUserNameLength = 100
+
+// What is wrong with the user's fields, after trimming spaces off them. A
+// name is required; an email is optional, but must be a plain address.
+func (u *UserInput) validate() []FieldError {
+	var fields []FieldError
+	u.Name = strings.TrimSpace(u.Name)
+	switch {
+	case u.Name == "":
+		fields = append(fields, FieldError{"name", "is required"})
+	case utf8.RuneCountInString(u.Name) > maxUserNameLength:
+		fields = append(fields, FieldError{"name", fmt.Sprintf("must be at most %d characters", maxUserNameLength)})
+	case strings.ContainsFunc(u.Name, unicode.IsControl):
+		fields = append(fields, FieldError{"name", "can't contain control characters"})
+	}
+	u.Email = strings.TrimSpace(u.Email)
+	if u.Email != "" {
+		if address, err := mail.ParseAddress(u.Email); err != nil || address.Address != u.Email {
+			fields = append(fields, FieldError{"email", "must be an email address, e.g. alice@example.com"})
+		}
+	}
+	return fields
+}
+
+var (
+	errUserNotFound = errors.New("user not found")
+	// Another user has the name, compared case-insensitively
+	errUserExists = errors.New("a user with this name already exists")
+)
+
+// Users the store starts out with
+var seedUsers = []string{"Alice", "Bird", "Charlie", "Dan"}
+
+// Users kept in a SQLite database, so POSTed users survive restarts and,
+// with the database on a volume the instances share, every instance behind
+// the load balancer serves the same ones. SQLite's own file locking keeps
+// instances writing in turn.
+type userStore struct {
+	db *sql.DB
+}
+
+// IDs are AUTOINCREMENT so a deleted user's isn't reused, and names are
+// unique regardless of case
+const usersSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id    INTEGER PRIMARY KEY AUTOINCREMENT,
+	name  TEXT NOT NULL,
+	email TEXT NOT NULL DEFAULT ''
+);
+CREATE UNIQUE INDEX IF NOT EXISTS users_name ON users (name COLLATE NOCASE);
+`
+
+func openUserStore(path string) (*userStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	// Another instance writing makes a call wait for it rather than fail
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	s := &userStore{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Creates the table and seeds it, unless an instance already did
+func (s *userStore) migrate() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(usersSchema); err != nil {
+		return err
+	}
+	// sqlite_sequence has a row for users once any user was inserted, so
+	// deleting the seeded ones doesn't bring them back
+	var seeded bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM sqlite_sequence WHERE name = 'users')`).Scan(&seeded)
+	if err != nil {
+		return err
+	}
+	if !seeded {
+		for _, name := range seedUsers {
+			if _, err := tx.Exec(`INSERT INTO users (name) VALUES (?)`, name); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *userStore) Close() error {
+	return s.db.Close()
+}
+
+// Up to limit users whose names contain query, case-insensitively, after
+// skipping offset of them, and how many there are in all
+func (s *userStore) Find(query string, offset, limit int) ([]User, int, error) {
+	pattern := "%" + likeEscaper.Replace(query) + "%"
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	var total int
+	err = tx.QueryRow(`SELECT count(*) FROM users WHERE name LIKE ? ESCAPE '\'`, pattern).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := tx.Query(`SELECT id, name, email FROM users WHERE name LIKE ? ESCAPE '\' ORDER BY id LIMIT ? OFFSET ?`,
+		pattern, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Name, &user.Email); err != nil {
+			return nil, 0, err
+		}
+		users = append(users, user)
+	}
+	return users, total, rows.Err()
+}
+
+// Makes LIKE match % and _ in a query literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (s *userStore) Get(id int64) (User, error) {
+	user := User{ID: id}
+	err := s.db.QueryRow(`SELECT name, email FROM users WHERE id = ?`, id).Scan(&user.Name, &user.Email)
+	return user, notFound(err)
+}
+
+// Whether the users can be read
+func (s *userStore) Ping() error {
+	_, err := s.db.Exec(`SELECT 1 FROM users LIMIT 1`)
+	return err
+}
+
+// Stores user under a new ID and returns it with the ID
+func (s *userStore) Create(user User) (User, error) {
+	result, err := s.db.Exec(`INSERT INTO users (name, email) VALUES (?, ?)`, user.Name, user.Email)
+	if err != nil {
+		return user, nameTaken(err)
+	}
+	user.ID, err = result.LastInsertId()
+	return user, err
+}
+
+// Replaces the user with user's ID
+func (s *userStore) Update(user User) (User, error) {
+	result, err := s.db.Exec(`UPDATE users SET name = ?, email = ? WHERE id = ?`, user.Name, user.Email, user.ID)
+	if err != nil {
+		return user, nameTaken(err)
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return user, err
+	} else if updated == 0 {
+		return user, errUserNotFound
+	}
+	return user, nil
+}
+
+// Removes the user with id and returns it. IDs aren't reused.
+func (s *userStore) Delete(id int64) (User, error) {
+	user := User{ID: id}
+	err := s.db.QueryRow(`DELETE FROM users WHERE id = ? RETURNING name, email`, id).Scan(&user.Name, &user.Email)
+	return user, notFound(err)
+}
+
+// errUserNotFound in place of sql.ErrNoRows
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return errUserNotFound
+	}
+	return err
+}
+
+// errUserExists in place of a violation of the unique index on names
+func nameTaken(err error) error {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+		return errUserExists
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Set when building, e.g. with
+// -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    string
+	buildTime string
+)
+
+// What /version answers with
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"buildTime,omitempty"`
+	// Whether the commit had uncommitted changes, when the Go toolchain
+	// stamped the build rather than -ldflags
+	Modified  bool      `json:"modified,omitempty"`
+	GoVersion string    `json:"goVersion"`
+	ServedBy  string    `json:"servedBy"`
+	Timestamp time.Time `json:"timestamp"`
+	RequestID string    `json:"requestId,omitempty"`
+}
+
+// The build's version, commit and time; for the commit and time, go build
+// stamps the VCS ones when built in a checkout without -ldflags setting them
+var buildInfo = sync.OnceValue(func() VersionInfo {
+	info := VersionInfo{Version: version, Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+	if build, ok := debug.ReadBuildInfo(); ok && info.Commit == "" {
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Commit = setting.Value
+			case "vcs.time":
+				if info.BuildTime == "" {
+					info.BuildTime = setting.Value
+				}
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	return info
+})
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// How long a WebSocket client gets to take a message or answer a ping
+	webSocketWriteTimeout = 10 * time.Second
+	// Pings keep idle connections from being timed out along the way, e.g.
+	// by the load balancer
+	echoKeepAlive = 30 * time.Second
+	// Messages are read whole, so their size is capped
+	maxEchoMessage = 64 << 10
+)
+
+// Anyone may talk to the echo, it hands out nothing
+var echoUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// What /ws/echo answers a text message with
+type EchoMessage struct {
+	Message   string    `json:"message"`
+	ServedBy  string    `json:"servedBy"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Echoes WebSocket messages: text ones as an EchoMessage naming the
+// instance, binary ones as they are
+type echoServer struct {
+	instanceName string
+	done         chan struct{}
+	conns        sync.WaitGroup
+}
+
+func newEchoServer(instanceName string) *echoServer {
+	return &echoServer{instanceName: instanceName, done: make(chan struct{})}
+}
+
+func (e *echoServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	conn, err := echoUpgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// The upgrader already answered the client
+		return
+	}
+	e.conns.Add(1)
+	defer e.conns.Done()
+	defer conn.Close()
+	conn.SetReadLimit(maxEchoMessage)
+
+	// Control messages may be written while a message is
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		keepAlive := time.NewTicker(echoKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-keepAlive.C:
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(webSocketWriteTimeout))
+			case <-e.done:
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"),
+					time.Now().Add(webSocketWriteTimeout))
+				// Reading ends with the client's answer, or without
+				conn.SetReadDeadline(time.Now().Add(webSocketWriteTimeout))
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		kind, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+		if kind == websocket.TextMessage {
+			err = conn.WriteJSON(EchoMessage{
+				Message:   string(message),
+				ServedBy:  e.instanceName,
+				Timestamp: time.Now().UTC(),
+			})
+		} else {
+			err = conn.WriteMessage(kind, message)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Closes the connections, which the HTTP server's shutdown leaves alone,
+// and waits for them to end
+func (e *echoServer) Close() {
+	close(e.done)
+	e.conns.Wait()
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"load-balancer-demo/pkg/loadbalancer"
+)
+
+func main() {
+	tui := flag.Bool("tui", false, "show a live terminal view instead of logs")
+	flag.Parse()
+
+	if err := loadbalancer.Run(loadbalancer.RunOptions{TUI: *tui}); err != nil {
+		log.Fatal(err)
+	}
+}
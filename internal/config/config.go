@@ -0,0 +1,51 @@
+// Package config reads the settings cmd/lb and cmd/api take from
+// environment variables. An unset or empty variable gets the default; one
+// that doesn't parse is an error, which the services exit on, as a bad
+// setting should stop a service from starting.
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+func Get(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func Bool(key string, defaultValue bool) (bool, error) {
+	value, err := strconv.ParseBool(Get(key, strconv.FormatBool(defaultValue)))
+	if err != nil {
+		return defaultValue, fmt.Errorf("invalid boolean for %s: %v", key, err)
+	}
+	return value, nil
+}
+
+func Int(key string, defaultValue int) (int, error) {
+	value, err := strconv.Atoi(Get(key, strconv.Itoa(defaultValue)))
+	if err != nil {
+		return defaultValue, fmt.Errorf("invalid integer for %s: %v", key, err)
+	}
+	return value, nil
+}
+
+func Float(key string, defaultValue float64) (float64, error) {
+	value, err := strconv.ParseFloat(Get(key, strconv.FormatFloat(defaultValue, 'f', -1, 64)), 64)
+	if err != nil {
+		return defaultValue, fmt.Errorf("invalid number for %s: %v", key, err)
+	}
+	return value, nil
+}
+
+func Duration(key string, defaultValue time.Duration) (time.Duration, error) {
+	value, err := time.ParseDuration(Get(key, defaultValue.String()))
+	if err != nil {
+		return defaultValue, fmt.Errorf("invalid duration for %s: %v", key, err)
+	}
+	return value, nil
+}
@@ -0,0 +1,29 @@
+// Package logging builds the slog loggers of cmd/lb and cmd/api from their
+// LOG_LEVEL and format settings.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// debug, info, warn or error, in any case
+func ParseLevel(level string) (slog.Level, error) {
+	var parsed slog.Level
+	if err := parsed.UnmarshalText([]byte(strings.ToUpper(level))); err != nil {
+		return 0, fmt.Errorf("invalid log level %q: must be debug, info, warn or error", level)
+	}
+	return parsed, nil
+}
+
+// A logger writing to w as key=value text, or JSON lines when format is
+// "json", from level up
+func New(w io.Writer, format string, level slog.Leveler) *slog.Logger {
+	options := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
+}
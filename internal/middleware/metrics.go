@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics of the requests an API instance handles, to compare
+// with what the load balancer reports for it. Every metric carries the
+// instance's name as instance_name, as Prometheus sets instance itself to
+// the address it scrapes.
+type Metrics struct {
+	handler  http.Handler
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// inFlight is the count QueueDepth keeps
+func NewMetrics(instanceName string, inFlight *int64) *Metrics {
+	labels := prometheus.Labels{"instance_name": instanceName}
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "api_http_requests_total",
+			Help:        "Requests handled by the API instance.",
+			ConstLabels: labels,
+		}, []string{"route", "method", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "api_http_request_duration_seconds",
+			Help:        "Time the API instance took to handle a request.",
+			ConstLabels: labels,
+			Buckets:     prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.duration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "api_http_requests_in_flight",
+			Help:        "Requests the API instance is handling.",
+			ConstLabels: labels,
+		}, func() float64 {
+			return float64(atomic.LoadInt64(inFlight))
+		}),
+	)
+	m.handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	return m
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	m.handler.ServeHTTP(w, req)
+}
+
+// Counts and times requests by their route's path template, e.g.
+// /api/users/{id:[0-9]+}, so the label set stays bounded whatever paths
+// clients send. Goes on a mux.Router.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		startTime := time.Now()
+		recorder := newStatusRecorder(w)
+		next.ServeHTTP(recorder, req)
+
+		route := "unmatched"
+		if current := mux.CurrentRoute(req); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		m.requests.WithLabelValues(route, req.Method, strconv.Itoa(recorder.status)).Inc()
+		m.duration.WithLabelValues(route, req.Method).Observe(time.Since(startTime).Seconds())
+	})
+}
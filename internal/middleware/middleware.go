@@ -0,0 +1,58 @@
+// Package middleware holds the net/http middleware of cmd/api.
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"load-balancer-demo/requestid"
+)
+
+// Logs every request with its request ID, so it can be tied to the load
+// balancer's access log line, its status and how long it took; 5xx
+// responses are logged as errors. Goes after requestid.Middleware.
+func RequestLog(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			startTime := time.Now()
+			recorder := newStatusRecorder(w)
+			next.ServeHTTP(recorder, req)
+
+			level := slog.LevelInfo
+			if recorder.status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+			logger.Log(req.Context(), level, "request",
+				"requestId", requestid.FromContext(req.Context()),
+				"method", req.Method,
+				"path", req.URL.Path,
+				"status", recorder.status,
+				"duration", time.Since(startTime))
+		})
+	}
+}
+
+// Counts the requests being handled in inFlight and reports how many were
+// ahead of each one in the X-Queue-Depth response header, which the load
+// balancer's admission control reads. WebSockets stay open for as long as
+// their clients like, so they aren't counted.
+func QueueDepth(inFlight *int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if websocket.IsWebSocketUpgrade(req) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			depth := atomic.AddInt64(inFlight, 1) - 1
+			defer atomic.AddInt64(inFlight, -1)
+
+			w.Header().Set("X-Queue-Depth", strconv.FormatInt(depth, 10))
+			next.ServeHTTP(w, req)
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+
+	"load-balancer-demo/adminclient"
+)
+
+const usage = `Usage: lbctl [flags] <command> [arguments]
+
+Commands:
+  status               List the backends and their state
+  drain <server>       Set a backend's weight to 0, so it gets no new requests
+  add <url> [options]  Add a backend, e.g. lbctl add http://api-4:8080 "pool=heavy;weight=2"
+  watch                Follow health changes, reloads and admin actions as they happen
+  bans                 List the banned clients
+  ban <ip> [duration]  Ban a client, e.g. lbctl ban 203.0.113.7 1h
+  unban <ip>           Lift a client's ban
+  profile <url> [duration]
+                       Load a URL through the load balancer and print its CPU and
+                       allocation hotspots, e.g. lbctl profile http://localhost:9080/api 30s
+
+Flags:
+`
+
+type client struct {
+	api *adminclient.Client
+}
+
+func main() {
+	addr := flag.String("addr", getEnv("LBCTL_ADDR", "http://localhost:9091"), "admin listener of the load balancer, or $LBCTL_ADDR")
+	// Not the flag default, so usage output doesn't print the token
+	token := flag.String("token", "", "admin API token (default $ADMIN_TOKEN)")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *token == "" {
+		*token = os.Getenv("ADMIN_TOKEN")
+	}
+
+	c := &client{api: adminclient.New(*addr, *token)}
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch {
+	case args[0] == "status" && len(args) == 1:
+		err = c.status()
+	case args[0] == "drain" && len(args) == 2:
+		err = c.drain(args[1])
+	case args[0] == "add" && (len(args) == 2 || len(args) == 3):
+		options := ""
+		if len(args) == 3 {
+			options = args[2]
+		}
+		err = c.add(args[1], options)
+	case args[0] == "watch" && len(args) == 1:
+		err = c.watch()
+	case args[0] == "bans" && len(args) == 1:
+		err = c.bans()
+	case args[0] == "ban" && (len(args) == 2 || len(args) == 3):
+		duration := ""
+		if len(args) == 3 {
+			duration = args[2]
+		}
+		err = c.ban(args[1], duration)
+	case args[0] == "unban" && len(args) == 2:
+		err = c.unban(args[1])
+	case args[0] == "profile" && (len(args) == 2 || len(args) == 3):
+		duration := ""
+		if len(args) == 3 {
+			duration = args[2]
+		}
+		err = c.profile(args[1], duration)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "lbctl:", err)
+		os.Exit(1)
+	}
+}
+
+func (c *client) status() error {
+	servers, err := c.api.ListServers(context.Background())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tPOOL\tSOURCE\tSTATE\tWEIGHT\tACTIVE\tREQUESTS\t5XX\tP95 MS")
+	for _, s := range servers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%.1f\n", s.ID, s.Pool, s.Source, s.State, s.Weight,
+			s.ActiveRequests, s.Stats.Requests, s.Stats.Status5xx, s.Stats.LatencyP95Ms)
+	}
+	return w.Flush()
+}
+
+// Requests already sent to the server finish; new ones go to the others
+func (c *client) drain(id string) error {
+	s, err := c.api.UpdateServer(context.Background(), id, adminclient.UpdateServerRequest{Weight: 0})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Draining %s (%d active requests)\n", s.ID, s.ActiveRequests)
+	return nil
+}
+
+func (c *client) add(rawURL, options string) error {
+	s, err := c.api.AddServer(context.Background(), adminclient.AddServerRequest{URL: rawURL, Options: options})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added %s to pool %s, %s\n", s.ID, s.Pool, s.State)
+	return nil
+}
+
+func (c *client) bans() error {
+	bans, err := c.api.ListBans(context.Background())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IP\tREASON\tSINCE\tUNTIL")
+	for _, b := range bans {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", b.IP, b.Reason,
+			b.Since.Local().Format("15:04:05"), b.Until.Local().Format("15:04:05"))
+	}
+	return w.Flush()
+}
+
+func (c *client) ban(ip, duration string) error {
+	b, err := c.api.AddBan(context.Background(), adminclient.BanRequest{IP: ip, Duration: duration})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Banned %s until %s\n", b.IP, b.Until.Local().Format("15:04:05"))
+	return nil
+}
+
+func (c *client) unban(ip string) error {
+	if err := c.api.LiftBan(context.Background(), ip); err != nil {
+		return err
+	}
+	fmt.Printf("Lifted the ban on %s\n", ip)
+	return nil
+}
+
+func (c *client) watch() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := c.api.WatchEvents(ctx, func(e adminclient.Event) {
+		fmt.Println(formatEvent(e))
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func formatEvent(e adminclient.Event) string {
+	line := e.Time.Local().Format("15:04:05") + " " + e.Type
+	if e.Server != "" {
+		line += " " + e.Server
+	}
+	if e.Method != "" {
+		line += fmt.Sprintf(" %s %s %d", e.Method, e.Path, e.Status)
+	}
+	if e.Role != "" {
+		line += " by " + e.Role
+	}
+	if e.Reason != "" {
+		line += ": " + e.Reason
+	}
+	return line
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
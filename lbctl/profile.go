@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Clients sending requests at once during profile
+	profileConcurrency = 16
+	// Functions listed per profile
+	profileTop = 15
+)
+
+// Loads target for duration while the load balancer samples its CPU, then
+// prints where the CPU time and the allocations of that load went. The
+// profiles stay in the current directory for go tool pprof -http.
+func (c *client) profile(target, duration string) error {
+	seconds := 10
+	if duration != "" {
+		d, err := time.ParseDuration(duration)
+		if err != nil || d < time.Second {
+			return fmt.Errorf("invalid duration %q, must be at least 1s", duration)
+		}
+		seconds = int(d / time.Second)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	// Allocations are counted since the process started, so the load's
+	// are the difference to a heap profile taken before it
+	if err := c.saveProfile(ctx, "heap", nil, "lb-heap-base.pprof"); err != nil {
+		return err
+	}
+
+	fmt.Printf("Sending requests to %s from %d clients for %ds\n", target, profileConcurrency, seconds)
+	cpu := make(chan error, 1)
+	go func() {
+		cpu <- c.saveProfile(ctx, "profile", url.Values{"seconds": {strconv.Itoa(seconds)}}, "lb-cpu.pprof")
+	}()
+	loadCtx, stopLoad := context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+	requests, failures := sendLoad(loadCtx, target)
+	stopLoad()
+	if err := <-cpu; err != nil {
+		return err
+	}
+	fmt.Printf("%d requests (%.0f/s), %d failed\n", requests, float64(requests)/float64(seconds), failures)
+
+	if err := c.saveProfile(ctx, "heap", nil, "lb-heap.pprof"); err != nil {
+		return err
+	}
+
+	fmt.Println("\nCPU:")
+	if err := pprofTop("lb-cpu.pprof"); err != nil {
+		return err
+	}
+	fmt.Println("\nAllocations:")
+	if err := pprofTop("-sample_index=alloc_space", "-base=lb-heap-base.pprof", "lb-heap.pprof"); err != nil {
+		return err
+	}
+	fmt.Println("\nSaved lb-cpu.pprof, lb-heap.pprof and lb-heap-base.pprof, e.g. go tool pprof -http=: lb-cpu.pprof")
+	return nil
+}
+
+func (c *client) saveProfile(ctx context.Context, name string, query url.Values, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := c.api.Profile(ctx, name, query, file); err != nil {
+		return fmt.Errorf("%s profile: %w", name, err)
+	}
+	return file.Close()
+}
+
+// GETs target from profileConcurrency clients until ctx is done. Failures
+// are errors and 5xx answers.
+func sendLoad(ctx context.Context, target string) (requests, failures int64) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = profileConcurrency
+	httpClient := &http.Client{Transport: transport}
+	defer transport.CloseIdleConnections()
+
+	var sent, failed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < profileConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+				if err != nil {
+					failed.Add(1)
+					return
+				}
+				resp, err := httpClient.Do(req)
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					// Cut short by the end of the load, not a failure
+					return
+				}
+				sent.Add(1)
+				if err != nil {
+					failed.Add(1)
+					continue
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode >= 500 {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return sent.Load(), failed.Load()
+}
+
+// Prints the functions a profile spends the most in, using the Go toolchain
+func pprofTop(args ...string) error {
+	args = append([]string{"tool", "pprof", "-top", "-nodecount=" + strconv.Itoa(profileTop)}, args...)
+	cmd := exec.Command("go", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("go tool pprof: %w", err)
+	}
+	return nil
+}
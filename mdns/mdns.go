@@ -0,0 +1,353 @@
+// Package mdns is the small part of multicast DNS service discovery (RFC
+// 6762 and 6763) the demo needs: the API services advertise themselves as
+// instances of a service type such as _user-api._tcp, and the load
+// balancer browses for them, so instances on the same network find each
+// other without any configuration.
+package mdns
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// The mDNS group and port
+var group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+const (
+	domain = "local."
+	// TTL of advertised records, and the most answers to one-shot queries
+	// may carry
+	ttl       = 120
+	legacyTTL = 10
+	// Top bit of a question's class asking for a unicast answer, and of a
+	// record's class saying it replaces whatever other hosts cached
+	unicastResponse = 1 << 15
+	cacheFlush      = 1 << 15
+)
+
+// An instance of a service
+type Instance struct {
+	// e.g. "api-service-1"
+	Name string
+	// e.g. "api-1.local."
+	Host  string
+	Addrs []net.IP
+	Port  int
+	// The key=value pairs of its TXT record
+	Text map[string]string
+}
+
+// Answers queries for the service, e.g. "_user-api._tcp", with instance
+// until ctx is done. The host name defaults to the machine's, and the
+// addresses to its IPv4 addresses.
+func Advertise(ctx context.Context, service string, instance Instance) error {
+	if instance.Host == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		hostname, _, _ = strings.Cut(hostname, ".")
+		instance.Host = hostname + "." + domain
+	}
+	if len(instance.Addrs) == 0 {
+		instance.Addrs = localAddrs()
+	}
+	if len(instance.Addrs) == 0 {
+		return errors.New("no IPv4 address to advertise")
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// The system-assigned interface is already joined
+	p := ipv4.NewPacketConn(conn)
+	for _, ifi := range multicastInterfaces() {
+		p.JoinGroup(&ifi, group)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	a := &advertisement{
+		service:  service + "." + domain,
+		name:     strings.ReplaceAll(instance.Name, ".", "-") + "." + service + "." + domain,
+		instance: instance,
+	}
+
+	// Announced once, so caches on the network learn about it right away
+	if announcement, err := a.answer(dnsmessage.Message{}, dnsmessage.TypePTR, false); err == nil {
+		conn.WriteToUDP(announcement, group)
+	}
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		var query dnsmessage.Message
+		if query.Unpack(buf[:n]) != nil || query.Response {
+			continue
+		}
+		// Queries from another port than 5353 are one-shot queries, e.g. the
+		// load balancer's, and answered to the sender alone
+		legacy := from.Port != group.Port
+		unicast := legacy
+		var qtype dnsmessage.Type
+		for _, question := range query.Questions {
+			if t, ok := a.matches(question); ok {
+				qtype = t
+				unicast = unicast || question.Class&unicastResponse != 0
+			}
+		}
+		if qtype == 0 {
+			continue
+		}
+
+		answer, err := a.answer(query, qtype, legacy)
+		if err != nil {
+			continue
+		}
+		to := group
+		if unicast {
+			to = from
+		}
+		conn.WriteToUDP(answer, to)
+	}
+}
+
+type advertisement struct {
+	// e.g. "_user-api._tcp.local."
+	service string
+	// e.g. "api-service-1._user-api._tcp.local."
+	name     string
+	instance Instance
+}
+
+// The record type asked for, if the question is about this instance
+func (a *advertisement) matches(question dnsmessage.Question) (dnsmessage.Type, bool) {
+	name := question.Name.String()
+	switch {
+	case strings.EqualFold(name, a.service) && (question.Type == dnsmessage.TypePTR || question.Type == dnsmessage.TypeALL):
+		return dnsmessage.TypePTR, true
+	case strings.EqualFold(name, a.name) && (question.Type == dnsmessage.TypeSRV || question.Type == dnsmessage.TypeTXT || question.Type == dnsmessage.TypeALL):
+		return dnsmessage.TypeSRV, true
+	case strings.EqualFold(name, a.instance.Host) && (question.Type == dnsmessage.TypeA || question.Type == dnsmessage.TypeALL):
+		return dnsmessage.TypeA, true
+	}
+	return 0, false
+}
+
+// The answer to a query for qtype, with the records needed to reach the
+// instance as additionals. One-shot queries get their ID and questions
+// back, and short TTLs.
+func (a *advertisement) answer(query dnsmessage.Message, qtype dnsmessage.Type, legacy bool) ([]byte, error) {
+	header := func(name string, unique bool) dnsmessage.ResourceHeader {
+		h := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: ttl}
+		if legacy {
+			h.TTL = legacyTTL
+		} else if unique {
+			h.Class |= cacheFlush
+		}
+		return h
+	}
+
+	text := []string{}
+	for key, value := range a.instance.Text {
+		text = append(text, key+"="+value)
+	}
+	if len(text) == 0 {
+		// A TXT record can't be empty
+		text = append(text, "")
+	}
+	ptr := dnsmessage.Resource{Header: header(a.service, false), Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(a.name)}}
+	srv := dnsmessage.Resource{Header: header(a.name, true), Body: &dnsmessage.SRVResource{
+		Port:   uint16(a.instance.Port),
+		Target: dnsmessage.MustNewName(a.instance.Host),
+	}}
+	txt := dnsmessage.Resource{Header: header(a.name, true), Body: &dnsmessage.TXTResource{TXT: text}}
+	var addrs []dnsmessage.Resource
+	for _, addr := range a.instance.Addrs {
+		var ip [4]byte
+		copy(ip[:], addr.To4())
+		addrs = append(addrs, dnsmessage.Resource{Header: header(a.instance.Host, true), Body: &dnsmessage.AResource{A: ip}})
+	}
+
+	message := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+	if legacy {
+		message.ID = query.ID
+		message.Questions = query.Questions
+	}
+	switch qtype {
+	case dnsmessage.TypePTR:
+		message.Answers = []dnsmessage.Resource{ptr}
+		message.Additionals = append([]dnsmessage.Resource{srv, txt}, addrs...)
+	case dnsmessage.TypeSRV:
+		message.Answers = []dnsmessage.Resource{srv, txt}
+		message.Additionals = addrs
+	default:
+		message.Answers = addrs
+	}
+	return message.Pack()
+}
+
+// The instances of service, e.g. "_user-api._tcp", that answer within
+// wait. Instances whose address wasn't in their answer are left out.
+func Browse(ctx context.Context, service string, wait time.Duration) ([]Instance, error) {
+	serviceName := service + "." + domain
+	name, err := dnsmessage.NewName(serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Not port 5353, so responders answer this socket directly
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32())},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, err
+	}
+	// Sent on every interface, or where the routing table says when there
+	// is none to choose from
+	p := ipv4.NewPacketConn(conn)
+	sent := false
+	for _, ifi := range multicastInterfaces() {
+		if p.SetMulticastInterface(&ifi) == nil {
+			if _, err := conn.WriteToUDP(query, group); err == nil {
+				sent = true
+			}
+		}
+	}
+	if !sent {
+		if _, err := conn.WriteToUDP(query, group); err != nil {
+			return nil, err
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(wait))
+	var names []string
+	srvs := map[string]*dnsmessage.SRVResource{}
+	texts := map[string][]string{}
+	addrs := map[string][]net.IP{}
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			return nil, err
+		}
+
+		var answer dnsmessage.Message
+		if answer.Unpack(buf[:n]) != nil || !answer.Response {
+			continue
+		}
+		for _, record := range append(answer.Answers, answer.Additionals...) {
+			owner := strings.ToLower(record.Header.Name.String())
+			switch body := record.Body.(type) {
+			case *dnsmessage.PTRResource:
+				if strings.EqualFold(owner, serviceName) {
+					names = append(names, body.PTR.String())
+				}
+			case *dnsmessage.SRVResource:
+				srvs[owner] = body
+			case *dnsmessage.TXTResource:
+				texts[owner] = body.TXT
+			case *dnsmessage.AResource:
+				addr := net.IP(body.A[:])
+				if !slices.ContainsFunc(addrs[owner], addr.Equal) {
+					addrs[owner] = append(addrs[owner], addr)
+				}
+			}
+		}
+	}
+
+	var instances []Instance
+	seen := map[string]bool{}
+	for _, name := range names {
+		key := strings.ToLower(name)
+		srv := srvs[key]
+		if seen[key] || srv == nil {
+			continue
+		}
+		seen[key] = true
+		host := strings.ToLower(srv.Target.String())
+		if len(addrs[host]) == 0 {
+			continue
+		}
+		instance := Instance{
+			Name:  name[:len(name)-len(serviceName)-1],
+			Host:  host,
+			Addrs: addrs[host],
+			Port:  int(srv.Port),
+			Text:  map[string]string{},
+		}
+		for _, entry := range texts[key] {
+			if key, value, _ := strings.Cut(entry, "="); key != "" {
+				instance.Text[strings.ToLower(key)] = value
+			}
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// Interfaces that are up and can send and receive multicast
+func multicastInterfaces() []net.Interface {
+	interfaces, _ := net.Interfaces()
+	var multicast []net.Interface
+	for _, ifi := range interfaces {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 {
+			multicast = append(multicast, ifi)
+		}
+	}
+	return multicast
+}
+
+// The machine's IPv4 addresses, loopback only when it has no other
+func localAddrs() []net.IP {
+	var local, loopback []net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+		if ipnet.IP.IsLoopback() {
+			loopback = append(loopback, ipnet.IP.To4())
+		} else {
+			local = append(local, ipnet.IP.To4())
+		}
+	}
+	if len(local) == 0 {
+		return loopback
+	}
+	return local
+}
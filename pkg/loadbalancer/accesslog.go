@@ -0,0 +1,357 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	otellog "go.opentelemetry.io/otel/log"
+
+	"load-balancer-demo/requestid"
+)
+
+// Apache log formats available by name in LOG_FORMAT
+const (
+	commonLogFormat   = `%h %l %u %t "%r" %>s %b`
+	combinedLogFormat = commonLogFormat + ` "%{Referer}i" "%{User-Agent}i"`
+)
+
+// Per-request details filled in while the request is proxied
+type requestInfo struct {
+	route   string
+	backend string
+	// The route itself, once matched
+	matched *Route
+}
+
+type requestInfoKey struct{}
+
+func getRequestInfo(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	if info == nil {
+		return &requestInfo{}
+	}
+	return info
+}
+
+// Everything known about a finished request
+type accessLogEntry struct {
+	request   *http.Request
+	header    http.Header
+	start     time.Time
+	duration  time.Duration
+	status    int
+	bytes     int64
+	backend   string
+	clientIP  string
+	requestID string
+}
+
+// Writes one line per request, either through slog (text and json) or
+// rendered from an Apache-style template
+type AccessLog struct {
+	logger   *slog.Logger
+	template []logDirective
+	out      io.Writer
+	mutex    sync.Mutex
+	// Writes the lines off the request path, nil with ACCESS_LOG_BUFFER=0
+	async *asyncWriter
+}
+
+// Appends one piece of a templated log line
+type logDirective func(b *bytes.Buffer, e *accessLogEntry)
+
+func getAccessLogEnv() (*AccessLog, error) {
+	size, err := getEnvInt("ACCESS_LOG_BUFFER", 8192)
+	if err != nil {
+		return nil, err
+	}
+	// Templates are parsed before the writer starts, which an invalid one
+	// would leave running
+	var template []logDirective
+	format := getEnv("LOG_FORMAT", "text")
+	switch format {
+	case "text", "json":
+	case "common":
+		template, err = parseLogTemplate(commonLogFormat)
+	case "combined":
+		template, err = parseLogTemplate(combinedLogFormat)
+	default:
+		if !strings.Contains(format, "%") {
+			return nil, fmt.Errorf("invalid LOG_FORMAT %q: must be text, json, common, combined or a %%-template", format)
+		}
+		template, err = parseLogTemplate(format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a := &AccessLog{template: template, out: logOutput}
+	if size > 0 {
+		a.async = newAsyncWriter(logOutput, size)
+		a.out = a.async
+	}
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "text":
+		a.logger = slog.New(slog.NewTextHandler(a.out, options))
+	case "json":
+		a.logger = slog.New(slog.NewJSONHandler(a.out, options))
+	}
+	return a, nil
+}
+
+// Lines dropped because the writer fell ACCESS_LOG_BUFFER lines behind
+func (a *AccessLog) Dropped() uint64 {
+	if a == nil || a.async == nil {
+		return 0
+	}
+	return a.async.dropped.Load()
+}
+
+// Writes the lines still queued, at shutdown
+func (a *AccessLog) Close() {
+	if a.async != nil {
+		a.async.Close()
+	}
+}
+
+func (a *AccessLog) Log(e *accessLogEntry) {
+	if slog.LevelInfo >= logLevel.Level() {
+		exportLog(e.request.Context(), slog.LevelInfo, "request",
+			otellog.String("method", e.request.Method),
+			otellog.String("path", e.request.URL.Path),
+			otellog.Int("status", e.status),
+			otellog.String("backend", e.backend),
+			otellog.Float64("duration_ms", milliseconds(e.duration)),
+			otellog.Int64("bytes", e.bytes),
+			otellog.String("client_ip", e.clientIP),
+			otellog.String("request_id", e.requestID),
+		)
+	}
+
+	if a.logger != nil {
+		a.logger.LogAttrs(e.request.Context(), slog.LevelInfo, "request",
+			slog.String("method", e.request.Method),
+			slog.String("path", e.request.URL.Path),
+			slog.Int("status", e.status),
+			slog.String("backend", e.backend),
+			slog.Float64("duration_ms", milliseconds(e.duration)),
+			slog.Int64("bytes", e.bytes),
+			slog.String("client_ip", e.clientIP),
+			slog.String("request_id", e.requestID),
+		)
+		return
+	}
+
+	if slog.LevelInfo < logLevel.Level() {
+		return
+	}
+
+	b := getByteBuffer()
+	defer putByteBuffer(b)
+	for _, directive := range a.template {
+		directive(b, e)
+	}
+	b.WriteByte('\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.out.Write(b.Bytes())
+}
+
+// Parses Apache mod_log_config style templates: %h %l %u %t %r %s %>s %b
+// %B %D %T %m %U %q %H, %{Name}i and %{Name}o for request and response
+// headers, and %{backend}x / %{request_id}x for load balancer fields
+func parseLogTemplate(format string) ([]logDirective, error) {
+	directives := []logDirective{}
+	literal := strings.Builder{}
+
+	flushLiteral := func() {
+		if literal.Len() > 0 {
+			text := literal.String()
+			directives = append(directives, func(b *bytes.Buffer, e *accessLogEntry) {
+				b.WriteString(text)
+			})
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			literal.WriteByte(format[i])
+			continue
+		}
+
+		i++
+		if i < len(format) && format[i] == '%' {
+			literal.WriteByte('%')
+			continue
+		}
+		if i < len(format) && format[i] == '>' {
+			i++
+		}
+
+		name := ""
+		if i < len(format) && format[i] == '{' {
+			end := strings.IndexByte(format[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid LOG_FORMAT %q: unterminated %%{", format)
+			}
+			name = format[i+1 : i+end]
+			i += end + 1
+		}
+		if i >= len(format) {
+			return nil, fmt.Errorf("invalid LOG_FORMAT %q: missing directive after %%", format)
+		}
+
+		directive := logTemplateDirective(format[i], name)
+		if directive == nil {
+			return nil, fmt.Errorf("invalid LOG_FORMAT %q: unknown directive %%%c", format, format[i])
+		}
+		flushLiteral()
+		directives = append(directives, directive)
+	}
+	flushLiteral()
+
+	return directives, nil
+}
+
+func logTemplateDirective(verb byte, name string) logDirective {
+	switch verb {
+	case 'h':
+		return func(b *bytes.Buffer, e *accessLogEntry) { b.WriteString(e.clientIP) }
+	case 'l':
+		return func(b *bytes.Buffer, e *accessLogEntry) { b.WriteByte('-') }
+	case 'u':
+		return func(b *bytes.Buffer, e *accessLogEntry) {
+			user, _, ok := e.request.BasicAuth()
+			writeLogValue(b, user, ok)
+		}
+	case 't':
+		return func(b *bytes.Buffer, e *accessLogEntry) {
+			b.WriteString(e.start.Format("[02/Jan/2006:15:04:05 -0700]"))
+		}
+	case 'r':
+		return func(b *bytes.Buffer, e *accessLogEntry) {
+			b.WriteString(e.request.Method + " " + e.request.RequestURI + " " + e.request.Proto)
+		}
+	case 's':
+		return func(b *bytes.Buffer, e *accessLogEntry) { b.WriteString(strconv.Itoa(e.status)) }
+	case 'b':
+		return func(b *bytes.Buffer, e *accessLogEntry) {
+			writeLogValue(b, strconv.FormatInt(e.bytes, 10), e.bytes > 0)
+		}
+	case 'B':
+		return func(b *bytes.Buffer, e *accessLogEntry) { b.WriteString(strconv.FormatInt(e.bytes, 10)) }
+	case 'D':
+		return func(b *bytes.Buffer, e *accessLogEntry) {
+			b.WriteString(strconv.FormatInt(e.duration.Microseconds(), 10))
+		}
+	case 'T':
+		return func(b *bytes.Buffer, e *accessLogEntry) {
+			b.WriteString(strconv.FormatInt(int64(e.duration.Seconds()), 10))
+		}
+	case 'm':
+		return func(b *bytes.Buffer, e *accessLogEntry) { b.WriteString(e.request.Method) }
+	case 'U':
+		return func(b *bytes.Buffer, e *accessLogEntry) { b.WriteString(e.request.URL.Path) }
+	case 'q':
+		return func(b *bytes.Buffer, e *accessLogEntry) {
+			if e.request.URL.RawQuery != "" {
+				b.WriteString("?" + e.request.URL.RawQuery)
+			}
+		}
+	case 'H':
+		return func(b *bytes.Buffer, e *accessLogEntry) { b.WriteString(e.request.Proto) }
+	case 'i':
+		return func(b *bytes.Buffer, e *accessLogEntry) {
+			value := e.request.Header.Get(name)
+			writeLogValue(b, value, value != "")
+		}
+	case 'o':
+		return func(b *bytes.Buffer, e *accessLogEntry) {
+			value := e.header.Get(name)
+			writeLogValue(b, value, value != "")
+		}
+	case 'x':
+		switch name {
+		case "backend":
+			return func(b *bytes.Buffer, e *accessLogEntry) { writeLogValue(b, e.backend, e.backend != "") }
+		case "request_id":
+			return func(b *bytes.Buffer, e *accessLogEntry) { b.WriteString(e.requestID) }
+		}
+	}
+	return nil
+}
+
+// Writes "-" for a missing value, as Apache does
+func writeLogValue(b *bytes.Buffer, value string, ok bool) {
+	if !ok {
+		value = "-"
+	}
+	b.WriteString(value)
+}
+
+// Wraps the load balancer with tracing, request metrics and one access log
+// entry per request; runs inside requestid.Middleware
+func (lb *LoadBalancer) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := requestid.FromContext(r.Context())
+
+		info := &requestInfo{}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		r, span := startServerSpan(r)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		var requestBody *cappedBuffer
+		logBodies := lb.bodyLog.selects(r)
+		if logBodies {
+			requestBody = lb.bodyLog.captureRequest(r)
+			recorder.body = &cappedBuffer{max: lb.bodyLog.MaxBytes}
+		}
+
+		next.ServeHTTP(recorder, r)
+
+		if logBodies {
+			lb.bodyLog.write(r, requestBody, recorder)
+		}
+
+		duration := time.Since(start)
+		lb.metrics.observeRequest(r, info.route, recorder.status, duration)
+		if info.route != "" {
+			lb.topPaths.Record(r.URL.Path, duration)
+		}
+		endSpan(span, recorder.status, nil)
+
+		lb.events.PublishSampled(Event{
+			Type:       EventRequest,
+			Server:     info.backend,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     recorder.status,
+			DurationMs: milliseconds(duration),
+		})
+
+		lb.accessLog.Log(&accessLogEntry{
+			request:   r,
+			header:    recorder.Header(),
+			start:     start,
+			duration:  duration,
+			status:    recorder.status,
+			bytes:     recorder.bytes,
+			backend:   info.backend,
+			clientIP:  lb.trustedProxies.ClientIP(r),
+			requestID: requestID,
+		})
+	})
+}
@@ -0,0 +1,942 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	"load-balancer-demo/requestid"
+)
+
+const adminPrefix = "/lb-admin"
+
+// How long a new process keeps trying to bind ADMIN_ADDR while the old one
+// still holds it during a graceful restart
+const adminListenRetries = 30
+
+// Roles granted by the admin API tokens
+const (
+	RoleOperator   = "operator"
+	RoleViewer     = "viewer"
+	RoleRegistrant = "registrant"
+)
+
+// Operational endpoints under /lb-admin, only served when a token is set
+// and only to requests carrying one as a bearer token or API key.
+// ADMIN_TOKEN grants the operator role; ADMIN_READ_TOKEN grants the viewer
+// role, which may only read, e.g. for dashboards. REGISTRATION_SECRET
+// grants the registrant role, which may only register backends.
+type AdminAPI struct {
+	lb        *LoadBalancer
+	token     string
+	readToken string
+	registry  *Registry
+	router    *mux.Router
+	// Whether /lb-status, its sub-resources and /lb-events require the
+	// token too, or the status credentials
+	protectStatus  bool
+	statusUsername string
+	statusPassword string
+	guard          *AdminGuard
+	audit          *AuditLog
+	// Serializes changes, so concurrent calls can't add the same server twice
+	mutex sync.Mutex
+}
+
+// Body of POST /lb-admin/servers; options use the TARGET_SERVICES syntax,
+// e.g. "pool=heavy;maxconns=10"
+type addServerRequest struct {
+	URL     string `json:"url"`
+	Options string `json:"options"`
+}
+
+// Body of POST /lb-admin/pools; options use the POOLS syntax, e.g.
+// "maxrequests=20;overflow=default"
+type addPoolRequest struct {
+	Name    string `json:"name"`
+	Options string `json:"options"`
+}
+
+// Body of POST /lb-admin/pools/{name}/routes; options use the ROUTES
+// syntax, e.g. "timeout=2s;redirects=follow"
+type addRouteRequest struct {
+	Prefix  string `json:"prefix"`
+	Options string `json:"options"`
+}
+
+// Body of PATCH /lb-admin/servers/{id}
+type updateServerRequest struct {
+	Weight *int64 `json:"weight"`
+}
+
+// Body of PUT /lb-admin/servers/{id}/health; without a ttl the override
+// stays until it is deleted
+type healthOverrideRequest struct {
+	Healthy *bool  `json:"healthy"`
+	TTL     string `json:"ttl"`
+}
+
+// Body of POST /lb-admin/bans; without a duration the ban lasts
+// BAN_DURATION
+type banRequest struct {
+	IP       string `json:"ip"`
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"`
+}
+
+func newAdminAPI(lb *LoadBalancer) (*AdminAPI, error) {
+	protectStatus, err := getEnvBool("STATUS_REQUIRE_TOKEN", false)
+	if err != nil {
+		return nil, err
+	}
+	guard, err := getAdminGuardEnv(lb.clock)
+	if err != nil {
+		return nil, err
+	}
+	registry, err := getRegistryEnv(lb)
+	if err != nil {
+		return nil, err
+	}
+	a := &AdminAPI{
+		lb:             lb,
+		token:          getEnv("ADMIN_TOKEN", ""),
+		readToken:      getEnv("ADMIN_READ_TOKEN", ""),
+		router:         mux.NewRouter(),
+		protectStatus:  protectStatus,
+		statusUsername: getEnv("STATUS_USERNAME", ""),
+		statusPassword: getEnv("STATUS_PASSWORD", ""),
+		guard:          guard,
+		registry:       registry,
+	}
+	if (a.statusUsername == "") != (a.statusPassword == "") {
+		return nil, errors.New("STATUS_USERNAME and STATUS_PASSWORD must be set together")
+	}
+	if a.statusUsername != "" {
+		a.protectStatus = true
+	}
+	if a.protectStatus && a.token == "" && a.readToken == "" && a.statusUsername == "" {
+		return nil, errors.New("STATUS_REQUIRE_TOKEN needs ADMIN_TOKEN, ADMIN_READ_TOKEN or STATUS_USERNAME to be set")
+	}
+	if a.token != "" && a.token == a.readToken {
+		return nil, errors.New("ADMIN_READ_TOKEN must differ from ADMIN_TOKEN")
+	}
+	if a.registry != nil && (a.registry.secret == a.token || a.registry.secret == a.readToken) {
+		return nil, errors.New("REGISTRATION_SECRET must differ from ADMIN_TOKEN and ADMIN_READ_TOKEN")
+	}
+	// Opened last, so an invalid setting doesn't leave the file open
+	if a.audit, err = getAuditLogEnv(); err != nil {
+		return nil, err
+	}
+
+	a.router.HandleFunc("/servers", a.listServers).Methods(http.MethodGet)
+	a.router.HandleFunc("/servers", a.addServer).Methods(http.MethodPost)
+	a.router.HandleFunc("/servers/{id}", a.getServer).Methods(http.MethodGet)
+	a.router.HandleFunc("/servers/{id}", a.updateServer).Methods(http.MethodPatch)
+	a.router.HandleFunc("/servers/{id}", a.removeServer).Methods(http.MethodDelete)
+	a.router.HandleFunc("/servers/{id}/disable", a.disableServer).Methods(http.MethodPost)
+	a.router.HandleFunc("/servers/{id}/enable", a.enableServer).Methods(http.MethodPost)
+	a.router.HandleFunc("/servers/{id}/health", a.overrideHealth).Methods(http.MethodPut)
+	a.router.HandleFunc("/servers/{id}/health", a.clearHealthOverride).Methods(http.MethodDelete)
+
+	a.router.HandleFunc("/pools", a.listPools).Methods(http.MethodGet)
+	a.router.HandleFunc("/pools", a.addPool).Methods(http.MethodPost)
+	a.router.HandleFunc("/pools/{name}", a.getPool).Methods(http.MethodGet)
+	a.router.HandleFunc("/pools/{name}", a.removePool).Methods(http.MethodDelete)
+	a.router.HandleFunc("/pools/{name}/servers/{id}", a.assignServer).Methods(http.MethodPut)
+	a.router.HandleFunc("/pools/{name}/routes", a.addRoute).Methods(http.MethodPost)
+	a.router.HandleFunc("/pools/{name}/routes", a.removeRoute).Methods(http.MethodDelete)
+	a.router.HandleFunc("/routes", a.listRoutes).Methods(http.MethodGet)
+
+	a.router.HandleFunc("/healthcheck", a.runHealthCheck).Methods(http.MethodPost)
+	a.router.HandleFunc("/drain", a.getDrain).Methods(http.MethodGet)
+	a.router.HandleFunc("/drain", a.startDrain).Methods(http.MethodPost)
+	a.router.HandleFunc("/drain", a.stopDrain).Methods(http.MethodDelete)
+	a.router.HandleFunc("/reload", a.reload).Methods(http.MethodPost)
+	a.router.HandleFunc("/register", a.register).Methods(http.MethodPost)
+	a.router.HandleFunc("/register", a.deregister).Methods(http.MethodDelete)
+
+	a.router.HandleFunc("/bans", a.listBans).Methods(http.MethodGet)
+	a.router.HandleFunc("/bans", a.addBan).Methods(http.MethodPost)
+	a.router.HandleFunc("/bans/{ip}", a.liftBan).Methods(http.MethodDelete)
+
+	a.router.HandleFunc("/state", a.exportState).Methods(http.MethodGet)
+	a.router.HandleFunc("/state", a.restoreState).Methods(http.MethodPut)
+
+	a.router.HandleFunc("/openapi.json", handleOpenAPI).Methods(http.MethodGet)
+	a.router.HandleFunc("/events", a.lb.events.ServeWebSocket).Methods(http.MethodGet)
+
+	// Profiles of the running balancer, e.g. /lb-admin/debug/pprof/profile?seconds=30
+	a.router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	a.router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	a.router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	a.router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	a.router.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+
+	return a, nil
+}
+
+// Serves the admin API and metrics on their own address, so operational
+// endpoints are never reachable through the traffic port
+func (lb *LoadBalancer) newAdminServer(addr string) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.Handle(adminPrefix+"/", lb.admin)
+	mux.Handle(lb.metrics.Path, lb.metrics)
+
+	server := &http.Server{Addr: addr, Handler: requestid.Middleware(lb.instrument(mux))}
+	if err := applyServerLimitsEnv(server); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+func startAdminServer(server *http.Server) {
+	addr := server.Addr
+	go func() {
+		for attempt := 1; ; attempt++ {
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				if attempt == adminListenRetries {
+					errorf("❌ Admin listener on %s failed: %v", addr, err)
+					return
+				}
+				time.Sleep(time.Second)
+				continue
+			}
+
+			if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+				errorf("❌ Admin listener on %s failed: %v", addr, err)
+			}
+			return
+		}
+	}()
+}
+
+func (a *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token == "" && a.readToken == "" && a.registry == nil {
+		http.NotFound(w, r)
+		return
+	}
+	a.guarded(w, r, func(w http.ResponseWriter, role string) {
+		switch {
+		case role == "":
+			writeUnauthorized(w)
+		case role == RoleViewer && !viewerAllowed(r):
+			http.Error(w, "Forbidden: the read-only token can't change the load balancer", http.StatusForbidden)
+		case role == RoleRegistrant && r.URL.Path != adminPrefix+"/register":
+			http.Error(w, "Forbidden: the registration secret can only register backends", http.StatusForbidden)
+		default:
+			http.StripPrefix(adminPrefix, a.router).ServeHTTP(w, r)
+		}
+	})
+}
+
+// Serves the call unless its client is rate limited or locked out. Failed
+// calls count towards the client's lockout; they and every call that may
+// change something go to the audit trail.
+func (a *AdminAPI) guarded(w http.ResponseWriter, r *http.Request, serve func(http.ResponseWriter, string)) {
+	client := a.lb.trustedProxies.ClientIP(r)
+	role := a.role(r)
+	if ok, retryAfter, reason := a.guard.Allow(client); !ok {
+		writeTooManyRequests(w, retryAfter)
+		a.audit.Record(r, "throttled", role, client, http.StatusTooManyRequests, "reason", reason)
+		return
+	}
+
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	serve(recorder, role)
+	a.recordCall(r, role, client, recorder.status)
+}
+
+func (a *AdminAPI) recordCall(r *http.Request, role, client string, status int) {
+	switch {
+	case status >= 400:
+		a.audit.Record(r, "failed", role, client, status)
+	case role == RoleRegistrant:
+		// Heartbeats would flood the trail; backends joining and leaving
+		// show up as server events
+	case r.Method != http.MethodGet && r.Method != http.MethodHead:
+		a.audit.Record(r, "change", role, client, status)
+		a.lb.events.Publish(Event{
+			Type:      EventAdminAction,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    status,
+			Role:      role,
+			adminOnly: true,
+		})
+	}
+
+	// Only the caller's mistakes count, not the balancer's own errors
+	if status < 400 || status >= 500 || !a.guard.RecordFailure(client) {
+		return
+	}
+	warnf("🔒 Admin client %s locked out for %s after %d failed calls", client, a.guard.duration, a.guard.threshold)
+	a.audit.Record(r, "lockout", role, client, status, "duration", a.guard.duration.String())
+}
+
+// Whether the request needs authorizeStatus: the status endpoints and the
+// event stream, and with status credentials the dashboard as well, so that
+// browsers ask for them once for the whole page. Without them the
+// dashboard stays open for #token, and fetches the status with the token.
+func (a *AdminAPI) isProtectedStatus(path string) bool {
+	if !a.protectStatus {
+		return false
+	}
+	switch {
+	case path == "/lb-status" || strings.HasPrefix(path, "/lb-status/") || path == "/lb-events":
+		return true
+	case path == "/lb-dashboard":
+		return a.statusUsername != ""
+	}
+	return false
+}
+
+// Answers 401 and returns false unless the request carries a token of
+// either role, or the status credentials with basic auth. Clients locked
+// out of the admin API get 429 instead, and every missing or wrong token
+// counts towards the lockout.
+func (a *AdminAPI) authorizeStatus(w http.ResponseWriter, r *http.Request) bool {
+	client := a.lb.trustedProxies.ClientIP(r)
+	if wait := a.guard.LockedOut(client); wait > 0 {
+		writeTooManyRequests(w, wait)
+		a.audit.Record(r, "throttled", "", client, http.StatusTooManyRequests, "reason", "locked_out")
+		return false
+	}
+	if a.role(r) != "" || a.statusCredentials(r) {
+		return true
+	}
+	if a.statusUsername != "" {
+		// Listed first, so browsers ask for the credentials
+		w.Header().Add("WWW-Authenticate", `Basic realm="lb-status", charset="UTF-8"`)
+	}
+	writeUnauthorized(w)
+	a.recordCall(r, "", client, http.StatusUnauthorized)
+	return false
+}
+
+// Whether the request has STATUS_USERNAME and STATUS_PASSWORD as basic auth
+func (a *AdminAPI) statusCredentials(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok || a.statusUsername == "" {
+		return false
+	}
+	// Both compared, so the time taken doesn't tell which one was wrong
+	usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(a.statusUsername))
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(a.statusPassword))
+	return usernameOK&passwordOK == 1
+}
+
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Add("WWW-Authenticate", `Bearer realm="lb-admin"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// Role of the request's token, empty without a valid one. The token is
+// accepted as "Authorization: Bearer <token>" or "X-API-Key: <token>", and
+// for WebSocket handshakes, which browsers can't add headers to, as the
+// access_token query parameter.
+func (a *AdminAPI) role(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.Header.Get("X-API-Key")
+	}
+	if token == "" && websocket.IsWebSocketUpgrade(r) {
+		token = r.URL.Query().Get("access_token")
+	}
+
+	switch {
+	case token == "":
+		return ""
+	case a.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1:
+		return RoleOperator
+	case a.readToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.readToken)) == 1:
+		return RoleViewer
+	case a.registry != nil && subtle.ConstantTimeCompare([]byte(token), []byte(a.registry.secret)) == 1:
+		return RoleRegistrant
+	}
+	return ""
+}
+
+// Viewers may read everything except profiles, which expose the process
+// internals and cost CPU while they run
+func viewerAllowed(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return !strings.HasPrefix(r.URL.Path, adminPrefix+"/debug/pprof/")
+}
+
+func (a *AdminAPI) listServers(w http.ResponseWriter, r *http.Request) {
+	servers := []ServerStatus{}
+	for _, server := range a.lb.Servers() {
+		servers = append(servers, server.Status(true))
+	}
+	writeJSON(w, http.StatusOK, servers)
+}
+
+func (a *AdminAPI) getServer(w http.ResponseWriter, r *http.Request) {
+	server := a.lb.findServer(mux.Vars(r)["id"])
+	if server == nil {
+		http.Error(w, "Server not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, server.Detail())
+}
+
+// Registers a backend at runtime. It is probed once before joining its
+// pool, so a dead backend doesn't get traffic until the next health check.
+func (a *AdminAPI) addServer(w http.ResponseWriter, r *http.Request) {
+	var request addServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	target, err := url.Parse(request.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(w, "url must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+	server, err := newServer(target, request.Options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if server.resolve {
+		http.Error(w, "resolve is only supported in TARGET_SERVICES", http.StatusBadRequest)
+		return
+	}
+	if a.lb.pool(server.Pool) == nil {
+		http.Error(w, "Unknown pool "+server.Pool, http.StatusBadRequest)
+		return
+	}
+	// Probed before taking the mutex, so a slow backend doesn't hold up
+	// every other change
+	a.lb.checkServer(server)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.lb.findServer(server.ID()) != nil {
+		http.Error(w, "Server "+server.ID()+" already exists", http.StatusConflict)
+		return
+	}
+	if err := a.lb.addServer(server); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	infof("➕ Added server %s to pool %s via admin API", server.rawURL, server.Pool)
+
+	writeJSON(w, http.StatusCreated, server.Status(true))
+}
+
+// Deregisters a backend; requests already sent to it finish. Discovered
+// backends come back as long as their source offers them, so they can only
+// be disabled.
+func (a *AdminAPI) removeServer(w http.ResponseWriter, r *http.Request) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	server := a.lb.findServer(mux.Vars(r)["id"])
+	if server == nil {
+		http.Error(w, "Server not found", http.StatusNotFound)
+		return
+	}
+	if server.Source != "" {
+		http.Error(w, "Server "+server.ID()+" is discovered from "+server.Source+", disable it or remove it there", http.StatusConflict)
+		return
+	}
+
+	a.lb.removeServer(server)
+	infof("➖ Removed server %s via admin API", server.rawURL)
+	// A discovered copy of it takes its place
+	a.lb.resyncDiscovered()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Changes a backend's weight, e.g. to shift traffic gradually during a deploy
+func (a *AdminAPI) updateServer(w http.ResponseWriter, r *http.Request) {
+	server := a.lb.findServer(mux.Vars(r)["id"])
+	if server == nil {
+		http.Error(w, "Server not found", http.StatusNotFound)
+		return
+	}
+
+	var request updateServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Weight == nil || *request.Weight < 0 {
+		http.Error(w, "weight must be a number of at least 0", http.StatusBadRequest)
+		return
+	}
+
+	previous := server.Weight()
+	server.SetWeight(*request.Weight)
+	infof("⚖️  Changed weight of server %s from %d to %d via admin API", server.rawURL, previous, *request.Weight)
+
+	writeJSON(w, http.StatusOK, server.Status(true))
+}
+
+// Probes all backends, or only the one given as ?server=<id>, right away
+// instead of waiting for the next health check cycle
+func (a *AdminAPI) runHealthCheck(w http.ResponseWriter, r *http.Request) {
+	servers := a.lb.Servers()
+	if id := r.URL.Query().Get("server"); id != "" {
+		server := a.lb.findServer(id)
+		if server == nil {
+			http.Error(w, "Server not found", http.StatusNotFound)
+			return
+		}
+		servers = []*Server{server}
+	}
+
+	results := make([]HealthCheckResult, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server *Server) {
+			defer wg.Done()
+			results[i] = a.lb.checkServer(server)
+		}(i, server)
+	}
+	wg.Wait()
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (a *AdminAPI) getDrain(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.lb.drainStatus())
+}
+
+// Poll GET /drain until inFlight is 0 to know when the LB can be removed
+func (a *AdminAPI) startDrain(w http.ResponseWriter, r *http.Request) {
+	a.lb.startDrain()
+	writeJSON(w, http.StatusOK, a.lb.drainStatus())
+}
+
+func (a *AdminAPI) stopDrain(w http.ResponseWriter, r *http.Request) {
+	a.lb.stopDrain()
+	writeJSON(w, http.StatusOK, a.lb.drainStatus())
+}
+
+func (a *AdminAPI) listPools(w http.ResponseWriter, r *http.Request) {
+	pools := []PoolDetail{}
+	for _, pool := range a.lb.Pools() {
+		pools = append(pools, a.lb.poolDetail(pool))
+	}
+	writeJSON(w, http.StatusOK, pools)
+}
+
+func (a *AdminAPI) getPool(w http.ResponseWriter, r *http.Request) {
+	pool := a.lb.pool(mux.Vars(r)["name"])
+	if pool == nil {
+		http.Error(w, "Pool not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.lb.poolDetail(pool))
+}
+
+// Creates an empty pool; servers are assigned and routes attached to it
+// afterwards
+func (a *AdminAPI) addPool(w http.ResponseWriter, r *http.Request) {
+	var request addPoolRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validPoolName(request.Name) {
+		http.Error(w, "name must be non-empty and can't contain commas, semicolons, equals signs or spaces", http.StatusBadRequest)
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	pool, err := a.lb.addPool(request.Name, request.Options)
+	switch {
+	case errors.Is(err, ErrPoolExists):
+		http.Error(w, "Pool "+request.Name+" already exists", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	infof("➕ Created pool %s via admin API", pool.Name)
+
+	writeJSON(w, http.StatusCreated, a.lb.poolDetail(pool))
+}
+
+func (a *AdminAPI) removePool(w http.ResponseWriter, r *http.Request) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	pool := a.lb.pool(mux.Vars(r)["name"])
+	if pool == nil {
+		http.Error(w, "Pool not found", http.StatusNotFound)
+		return
+	}
+	if err := a.lb.removePool(pool); err != nil {
+		http.Error(w, "Can't remove pool "+pool.Name+": "+err.Error(), http.StatusConflict)
+		return
+	}
+	infof("➖ Removed pool %s via admin API", pool.Name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Moves a backend into the pool
+func (a *AdminAPI) assignServer(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pool := a.lb.pool(vars["name"])
+	server := a.lb.findServer(vars["id"])
+	switch {
+	case pool == nil:
+		http.Error(w, "Pool not found", http.StatusNotFound)
+		return
+	case server == nil:
+		http.Error(w, "Server not found", http.StatusNotFound)
+		return
+	case server.Source != "":
+		http.Error(w, "Server "+server.ID()+" is discovered from "+server.Source+", change its pool there", http.StatusConflict)
+		return
+	case server.Pool == pool.Name:
+		writeJSON(w, http.StatusOK, server.Status(true))
+		return
+	}
+
+	// Probed before taking the mutex, so a slow backend doesn't hold up
+	// every other change
+	moved, err := a.lb.serverInPool(server, pool)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if err := a.lb.replaceServer(server, moved); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	infof("🔀 Moved server %s from pool %s to %s via admin API", server.rawURL, server.Pool, pool.Name)
+
+	writeJSON(w, http.StatusOK, moved.Status(true))
+}
+
+func (a *AdminAPI) listRoutes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.lb.Routes())
+}
+
+// Sends requests under a path prefix to the pool
+func (a *AdminAPI) addRoute(w http.ResponseWriter, r *http.Request) {
+	var request addRouteRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(request.Prefix, "/") {
+		http.Error(w, "prefix must start with /", http.StatusBadRequest)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	route := &Route{Prefix: request.Prefix, Pool: name, Redirects: RedirectPass, options: request.Options}
+	if err := parseRouteOptions(route, request.Options, a.lb.clock); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if route.Pool != name {
+		http.Error(w, "The route's pool is given by the URL, not the pool option", http.StatusBadRequest)
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.lb.pool(name) == nil {
+		http.Error(w, "Pool not found", http.StatusNotFound)
+		return
+	}
+	err := a.lb.addRoute(route)
+	switch {
+	case errors.Is(err, errRouteExists):
+		http.Error(w, "Route "+route.Prefix+" already exists", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	infof("➕ Routing %s to pool %s via admin API", route.Prefix, name)
+
+	writeJSON(w, http.StatusCreated, route)
+}
+
+// Detaches the route given as ?prefix= from the pool; its requests fall
+// back to the next longest matching route
+func (a *AdminAPI) removeRoute(w http.ResponseWriter, r *http.Request) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	name, prefix := mux.Vars(r)["name"], r.URL.Query().Get("prefix")
+	if route := a.lb.Routes().Match(prefix); route.Prefix != prefix || route.Pool != name {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+	if err := a.lb.removeRoute(prefix); err != nil {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+	infof("➖ Stopped routing %s to pool %s via admin API", prefix, name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Re-reads CONFIG_FILE and applies its backend list. Nothing is applied
+// unless the whole file validates; the response lists what changed.
+func (a *AdminAPI) reload(w http.ResponseWriter, r *http.Request) {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		http.Error(w, "CONFIG_FILE is not set, there is nothing to reload", http.StatusConflict)
+		return
+	}
+
+	values, err := readConfigFile(path)
+	if err != nil {
+		result := ReloadResult{Errors: []string{err.Error()}}
+		a.lb.configReloaded(result)
+		writeJSON(w, http.StatusUnprocessableEntity, result)
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	result := a.lb.reload(values)
+	a.lb.configReloaded(result)
+	if len(result.Errors) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, result)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (a *AdminAPI) exportState(w http.ResponseWriter, r *http.Request) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	writeJSON(w, http.StatusOK, a.lb.snapshot())
+}
+
+// Re-applies a state exported with GET /lb-admin/state, e.g. after a
+// restart. Nothing is applied unless the whole state validates.
+func (a *AdminAPI) restoreState(w http.ResponseWriter, r *http.Request) {
+	var state RuntimeState
+	if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	result := a.lb.restore(state)
+	if len(result.Errors) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, result)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (a *AdminAPI) disableServer(w http.ResponseWriter, r *http.Request) {
+	a.setDisabled(w, r, true)
+}
+
+func (a *AdminAPI) enableServer(w http.ResponseWriter, r *http.Request) {
+	a.setDisabled(w, r, false)
+}
+
+// Takes a backend out of selection, or puts it back, independently of its
+// health and maintenance state
+func (a *AdminAPI) setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	server := a.lb.findServer(mux.Vars(r)["id"])
+	if server == nil {
+		http.Error(w, "Server not found", http.StatusNotFound)
+		return
+	}
+
+	a.lb.setDisabled(server, disabled)
+	if disabled {
+		infof("⏸️  Disabled server %s via admin API", server.rawURL)
+		a.lb.events.Publish(serverEvent(EventServerDisabled, server, "admin API"))
+	} else {
+		infof("▶️  Enabled server %s via admin API", server.rawURL)
+		a.lb.events.Publish(serverEvent(EventServerEnabled, server, "admin API"))
+	}
+
+	writeJSON(w, http.StatusOK, server.Status(true))
+}
+
+// Forces a backend up or down, optionally for a limited time, while its
+// probes keep running
+func (a *AdminAPI) overrideHealth(w http.ResponseWriter, r *http.Request) {
+	server := a.lb.findServer(mux.Vars(r)["id"])
+	if server == nil {
+		http.Error(w, "Server not found", http.StatusNotFound)
+		return
+	}
+
+	var request healthOverrideRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Healthy == nil {
+		http.Error(w, "healthy must be true or false", http.StatusBadRequest)
+		return
+	}
+	var ttl time.Duration
+	if request.TTL != "" {
+		parsed, err := time.ParseDuration(request.TTL)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid ttl, use a duration like 10m", http.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+
+	a.lb.overrideHealth(server, *request.Healthy, ttl)
+	writeJSON(w, http.StatusOK, server.Status(true))
+}
+
+func (a *AdminAPI) clearHealthOverride(w http.ResponseWriter, r *http.Request) {
+	server := a.lb.findServer(mux.Vars(r)["id"])
+	if server == nil {
+		http.Error(w, "Server not found", http.StatusNotFound)
+		return
+	}
+
+	a.lb.clearHealthOverride(server, "override cleared via admin API")
+	writeJSON(w, http.StatusOK, server.Status(true))
+}
+
+func (a *AdminAPI) listBans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.lb.bans.List())
+}
+
+// Bans a client by hand, e.g. one found scraping in the access log
+func (a *AdminAPI) addBan(w http.ResponseWriter, r *http.Request) {
+	var request banRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ip := net.ParseIP(request.IP)
+	if ip == nil {
+		http.Error(w, "Invalid ip: "+request.IP, http.StatusBadRequest)
+		return
+	}
+	var duration time.Duration
+	if request.Duration != "" {
+		parsed, err := time.ParseDuration(request.Duration)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid duration, use a duration like 1h", http.StatusBadRequest)
+			return
+		}
+		duration = parsed
+	}
+	if request.Reason == "" {
+		request.Reason = "admin"
+	}
+
+	ban := a.lb.bans.Ban(ip.String(), request.Reason, duration)
+	infof("⛔ Banned %s until %s via admin API", ban.IP, ban.Until.Format(time.RFC3339))
+	writeJSON(w, http.StatusCreated, ban)
+}
+
+func (a *AdminAPI) liftBan(w http.ResponseWriter, r *http.Request) {
+	client := mux.Vars(r)["ip"]
+	if ip := net.ParseIP(client); ip != nil {
+		client = ip.String()
+	}
+	if !a.lb.bans.Lift(client) {
+		http.Error(w, "Ban not found", http.StatusNotFound)
+		return
+	}
+	infof("✅ Lifted the ban on %s via admin API", client)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Registers the calling backend, or renews its registration when it is
+// already registered; backends call it on startup and then as a heartbeat
+func (a *AdminAPI) register(w http.ResponseWriter, r *http.Request) {
+	if a.registry == nil {
+		http.Error(w, "Self-registration is disabled, set REGISTRATION_SECRET", http.StatusNotFound)
+		return
+	}
+
+	var request addServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	target, err := url.Parse(request.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(w, "url must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+	server, err := newServer(target, request.Options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if server.resolve {
+		http.Error(w, "resolve is only supported in TARGET_SERVICES", http.StatusBadRequest)
+		return
+	}
+	if a.lb.pool(server.Pool) == nil {
+		http.Error(w, "Unknown pool "+server.Pool, http.StatusBadRequest)
+		return
+	}
+
+	response, ok := a.registry.Register(server)
+	if !ok {
+		http.Error(w, "Server "+server.ID()+" already exists and isn't self-registered", http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Removes a registered backend right away, e.g. when it shuts down
+func (a *AdminAPI) deregister(w http.ResponseWriter, r *http.Request) {
+	if a.registry == nil {
+		http.Error(w, "Self-registration is disabled, set REGISTRATION_SECRET", http.StatusNotFound)
+		return
+	}
+	target, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || !a.registry.Deregister(target.String()) {
+		http.Error(w, "Server not registered", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encodeJSON(w, value)
+}
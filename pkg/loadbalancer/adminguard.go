@@ -0,0 +1,125 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Clients whose failures are tracked at most; stale ones are dropped first
+const adminGuardMaxClients = 10000
+
+// Throttles the admin API per client address: a rate limit on all calls,
+// and a lockout after too many failed ones (bad tokens, forbidden or
+// invalid requests) within a window, so tokens can't be brute-forced
+type AdminGuard struct {
+	rate      *ClientRateLimiter
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	clients   map[string]*adminClient
+	clock     Clock
+	mutex     sync.Mutex
+}
+
+type adminClient struct {
+	failures    []time.Time
+	lockedUntil time.Time
+}
+
+func getAdminGuardEnv(clock Clock) (*AdminGuard, error) {
+	var env envReader
+	g := &AdminGuard{
+		threshold: env.Int("ADMIN_LOCKOUT_THRESHOLD", 10),
+		window:    env.Duration("ADMIN_LOCKOUT_WINDOW", 5*time.Minute),
+		duration:  env.Duration("ADMIN_LOCKOUT_DURATION", 15*time.Minute),
+		clients:   map[string]*adminClient{},
+		clock:     clock,
+	}
+
+	if rps := env.Float("ADMIN_RATE_LIMIT_RPS", 5); rps > 0 {
+		burst := env.Int("ADMIN_RATE_LIMIT_BURST", int(math.Max(20, math.Ceil(rps))))
+		if burst < 1 {
+			return nil, fmt.Errorf("invalid ADMIN_RATE_LIMIT_BURST: %d", burst)
+		}
+		g.rate = newClientRateLimiter(clock, rps, burst, adminGuardMaxClients)
+	}
+	return g, env.err
+}
+
+// Whether the client may make a call now, and otherwise how long until it
+// may, and why
+func (g *AdminGuard) Allow(client string) (bool, time.Duration, string) {
+	if wait := g.LockedOut(client); wait > 0 {
+		return false, wait, "locked_out"
+	}
+	if g.rate != nil {
+		if ok, wait := g.rate.Allow(client); !ok {
+			return false, wait, "rate_limited"
+		}
+	}
+	return true, 0, ""
+}
+
+// How much longer the client is locked out, 0 if it isn't
+func (g *AdminGuard) LockedOut(client string) time.Duration {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if c, ok := g.clients[client]; ok {
+		return max(c.lockedUntil.Sub(g.clock.Now()), 0)
+	}
+	return 0
+}
+
+// Counts a failed call and reports whether it locked the client out
+func (g *AdminGuard) RecordFailure(client string) bool {
+	if g.threshold <= 0 {
+		return false
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := g.clock.Now()
+	c, ok := g.clients[client]
+	if !ok {
+		if len(g.clients) >= adminGuardMaxClients {
+			g.prune(now)
+		}
+		c = &adminClient{}
+		g.clients[client] = c
+	}
+
+	c.failures = append(c.failures, now)
+	for len(c.failures) > 0 && now.Sub(c.failures[0]) > g.window {
+		c.failures = c.failures[1:]
+	}
+	if len(c.failures) < g.threshold {
+		return false
+	}
+
+	c.failures = nil
+	c.lockedUntil = now.Add(g.duration)
+	return true
+}
+
+// Forgets clients that are not locked out and have no recent failures,
+// or, if all are, the one whose lockout ends first
+func (g *AdminGuard) prune(now time.Time) {
+	oldest := ""
+	for client, c := range g.clients {
+		recent := len(c.failures) > 0 && now.Sub(c.failures[len(c.failures)-1]) <= g.window
+		if !recent && !now.Before(c.lockedUntil) {
+			delete(g.clients, client)
+			continue
+		}
+		if oldest == "" || c.lockedUntil.Before(g.clients[oldest].lockedUntil) {
+			oldest = client
+		}
+	}
+	if len(g.clients) >= adminGuardMaxClients {
+		delete(g.clients, oldest)
+	}
+}
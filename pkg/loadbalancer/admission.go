@@ -0,0 +1,46 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Backends may report their own queue depth, either in an X-Queue-Depth
+// response header or as "queueDepth" in their /health response. A server
+// whose latest report reaches its MaxQueueDepth is treated like one at its
+// concurrency cap: skipped in selection, so requests queue at the LB (when
+// QUEUE_MAX_DEPTH is set) or are rejected instead of piling onto it.
+const queueDepthHeader = "X-Queue-Depth"
+
+// How long a reported queue depth is believed, unless ADMISSION_SIGNAL_TTL
+// says otherwise. Overloaded servers get no traffic and so no new reports,
+// and must not be shut out forever.
+const defaultQueueDepthTTL = 5 * time.Second
+
+func (s *Server) reportQueueDepth(depth int64) {
+	atomic.StoreInt64(&s.queueDepth, depth)
+	atomic.StoreInt64(&s.queueDepthAt, time.Now().UnixNano())
+}
+
+// Latest reported queue depth, or -1 when there is no recent report
+func (s *Server) QueueDepth() int64 {
+	reportedAt := atomic.LoadInt64(&s.queueDepthAt)
+	if reportedAt == 0 || time.Since(time.Unix(0, reportedAt)) > s.queueDepthTTL {
+		return -1
+	}
+	return atomic.LoadInt64(&s.queueDepth)
+}
+
+func (s *Server) isOverloaded() bool {
+	return s.MaxQueueDepth > 0 && s.QueueDepth() >= s.MaxQueueDepth
+}
+
+func (s *Server) recordQueueDepthHeader(header http.Header) {
+	if value := header.Get(queueDepthHeader); value != "" {
+		if depth, err := strconv.ParseInt(value, 10, 64); err == nil && depth >= 0 {
+			s.reportQueueDepth(depth)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Value of the affinity pool option that turns on sticky sessions
+const affinityCookie = "cookie"
+
+// Sticky sessions for pools with the affinity=cookie option: a response
+// sets a cookie, one per pool, naming the server that sent it, and
+// requests carrying the cookie go back to that server while it is
+// available. The cookie is sealed with AES-GCM, so clients can neither
+// read which backend it names nor make one up to pick a server themselves,
+// nor keep one past AFFINITY_COOKIE_MAX_AGE.
+type AffinityCookies struct {
+	name   string
+	maxAge time.Duration
+	aead   cipher.AEAD
+	clock  Clock
+}
+
+// AFFINITY_COOKIE_SECRET keeps cookies valid across restarts and between
+// load balancers sharing it; without it, each process seals with a key of
+// its own.
+func getAffinityCookiesEnv(clock Clock) (*AffinityCookies, error) {
+	maxAge, err := getEnvDuration("AFFINITY_COOKIE_MAX_AGE", 0)
+	if err != nil {
+		return nil, err
+	}
+	secret := []byte(getEnv("AFFINITY_COOKIE_SECRET", ""))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("generating the affinity cookie key: %w", err)
+		}
+	}
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AffinityCookies{
+		name:   getEnv("AFFINITY_COOKIE_PREFIX", "lb_affinity"),
+		maxAge: maxAge,
+		aead:   aead,
+		clock:  clock,
+	}, nil
+}
+
+// One cookie per pool, so a client can stick to a server in each
+func (a *AffinityCookies) cookieName(pool string) string {
+	return a.name + "_" + pool
+}
+
+// The server ID sealed for pool, after the Unix time it was sealed at. The
+// pool name is authenticated with it, so a cookie of one pool is no good
+// for another.
+func (a *AffinityCookies) seal(pool, id string) (string, error) {
+	nonce := make([]byte, a.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	plaintext := binary.BigEndian.AppendUint64(nil, uint64(a.clock.Now().Unix()))
+	plaintext = append(plaintext, id...)
+	return base64.RawURLEncoding.EncodeToString(a.aead.Seal(nonce, nonce, plaintext, []byte(pool))), nil
+}
+
+// The server ID r's cookie names for pool, "" when it has none, it was
+// tampered with or it's older than maxAge
+func (a *AffinityCookies) open(r *http.Request, pool string) string {
+	cookie, err := r.Cookie(a.cookieName(pool))
+	if err != nil {
+		return ""
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(sealed) < a.aead.NonceSize() {
+		return ""
+	}
+	nonce, ciphertext := sealed[:a.aead.NonceSize()], sealed[a.aead.NonceSize():]
+	plaintext, err := a.aead.Open(nil, nonce, ciphertext, []byte(pool))
+	if err != nil || len(plaintext) < 8 {
+		return ""
+	}
+	sealedAt := time.Unix(int64(binary.BigEndian.Uint64(plaintext)), 0)
+	if a.maxAge > 0 && a.clock.Now().Sub(sealedAt) > a.maxAge {
+		return ""
+	}
+	return string(plaintext[8:])
+}
+
+// Picks the server of pool r sticks to, or else one by Pool.Pick
+func (lb *LoadBalancer) pick(ctx context.Context, r *http.Request, pool *Pool) (*Server, error) {
+	if server := lb.affinityServer(ctx, r, pool); server != nil {
+		return server, nil
+	}
+	return pool.Pick(ctx, r)
+}
+
+// The server r sticks to, with an in-flight slot reserved, or nil when it
+// has no cookie or that server is unavailable, busy or already failed it
+func (lb *LoadBalancer) affinityServer(ctx context.Context, r *http.Request, pool *Pool) *Server {
+	if pool.Affinity != affinityCookie || r == nil {
+		return nil
+	}
+	id := lb.affinity.open(r, pool.Name)
+	if id == "" {
+		return nil
+	}
+
+	for _, server := range pool.snapshot().servers {
+		if server.ID() == id && !slices.Contains(AttemptedBackends(ctx), server) && server.Acquire() {
+			return server
+		}
+	}
+	return nil
+}
+
+// Sets the cookie for server on resp, unless r already sticks to it
+func (lb *LoadBalancer) stick(resp *http.Response, r *http.Request, pool *Pool, server *Server) {
+	if lb.affinity.open(r, pool.Name) == server.ID() {
+		return
+	}
+	value, err := lb.affinity.seal(pool.Name, server.ID())
+	if err != nil {
+		warnf("⚠️  Sealing the affinity cookie for %s failed: %v", pool.Name, err)
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     lb.affinity.cookieName(pool.Name),
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(lb.affinity.maxAge.Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
@@ -0,0 +1,52 @@
+package loadbalancer
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAffinityCookies(t *testing.T) {
+	t.Setenv("AFFINITY_COOKIE_SECRET", "test secret")
+	t.Setenv("AFFINITY_COOKIE_MAX_AGE", "1h")
+	clock := newFakeClock()
+	cookies, err := getAffinityCookiesEnv(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := cookies.seal("api", "backend-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 1
+	tampered := base64.RawURLEncoding.EncodeToString(raw)
+
+	for _, test := range []struct {
+		name    string
+		pool    string
+		value   string
+		advance time.Duration
+		want    string
+	}{
+		{"round trip", "api", sealed, 0, "backend-1"},
+		{"tampered", "api", tampered, 0, ""},
+		// The pool is authenticated with the ID, so another pool's cookie
+		// under this one's name doesn't open
+		{"other pool", "web", sealed, 0, ""},
+		{"within max age", "api", sealed, time.Hour, "backend-1"},
+		{"expired", "api", sealed, time.Second, ""},
+	} {
+		clock.Advance(test.advance)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: cookies.cookieName(test.pool), Value: test.value})
+		if id := cookies.open(r, test.pool); id != test.want {
+			t.Errorf("%s: opened %q, want %q", test.name, id, test.want)
+		}
+	}
+}
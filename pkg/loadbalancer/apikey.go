@@ -0,0 +1,78 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Tells backends which API key a request came with, by name. Spelled
+// canonically, so removing it from every request doesn't allocate.
+const apiKeyNameHeader = "X-Api-Key-Name"
+
+// Named keys of API_KEYS, which clients of routes with the apikey option
+// send as an X-API-Key header
+type APIKeys struct {
+	names []string
+	keys  [][]byte
+}
+
+func getAPIKeysEnv() (*APIKeys, error) {
+	value := getEnv("API_KEYS", "")
+	if value == "" {
+		return nil, nil
+	}
+
+	k := &APIKeys{}
+	for i, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		// Keys may end in = padding, names don't have any
+		name, key, ok := strings.Cut(entry, "=")
+		name, key = strings.TrimSpace(name), strings.TrimSpace(key)
+		if !ok || name == "" || key == "" {
+			// Not quoted, as it could be a key
+			return nil, fmt.Errorf("invalid API_KEYS entry %d, want name=key", i+1)
+		}
+		k.names = append(k.names, name)
+		k.keys = append(k.keys, []byte(key))
+	}
+	return k, nil
+}
+
+// The name of the key, or "" when it isn't one. Every key is compared, in
+// constant time, so timing doesn't tell how close a guess was.
+func (k *APIKeys) Lookup(key string) string {
+	found := ""
+	for i, candidate := range k.keys {
+		if subtle.ConstantTimeCompare([]byte(key), candidate) == 1 {
+			found = k.names[i]
+		}
+	}
+	return found
+}
+
+// Answers 401 and returns false unless a route with the apikey option gets
+// one of its keys. The key itself isn't passed on; its name is, as
+// X-API-Key-Name.
+func (lb *LoadBalancer) authenticateAPIKey(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	if !route.APIKey {
+		return true
+	}
+
+	name := ""
+	if lb.apiKeys != nil {
+		name = lb.apiKeys.Lookup(r.Header.Get("X-API-Key"))
+	}
+	if name == "" || (len(route.APIKeyNames) > 0 && !containsFold(route.APIKeyNames, name)) {
+		debugf("🔑 Rejected API key for %s %s", r.Method, r.URL.Path)
+		http.Error(w, "Unauthorized: valid X-API-Key required", http.StatusUnauthorized)
+		return false
+	}
+
+	r.Header.Del("X-API-Key")
+	r.Header.Set(apiKeyNameHeader, name)
+	return true
+}
@@ -0,0 +1,18 @@
+package loadbalancer
+
+import "embed"
+
+// Files the binary serves without reading them from disk: the dashboard,
+// the OpenAPI description and the default error page
+//
+//go:embed dashboard.html openapi.json errorpages
+var assets embed.FS
+
+// An embedded file; they are all there at build time
+func asset(name string) []byte {
+	content, err := assets.ReadFile(name)
+	if err != nil {
+		panic(err)
+	}
+	return content
+}
@@ -0,0 +1,96 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Lines written in one go at most; more than that queued is written in
+// several batches
+const asyncLogBatchSize = 64 << 10
+
+// Hands lines to a goroutine that writes them in batches, so a slow disk
+// or pipe never holds up the request whose line it is. Lines that find the
+// queue full are dropped and counted rather than waited for.
+type asyncWriter struct {
+	out     io.Writer
+	lines   chan *bytes.Buffer
+	dropped atomic.Uint64
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newAsyncWriter(out io.Writer, size int) *asyncWriter {
+	w := &asyncWriter{
+		out:   out,
+		lines: make(chan *bytes.Buffer, size),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Queues a copy of p, which callers such as slog handlers reuse
+func (w *asyncWriter) Write(p []byte) (int, error) {
+	line := getByteBuffer()
+	line.Write(p)
+	select {
+	case w.lines <- line:
+	default:
+		putByteBuffer(line)
+		w.dropped.Add(1)
+	}
+	return len(p), nil
+}
+
+func (w *asyncWriter) run() {
+	defer close(w.done)
+	var batch bytes.Buffer
+	for {
+		select {
+		case line := <-w.lines:
+			w.append(&batch, line)
+			w.takeQueued(&batch)
+			w.out.Write(batch.Bytes())
+			batch.Reset()
+		case <-w.stop:
+			for w.takeQueued(&batch) {
+				w.out.Write(batch.Bytes())
+				batch.Reset()
+			}
+			return
+		}
+	}
+}
+
+// Adds lines already queued to batch until it is full; false if there
+// were none
+func (w *asyncWriter) takeQueued(batch *bytes.Buffer) bool {
+	took := false
+	for batch.Len() < asyncLogBatchSize {
+		select {
+		case line := <-w.lines:
+			w.append(batch, line)
+			took = true
+		default:
+			return took
+		}
+	}
+	return took
+}
+
+func (w *asyncWriter) append(batch *bytes.Buffer, line *bytes.Buffer) {
+	batch.Write(line.Bytes())
+	putByteBuffer(line)
+}
+
+// Writes what is queued and stops the writer; lines written afterwards,
+// e.g. by WebSockets outliving shutdown, are dropped once the queue fills
+func (w *asyncWriter) Close() {
+	w.once.Do(func() { close(w.stop) })
+	<-w.done
+}
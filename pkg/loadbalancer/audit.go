@@ -0,0 +1,43 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"load-balancer-demo/requestid"
+)
+
+// Trail of admin API use: every call that changes something, every failed
+// or throttled call and every lockout, with the caller's role and address.
+// Written as JSON lines to ADMIN_AUDIT_LOG, or with the operational log.
+type AuditLog struct {
+	logger *slog.Logger
+}
+
+func getAuditLogEnv() (*AuditLog, error) {
+	out := logOutput
+	if path := getEnv("ADMIN_AUDIT_LOG", ""); path != "" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open ADMIN_AUDIT_LOG: %v", err)
+		}
+		out = file
+	}
+	return &AuditLog{logger: slog.New(slog.NewJSONHandler(out, nil))}, nil
+}
+
+func (a *AuditLog) Record(r *http.Request, event, role, clientIP string, status int, attrs ...any) {
+	if role == "" {
+		role = "none"
+	}
+	a.logger.Info("admin "+event, append([]any{
+		"method", r.Method,
+		"path", r.URL.Path,
+		"status", status,
+		"role", role,
+		"client_ip", clientIP,
+		"request_id", requestid.FromContext(r.Context()),
+	}, attrs...)...)
+}
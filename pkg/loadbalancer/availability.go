@@ -0,0 +1,112 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Health transitions kept per backend for GET /lb-admin/servers/{id}
+const availabilityHistory = 20
+
+// Health history of a backend since it was added: the share of time it was
+// up, how long it has been in its current state and its latest transitions
+type Availability struct {
+	since     time.Time
+	up        bool
+	changedAt time.Time
+	upTime    time.Duration
+	history   []HealthChange
+	mutex     sync.Mutex
+}
+
+type HealthChange struct {
+	State string    `json:"state"`
+	At    time.Time `json:"at"`
+}
+
+// Availability at one point in time, as /lb-status?verbose=true reports it
+type AvailabilityStatus struct {
+	// Share of TrackedSeconds the backend was up
+	UptimePercent float64 `json:"uptimePercent"`
+	// "up" or "down", by its effective health
+	State          string    `json:"state"`
+	StateSince     time.Time `json:"stateSince"`
+	InStateSeconds float64   `json:"inStateSeconds"`
+	// Time since the backend was added
+	TrackedSeconds float64 `json:"trackedSeconds"`
+}
+
+func (a *Availability) start(healthy bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	a.since, a.changedAt, a.up = now, now, healthy
+	a.addHistory(healthy, now)
+}
+
+func (a *Availability) record(healthy bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if healthy == a.up {
+		return
+	}
+
+	now := time.Now()
+	if a.up {
+		a.upTime += now.Sub(a.changedAt)
+	}
+	a.up, a.changedAt = healthy, now
+	a.addHistory(healthy, now)
+}
+
+func (a *Availability) addHistory(healthy bool, at time.Time) {
+	change := HealthChange{State: "down", At: at}
+	if healthy {
+		change.State = "up"
+	}
+	a.history = append(a.history, change)
+	if len(a.history) > availabilityHistory {
+		a.history = a.history[len(a.history)-availabilityHistory:]
+	}
+}
+
+// Latest health transitions, oldest first
+func (a *Availability) History() []HealthChange {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return append([]HealthChange{}, a.history...)
+}
+
+func (a *Availability) Snapshot() AvailabilityStatus {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	upTime := a.upTime
+	if a.up {
+		upTime += now.Sub(a.changedAt)
+	}
+
+	availability := AvailabilityStatus{
+		UptimePercent:  100,
+		State:          "down",
+		StateSince:     a.changedAt,
+		InStateSeconds: now.Sub(a.changedAt).Seconds(),
+		TrackedSeconds: now.Sub(a.since).Seconds(),
+	}
+	if a.up {
+		availability.State = "up"
+	}
+	if tracked := now.Sub(a.since); tracked > 0 {
+		availability.UptimePercent = 100 * float64(upTime) / float64(tracked)
+	}
+	return availability
+}
+
+func (a *Availability) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.Snapshot())
+}
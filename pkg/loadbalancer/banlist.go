@@ -0,0 +1,231 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Clients whose violations are tracked at most; stale ones are dropped first
+const banListMaxClients = 10000
+
+// Violations counted on their own, against AUTH_BAN_THRESHOLD, as a few
+// failed logins are normal where a few WAF matches are not
+const violationAuthFailure = "auth_failure"
+
+// Bans clients that keep misbehaving: BAN_THRESHOLD violations, like
+// exceeding CLIENT_RATE_LIMIT_RPS or matching a WAF rule, within
+// BAN_WINDOW, or AUTH_BAN_THRESHOLD 401 and 403 answers within
+// AUTH_BAN_WINDOW, get the client refused for BAN_DURATION. Operators can
+// list, add and lift bans through the admin API, also when automatic
+// banning is off.
+type BanList struct {
+	abuse    banPolicy
+	auth     banPolicy
+	duration time.Duration
+	clients  map[string]*bannedClient
+	clock    Clock
+	mutex    sync.Mutex
+}
+
+type banPolicy struct {
+	threshold int
+	window    time.Duration
+}
+
+type bannedClient struct {
+	// Recent violations, by policy
+	violations map[*banPolicy][]time.Time
+	ban        *Ban
+}
+
+type Ban struct {
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+}
+
+func getBanListEnv(clock Clock) (*BanList, error) {
+	var env envReader
+	bans := &BanList{
+		abuse: banPolicy{
+			threshold: env.Int("BAN_THRESHOLD", 0),
+			window:    env.Duration("BAN_WINDOW", time.Minute),
+		},
+		auth: banPolicy{
+			threshold: env.Int("AUTH_BAN_THRESHOLD", 0),
+			window:    env.Duration("AUTH_BAN_WINDOW", 10*time.Minute),
+		},
+		duration: env.Duration("BAN_DURATION", 10*time.Minute),
+		clients:  map[string]*bannedClient{},
+		clock:    clock,
+	}
+	return bans, env.err
+}
+
+// The client's current ban, nil if it isn't banned
+func (b *BanList) Banned(client string) *Ban {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if c, ok := b.clients[client]; ok && c.ban != nil && b.clock.Now().Before(c.ban.Until) {
+		ban := *c.ban
+		return &ban
+	}
+	return nil
+}
+
+// Counts a violation, e.g. "rate_limited", and returns the ban it led to
+func (b *BanList) RecordViolation(client, reason string) *Ban {
+	policy := &b.abuse
+	if reason == violationAuthFailure {
+		policy = &b.auth
+	}
+	if policy.threshold <= 0 {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.clock.Now()
+	c := b.client(client, now)
+	violations := append(c.violations[policy], now)
+	for len(violations) > 0 && now.Sub(violations[0]) > policy.window {
+		violations = violations[1:]
+	}
+	c.violations[policy] = violations
+	if len(violations) < policy.threshold {
+		return nil
+	}
+
+	c.violations = map[*banPolicy][]time.Time{}
+	c.ban = &Ban{IP: client, Reason: reason, Since: now, Until: now.Add(b.duration)}
+	ban := *c.ban
+	return &ban
+}
+
+// Bans the client for the duration, or BAN_DURATION when it's 0,
+// replacing any ban it has
+func (b *BanList) Ban(client, reason string, duration time.Duration) Ban {
+	if duration <= 0 {
+		duration = b.duration
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.clock.Now()
+	c := b.client(client, now)
+	c.violations = map[*banPolicy][]time.Time{}
+	c.ban = &Ban{IP: client, Reason: reason, Since: now, Until: now.Add(duration)}
+	return *c.ban
+}
+
+// Lifts the client's ban and forgets its violations, reporting whether it
+// was banned
+func (b *BanList) Lift(client string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c, ok := b.clients[client]
+	banned := ok && c.ban != nil && b.clock.Now().Before(c.ban.Until)
+	delete(b.clients, client)
+	return banned
+}
+
+// The current bans, by when they end
+func (b *BanList) List() []Ban {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.clock.Now()
+	bans := []Ban{}
+	for _, c := range b.clients {
+		if c.ban != nil && now.Before(c.ban.Until) {
+			bans = append(bans, *c.ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+func (b *BanList) client(client string, now time.Time) *bannedClient {
+	c, ok := b.clients[client]
+	if !ok {
+		if len(b.clients) >= banListMaxClients {
+			b.prune(now)
+		}
+		c = &bannedClient{violations: map[*banPolicy][]time.Time{}}
+		b.clients[client] = c
+	}
+	return c
+}
+
+// Forgets clients that are not banned and have no recent violations, or,
+// if all are, the one whose ban ends first
+func (b *BanList) prune(now time.Time) {
+	oldest := ""
+	until := func(c *bannedClient) time.Time {
+		if c.ban == nil {
+			return time.Time{}
+		}
+		return c.ban.Until
+	}
+	for client, c := range b.clients {
+		recent := false
+		for policy, violations := range c.violations {
+			if len(violations) > 0 && now.Sub(violations[len(violations)-1]) <= policy.window {
+				recent = true
+			}
+		}
+		if !recent && !now.Before(until(c)) {
+			delete(b.clients, client)
+			continue
+		}
+		if oldest == "" || until(c).Before(until(b.clients[oldest])) {
+			oldest = client
+		}
+	}
+	if len(b.clients) >= banListMaxClients {
+		delete(b.clients, oldest)
+	}
+}
+
+// Answers 403 to a banned client, telling it when to come back
+func (lb *LoadBalancer) refuseBannedClient(w http.ResponseWriter, r *http.Request) bool {
+	client := lb.trustedProxies.ClientIP(r)
+	ban := lb.bans.Banned(client)
+	if ban == nil {
+		return false
+	}
+
+	debugf("⛔ Refused banned client %s: %s %s", client, r.Method, r.URL.Path)
+	lb.metrics.observeBlockedClient("ban")
+	seconds := int(ban.Until.Sub(lb.clock.Now()).Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return true
+}
+
+// Counts a violation by the request's client against the ban list
+func (lb *LoadBalancer) recordViolation(r *http.Request, reason string) {
+	client := lb.trustedProxies.ClientIP(r)
+	if ban := lb.bans.RecordViolation(client, reason); ban != nil {
+		warnf("⛔ Banned %s until %s after repeated %s", client, ban.Until.Format(time.RFC3339), reason)
+		lb.metrics.observeBan(reason)
+	}
+}
+
+// Counts a 401 or 403 answer, by the balancer's own checks or a backend,
+// toward AUTH_BAN_THRESHOLD
+func (lb *LoadBalancer) observeAuthFailure(r *http.Request, status int, source string) {
+	if status != http.StatusUnauthorized && status != http.StatusForbidden {
+		return
+	}
+	lb.metrics.observeAuthFailure(source, status)
+	lb.recordViolation(r, violationAuthFailure)
+}
@@ -0,0 +1,58 @@
+package loadbalancer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBanExpiry(t *testing.T) {
+	t.Setenv("BAN_THRESHOLD", "3")
+	t.Setenv("BAN_WINDOW", "1m")
+	t.Setenv("BAN_DURATION", "10m")
+	clock := newFakeClock()
+	bans, err := getBanListEnv(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const client = "192.0.2.1"
+
+	elapsed := time.Duration(0)
+	for _, step := range []struct {
+		advance    time.Duration
+		violations int
+		// Manual ban of this long, or none when 0
+		ban    time.Duration
+		banned bool
+	}{
+		{0, 2, 0, false},
+		// The first two left BAN_WINDOW before the third
+		{61 * time.Second, 1, 0, false},
+		{time.Second, 1, 0, false},
+		{time.Second, 1, 0, true},
+		{10*time.Minute - time.Second, 0, 0, true},
+		{time.Second, 0, 0, false},
+		// Counting starts over once a ban ends
+		{0, 2, 0, false},
+		// A manual ban lasts its own duration
+		{0, 0, 30 * time.Second, true},
+		{29 * time.Second, 0, 0, true},
+		{time.Second, 0, 0, false},
+	} {
+		clock.Advance(step.advance)
+		elapsed += step.advance
+		for i := 0; i < step.violations; i++ {
+			bans.RecordViolation(client, "waf")
+		}
+		if step.ban > 0 {
+			bans.Ban(client, "manual", step.ban)
+		}
+
+		ban := bans.Banned(client)
+		if (ban != nil) != step.banned {
+			t.Fatalf("at %v: banned %v, want %v", elapsed, ban, step.banned)
+		}
+		if listed := len(bans.List()); (listed == 1) != step.banned {
+			t.Errorf("at %v: %d bans listed, banned %v", elapsed, listed, step.banned)
+		}
+	}
+}
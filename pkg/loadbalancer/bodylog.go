@@ -0,0 +1,132 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Headers never written to the body log
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// Debug logging of headers and truncated bodies for a sample of requests,
+// or for every request under one of the configured path prefixes
+type BodyLog struct {
+	SampleRate float64
+	Paths      []string
+	MaxBytes   int
+}
+
+func getBodyLogEnv() (*BodyLog, error) {
+	var env envReader
+	bodyLog := &BodyLog{
+		SampleRate: env.Float("BODY_LOG_SAMPLE_RATE", 0),
+		MaxBytes:   env.Int("BODY_LOG_MAX_BYTES", 1024),
+	}
+	if env.err != nil {
+		return nil, env.err
+	}
+	for _, path := range strings.Split(getEnv("BODY_LOG_PATHS", ""), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			bodyLog.Paths = append(bodyLog.Paths, path)
+		}
+	}
+
+	if bodyLog.SampleRate <= 0 && len(bodyLog.Paths) == 0 {
+		return nil, nil
+	}
+	return bodyLog, nil
+}
+
+func (b *BodyLog) selects(r *http.Request) bool {
+	if b == nil {
+		return false
+	}
+	for _, path := range b.Paths {
+		if strings.HasPrefix(r.URL.Path, path) {
+			return true
+		}
+	}
+	return b.SampleRate > 0 && rand.Float64() < b.SampleRate
+}
+
+// Starts capturing the request body as the proxy reads it
+func (b *BodyLog) captureRequest(r *http.Request) *cappedBuffer {
+	capture := &cappedBuffer{max: b.MaxBytes}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, capture), r.Body}
+	}
+	return capture
+}
+
+func (b *BodyLog) write(r *http.Request, requestBody *cappedBuffer, recorder *statusRecorder) {
+	var out strings.Builder
+	fmt.Fprintf(&out, "🐛 %s %s %s\n", r.Method, r.URL.RequestURI(), r.Proto)
+	writeHeaders(&out, r.Header)
+	requestBody.writeTo(&out)
+
+	fmt.Fprintf(&out, "🐛 -> %d %s\n", recorder.status, http.StatusText(recorder.status))
+	writeHeaders(&out, recorder.Header())
+	recorder.body.writeTo(&out)
+
+	infof("%s", strings.TrimSuffix(out.String(), "\n"))
+}
+
+func writeHeaders(out *strings.Builder, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if redactedHeaders[name] {
+			value = "[redacted]"
+		}
+		fmt.Fprintf(out, "   %s: %s\n", name, value)
+	}
+}
+
+// Keeps the first max bytes written to it
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if room := c.max - c.buf.Len(); room < len(p) {
+		c.truncated = true
+		if room > 0 {
+			c.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	c.buf.Write(p)
+	return len(p), nil
+}
+
+func (c *cappedBuffer) writeTo(out *strings.Builder) {
+	if c == nil || c.buf.Len() == 0 {
+		return
+	}
+	out.WriteString("   | ")
+	out.WriteString(strings.ReplaceAll(c.buf.String(), "\n", "\n   | "))
+	if c.truncated {
+		out.WriteString(" [truncated]")
+	}
+	out.WriteString("\n")
+}
@@ -0,0 +1,43 @@
+package loadbalancer
+
+import (
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+)
+
+// Brownout responses for shed requests, set with the "brownoutmode" route
+// option
+const (
+	BrownoutReject      = "reject"
+	BrownoutPlaceholder = "placeholder"
+)
+
+// The LB is in brownout while at least BROWNOUT_THRESHOLD requests are in
+// flight. Routes with the "brownout" option then shed that fraction of their
+// requests, keeping capacity for the routes without it.
+func (lb *LoadBalancer) inBrownout() bool {
+	return lb.brownoutThreshold > 0 && atomic.LoadInt64(&lb.inFlight) >= lb.brownoutThreshold
+}
+
+// Sheds the request if its route is degraded during brownout
+func (lb *LoadBalancer) shedForBrownout(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	if route.BrownoutFraction == 0 || !lb.inBrownout() || rand.Float64() >= route.BrownoutFraction {
+		return false
+	}
+
+	atomic.AddUint64(&lb.brownoutShed, 1)
+
+	if route.BrownoutMode == BrownoutPlaceholder && lb.fallback != nil {
+		lb.fallback.Write(w)
+		return true
+	}
+
+	if logEnabled(slog.LevelDebug) {
+		debugf("🟤 Brownout: shedding %s", r.URL.Path)
+	}
+	w.Header().Set("Retry-After", "1")
+	lb.errorPages.Write(w, r, http.StatusServiceUnavailable, "Service Unavailable: degraded under load")
+	return true
+}
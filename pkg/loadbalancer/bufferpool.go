@@ -0,0 +1,78 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// Twice the 32KiB ReverseProxy allocates per copy when no BufferPool is
+// set. Responses without a Content-Length are flushed after every read, so
+// larger reads mean fewer flushes; BenchmarkProxyLargeResponse shows the
+// difference.
+//
+// ReverseProxy copies bodies through this buffer in any case: bodies come
+// framed by net/http, so there's no socket-to-socket copy for the kernel to
+// do with splice or sendfile.
+const proxyBufferSize = 64 * 1024
+
+// httputil.BufferPool backed by a sync.Pool, so body copies reuse buffers
+// instead of allocating a fresh one for every proxied request. It holds
+// array pointers, which unlike slices go into the pool without allocating.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool() *bufferPool {
+	p := &bufferPool{}
+	p.pool.New = func() any {
+		return new([proxyBufferSize]byte)
+	}
+	return p
+}
+
+func (p *bufferPool) Get() []byte {
+	return p.pool.Get().(*[proxyBufferSize]byte)[:]
+}
+
+func (p *bufferPool) Put(buf []byte) {
+	// Foreign or resliced buffers would shrink later copies
+	if cap(buf) != proxyBufferSize {
+		return
+	}
+	p.pool.Put((*[proxyBufferSize]byte)(buf[:proxyBufferSize]))
+}
+
+// Buffers grown past this aren't kept, so one huge response doesn't pin
+// its memory
+const maxPooledBufferSize = 64 * 1024
+
+// bytes.Buffers for JSON responses, error pages and access log lines,
+// which would otherwise be allocated and grown for every request
+var byteBuffers = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+func getByteBuffer() *bytes.Buffer {
+	return byteBuffers.Get().(*bytes.Buffer)
+}
+
+func putByteBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	byteBuffers.Put(buf)
+}
+
+// Encodes value as JSON into a pooled buffer and writes it in one go
+func encodeJSON(w io.Writer, value any) error {
+	buf := getByteBuffer()
+	defer putByteBuffer(buf)
+	if err := json.NewEncoder(buf).Encode(value); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,280 @@
+package loadbalancer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Responses of cached routes (the "cache" route option). An entry is fresh
+// for the route's TTL; for the "stale" window after that it is still served
+// while a background request refreshes it, and for the "staleiferror"
+// window it is served whenever the pool can't answer.
+type ResponseCache struct {
+	mutex      sync.Mutex
+	clock      Clock
+	maxEntries int
+	entries    map[string]*cacheEntry
+	// Headers named by the Vary of the response last stored for a URL
+	vary map[string][]string
+}
+
+type cacheEntry struct {
+	response   *FallbackResponse
+	stored     time.Time
+	refreshing bool
+	url        string
+}
+
+func NewResponseCache(maxEntries int) *ResponseCache {
+	return newCache(realClock{}, maxEntries)
+}
+
+func newCache(clock Clock, maxEntries int) *ResponseCache {
+	return &ResponseCache{clock: clock, maxEntries: maxEntries, entries: map[string]*cacheEntry{}, vary: map[string][]string{}}
+}
+
+// The URL of r followed, as in coalesceKey, by its values of the headers
+// in vary
+func cacheKey(r *http.Request, vary []string) string {
+	var key strings.Builder
+	key.WriteString(r.Host)
+	key.WriteString(r.URL.RequestURI())
+	for _, name := range vary {
+		key.WriteByte(0)
+		key.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return key.String()
+}
+
+// Headers named by resp's Vary; false for "Vary: *", which no request
+// can be known to match
+func varyHeaders(resp *http.Response) ([]string, bool) {
+	var names []string
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names, true
+}
+
+// The key r's response is stored under
+func (c *ResponseCache) key(r *http.Request) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.keyLocked(r)
+}
+
+func (c *ResponseCache) keyLocked(r *http.Request) string {
+	return cacheKey(r, c.vary[cacheKey(r, nil)])
+}
+
+func isCacheable(r *http.Request, route *Route) bool {
+	return route.CacheTTL > 0 && r.Method == http.MethodGet
+}
+
+// Returns the cached response for r and its age
+func (c *ResponseCache) Get(r *http.Request) (*FallbackResponse, time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[c.keyLocked(r)]
+	if !ok {
+		return nil, 0
+	}
+	return entry.response, c.clock.Now().Sub(entry.stored)
+}
+
+// Marks the entry as being refreshed; false if a refresh already runs
+func (c *ResponseCache) startRefresh(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || entry.refreshing {
+		return false
+	}
+	entry.refreshing = true
+	return true
+}
+
+func (c *ResponseCache) finishRefresh(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if entry, ok := c.entries[key]; ok {
+		entry.refreshing = false
+	}
+}
+
+func (c *ResponseCache) store(r *http.Request, vary []string, response *FallbackResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	url := cacheKey(r, nil)
+	c.vary[url] = vary
+	key := cacheKey(r, vary)
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		// Drop the oldest entry to keep memory bounded
+		var oldest string
+		for k, entry := range c.entries {
+			if oldest == "" || entry.stored.Before(c.entries[oldest].stored) {
+				oldest = k
+			}
+		}
+		c.evict(oldest)
+	}
+
+	c.entries[key] = &cacheEntry{response: response, stored: c.clock.Now(), url: url}
+}
+
+// Drops the entry under key, and its URL's Vary once no entry has the URL
+func (c *ResponseCache) evict(key string) {
+	url := c.entries[key].url
+	delete(c.entries, key)
+
+	for _, entry := range c.entries {
+		if entry.url == url {
+			return
+		}
+	}
+	delete(c.vary, url)
+}
+
+// Caches the response to r once the proxy has streamed its body to the
+// client
+func (c *ResponseCache) Record(r *http.Request, resp *http.Response) {
+	vary, ok := varyHeaders(resp)
+	if !ok || !isStorable(r, resp) {
+		return
+	}
+
+	header := resp.Header.Clone()
+	resp.Body = &recordingBody{
+		ReadCloser: resp.Body,
+		done: func(body []byte) {
+			c.store(r, vary, &FallbackResponse{Status: resp.StatusCode, Header: header, Body: body})
+		},
+	}
+}
+
+func isStorable(r *http.Request, resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK || resp.ContentLength > maxCachedBodySize {
+		return false
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+
+	cacheControl := strings.ToLower(resp.Header.Get("Cache-Control"))
+	if strings.Contains(cacheControl, "no-store") || strings.Contains(cacheControl, "private") {
+		return false
+	}
+	// A response to a client's credentials is only shared when the
+	// backend says it may be
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+		return strings.Contains(cacheControl, "public")
+	}
+	return true
+}
+
+// Serves fresh or stale-while-revalidate entries. Returns false when the
+// request has to go to the pool.
+func (lb *LoadBalancer) serveFromCache(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	response, age := lb.cache.Get(r)
+	if response == nil {
+		return false
+	}
+
+	switch {
+	case age < route.CacheTTL:
+		writeCached(w, response, age, "HIT")
+		return true
+
+	case age < route.CacheTTL+route.StaleWhileRevalidate:
+		if key := lb.cache.key(r); lb.cache.startRefresh(key) {
+			go lb.refreshCache(r.Clone(context.Background()), route, key)
+		}
+		writeCached(w, response, age, "STALE")
+		return true
+	}
+
+	return false
+}
+
+// Serves a stale entry in place of an error, within the stale-if-error window
+func (lb *LoadBalancer) serveStaleOnError(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	if !isCacheable(r, route) || route.StaleIfError == 0 {
+		return false
+	}
+
+	response, age := lb.cache.Get(r)
+	if response == nil || age >= route.CacheTTL+route.StaleIfError {
+		return false
+	}
+
+	warnf("⚠️  Serving stale response for %s", r.URL.Path)
+	writeCached(w, response, age, "STALE-IF-ERROR")
+	return true
+}
+
+func (lb *LoadBalancer) refreshCache(r *http.Request, route *Route, key string) {
+	defer lb.cache.finishRefresh(key)
+
+	pool := lb.pool(route.Pool)
+	// The refresh outlives the request that triggered it
+	server, err := pool.Pick(context.Background(), r)
+	if err != nil {
+		errorf("❌ Cache refresh for %s failed: %v", r.URL.Path, err)
+		return
+	}
+	defer lb.releaseServer(server)
+
+	ctx := context.Background()
+	if route.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, route.Timeout)
+		defer cancel()
+	}
+
+	target := *server.URL
+	target.Path = r.URL.Path
+	target.RawPath = r.URL.RawPath
+	target.RawQuery = r.URL.RawQuery
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return
+	}
+	req.Header = r.Header.Clone()
+	req.Host = r.Host
+	server.rewriteHost(req)
+
+	resp, err := pool.transport.RoundTrip(req)
+	if err != nil {
+		errorf("❌ Cache refresh for %s failed: %v", r.URL.Path, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	lb.cache.Record(r, resp)
+	io.Copy(io.Discard, resp.Body)
+}
+
+func writeCached(w http.ResponseWriter, response *FallbackResponse, age time.Duration, status string) {
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	w.Header().Set("X-Cache", status)
+	response.Write(w)
+}
@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Proxies whose X-Forwarded-For entries are believed, from TRUSTED_PROXIES
+// (comma-separated CIDRs or IPs)
+type TrustedProxies []*net.IPNet
+
+func getTrustedProxiesEnv() (TrustedProxies, error) {
+	return getNetworksEnv("TRUSTED_PROXIES")
+}
+
+// Comma-separated CIDRs or IPs in the environment variable key
+func getNetworksEnv(key string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+
+	for _, value := range strings.Split(getEnv(key, ""), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		network, err := parseCIDROrIP(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %v", key, value, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func parseCIDROrIP(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: value}
+		}
+		if ip.To4() != nil {
+			value += "/32"
+		} else {
+			value += "/128"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
+
+func (t TrustedProxies) Contains(ip net.IP) bool {
+	return networksContain(t, ip)
+}
+
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client address of the request. X-Forwarded-For is only consulted when the
+// direct peer is a trusted proxy, and is walked right to left so a client
+// can't spoof its address by prepending entries.
+func (t TrustedProxies) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	peer := net.ParseIP(host)
+	if peer == nil || !t.Contains(peer) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		if !t.Contains(ip) {
+			return ip.String()
+		}
+		host = ip.String()
+	}
+
+	return host
+}
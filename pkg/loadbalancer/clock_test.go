@@ -0,0 +1,130 @@
+package loadbalancer
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock tests move forward by hand with Advance, which fires the timers
+// and tickers that are due
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	return fakeTimer{c.newWaiter(d, 0)}
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{c.newWaiter(d, d)}
+}
+
+func (c *fakeClock) newWaiter(d, period time.Duration) *fakeWaiter {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	w := &fakeWaiter{clock: c, c: make(chan time.Time, 1), at: c.now.Add(d), period: period}
+	c.waiters = append(c.waiters, w)
+	return w
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+
+	for _, w := range c.waiters {
+		if w.stopped || w.at.After(c.now) {
+			continue
+		}
+		// Like time.Ticker, drops ticks the reader isn't ready for
+		select {
+		case w.c <- c.now:
+		default:
+		}
+		if w.period == 0 {
+			w.stopped = true
+			continue
+		}
+		for !w.at.After(c.now) {
+			w.at = w.at.Add(w.period)
+		}
+	}
+}
+
+// Waits until n timers or tickers are running, e.g. until a goroutine
+// started its loop and will see the next Advance
+func (c *fakeClock) waitForWaiters(t *testing.T, n int) {
+	t.Helper()
+	eventually(t, func() bool {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		running := 0
+		for _, w := range c.waiters {
+			if !w.stopped {
+				running++
+			}
+		}
+		return running >= n
+	})
+}
+
+type fakeWaiter struct {
+	clock   *fakeClock
+	c       chan time.Time
+	at      time.Time
+	period  time.Duration
+	stopped bool
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.c
+}
+
+func (w *fakeWaiter) stop() bool {
+	w.clock.mutex.Lock()
+	defer w.clock.mutex.Unlock()
+	wasRunning := !w.stopped
+	w.stopped = true
+	return wasRunning
+}
+
+type fakeTimer struct{ *fakeWaiter }
+
+func (t fakeTimer) Stop() bool { return t.stop() }
+
+type fakeTicker struct{ *fakeWaiter }
+
+func (t fakeTicker) Stop() { t.stop() }
+
+func (t fakeTicker) Reset(d time.Duration) {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	t.stopped = false
+	t.at = t.clock.now.Add(d)
+	t.period = d
+}
+
+// Fails the test unless condition turns true within a second, for what
+// goroutines do in response to the clock
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 1s")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,160 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"load-balancer-demo/requestid"
+)
+
+// Request headers that can change a response, so only requests agreeing on
+// all of them share one. Authorization, Cookie and the identity headers
+// keep one client's response from reaching another.
+var coalesceKeyHeaders = []string{
+	"Authorization", "Cookie", "Accept", "Accept-Encoding", "Accept-Language", "Origin", "Range",
+	apiKeyNameHeader, clientCertSubjectHeader, clientCertFingerprintHeader, clientSPIFFEIDHeader,
+}
+
+// Identical GETs of routes with the "coalesce" option that arrive while
+// one of them is in flight wait for its response instead of each going to
+// a backend, so a burst of reads of the same URL costs one upstream call.
+type Coalescer struct {
+	mutex   sync.Mutex
+	flights map[string]*flight
+}
+
+// The request in flight for a key and the requests waiting for it
+type flight struct {
+	done chan struct{}
+	// Set before done is closed; nil when the response can't be shared,
+	// e.g. it was too large or the request failed halfway
+	response *FallbackResponse
+}
+
+func NewCoalescer() *Coalescer {
+	return &Coalescer{flights: map[string]*flight{}}
+}
+
+func isCoalescable(r *http.Request, route *Route) bool {
+	return route.Coalesce && r.Method == http.MethodGet && r.Header.Get("Upgrade") == ""
+}
+
+func coalesceKey(r *http.Request) string {
+	var key strings.Builder
+	key.WriteString(r.Host)
+	key.WriteString(r.URL.RequestURI())
+	for _, name := range coalesceKeyHeaders {
+		key.WriteByte(0)
+		key.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return key.String()
+}
+
+// The flight for key and whether the caller leads it, in which case it
+// has to call land once its response is written
+func (c *Coalescer) join(key string) (*flight, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if f, ok := c.flights[key]; ok {
+		return f, false
+	}
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	return f, true
+}
+
+func (c *Coalescer) land(key string, f *flight, response *FallbackResponse) {
+	c.mutex.Lock()
+	delete(c.flights, key)
+	c.mutex.Unlock()
+
+	f.response = response
+	close(f.done)
+}
+
+// Serves r with the response of an identical request already in flight.
+// Returns a recorder to write r's own response through when r leads the
+// flight instead, nil when r has to be proxied on its own as the leading
+// request's response can't be shared; served is true when r was answered
+// or its client went away.
+func (lb *LoadBalancer) coalesce(w http.ResponseWriter, r *http.Request) (recorder *coalesceRecorder, served bool) {
+	key := coalesceKey(r)
+	f, leader := lb.coalescer.join(key)
+	if leader {
+		return &coalesceRecorder{ResponseWriter: w, key: key, flight: f, coalescer: lb.coalescer}, false
+	}
+
+	select {
+	case <-f.done:
+	case <-r.Context().Done():
+		return nil, true
+	}
+	if f.response == nil {
+		return nil, false
+	}
+
+	lb.metrics.observeCoalesced(getRequestInfo(r.Context()).route)
+	w.Header().Set("X-Coalesced", "true")
+	f.response.Write(w)
+	return nil, true
+}
+
+// Copies the leading request's response as it is written, to hand it to
+// the waiting requests
+type coalesceRecorder struct {
+	http.ResponseWriter
+	key       string
+	flight    *flight
+	coalescer *Coalescer
+	status    int
+	header    http.Header
+	body      []byte
+	// The body outgrew maxCachedBodySize, or the response can't be shared
+	discard bool
+}
+
+func (c *coalesceRecorder) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+		c.header = c.Header().Clone()
+		// The waiting requests have IDs of their own
+		c.header.Del(requestid.Header)
+		c.discard = c.header.Get("Set-Cookie") != ""
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *coalesceRecorder) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	n, err := c.ResponseWriter.Write(b)
+	if err != nil {
+		c.discard = true
+	}
+	if !c.discard {
+		if len(c.body)+n > maxCachedBodySize {
+			c.discard, c.body = true, nil
+		} else {
+			c.body = append(c.body, b[:n]...)
+		}
+	}
+	return n, err
+}
+
+// Lets http.ResponseController reach Flush of the wrapped writer
+func (c *coalesceRecorder) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// Hands the response to the waiting requests, unless proxying failed
+// before it was complete, which ReverseProxy signals with a panic
+func (c *coalesceRecorder) land(r *http.Request, failed bool) {
+	var response *FallbackResponse
+	if !failed && c.status != 0 && !c.discard && r.Context().Err() == nil {
+		response = &FallbackResponse{Status: c.status, Header: c.header, Body: c.body}
+	}
+	c.coalescer.land(c.key, c.flight, response)
+}
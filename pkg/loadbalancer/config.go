@@ -0,0 +1,197 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What POST /lb-admin/reload or PUT /lb-admin/state changed, by server ID.
+// Settings other than TARGET_SERVICES and HEALTH_CHECK_INTERVAL are read
+// once at startup, so a reload only lists changes to them as needing a
+// restart.
+type ReloadResult struct {
+	Added           []string `json:"added"`
+	Removed         []string `json:"removed"`
+	Changed         []string `json:"changed"`
+	RestartRequired []string `json:"restartRequired"`
+	Errors          []string `json:"errors,omitempty"`
+}
+
+// Applies CONFIG_FILE, if set, on top of the environment, so every getEnv
+// call sees its values
+func loadConfigFile() error {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil
+	}
+
+	values, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		os.Setenv(key, value)
+	}
+	return nil
+}
+
+// Parses a file of KEY=VALUE lines, the same format as .env; blank lines
+// and lines starting with # are skipped
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(strings.TrimPrefix(key, "export "))
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, i+1)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// Brings the backends in line with TARGET_SERVICES from values. Everything
+// is validated before the first server is touched; servers added through
+// the admin API are removed unless the file lists them too.
+func (lb *LoadBalancer) reload(values map[string]string) ReloadResult {
+	result := ReloadResult{Added: []string{}, Removed: []string{}, Changed: []string{}, RestartRequired: []string{}}
+
+	for key, value := range values {
+		if !reloadable[key] && value != os.Getenv(key) {
+			result.RestartRequired = append(result.RestartRequired, key)
+		}
+	}
+	sort.Strings(result.RestartRequired)
+
+	interval := lb.health.Interval()
+	if value := values["HEALTH_CHECK_INTERVAL"]; value != "" {
+		var err error
+		if interval, err = time.ParseDuration(value); err != nil || interval <= 0 {
+			result.Errors = append(result.Errors, fmt.Sprintf("invalid HEALTH_CHECK_INTERVAL %q, must be a positive duration", value))
+		}
+	}
+
+	value := values["TARGET_SERVICES"]
+	if value == "" && !discoveryEnabled() {
+		value = defaultTargetServices
+	}
+	targets, err := parseTargetServices(value)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+	// Validated at startup
+	previous, _ := parseTargetServices(targetServicesEnv())
+	if !slices.Equal(resolveTargets(targets), resolveTargets(previous)) {
+		result.Errors = append(result.Errors, "servers with the resolve option can only be changed with a restart")
+	}
+
+	wanted := map[string]*Server{}
+	for _, target := range targets {
+		if target.resolve {
+			continue
+		}
+		if lb.pool(target.Pool) == nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("unknown pool %q for %s, new pools need a restart", target.Pool, target.rawURL))
+		}
+		if _, ok := wanted[target.ID()]; ok {
+			result.Errors = append(result.Errors, "duplicate server "+target.ID())
+		}
+		wanted[target.ID()] = target
+	}
+	if len(result.Errors) > 0 {
+		return result
+	}
+
+	lb.syncServers(wanted, &result)
+	lb.health.SetInterval(interval)
+
+	os.Setenv("TARGET_SERVICES", value)
+	os.Setenv("HEALTH_CHECK_INTERVAL", interval.String())
+	infof("🔄 Reloaded config: %d added, %d removed, %d changed", len(result.Added), len(result.Removed), len(result.Changed))
+	lb.events.Publish(Event{
+		Type:   EventConfigReloaded,
+		Reason: fmt.Sprintf("%d added, %d removed, %d changed", len(result.Added), len(result.Removed), len(result.Changed)),
+	})
+	return result
+}
+
+// Adds, removes and re-creates servers until the ones not resolved from
+// DNS or discovered are exactly wanted; servers whose URL or options changed are
+// re-created
+func (lb *LoadBalancer) syncServers(wanted map[string]*Server, result *ReloadResult) {
+	current := map[string]*Server{}
+	for _, server := range lb.Servers() {
+		// Servers resolved from DNS or discovered are managed by their source
+		if server.Source == "" {
+			current[server.ID()] = server
+		}
+	}
+
+	for id, server := range current {
+		target, ok := wanted[id]
+		switch {
+		case !ok:
+			lb.removeServer(server)
+			result.Removed = append(result.Removed, id)
+		case target.rawURL != server.rawURL || target.options != server.options:
+			lb.checkServer(target)
+			if err := lb.replaceServer(server, target); err != nil {
+				result.Errors = append(result.Errors, err.Error())
+				continue
+			}
+			result.Changed = append(result.Changed, id)
+		}
+	}
+	for id, target := range wanted {
+		if _, ok := current[id]; !ok {
+			lb.checkServer(target)
+			if err := lb.addServer(target); err != nil {
+				result.Errors = append(result.Errors, err.Error())
+				continue
+			}
+			result.Added = append(result.Added, id)
+		}
+	}
+	sort.Strings(result.Added)
+	sort.Strings(result.Removed)
+	sort.Strings(result.Changed)
+
+	// Discovered copies of removed servers take their place
+	lb.resyncDiscovered()
+}
+
+// Settings a reload applies to the running balancer
+var reloadable = map[string]bool{
+	"TARGET_SERVICES":       true,
+	"HEALTH_CHECK_INTERVAL": true,
+}
+
+func resolveTargets(servers []*Server) []string {
+	targets := []string{}
+	for _, server := range servers {
+		if server.resolve {
+			targets = append(targets, server.rawURL+";"+server.options)
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Client connections of the traffic listener, for metrics
+var clientConns struct {
+	open atomic.Int64
+	// Accepts that had to wait for a connection to close first
+	waited atomic.Uint64
+}
+
+// Counts the connections accepted and, with a limit, stops accepting while
+// limit of them are open, like netutil.LimitListener. Further clients wait
+// in the kernel's accept backlog instead of each costing a file descriptor,
+// so a flood of connections can't exhaust them and take the process down.
+type limitListener struct {
+	net.Listener
+	// A token per open connection, nil without a limit
+	slots  chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func limitListenerEnv(listener net.Listener) (net.Listener, error) {
+	limit, err := getEnvInt("MAX_CONNECTIONS", 0)
+	if err != nil {
+		return nil, err
+	}
+	l := &limitListener{Listener: listener, closed: make(chan struct{})}
+	if limit > 0 {
+		l.slots = make(chan struct{}, limit)
+	}
+	return l, nil
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	if l.slots != nil && !l.acquire() {
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	clientConns.open.Add(1)
+	return &limitedConn{Conn: conn, listener: l}, nil
+}
+
+// Takes a slot, waiting for one while all are taken; false once the
+// listener is closed
+func (l *limitListener) acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	clientConns.waited.Add(1)
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+func (l *limitListener) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *limitListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+type limitedConn struct {
+	net.Conn
+	listener *limitListener
+	once     sync.Once
+}
+
+// Hijacked connections, e.g. WebSockets, keep their slot until closed too
+func (c *limitedConn) Close() error {
+	c.once.Do(func() {
+		clientConns.open.Add(-1)
+		c.listener.release()
+	})
+	return c.Conn.Close()
+}
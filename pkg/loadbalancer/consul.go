@@ -0,0 +1,269 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a blocking query waits for a change before Consul answers anyway
+const consulWait = 5 * time.Minute
+
+// Keeps one server per passing instance of a Consul service, using
+// blocking queries so changes in the catalog show up right away
+type ConsulDiscovery struct {
+	api     *consulClient
+	service string
+	tag     string
+	scheme  string
+	options string
+}
+
+// Part of an entry of GET /v1/health/service/:service
+type consulServiceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		ID      string `json:"ID"`
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+		Weights struct {
+			Passing int `json:"Passing"`
+		} `json:"Weights"`
+	} `json:"Service"`
+}
+
+type consulClient struct {
+	address string
+	token   string
+	client  *http.Client
+}
+
+// Registration of the load balancer itself, so clients can find it in
+// Consul too
+type consulRegistration struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Address string            `json:"Address,omitempty"`
+	Port    int               `json:"Port"`
+	Check   consulHealthCheck `json:"Check"`
+}
+
+type consulHealthCheck struct {
+	HTTP                           string `json:"HTTP"`
+	Interval                       string `json:"Interval"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+}
+
+func getConsulClientEnv() *consulClient {
+	return &consulClient{
+		address: strings.TrimSuffix(getEnv("CONSUL_HTTP_ADDR", "http://127.0.0.1:8500"), "/"),
+		token:   getEnv("CONSUL_HTTP_TOKEN", ""),
+		// Longer than a blocking query, which Consul may stretch by up to
+		// a sixteenth to spread out the answers
+		client: &http.Client{Timeout: consulWait + consulWait/16 + 30*time.Second},
+	}
+}
+
+func getConsulDiscoveryEnv() (*ConsulDiscovery, error) {
+	service := getEnv("CONSUL_SERVICE", "")
+	if service == "" {
+		return nil, nil
+	}
+	c := &ConsulDiscovery{
+		api:     getConsulClientEnv(),
+		service: service,
+		tag:     getEnv("CONSUL_TAG", ""),
+		scheme:  getEnv("CONSUL_SCHEME", "http"),
+		options: getEnv("CONSUL_SERVER_OPTIONS", ""),
+	}
+	if c.scheme != "http" && c.scheme != "https" {
+		return nil, fmt.Errorf("invalid CONSUL_SCHEME %q, use http or https", c.scheme)
+	}
+	return c, nil
+}
+
+func (c *ConsulDiscovery) source() string {
+	return "consul:" + c.service
+}
+
+func (c *ConsulDiscovery) Watch(ctx context.Context) (<-chan []Backend, error) {
+	updates := make(chan []Backend)
+	go func() {
+		defer close(updates)
+		index := uint64(0)
+		for ctx.Err() == nil {
+			entries, next, err := c.passing(ctx, index)
+			if err != nil {
+				if ctx.Err() == nil {
+					errorf("❌ Querying Consul for %s failed, keeping current servers: %v", c.service, err)
+					sleepContext(ctx, 5*time.Second)
+				}
+				continue
+			}
+
+			// The index going backwards means Consul's state was reset, and
+			// the next query must start over so it doesn't wait for nothing
+			if next < index {
+				next = 0
+			}
+			if (next != index || index == 0) && !sendBackends(ctx, updates, c.backends(entries)) {
+				return
+			}
+			index = next
+		}
+	}()
+	return updates, nil
+}
+
+// Passing instances, waiting for a change after index unless it is 0
+func (c *ConsulDiscovery) passing(ctx context.Context, index uint64) ([]consulServiceEntry, uint64, error) {
+	query := url.Values{"passing": {"true"}}
+	if c.tag != "" {
+		query.Set("tag", c.tag)
+	}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", consulWait.String())
+	}
+
+	req, err := c.api.request(ctx, http.MethodGet, "/v1/health/service/"+url.PathEscape(c.service)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := c.api.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul answered %s", resp.Status)
+	}
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid X-Consul-Index: %w", err)
+	}
+	return entries, next, nil
+}
+
+// URLs and options of the instances; the service's passing weight becomes
+// the server's weight
+func (c *ConsulDiscovery) backends(entries []consulServiceEntry) []Backend {
+	backends := []Backend{}
+	for _, entry := range entries {
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		if address == "" || entry.Service.Port == 0 {
+			warnf("⚠️  consul: skipping instance %s without an address and port", entry.Service.ID)
+			continue
+		}
+
+		options := c.options
+		if weight := entry.Service.Weights.Passing; weight > 0 {
+			options = setOption(options, "weight", strconv.Itoa(weight))
+		}
+		backends = append(backends, Backend{
+			URL:     c.scheme + "://" + net.JoinHostPort(address, strconv.Itoa(entry.Service.Port)),
+			Options: options,
+		})
+	}
+	return backends
+}
+
+// Registers the load balancer with the local Consul agent, health-checked
+// through /readyz, and returns a function that deregisters it
+func registerInConsul(port string) (func(), error) {
+	name := getEnv("CONSUL_REGISTER_NAME", "load-balancer")
+	address := getEnv("CONSUL_REGISTER_ADDRESS", "")
+	interval, err := getEnvDuration("CONSUL_REGISTER_CHECK_INTERVAL", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+
+	portNumber, _ := strconv.Atoi(port)
+	checkHost := address
+	if checkHost == "" {
+		checkHost = "127.0.0.1"
+	}
+	registration := consulRegistration{
+		ID:      name + "-" + hostname + "-" + port,
+		Name:    name,
+		Address: address,
+		Port:    portNumber,
+		Check: consulHealthCheck{
+			HTTP:     "http://" + net.JoinHostPort(checkHost, port) + "/readyz",
+			Interval: interval.String(),
+			// Cleans up after a crash that skipped deregistering
+			DeregisterCriticalServiceAfter: "1m",
+		},
+	}
+
+	api := getConsulClientEnv()
+	if err := api.put(context.Background(), "/v1/agent/service/register", registration); err != nil {
+		return nil, err
+	}
+	infof("📇 Registered in Consul as %s (%s)", registration.Name, registration.ID)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := api.put(ctx, "/v1/agent/service/deregister/"+url.PathEscape(registration.ID), nil); err != nil {
+			warnf("⚠️  Failed to deregister from Consul: %v", err)
+		}
+	}, nil
+}
+
+func (c *consulClient) request(ctx context.Context, method, path string, body any) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.address+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	return req, nil
+}
+
+func (c *consulClient) put(ctx context.Context, path string, body any) error {
+	req, err := c.request(ctx, http.MethodPut, path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul answered %s", resp.Status)
+	}
+	return nil
+}
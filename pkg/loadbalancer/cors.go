@@ -0,0 +1,182 @@
+package loadbalancer
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cross-origin access answered by the load balancer, so backends don't
+// each implement CORS. Set for every route with CORS_ORIGINS; routes can
+// override the origins, methods and headers, or turn it off.
+type CORSPolicy struct {
+	// "*" for any origin, or e.g. "https://app.example.com" and
+	// "https://*.example.com"
+	Origins []string
+	Methods []string
+	// Request headers browsers may send; "*" allows whatever they ask for
+	Headers       []string
+	ExposeHeaders []string
+	Credentials   bool
+	MaxAge        time.Duration
+}
+
+func getCORSPolicyEnv() (*CORSPolicy, error) {
+	var env envReader
+	policy := &CORSPolicy{
+		Origins:       splitList(getEnv("CORS_ORIGINS", ""), ","),
+		Methods:       splitList(getEnv("CORS_METHODS", "GET,HEAD,POST,PUT,PATCH,DELETE"), ","),
+		Headers:       splitList(getEnv("CORS_HEADERS", "Content-Type,Authorization"), ","),
+		ExposeHeaders: splitList(getEnv("CORS_EXPOSE_HEADERS", ""), ","),
+		Credentials:   env.Bool("CORS_CREDENTIALS", false),
+		MaxAge:        env.Duration("CORS_MAX_AGE", 10*time.Minute),
+	}
+	// Echoing any origin with credentials would let every site act as
+	// the user
+	if policy.Credentials && policy.allowsAnyOrigin() {
+		return nil, errors.New("CORS_CREDENTIALS needs CORS_ORIGINS to list the allowed origins instead of *")
+	}
+	return policy, env.err
+}
+
+// Non-empty, trimmed items of a separated list
+func splitList(value, separator string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, separator) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// The policy of a route with its overrides applied, nil when the route
+// has no CORS handling
+func (lb *LoadBalancer) corsPolicy(route *Route) *CORSPolicy {
+	if route.CORSDisabled {
+		return nil
+	}
+	policy := *lb.cors
+	if len(route.CORSOrigins) > 0 {
+		policy.Origins = route.CORSOrigins
+	}
+	if len(route.CORSMethods) > 0 {
+		policy.Methods = route.CORSMethods
+	}
+	if len(route.CORSHeaders) > 0 {
+		policy.Headers = route.CORSHeaders
+	}
+	if len(policy.Origins) == 0 {
+		return nil
+	}
+	return &policy
+}
+
+// Adds the CORS headers for an allowed origin, and answers preflight
+// requests itself, returning true, so they never reach a backend. A
+// preflight from an origin or for a method that isn't allowed gets 204
+// without them, which makes the browser refuse the actual request.
+func (lb *LoadBalancer) handleCORS(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	policy := lb.corsPolicy(route)
+	origin := r.Header.Get("Origin")
+	if policy == nil || origin == "" {
+		return false
+	}
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	if preflight {
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+	}
+
+	allowed := policy.allowsOrigin(origin)
+	if preflight {
+		allowed = allowed && policy.allowsMethod(r.Header.Get("Access-Control-Request-Method"))
+	}
+	if allowed {
+		if policy.allowsAnyOrigin() {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		// Not even when a route's cors=* overrides the listed origins
+		if policy.Credentials && !policy.allowsAnyOrigin() {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	if !preflight {
+		if allowed && len(policy.ExposeHeaders) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(policy.ExposeHeaders, ", "))
+		}
+		return false
+	}
+
+	if allowed {
+		header.Set("Access-Control-Allow-Methods", strings.Join(policy.Methods, ", "))
+		if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			if len(policy.Headers) == 1 && policy.Headers[0] == "*" {
+				header.Set("Access-Control-Allow-Headers", requested)
+			} else {
+				header.Set("Access-Control-Allow-Headers", strings.Join(policy.Headers, ", "))
+			}
+		}
+		if policy.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func (p *CORSPolicy) allowsAnyOrigin() bool {
+	for _, allowed := range p.Origins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	for _, allowed := range p.Origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		// e.g. https://*.example.com, which doesn't match example.com itself
+		if prefix, suffix, ok := strings.Cut(strings.ToLower(allowed), "*"); ok {
+			origin := strings.ToLower(origin)
+			if len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Simple methods are always allowed, as browsers send them without asking
+func (p *CORSPolicy) allowsMethod(method string) bool {
+	if method == http.MethodGet || method == http.MethodHead || method == http.MethodPost {
+		return true
+	}
+	for _, allowed := range p.Methods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Backends' own CORS headers, which would duplicate or contradict the load
+// balancer's
+func dropCORSHeaders(header http.Header) {
+	for key := range header {
+		if strings.HasPrefix(key, "Access-Control-") {
+			header.Del(key)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package loadbalancer
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// Shards of a shardedCounter, enough that concurrent requests rarely pick
+// the same one
+const counterShards = 16
+
+// Counter that requests on different cores can increment without fighting
+// over one cache line: each increment goes to a random shard, each shard
+// has a cache line to itself, and reads add the shards up. Reads are rarer
+// and slower, which suits counters only read by /lb-status and metrics.
+type shardedCounter struct {
+	shards [counterShards]counterShard
+}
+
+type counterShard struct {
+	value atomic.Uint64
+	// Pads the shard to a 64-byte cache line
+	_ [56]byte
+}
+
+func (c *shardedCounter) Add(n uint64) {
+	c.shards[rand.Uint32()%counterShards].value.Add(n)
+}
+
+func (c *shardedCounter) Load() uint64 {
+	var total uint64
+	for i := range c.shards {
+		total += c.shards[i].value.Load()
+	}
+	return total
+}
@@ -0,0 +1,14 @@
+package loadbalancer
+
+import (
+	"net/http"
+)
+
+// Single-page dashboard polling /lb-status and following /lb-events, or the
+// admin WebSocket feed when opened with #token=<token>
+var dashboardHTML = asset("dashboard.html")
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
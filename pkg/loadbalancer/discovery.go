@@ -0,0 +1,250 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/url"
+	"slices"
+	"sort"
+	"time"
+)
+
+// A backend found by a discovery provider
+type Backend struct {
+	URL string
+	// TARGET_SERVICES options, e.g. "pool=heavy;weight=2"
+	Options string
+}
+
+// A source of backends, e.g. DNS, Docker, Kubernetes or Consul. Watch sends
+// the complete set of backends whenever it changes, until ctx is done and
+// the channel is closed. While the source can't be reached it sends
+// nothing, so the current backends stay.
+type Discovery interface {
+	Watch(ctx context.Context) (<-chan []Backend, error)
+}
+
+// A configured provider and the source label of its servers in /lb-status
+type discoveryProvider struct {
+	source    string
+	discovery Discovery
+}
+
+// Whether backends come from a discovery mechanism, in which case
+// TARGET_SERVICES may be left empty for no static backends
+func discoveryEnabled() bool {
+	// An invalid value fails New in getDockerDiscoveryEnv
+	docker, _ := getEnvBool("DOCKER_DISCOVERY", false)
+	return docker || getEnv("K8S_SERVICE", "") != "" ||
+		getEnv("CONSUL_SERVICE", "") != "" || getEnv("ETCD_PREFIX", "") != "" ||
+		getEnv("BACKENDS_FILE", "") != "" || getEnv("REGISTRATION_SECRET", "") != "" ||
+		getEnv("EUREKA_APP", "") != "" || getEnv("MDNS_SERVICE", "") != "" ||
+		getEnv("DISCOVERY", "") != ""
+}
+
+// The providers configured in the environment. A provider of your own
+// plugs in by implementing Discovery and being registered with
+// RegisterDiscovery.
+func discoveryProvidersEnv() ([]discoveryProvider, error) {
+	var providers []discoveryProvider
+	add := func(source string, d Discovery) {
+		providers = append(providers, discoveryProvider{source, d})
+	}
+
+	docker, err := getDockerDiscoveryEnv()
+	if err != nil {
+		return nil, err
+	} else if docker != nil {
+		add(dockerSource, docker)
+	}
+	kubernetes, err := getKubernetesDiscoveryEnv()
+	if err != nil {
+		return nil, err
+	} else if kubernetes != nil {
+		add(kubernetes.source(), kubernetes)
+	}
+	consul, err := getConsulDiscoveryEnv()
+	if err != nil {
+		return nil, err
+	} else if consul != nil {
+		add(consul.source(), consul)
+	}
+	etcd, err := getEtcdDiscoveryEnv()
+	if err != nil {
+		return nil, err
+	} else if etcd != nil {
+		add(etcd.source(), etcd)
+	}
+	file, err := getFileDiscoveryEnv()
+	if err != nil {
+		return nil, err
+	} else if file != nil {
+		add(file.source(), file)
+	}
+	eureka, err := getEurekaDiscoveryEnv()
+	if err != nil {
+		return nil, err
+	} else if eureka != nil {
+		add(eureka.source(), eureka)
+	}
+	mdns, err := getMDNSDiscoveryEnv()
+	if err != nil {
+		return nil, err
+	} else if mdns != nil {
+		add(mdns.source(), mdns)
+	}
+
+	registered, err := registeredDiscoveryEnv()
+	return append(providers, registered...), err
+}
+
+// Keeps the servers from source in line with what d finds, until ctx is
+// done
+func (lb *LoadBalancer) runDiscovery(ctx context.Context, source string, d Discovery) {
+	updates, err := d.Watch(ctx)
+	if err != nil {
+		errorf("❌ %s: discovery failed to start: %v", source, err)
+		return
+	}
+	for backends := range updates {
+		lb.syncDiscovered(source, backends)
+	}
+}
+
+// Sends backends to a watcher, unless ctx is done first
+func sendBackends(ctx context.Context, updates chan<- []Backend, backends []Backend) bool {
+	select {
+	case updates <- backends:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Waits for d, unless ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Records the backends source offers now, and brings the discovered
+// servers in line with every source's latest set. Invalid backends are
+// logged and dropped here, so they aren't reported again on every change
+// of another source.
+func (lb *LoadBalancer) syncDiscovered(source string, backends []Backend) {
+	valid := []discoveredBackend{}
+	for _, backend := range backends {
+		target, err := url.Parse(backend.URL)
+		if err != nil {
+			warnf("⚠️  %s: invalid backend %s: %v", source, backend.URL, err)
+			continue
+		}
+		server, err := newServer(target, backend.Options)
+		switch {
+		case err != nil:
+			warnf("⚠️  %s: skipping %s: %v", source, backend.URL, err)
+			continue
+		case lb.pool(server.Pool) == nil:
+			warnf("⚠️  %s: skipping %s: unknown pool %q", source, backend.URL, server.Pool)
+			continue
+		}
+		valid = append(valid, discoveredBackend{Backend: backend, id: server.ID()})
+	}
+
+	lb.discoveryMutex.Lock()
+	defer lb.discoveryMutex.Unlock()
+
+	lb.discovered[source] = valid
+	lb.reconcileDiscovered()
+}
+
+// Brings the discovered servers in line again, e.g. after a static server
+// was removed so that a discovered copy of it can take its place
+func (lb *LoadBalancer) resyncDiscovered() {
+	lb.discoveryMutex.Lock()
+	defer lb.discoveryMutex.Unlock()
+
+	lb.reconcileDiscovered()
+}
+
+// A valid backend from a source, with its server ID
+type discoveredBackend struct {
+	Backend
+	id string
+}
+
+// Serves each backend once, however many sources offer it. Static servers,
+// from TARGET_SERVICES or the admin API, come first; otherwise the source
+// first in alphabetical order serves it, and the others are listed in
+// alsoDiscoveredBy so it is clear who takes over when that source drops it.
+// Servers whose options changed are re-created.
+func (lb *LoadBalancer) reconcileDiscovered() {
+	type owner struct {
+		source  string
+		backend Backend
+		also    []string
+	}
+	owners := map[string]*owner{}
+	static := map[string]*Server{}
+	for _, server := range lb.Servers() {
+		if server.Source == "" {
+			static[server.ID()] = server
+			owners[server.ID()] = &owner{}
+		}
+	}
+
+	sources := make([]string, 0, len(lb.discovered))
+	for source := range lb.discovered {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		for _, backend := range lb.discovered[source] {
+			switch o, ok := owners[backend.id]; {
+			case !ok:
+				owners[backend.id] = &owner{source: source, backend: backend.Backend}
+			case o.source != source && !slices.Contains(o.also, source):
+				o.also = append(o.also, source)
+			}
+		}
+	}
+
+	current := map[string]*Server{}
+	for _, server := range lb.Servers() {
+		if server.Source == "" {
+			continue
+		}
+		o := owners[server.ID()]
+		if o != nil && o.source == server.Source && o.backend.URL == server.rawURL && o.backend.Options == server.options {
+			current[server.ID()] = server
+			continue
+		}
+		infof("➖ %s: removing %s", server.Source, server.rawURL)
+		lb.removeServer(server)
+	}
+
+	for id, o := range owners {
+		if server := static[id]; server != nil {
+			server.setAlsoDiscoveredBy(o.also)
+			continue
+		}
+		server := current[id]
+		if server == nil {
+			// Validated when the source sent it, but its pool may be gone
+			target, _ := url.Parse(o.backend.URL)
+			server, _ = newServer(target, o.backend.Options)
+			server.Source = o.source
+			if err := lb.addServer(server); err != nil {
+				continue
+			}
+			infof("➕ %s: adding %s", o.source, o.backend.URL)
+		}
+		server.setAlsoDiscoveredBy(o.also)
+	}
+}
@@ -0,0 +1,86 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Keeps one server per address the template's hostname resolves to, for
+// backends given with the "resolve" option. Addresses that disappear from
+// DNS leave the pool and new ones join it; when resolution fails the
+// current set is kept, and health checks fail over among the addresses.
+type DNSDiscovery struct {
+	template *Server
+	interval time.Duration
+}
+
+func newDNSDiscovery(template *Server) (*DNSDiscovery, error) {
+	interval, err := getEnvDuration("DNS_REFRESH_INTERVAL", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &DNSDiscovery{template: template, interval: interval}, nil
+}
+
+func (d *DNSDiscovery) source() string {
+	return "dns:" + d.template.URL.Host
+}
+
+func (d *DNSDiscovery) Watch(ctx context.Context) (<-chan []Backend, error) {
+	updates := make(chan []Backend)
+	go func() {
+		defer close(updates)
+		for ; ; sleepContext(ctx, d.interval) {
+			if ctx.Err() != nil {
+				return
+			}
+			backends, err := d.resolve(ctx)
+			if err != nil {
+				errorf("❌ Resolving %s failed, keeping current servers: %v", d.template.URL.Hostname(), err)
+				continue
+			}
+			if !sendBackends(ctx, updates, backends) {
+				return
+			}
+		}
+	}()
+	return updates, nil
+}
+
+func (d *DNSDiscovery) resolve(ctx context.Context) ([]Backend, error) {
+	hostname, port := d.template.URL.Hostname(), d.template.URL.Port()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	addresses, err := net.DefaultResolver.LookupHost(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	// The template's options were validated at startup
+	options := withoutOption(d.template.options, "resolve")
+	// Name-based virtual hosts expect the DNS name, not the address
+	if d.template.HostHeader == HostBackend {
+		options = setOption(options, "host", d.template.URL.Host)
+	}
+
+	backends := []Backend{}
+	for _, address := range addresses {
+		target := *d.template.URL
+		target.Host = hostPort(address, port)
+		backends = append(backends, Backend{URL: target.String(), Options: options})
+	}
+	return backends, nil
+}
+
+func hostPort(address, port string) string {
+	if port == "" {
+		if net.ParseIP(address).To4() == nil {
+			return "[" + address + "]"
+		}
+		return address
+	}
+	return net.JoinHostPort(address, port)
+}
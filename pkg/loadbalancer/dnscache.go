@@ -0,0 +1,135 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Backend host names resolved ahead of dialing, so new upstream
+// connections dial an IP instead of waiting for a lookup each. Names are
+// resolved when a backend is added and again once UPSTREAM_DNS_TTL has
+// passed, or right away when none of their addresses can be dialed.
+type DNSCache struct {
+	ttl      time.Duration
+	resolver *net.Resolver
+	mutex    sync.Mutex
+	hosts    map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs    []string
+	resolved time.Time
+}
+
+// Built on first use, after CONFIG_FILE is applied. New reads it first, so
+// an invalid UPSTREAM_DNS_TTL fails there.
+var upstreamDNSEnv = sync.OnceValues(func() (*DNSCache, error) {
+	ttl, err := getEnvDuration("UPSTREAM_DNS_TTL", 30*time.Second)
+	return newDNSCache(ttl), err
+})
+
+// The cache, with the default TTL when UPSTREAM_DNS_TTL is invalid
+func upstreamDNS() *DNSCache {
+	cache, _ := upstreamDNSEnv()
+	return cache
+}
+
+func newDNSCache(ttl time.Duration) *DNSCache {
+	return &DNSCache{ttl: ttl, resolver: net.DefaultResolver, hosts: map[string]*dnsEntry{}}
+}
+
+func (c *DNSCache) enabled() bool {
+	return c.ttl > 0
+}
+
+// Resolves host in the background, for a backend being added
+func (c *DNSCache) prefetch(host string) {
+	if !c.enabled() || net.ParseIP(host) != nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := c.resolve(ctx, host); err != nil {
+			warnf("Could not resolve backend %s: %v", host, err)
+		}
+	}()
+}
+
+// The addresses of host, looked up again when they're older than the TTL
+func (c *DNSCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mutex.Lock()
+	entry := c.hosts[host]
+	c.mutex.Unlock()
+	if entry != nil && time.Since(entry.resolved) < c.ttl {
+		return entry.addrs, nil
+	}
+
+	addrs, err := c.resolve(ctx, host)
+	if err != nil && entry != nil {
+		// Stale addresses beat none while DNS is down
+		debugf("Resolving %s failed, dialing its cached addresses: %v", host, err)
+		return entry.addrs, nil
+	}
+	return addrs, err
+}
+
+func (c *DNSCache) resolve(ctx context.Context, host string) ([]string, error) {
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	previous := c.hosts[host]
+	c.hosts[host] = &dnsEntry{addrs: addrs, resolved: time.Now()}
+	c.mutex.Unlock()
+
+	if previous != nil && !slices.Equal(previous.addrs, addrs) {
+		infof("🌐 Backend %s now resolves to %v", host, addrs)
+	}
+	return addrs, nil
+}
+
+// Dials addr through the cached addresses of its host. When none of them
+// answers the host is resolved again and its new addresses, if any, tried.
+func (c *DNSCache) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || !c.enabled() || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialAny(ctx, dialer, network, addrs, port)
+	if err == nil {
+		return conn, nil
+	}
+
+	fresh, resolveErr := c.resolve(ctx, host)
+	if resolveErr != nil || slices.Equal(fresh, addrs) {
+		return nil, err
+	}
+	return dialAny(ctx, dialer, network, fresh, port)
+}
+
+// Tries the addresses in order, returning the first connection
+func dialAny(ctx context.Context, dialer *net.Dialer, network string, addrs []string, port string) (net.Conn, error) {
+	var err error
+	for _, ip := range addrs {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,242 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dockerSource = "docker"
+
+// Registers running containers labeled <prefix>.enable=true as backends,
+// watching the Docker API so containers join when they start and leave
+// when they stop. Labels:
+//
+//	<prefix>.port    port the container serves on, required unless it
+//	                 exposes exactly one TCP port
+//	<prefix>.weight  share of its pool's traffic (default 1)
+//	<prefix>.pool    pool to join (default "default")
+//	<prefix>.scheme  http or https (default http)
+type DockerDiscovery struct {
+	client  *http.Client
+	baseURL string
+	prefix  string
+	// Network whose address is used, for containers on several
+	network string
+	// Full resync, in case an event was missed
+	interval time.Duration
+}
+
+// Part of GET /containers/json
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	Labels          map[string]string `json:"Labels"`
+	Ports           []dockerPort      `json:"Ports"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+type dockerPort struct {
+	PrivatePort int    `json:"PrivatePort"`
+	Type        string `json:"Type"`
+}
+
+func getDockerDiscoveryEnv() (*DockerDiscovery, error) {
+	var env envReader
+	if !env.Bool("DOCKER_DISCOVERY", false) {
+		return nil, env.err
+	}
+
+	d := &DockerDiscovery{
+		prefix:   getEnv("DOCKER_LABEL_PREFIX", "lb"),
+		network:  getEnv("DOCKER_NETWORK", ""),
+		interval: env.Duration("DOCKER_RESYNC_INTERVAL", time.Minute),
+	}
+
+	host := getEnv("DOCKER_HOST", "unix:///var/run/docker.sock")
+	switch {
+	case strings.HasPrefix(host, "unix://"):
+		path := strings.TrimPrefix(host, "unix://")
+		d.baseURL = "http://docker"
+		d.client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		}}
+	case strings.HasPrefix(host, "tcp://"):
+		d.baseURL = "http://" + strings.TrimPrefix(host, "tcp://")
+		d.client = &http.Client{}
+	default:
+		return nil, fmt.Errorf("invalid DOCKER_HOST %q, use unix:///path or tcp://host:port", host)
+	}
+	return d, env.err
+}
+
+func (d *DockerDiscovery) Watch(ctx context.Context) (<-chan []Backend, error) {
+	updates := make(chan []Backend)
+	go func() {
+		defer close(updates)
+		for ctx.Err() == nil {
+			since := time.Now()
+			backends, err := d.list(ctx)
+			if err != nil {
+				errorf("❌ Docker discovery failed, keeping current servers: %v", err)
+			} else if !sendBackends(ctx, updates, backends) {
+				return
+			}
+
+			if err := d.waitForChange(ctx, since); err != nil {
+				errorf("❌ Watching Docker events failed: %v", err)
+				sleepContext(ctx, 5*time.Second)
+			}
+		}
+	}()
+	return updates, nil
+}
+
+func (d *DockerDiscovery) list(ctx context.Context) ([]Backend, error) {
+	filters, _ := json.Marshal(map[string][]string{"label": {d.prefix + ".enable=true"}})
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var containers []dockerContainer
+	if err := d.get(ctx, "/containers/json?filters="+url.QueryEscape(string(filters)), &containers); err != nil {
+		return nil, err
+	}
+
+	backends := []Backend{}
+	for _, container := range containers {
+		rawURL, options, err := d.backend(container)
+		if err != nil {
+			warnf("⚠️  docker: skipping container %s: %v", container.name(), err)
+			continue
+		}
+		backends = append(backends, Backend{URL: rawURL, Options: options})
+	}
+	return backends, nil
+}
+
+// Blocks until a container starts or stops after since, or the resync
+// interval passes
+func (d *DockerDiscovery) waitForChange(ctx context.Context, since time.Time) error {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"event": {"start", "die", "pause", "unpause"},
+		"label": {d.prefix + ".enable=true"},
+	})
+	query := url.Values{
+		"since":   {fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond())},
+		"filters": {string(filters)},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.interval)
+	defer cancel()
+
+	var event struct {
+		Action string `json:"Action"`
+	}
+	err := d.get(ctx, "/events?"+query.Encode(), &event)
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err == nil {
+		debugf("🐳 Docker container event: %s", event.Action)
+	}
+	return err
+}
+
+// Decodes the first JSON value of the response into result
+func (d *DockerDiscovery) get(ctx context.Context, path string, result any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker API answered %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// The container's backend URL and TARGET_SERVICES options
+func (d *DockerDiscovery) backend(c dockerContainer) (string, string, error) {
+	address := ""
+	if d.network != "" {
+		address = c.NetworkSettings.Networks[d.network].IPAddress
+	} else {
+		names := []string{}
+		for name, network := range c.NetworkSettings.Networks {
+			if network.IPAddress != "" {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			address = c.NetworkSettings.Networks[names[0]].IPAddress
+		}
+	}
+	if address == "" {
+		return "", "", fmt.Errorf("no address on network %q", d.network)
+	}
+
+	port := c.Labels[d.prefix+".port"]
+	if port == "" {
+		exposed := map[int]bool{}
+		for _, p := range c.Ports {
+			if p.Type == "tcp" {
+				exposed[p.PrivatePort] = true
+			}
+		}
+		if len(exposed) != 1 {
+			return "", "", fmt.Errorf("set the %s.port label, it exposes %d TCP ports", d.prefix, len(exposed))
+		}
+		for p := range exposed {
+			port = strconv.Itoa(p)
+		}
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", "", fmt.Errorf("invalid %s.port %q", d.prefix, port)
+	}
+
+	scheme := c.Labels[d.prefix+".scheme"]
+	switch scheme {
+	case "":
+		scheme = "http"
+	case "http", "https":
+	default:
+		return "", "", fmt.Errorf("invalid %s.scheme %q", d.prefix, scheme)
+	}
+
+	options := ""
+	if pool := c.Labels[d.prefix+".pool"]; pool != "" {
+		options = setOption(options, "pool", pool)
+	}
+	if weight := c.Labels[d.prefix+".weight"]; weight != "" {
+		options = setOption(options, "weight", weight)
+	}
+	return scheme + "://" + net.JoinHostPort(address, port), options, nil
+}
+
+func (c dockerContainer) name() string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	return c.ID[:min(12, len(c.ID))]
+}
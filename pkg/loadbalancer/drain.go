@@ -0,0 +1,64 @@
+package loadbalancer
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Whether the whole LB is draining, and for how long clients are told to
+// stay away, as returned by /lb-admin/drain
+type DrainStatus struct {
+	Draining   bool       `json:"draining"`
+	Since      *time.Time `json:"since,omitempty"`
+	RetryAfter string     `json:"retryAfter"`
+	InFlight   int64      `json:"inFlight"`
+}
+
+// Takes the LB out of an upstream rotation without dropping anything: while
+// draining, new requests get 503 with Retry-After and /readyz fails, and
+// requests already in flight finish
+func (lb *LoadBalancer) startDrain() {
+	if !atomic.CompareAndSwapInt64(&lb.drainingSince, 0, time.Now().UnixNano()) {
+		return
+	}
+	infof("🚰 Draining: refusing new requests, %d in flight", atomic.LoadInt64(&lb.inFlight))
+	lb.events.Publish(Event{Type: EventDrainStarted, Reason: "admin API"})
+}
+
+func (lb *LoadBalancer) stopDrain() {
+	if atomic.SwapInt64(&lb.drainingSince, 0) == 0 {
+		return
+	}
+	infof("🚰 Drain stopped, accepting requests again")
+	lb.events.Publish(Event{Type: EventDrainStopped, Reason: "admin API"})
+}
+
+func (lb *LoadBalancer) draining() bool {
+	return atomic.LoadInt64(&lb.drainingSince) != 0
+}
+
+func (lb *LoadBalancer) drainStatus() DrainStatus {
+	status := DrainStatus{
+		RetryAfter: lb.drainRetryAfter.String(),
+		InFlight:   atomic.LoadInt64(&lb.inFlight),
+	}
+	if since := atomic.LoadInt64(&lb.drainingSince); since != 0 {
+		at := time.Unix(0, since)
+		status.Draining, status.Since = true, &at
+	}
+	return status
+}
+
+// Refuses the request if the LB is draining
+func (lb *LoadBalancer) refuseWhileDraining(w http.ResponseWriter, r *http.Request) bool {
+	if !lb.draining() {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(lb.drainRetryAfter.Seconds())), 1)))
+	w.Header().Set("Connection", "close")
+	lb.errorPages.Write(w, r, http.StatusServiceUnavailable, "Service Unavailable: draining")
+	return true
+}
@@ -0,0 +1,51 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Classes of failed upstream requests, used in error metrics and logs to
+// tell a dead backend from a slow or misconfigured one
+const (
+	ErrorClassRefused  = "connection_refused"
+	ErrorClassReset    = "connection_reset"
+	ErrorClassTimeout  = "timeout"
+	ErrorClassTLS      = "tls"
+	ErrorClassDNS      = "dns"
+	ErrorClassCanceled = "client_canceled"
+	ErrorClassOther    = "other"
+	ErrorClassHTTP5xx  = "http_5xx"
+)
+
+func classifyProxyError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+
+	switch {
+	case errors.Is(err, ErrBackendTimeout), errors.Is(err, context.DeadlineExceeded):
+		return ErrorClassTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCanceled
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorClassRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return ErrorClassReset
+	case errors.As(err, &dnsErr):
+		return ErrorClassDNS
+	case errors.As(err, &recordErr), errors.As(err, &certErr),
+		errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr):
+		return ErrorClassTLS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorClassTimeout
+	}
+	return ErrorClassOther
+}
@@ -0,0 +1,127 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type ErrorPage struct {
+	ContentType string
+	template    interface {
+		Execute(w io.Writer, data any) error
+	}
+}
+
+// Fields available to error page templates
+type ErrorPageData struct {
+	Status     int
+	StatusText string
+	Message    string
+	Method     string
+	Path       string
+	Timestamp  time.Time
+}
+
+type ErrorPages map[int]*ErrorPage
+
+// What browsers get for statuses without a configured page
+var defaultErrorPage = &ErrorPage{
+	ContentType: "text/html; charset=utf-8",
+	template:    htmltemplate.Must(htmltemplate.New("default.html").Parse(string(asset("errorpages/default.html")))),
+}
+
+// ERROR_PAGE_502, ERROR_PAGE_503 and ERROR_PAGE_504 point to template files.
+// The content type follows the file extension; HTML files are escaped as
+// HTML, anything else (e.g. JSON) can use {{json .Message}} for quoting.
+func getErrorPagesEnv() (ErrorPages, error) {
+	pages := ErrorPages{}
+
+	for _, status := range []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		path := getEnv(fmt.Sprintf("ERROR_PAGE_%d", status), "")
+		if path == "" {
+			continue
+		}
+
+		page, err := loadErrorPage(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid error page for %d: %v", status, err)
+		}
+		pages[status] = page
+	}
+
+	return pages, nil
+}
+
+func loadErrorPage(path string) (*ErrorPage, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	page := &ErrorPage{ContentType: contentType}
+
+	if strings.HasPrefix(contentType, "text/html") {
+		page.template, err = htmltemplate.New(path).Parse(string(content))
+	} else {
+		page.template, err = template.New(path).Funcs(template.FuncMap{"json": toJSON}).Parse(string(content))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// Writes the configured page for status, falling back to the default page
+// for browsers and to a plain-text error for other clients
+func (p ErrorPages) Write(w http.ResponseWriter, r *http.Request, status int, message string) {
+	page, ok := p[status]
+	if !ok && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		page, ok = defaultErrorPage, true
+	}
+	if !ok {
+		http.Error(w, message, status)
+		return
+	}
+
+	data := ErrorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Timestamp:  time.Now().UTC(),
+	}
+
+	body := getByteBuffer()
+	defer putByteBuffer(body)
+	if err := page.template.Execute(body, data); err != nil {
+		errorf("❌ Error page for %d failed to render: %v", status, err)
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", page.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+func toJSON(value any) (string, error) {
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
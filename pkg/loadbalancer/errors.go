@@ -0,0 +1,34 @@
+package loadbalancer
+
+import "errors"
+
+// Errors the load balancer returns, to be told apart with errors.Is
+var (
+	// A pool has no server that is up, out of maintenance and enabled
+	ErrNoHealthyBackends = errors.New("no healthy servers available")
+	// Every available server of a pool is at its concurrency limit
+	ErrAllBackendsBusy = errors.New("all servers are at their concurrency limit")
+	// A backend didn't answer within its route's timeout
+	ErrBackendTimeout = errors.New("upstream timed out")
+
+	ErrPoolNotFound = errors.New("unknown pool")
+	ErrPoolExists   = errors.New("pool already exists")
+	ErrPoolInUse    = errors.New("pool is in use")
+	ErrServerExists = errors.New("server already exists")
+)
+
+// A request a backend failed: it couldn't be reached, reset the connection
+// or timed out. Class is one of the ErrorClass constants.
+type BackendError struct {
+	Server *Server
+	Class  string
+	Err    error
+}
+
+func (e *BackendError) Error() string {
+	return e.Server.ID() + ": " + e.Err.Error()
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
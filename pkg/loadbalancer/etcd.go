@@ -0,0 +1,307 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How long a watch runs before it is restarted from the last revision, so
+// a connection that silently died doesn't stop updates for good
+const etcdWatchTimeout = 5 * time.Minute
+
+// The revision to resume from has been compacted away
+var errEtcdCompacted = errors.New("revision compacted")
+
+// Keeps one server per key under an etcd prefix, so several load balancer
+// replicas can share one list of backends. Each value is an entry in the
+// TARGET_SERVICES syntax, e.g. "http://10.0.0.5:8080;weight=2", and the
+// key can be anything, e.g. "/lb/backends/api-1". Talks to etcd's JSON
+// gateway, so no client library is needed.
+type EtcdDiscovery struct {
+	endpoints []string
+	prefix    string
+	username  string
+	password  string
+	client    *http.Client
+	// Endpoint that answered last, tried first next time
+	current int
+}
+
+type etcdKeyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision int64  `json:"mod_revision,string"`
+}
+
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader     `json:"header"`
+	Kvs    []etcdKeyValue `json:"kvs"`
+}
+
+// One message of the /v3/watch stream
+type etcdWatchMessage struct {
+	Result *struct {
+		Header          etcdHeader `json:"header"`
+		Canceled        bool       `json:"canceled"`
+		CancelReason    string     `json:"cancel_reason"`
+		CompactRevision int64      `json:"compact_revision,string"`
+		Events          []struct {
+			// PUT is left out, being the default
+			Type string       `json:"type"`
+			Kv   etcdKeyValue `json:"kv"`
+		} `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func getEtcdDiscoveryEnv() (*EtcdDiscovery, error) {
+	prefix := getEnv("ETCD_PREFIX", "")
+	if prefix == "" {
+		return nil, nil
+	}
+
+	e := &EtcdDiscovery{
+		prefix:   prefix,
+		username: getEnv("ETCD_USERNAME", ""),
+		password: getEnv("ETCD_PASSWORD", ""),
+		client:   &http.Client{},
+	}
+	for _, endpoint := range strings.Split(getEnv("ETCD_ENDPOINTS", "http://127.0.0.1:2379"), ",") {
+		if endpoint = strings.TrimSuffix(strings.TrimSpace(endpoint), "/"); endpoint != "" {
+			e.endpoints = append(e.endpoints, endpoint)
+		}
+	}
+	if len(e.endpoints) == 0 {
+		return nil, errors.New("ETCD_ENDPOINTS is empty")
+	}
+	return e, nil
+}
+
+func (e *EtcdDiscovery) source() string {
+	return "etcd:" + e.prefix
+}
+
+func (e *EtcdDiscovery) Watch(ctx context.Context) (<-chan []Backend, error) {
+	updates := make(chan []Backend)
+	go func() {
+		defer close(updates)
+		for ctx.Err() == nil {
+			entries, revision, err := e.list(ctx)
+			if err != nil {
+				errorf("❌ Listing %s failed, keeping current servers: %v", e.source(), err)
+				sleepContext(ctx, 5*time.Second)
+				continue
+			}
+			if !sendBackends(ctx, updates, e.backends(entries)) {
+				return
+			}
+
+			// Follows changes until the watch fails, then lists again
+			for err == nil && ctx.Err() == nil {
+				revision, err = e.watch(ctx, entries, revision, func() {
+					sendBackends(ctx, updates, e.backends(entries))
+				})
+			}
+			if err != nil && ctx.Err() == nil && !errors.Is(err, errEtcdCompacted) {
+				errorf("❌ Watching %s failed: %v", e.source(), err)
+				sleepContext(ctx, 5*time.Second)
+			}
+		}
+	}()
+	return updates, nil
+}
+
+// Values by key under the prefix, and the revision they were read at
+func (e *EtcdDiscovery) list(ctx context.Context) (map[string]string, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	resp, err := e.post(ctx, "/v3/kv/range", map[string]any{
+		"key":       []byte(e.prefix),
+		"range_end": prefixRangeEnd(e.prefix),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var result etcdRangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, 0, err
+	}
+	entries := map[string]string{}
+	for _, kv := range result.Kvs {
+		entries[string(kv.Key)] = string(kv.Value)
+	}
+	return entries, result.Header.Revision, nil
+}
+
+// Applies changes after revision to entries, calling changed after each
+// batch, until the watch ends; returns the revision to resume from
+func (e *EtcdDiscovery) watch(ctx context.Context, entries map[string]string, revision int64, changed func()) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, etcdWatchTimeout)
+	defer cancel()
+
+	resp, err := e.post(ctx, "/v3/watch", map[string]any{
+		"create_request": map[string]any{
+			"key":            []byte(e.prefix),
+			"range_end":      prefixRangeEnd(e.prefix),
+			"start_revision": revision + 1,
+			// Empty messages every few minutes, which move the revision on
+			"progress_notify": true,
+		},
+	})
+	if err != nil {
+		return revision, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message etcdWatchMessage
+		if err := decoder.Decode(&message); err != nil {
+			// Restarted from the same revision, without listing again
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return revision, nil
+			}
+			return revision, err
+		}
+
+		switch result := message.Result; {
+		case message.Error != nil:
+			return revision, errors.New(message.Error.Message)
+		case result == nil:
+			continue
+		case result.CompactRevision > 0:
+			return revision, errEtcdCompacted
+		case result.Canceled:
+			return revision, fmt.Errorf("watch canceled: %s", result.CancelReason)
+		case len(result.Events) == 0:
+			if result.Header.Revision > revision {
+				revision = result.Header.Revision
+			}
+			continue
+		default:
+			for _, event := range result.Events {
+				if event.Type == "DELETE" {
+					delete(entries, string(event.Kv.Key))
+				} else {
+					entries[string(event.Kv.Key)] = string(event.Kv.Value)
+				}
+				revision = event.Kv.ModRevision
+			}
+			changed()
+		}
+	}
+}
+
+// URLs and options of the entries
+func (e *EtcdDiscovery) backends(entries map[string]string) []Backend {
+	backends := []Backend{}
+	for key, value := range entries {
+		rawURL, options, _ := strings.Cut(strings.TrimSpace(value), ";")
+		if rawURL == "" {
+			warnf("⚠️  %s: skipping %s without a backend URL", e.source(), key)
+			continue
+		}
+		backends = append(backends, Backend{URL: rawURL, Options: options})
+	}
+	return backends
+}
+
+// Sends a request to the first endpoint that answers, authenticating
+// first when ETCD_USERNAME is set
+func (e *EtcdDiscovery) post(ctx context.Context, path string, body any) (*http.Response, error) {
+	var lastErr error
+	for i := range e.endpoints {
+		endpoint := e.endpoints[(e.current+i)%len(e.endpoints)]
+
+		token := ""
+		if e.username != "" {
+			var err error
+			if token, err = e.authenticate(ctx, endpoint); err != nil {
+				lastErr = err
+				continue
+			}
+		}
+		resp, err := e.send(ctx, endpoint+path, token, body)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			lastErr = fmt.Errorf("%s answered %s: %s", endpoint, resp.Status, bytes.TrimSpace(message))
+			continue
+		}
+		e.current = (e.current + i) % len(e.endpoints)
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// A fresh token is cheap, and avoids tracking when the old one expires
+func (e *EtcdDiscovery) authenticate(ctx context.Context, endpoint string) (string, error) {
+	resp, err := e.send(ctx, endpoint+"/v3/auth/authenticate", "", map[string]string{
+		"name":     e.username,
+		"password": e.password,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s refused the credentials: %s", endpoint, resp.Status)
+	}
+	var result struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.Token, nil
+}
+
+func (e *EtcdDiscovery) send(ctx context.Context, url, token string, body any) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return e.client.Do(req)
+}
+
+// The end of the key range holding every key that starts with prefix
+func prefixRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// Every byte is 0xff: up to the end of the keyspace
+	return []byte{0}
+}
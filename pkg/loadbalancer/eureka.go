@@ -0,0 +1,182 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keeps one server per UP instance of an application registered in Netflix
+// Eureka, e.g. by Spring Cloud services, fetching it again every interval
+// as Eureka clients do
+type EurekaDiscovery struct {
+	// Eureka servers' base URLs, e.g. http://eureka:8761/eureka; user info
+	// in the URL is sent as basic auth
+	servers  []string
+	app      string
+	interval time.Duration
+	// Whether to use the instance's IP address rather than its hostname
+	preferIP bool
+	options  string
+	client   *http.Client
+}
+
+// Part of GET /apps/{app} in JSON
+type eurekaApplication struct {
+	Application struct {
+		// An object rather than an array when there is one instance
+		Instance json.RawMessage `json:"instance"`
+	} `json:"application"`
+}
+
+type eurekaInstance struct {
+	InstanceID string     `json:"instanceId"`
+	HostName   string     `json:"hostName"`
+	IPAddr     string     `json:"ipAddr"`
+	Status     string     `json:"status"`
+	Port       eurekaPort `json:"port"`
+	SecurePort eurekaPort `json:"securePort"`
+}
+
+type eurekaPort struct {
+	Port    int    `json:"$"`
+	Enabled string `json:"@enabled"`
+}
+
+func getEurekaDiscoveryEnv() (*EurekaDiscovery, error) {
+	app := getEnv("EUREKA_APP", "")
+	if app == "" {
+		return nil, nil
+	}
+
+	var env envReader
+	e := &EurekaDiscovery{
+		app:      app,
+		interval: env.Duration("EUREKA_REFRESH_INTERVAL", 30*time.Second),
+		preferIP: env.Bool("EUREKA_PREFER_IP", true),
+		options:  getEnv("EUREKA_SERVER_OPTIONS", ""),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, server := range strings.Split(getEnv("EUREKA_URL", "http://127.0.0.1:8761/eureka"), ",") {
+		if server = strings.TrimSuffix(strings.TrimSpace(server), "/"); server != "" {
+			e.servers = append(e.servers, server)
+		}
+	}
+	return e, env.err
+}
+
+func (e *EurekaDiscovery) source() string {
+	return "eureka:" + e.app
+}
+
+func (e *EurekaDiscovery) Watch(ctx context.Context) (<-chan []Backend, error) {
+	updates := make(chan []Backend)
+	go func() {
+		defer close(updates)
+		for ; ; sleepContext(ctx, e.interval) {
+			if ctx.Err() != nil {
+				return
+			}
+			instances, err := e.fetch(ctx)
+			if err != nil {
+				errorf("❌ Fetching %s from Eureka failed, keeping current servers: %v", e.app, err)
+				continue
+			}
+			if !sendBackends(ctx, updates, e.backends(instances)) {
+				return
+			}
+		}
+	}()
+	return updates, nil
+}
+
+// Instances of the app from the first Eureka server that answers; an app
+// that isn't registered has none
+func (e *EurekaDiscovery) fetch(ctx context.Context) ([]eurekaInstance, error) {
+	var lastErr error
+	for _, server := range e.servers {
+		instances, err := e.fetchFrom(ctx, server)
+		if err == nil {
+			return instances, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (e *EurekaDiscovery) fetchFrom(ctx context.Context, server string) ([]eurekaInstance, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server+"/apps/"+url.PathEscape(e.app), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%s answered %s", req.URL.Redacted(), resp.Status)
+	}
+
+	var app eurekaApplication
+	if err := json.NewDecoder(resp.Body).Decode(&app); err != nil {
+		return nil, err
+	}
+	raw := bytes.TrimSpace(app.Application.Instance)
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	if raw[0] == '{' {
+		var instance eurekaInstance
+		err := json.Unmarshal(raw, &instance)
+		return []eurekaInstance{instance}, err
+	}
+	var instances []eurekaInstance
+	err = json.Unmarshal(raw, &instances)
+	return instances, err
+}
+
+// URLs and options of the UP instances, over HTTPS when the instance's
+// secure port is enabled
+func (e *EurekaDiscovery) backends(instances []eurekaInstance) []Backend {
+	backends := []Backend{}
+	for _, instance := range instances {
+		if instance.Status != "UP" {
+			continue
+		}
+
+		host := instance.HostName
+		if e.preferIP && instance.IPAddr != "" {
+			host = instance.IPAddr
+		}
+		scheme, port := "http", instance.Port.Port
+		if instance.SecurePort.Enabled == "true" {
+			scheme, port = "https", instance.SecurePort.Port
+		}
+		if host == "" || port == 0 {
+			warnf("⚠️  %s: skipping instance %s without an address and port", e.source(), instance.InstanceID)
+			continue
+		}
+		backends = append(backends, Backend{
+			URL:     scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port)),
+			Options: e.options,
+		})
+	}
+	return backends
+}
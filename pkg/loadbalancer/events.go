@@ -0,0 +1,153 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event types streamed on /lb-events
+const (
+	EventServerUp       = "server_up"
+	EventServerDown     = "server_down"
+	EventServerAdded    = "server_added"
+	EventServerRemoved  = "server_removed"
+	EventServerDisabled = "server_disabled"
+	EventServerEnabled  = "server_enabled"
+	EventDrainStarted   = "drain_started"
+	EventDrainStopped   = "drain_stopped"
+	EventConfigReloaded = "config_reloaded"
+	EventRequest        = "request"
+	// Only on the admin listener's WebSocket feed
+	EventAdminAction = "admin_action"
+)
+
+// Buffered events per subscriber; a subscriber that falls further behind
+// misses events instead of slowing down the load balancer
+const eventBufferSize = 64
+
+const eventKeepAlive = 15 * time.Second
+
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Server     string    `json:"server,omitempty"`
+	Pool       string    `json:"pool,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	DurationMs float64   `json:"durationMs,omitempty"`
+	Role       string    `json:"role,omitempty"`
+	// Left out of the public /lb-events stream
+	adminOnly bool
+}
+
+// Fans out load balancer events to /lb-events subscribers
+type EventBus struct {
+	sampleRate  float64
+	subscribers map[chan Event]struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+	mutex       sync.Mutex
+}
+
+func NewEventBus(sampleRate float64) *EventBus {
+	return &EventBus{
+		sampleRate:  sampleRate,
+		subscribers: map[chan Event]struct{}{},
+		done:        make(chan struct{}),
+	}
+}
+
+func (b *EventBus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+
+	b.mutex.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mutex.Unlock()
+
+	return ch, func() {
+		b.mutex.Lock()
+		delete(b.subscribers, ch)
+		b.mutex.Unlock()
+	}
+}
+
+func (b *EventBus) Publish(event Event) {
+	event.Time = time.Now()
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Publishes a request event for a sample of requests
+func (b *EventBus) PublishSampled(event Event) {
+	if b.sampleRate > 0 && rand.Float64() < b.sampleRate {
+		b.Publish(event)
+	}
+}
+
+// Ends all streams, so they don't hold up a graceful shutdown
+func (b *EventBus) Close() {
+	b.closeOnce.Do(func() {
+		close(b.done)
+	})
+}
+
+func (b *EventBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	events, unsubscribe := b.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	flusher := http.NewResponseController(w)
+	// The stream lasts as long as the client listens, past WRITE_TIMEOUT
+	flusher.SetWriteDeadline(time.Time{})
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			if event.adminOnly {
+				continue
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-b.done:
+			return
+		}
+
+		if err := flusher.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func serverEvent(eventType string, server *Server, reason string) Event {
+	return Event{
+		Type:   eventType,
+		Server: server.rawURL,
+		Pool:   server.Pool,
+		Reason: reason,
+	}
+}
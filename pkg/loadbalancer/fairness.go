@@ -0,0 +1,170 @@
+package loadbalancer
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How often request totals are snapshotted for the fairness report
+const fairnessSampleInterval = 10 * time.Second
+
+// Snapshots of per-backend request totals, kept for FAIRNESS_HISTORY so
+// /lb-status/fairness can tell how evenly any recent window was spread
+type FairnessTracker struct {
+	history   time.Duration
+	snapshots []fairnessSnapshot
+	mutex     sync.Mutex
+}
+
+type fairnessSnapshot struct {
+	at       time.Time
+	requests map[string]uint64
+}
+
+type FairnessBackend struct {
+	Backend  string  `json:"backend"`
+	Pool     string  `json:"pool"`
+	Requests uint64  `json:"requests"`
+	Share    float64 `json:"sharePercent"`
+}
+
+type FairnessReport struct {
+	Window   string            `json:"window"`
+	Since    time.Time         `json:"since"`
+	Requests uint64            `json:"requests"`
+	Backends []FairnessBackend `json:"backends"`
+	Mean     float64           `json:"mean"`
+	StdDev   float64           `json:"stddev"`
+	// Standard deviation relative to the mean; 0 is a perfectly even spread
+	CoefficientOfVariation float64 `json:"coefficientOfVariation"`
+	Spread                 uint64  `json:"spread"`
+	MaxMinRatio            float64 `json:"maxMinRatio,omitempty"`
+}
+
+func getFairnessEnv() (*FairnessTracker, error) {
+	history, err := getEnvDuration("FAIRNESS_HISTORY", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	return &FairnessTracker{history: history}, nil
+}
+
+func (lb *LoadBalancer) trackFairness(ctx context.Context) {
+	lb.fairness.sample(lb.Servers())
+	ticker := time.NewTicker(fairnessSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			lb.fairness.sample(lb.Servers())
+		}
+	}
+}
+
+func (f *FairnessTracker) sample(servers []*Server) {
+	snapshot := fairnessSnapshot{at: time.Now(), requests: requestTotals(servers)}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.snapshots = append(f.snapshots, snapshot)
+	for len(f.snapshots) > 1 && snapshot.at.Sub(f.snapshots[1].at) >= f.history {
+		f.snapshots = f.snapshots[1:]
+	}
+}
+
+// Oldest snapshot that still falls within window
+func (f *FairnessTracker) since(window time.Duration) fairnessSnapshot {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	cutoff := time.Now().Add(-window)
+	for _, snapshot := range f.snapshots {
+		if !snapshot.at.Before(cutoff) {
+			return snapshot
+		}
+	}
+	return fairnessSnapshot{at: time.Now(), requests: map[string]uint64{}}
+}
+
+func requestTotals(servers []*Server) map[string]uint64 {
+	totals := make(map[string]uint64, len(servers))
+	for _, server := range servers {
+		totals[server.rawURL] = server.Stats.requests.Load()
+	}
+	return totals
+}
+
+// Requests each backend got over window, and how far the split is from
+// even. Backends in maintenance or disabled get no traffic by design and
+// are left out.
+func (lb *LoadBalancer) fairnessReport(window time.Duration) FairnessReport {
+	start := lb.fairness.since(window)
+	report := FairnessReport{Window: window.String(), Since: start.at, Backends: []FairnessBackend{}}
+
+	for _, server := range lb.Servers() {
+		if server.InMaintenance() || server.IsDisabled() {
+			continue
+		}
+		// Backends (re-)added after the snapshot count from zero
+		requests := server.Stats.requests.Load()
+		if before := start.requests[server.rawURL]; before <= requests {
+			requests -= before
+		}
+		report.Backends = append(report.Backends, FairnessBackend{
+			Backend:  server.URL.Host,
+			Pool:     server.Pool,
+			Requests: requests,
+		})
+		report.Requests += requests
+	}
+	if len(report.Backends) == 0 {
+		return report
+	}
+
+	sort.Slice(report.Backends, func(i, j int) bool {
+		return report.Backends[i].Requests > report.Backends[j].Requests
+	})
+
+	report.Mean = float64(report.Requests) / float64(len(report.Backends))
+	var squares float64
+	for i := range report.Backends {
+		backend := &report.Backends[i]
+		if report.Requests > 0 {
+			backend.Share = 100 * float64(backend.Requests) / float64(report.Requests)
+		}
+		squares += math.Pow(float64(backend.Requests)-report.Mean, 2)
+	}
+	report.StdDev = math.Sqrt(squares / float64(len(report.Backends)))
+	if report.Mean > 0 {
+		report.CoefficientOfVariation = report.StdDev / report.Mean
+	}
+
+	most, least := report.Backends[0].Requests, report.Backends[len(report.Backends)-1].Requests
+	report.Spread = most - least
+	if least > 0 {
+		report.MaxMinRatio = float64(most) / float64(least)
+	}
+	return report
+}
+
+func (lb *LoadBalancer) handleFairness(w http.ResponseWriter, r *http.Request) {
+	window := 5 * time.Minute
+	if value := r.URL.Query().Get("window"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid window, use a duration like 5m", http.StatusBadRequest)
+			return
+		}
+		window = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encodeJSON(w, lb.fairnessReport(window))
+}
@@ -0,0 +1,65 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Canned response served when no backend is available, e.g. a maintenance page
+type FallbackResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// Enabled by FALLBACK_BODY or FALLBACK_BODY_FILE. FALLBACK_HEADERS is a
+// "|"-separated list of "Name: value" pairs.
+func getFallbackResponseEnv() (*FallbackResponse, error) {
+	body := []byte(getEnv("FALLBACK_BODY", ""))
+
+	if path := getEnv("FALLBACK_BODY_FILE", ""); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FALLBACK_BODY_FILE: %v", err)
+		}
+		body = content
+	}
+
+	if len(body) == 0 {
+		return nil, nil
+	}
+
+	status, err := strconv.Atoi(getEnv("FALLBACK_STATUS", "503"))
+	if err != nil || status < 100 || status > 999 {
+		return nil, fmt.Errorf("invalid FALLBACK_STATUS: %q", getEnv("FALLBACK_STATUS", ""))
+	}
+
+	header := http.Header{}
+	if headers := getEnv("FALLBACK_HEADERS", ""); headers != "" {
+		for _, pair := range strings.Split(headers, "|") {
+			name, value, ok := strings.Cut(pair, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid FALLBACK_HEADERS entry: %q", pair)
+			}
+			header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", http.DetectContentType(body))
+	}
+
+	return &FallbackResponse{Status: status, Header: header, Body: body}, nil
+}
+
+func (f *FallbackResponse) Write(w http.ResponseWriter) {
+	for name, values := range f.Header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(f.Body)))
+	w.WriteHeader(f.Status)
+	w.Write(f.Body)
+}
@@ -0,0 +1,102 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Keeps one server per entry of a backends file, read again whenever it
+// changes. The file holds entries in the TARGET_SERVICES syntax, either one
+// per line, with blank lines and # comments skipped, or as a JSON array of
+// strings.
+type FileDiscovery struct {
+	path     string
+	interval time.Duration
+}
+
+func getFileDiscoveryEnv() (*FileDiscovery, error) {
+	path := getEnv("BACKENDS_FILE", "")
+	if path == "" {
+		return nil, nil
+	}
+	interval, err := getEnvDuration("BACKENDS_FILE_INTERVAL", 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDiscovery{path: path, interval: interval}, nil
+}
+
+func (f *FileDiscovery) source() string {
+	return "file:" + f.path
+}
+
+// Checks the file every interval; a file that is missing or doesn't parse
+// keeps the current servers, so it can be rewritten in place
+func (f *FileDiscovery) Watch(ctx context.Context) (<-chan []Backend, error) {
+	updates := make(chan []Backend)
+	go func() {
+		defer close(updates)
+		var last []byte
+		loaded, failing := false, false
+		for ; ; sleepContext(ctx, f.interval) {
+			if ctx.Err() != nil {
+				return
+			}
+			data, err := os.ReadFile(f.path)
+			if err == nil && loaded && bytes.Equal(data, last) {
+				continue
+			}
+
+			var backends []Backend
+			if err == nil {
+				backends, err = parseBackendsFile(data)
+			}
+			if err != nil {
+				// Logged once, not on every check
+				if !failing {
+					errorf("❌ Reading %s failed, keeping current servers: %v", f.path, err)
+				}
+				failing = true
+				continue
+			}
+
+			loaded, failing = true, false
+			last = data
+			if !sendBackends(ctx, updates, backends) {
+				return
+			}
+		}
+	}()
+	return updates, nil
+}
+
+// URLs and options of the file's entries
+func parseBackendsFile(data []byte) ([]Backend, error) {
+	var entries []string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+	}
+
+	backends := []Backend{}
+	for i, entry := range entries {
+		rawURL, options, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		if rawURL == "" {
+			return nil, fmt.Errorf("entry %d has no backend URL", i+1)
+		}
+		backends = append(backends, Backend{URL: rawURL, Options: options})
+	}
+	return backends, nil
+}
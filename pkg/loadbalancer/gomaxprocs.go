@@ -0,0 +1,98 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Matches GOMAXPROCS to the container's CPU quota. Go sizes it by the
+// host's cores, so with a quota of 2 CPUs on a 64-core host 64 threads
+// share 2 CPUs' worth of time, get throttled and stall requests. GOMAXPROCS
+// from the environment or CONFIG_FILE wins over the quota.
+func configureGOMAXPROCSEnv() error {
+	if value := os.Getenv("GOMAXPROCS"); value != "" {
+		procs, err := strconv.Atoi(value)
+		if err != nil || procs < 1 {
+			return fmt.Errorf("invalid GOMAXPROCS %q, must be a positive integer", value)
+		}
+		// The runtime only read it at startup, before CONFIG_FILE applied
+		runtime.GOMAXPROCS(procs)
+		return nil
+	}
+	if auto, err := getEnvBool("AUTO_GOMAXPROCS", true); !auto || err != nil {
+		return err
+	}
+
+	quota, ok := cgroupCPUQuota()
+	if !ok {
+		return nil
+	}
+	procs := max(1, int(quota))
+	if procs >= runtime.GOMAXPROCS(0) {
+		return nil
+	}
+	runtime.GOMAXPROCS(procs)
+	infof("⚙️ GOMAXPROCS set to %d for a CPU quota of %g", procs, quota)
+	return nil
+}
+
+// The CPUs the process's cgroup may use, from cgroup v2's cpu.max or
+// cgroup v1's CFS quota; false without a limit
+func cgroupCPUQuota() (float64, bool) {
+	for _, path := range cgroupV2Paths() {
+		data, err := os.ReadFile(filepath.Join(path, "cpu.max"))
+		if err != nil {
+			continue
+		}
+		quota, period, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+		return cpuQuota(quota, period)
+	}
+
+	for _, dir := range []string{"/sys/fs/cgroup/cpu", "/sys/fs/cgroup/cpu,cpuacct"} {
+		quota, err := os.ReadFile(filepath.Join(dir, "cpu.cfs_quota_us"))
+		if err != nil {
+			continue
+		}
+		period, err := os.ReadFile(filepath.Join(dir, "cpu.cfs_period_us"))
+		if err != nil {
+			continue
+		}
+		return cpuQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+	}
+	return 0, false
+}
+
+// Where cpu.max may be: the process's own cgroup, as listed in
+// /proc/self/cgroup, and the root one that containers usually see
+func cgroupV2Paths() []string {
+	paths := []string{}
+	if file, err := os.Open("/proc/self/cgroup"); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok && path != "/" {
+				paths = append(paths, filepath.Join("/sys/fs/cgroup", path))
+			}
+		}
+	}
+	return append(paths, "/sys/fs/cgroup")
+}
+
+// Quota over period, e.g. 150000 and 100000 for 1.5 CPUs; "max" or -1 is
+// no limit
+func cpuQuota(quota, period string) (float64, bool) {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
@@ -0,0 +1,97 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Set for a child started by a graceful restart, naming the inherited
+// listening socket's file descriptor
+const listenFDEnv = "LB_LISTEN_FD"
+
+// Listens on addr, or takes over the socket handed down by the parent process
+func listen(addr string) (net.Listener, error) {
+	fd := os.Getenv(listenFDEnv)
+	if fd == "" {
+		return net.Listen("tcp", addr)
+	}
+
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	file := os.NewFile(uintptr(n), "inherited-listener")
+	defer file.Close()
+
+	infof("♻️  Inherited listening socket from parent process")
+	return net.FileListener(file)
+}
+
+// Blocks until the process is asked to stop. SIGINT/SIGTERM drain in-flight
+// requests and exit; the restart signal (SIGUSR2) first starts a new copy of
+// the binary on the same socket, so no connection is refused while upgrading.
+// Reports whether a new copy took over.
+func serveUntilShutdown(server *http.Server, listener net.Listener) (bool, error) {
+	// The plain listener is kept for handing over on restart
+	serving, err := limitListenerEnv(listener)
+	if err != nil {
+		return false, err
+	}
+	timeout, err := getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return false, err
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			errs <- server.ServeTLS(serving, "", "")
+		} else {
+			errs <- server.Serve(serving)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append(restartSignals(), os.Interrupt, syscall.SIGTERM)...)
+
+	for {
+		select {
+		case err := <-errs:
+			if errors.Is(err, http.ErrServerClosed) {
+				err = nil
+			}
+			return false, err
+		case sig := <-signals:
+			if sig != os.Interrupt && sig != syscall.SIGTERM {
+				if err := startChild(listener); err != nil {
+					errorf("❌ Graceful restart failed: %v", err)
+					continue
+				}
+				infof("♻️  Started new process, draining this one")
+			}
+
+			shutdown(server, timeout)
+			return sig != os.Interrupt && sig != syscall.SIGTERM, nil
+		}
+	}
+}
+
+// Waits up to SHUTDOWN_TIMEOUT for requests in flight
+func shutdown(server *http.Server, timeout time.Duration) {
+	infof("🛑 Shutting down, waiting up to %v for in-flight requests", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		errorf("❌ Shutdown did not complete: %v", err)
+	}
+}
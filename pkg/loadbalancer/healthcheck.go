@@ -0,0 +1,253 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Probes each backend from its own goroutine, every HEALTH_CHECK_INTERVAL
+// or the backend's healthinterval, so a hung backend only delays its own
+// checks. The interval can change while they run, e.g. on POST
+// /lb-admin/reload, and takes effect right away.
+type HealthChecker struct {
+	clock    Clock
+	interval atomic.Int64
+	// Up to what failing probes double a backend's interval, 0 for no backoff
+	maxBackoff time.Duration
+	mutex      sync.Mutex
+	// Closed and replaced when the interval changes
+	changed chan struct{}
+	// Wakes HealthCheck up to start or stop goroutines
+	serversChanged chan struct{}
+}
+
+func getHealthCheckerEnv(clock Clock) (*HealthChecker, error) {
+	var env envReader
+	interval := env.Duration("HEALTH_CHECK_INTERVAL", 30*time.Second)
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid HEALTH_CHECK_INTERVAL %v, must be positive", interval)
+	}
+	h := newHealthChecker(clock, interval)
+	h.maxBackoff = env.Duration("HEALTH_CHECK_MAX_BACKOFF", 0)
+	return h, env.err
+}
+
+func newHealthChecker(clock Clock, interval time.Duration) *HealthChecker {
+	h := &HealthChecker{clock: clock, changed: make(chan struct{}), serversChanged: make(chan struct{}, 1)}
+	h.interval.Store(int64(interval))
+	return h
+}
+
+func (h *HealthChecker) Interval() time.Duration {
+	return time.Duration(h.interval.Load())
+}
+
+func (h *HealthChecker) SetInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid HEALTH_CHECK_INTERVAL %v, must be positive", interval)
+	}
+	if time.Duration(h.interval.Swap(int64(interval))) == interval {
+		return nil
+	}
+	infof("🩺 Health checks now run every %v", interval)
+
+	h.mutex.Lock()
+	close(h.changed)
+	h.changed = make(chan struct{})
+	h.mutex.Unlock()
+	return nil
+}
+
+func (h *HealthChecker) intervalChanged() <-chan struct{} {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.changed
+}
+
+// Called when servers are added or removed
+func (h *HealthChecker) notifyServersChanged() {
+	// A pending wake-up already sees the change
+	select {
+	case h.serversChanged <- struct{}{}:
+	default:
+	}
+}
+
+// How long until the next probe of a server checked every base, 0 for
+// HEALTH_CHECK_INTERVAL, after failures failed ones in a row
+func (h *HealthChecker) intervalFor(base time.Duration, failures int) time.Duration {
+	if base == 0 {
+		base = h.Interval()
+	}
+	interval := base
+	for i := 0; i < failures && interval < h.maxBackoff; i++ {
+		interval *= 2
+	}
+	return max(base, min(interval, h.maxBackoff))
+}
+
+// Keeps one probing goroutine per backend, starting them for added
+// servers and stopping those of removed ones, until ctx is done
+func (lb *LoadBalancer) HealthCheck(ctx context.Context) {
+	checkers := map[*Server]context.CancelFunc{}
+	for {
+		current := map[*Server]bool{}
+		for _, server := range lb.Servers() {
+			current[server] = true
+			if checkers[server] == nil {
+				serverCtx, cancel := context.WithCancel(ctx)
+				checkers[server] = cancel
+				go lb.checkServerEvery(serverCtx, server)
+			}
+		}
+		for server, cancel := range checkers {
+			if !current[server] {
+				cancel()
+				delete(checkers, server)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			debugf("Health checks stopped")
+			return
+		case <-lb.health.serversChanged:
+		}
+	}
+}
+
+// Probes the server right away and then every interval, backing off while
+// it keeps failing
+func (lb *LoadBalancer) checkServerEvery(ctx context.Context, server *Server) {
+	h := lb.health
+	changed := h.intervalChanged()
+	failures := 0
+	probe := func() {
+		debugf("Performing health check (/health) of %s", server.rawURL)
+		if lb.checkServer(server).Healthy {
+			failures = 0
+		} else {
+			failures++
+		}
+	}
+
+	defer lb.closeHealthProbe(server)
+	probe()
+	ticker := h.clock.NewTicker(h.intervalFor(lb.healthInterval(server), failures))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+			changed = h.intervalChanged()
+			ticker.Reset(h.intervalFor(lb.healthInterval(server), failures))
+		case <-ticker.C():
+			probe()
+			ticker.Reset(h.intervalFor(lb.healthInterval(server), failures))
+		}
+	}
+}
+
+// The server's healthinterval, else its pool's, 0 for HEALTH_CHECK_INTERVAL
+func (lb *LoadBalancer) healthInterval(server *Server) time.Duration {
+	if server.HealthInterval > 0 {
+		return server.HealthInterval
+	}
+	if pool := lb.pool(server.Pool); pool != nil {
+		return pool.HealthInterval
+	}
+	return 0
+}
+
+// The probe the server is checked with, by its healthprobe option, else its
+// pool's, else HEALTH_CHECK_PROBE; nil for GET /health. Each server keeps
+// its own instance of the probe.
+func (lb *LoadBalancer) healthProbe(server *Server) HealthProbe {
+	name := server.HealthProbe
+	if pool := lb.pool(server.Pool); name == "" && pool != nil {
+		name = pool.HealthProbe
+	}
+	if name == "" {
+		name = getEnv("HEALTH_CHECK_PROBE", httpHealthProbe)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.probeName != name {
+		closeProbe(server.probe)
+		// Names are validated when they are configured
+		server.probe, _ = newHealthProbe(name)
+		server.probeName = name
+	}
+	return server.probe
+}
+
+// Path the http probe requests unless HEALTH_CHECK_PATH or a healthpath
+// option says otherwise
+const defaultHealthPath = "/health"
+
+func checkHealthPath(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("%q must start with /", path)
+	}
+	return nil
+}
+
+// The path the server's http probe requests, by its healthpath option, else
+// its pool's, else HEALTH_CHECK_PATH
+func (lb *LoadBalancer) healthPath(server *Server) string {
+	if server.HealthPath != "" {
+		return server.HealthPath
+	}
+	if pool := lb.pool(server.Pool); pool != nil && pool.HealthPath != "" {
+		return pool.HealthPath
+	}
+	return getEnv("HEALTH_CHECK_PATH", defaultHealthPath)
+}
+
+// Each backend is probed through a client of its own, which keeps the
+// connection of one probe for the next unless keepAlives is false, e.g. for
+// backends whose checks have to cover dialing and the TLS handshake too
+func newHealthCheckClient(keepAlives bool) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = !keepAlives
+	transport.MaxIdleConnsPerHost = 1
+	// Probes are an interval apart, which may be longer than any timeout
+	// fit for proxied requests; the backend closing the connection first is
+	// handled by redialing
+	transport.IdleConnTimeout = 0
+	if upstreamTLS != nil {
+		transport.DialTLSContext = upstreamTLS.DialTLSContext
+	}
+	return &http.Client{Transport: transport, Timeout: 5 * time.Second}
+}
+
+// How a probe got its connection
+type probeConn struct {
+	got    bool
+	reused bool
+	// Time to dial and handshake, 0 for reused connections
+	connect time.Duration
+}
+
+func (c *probeConn) request(target string) *http.Request {
+	var start time.Time
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) { start = time.Now() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.got, c.reused = true, info.Reused
+			if !info.Reused {
+				c.connect = time.Since(start)
+			}
+		},
+	}
+	req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, target, nil)
+	return req
+}
@@ -0,0 +1,171 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Health probe whose answers tests script: a server passes unless its ID
+// was made to fail. It counts the probes and closes of each server's.
+const scriptedHealthProbe = "scripted"
+
+var scripted = struct {
+	mutex   sync.Mutex
+	failing map[string]bool
+	probes  map[string]int
+	closed  map[string]int
+}{failing: map[string]bool{}, probes: map[string]int{}, closed: map[string]int{}}
+
+func init() {
+	RegisterHealthProbe(scriptedHealthProbe, func() HealthProbe { return &scriptedProbe{} })
+}
+
+// Each server has a probe of its own, which learns its ID from the first
+// probe
+type scriptedProbe struct{ server string }
+
+func (p *scriptedProbe) Probe(ctx context.Context, server *Server) error {
+	scripted.mutex.Lock()
+	defer scripted.mutex.Unlock()
+	p.server = server.ID()
+	scripted.probes[server.ID()]++
+	if scripted.failing[server.ID()] {
+		return errors.New("scripted failure")
+	}
+	return nil
+}
+
+func (p *scriptedProbe) Close() error {
+	scripted.mutex.Lock()
+	defer scripted.mutex.Unlock()
+	scripted.closed[p.server]++
+	return nil
+}
+
+// Forgets what earlier runs of a test recorded for the server
+func resetScript(id string) {
+	scripted.mutex.Lock()
+	defer scripted.mutex.Unlock()
+	delete(scripted.failing, id)
+	delete(scripted.probes, id)
+	delete(scripted.closed, id)
+}
+
+func setFailing(id string, failing bool) {
+	scripted.mutex.Lock()
+	defer scripted.mutex.Unlock()
+	scripted.failing[id] = failing
+}
+
+func probeCount(id string) int {
+	scripted.mutex.Lock()
+	defer scripted.mutex.Unlock()
+	return scripted.probes[id]
+}
+
+func closeCount(id string) int {
+	scripted.mutex.Lock()
+	defer scripted.mutex.Unlock()
+	return scripted.closed[id]
+}
+
+func TestHealthCheckEjectsAndReadmits(t *testing.T) {
+	t.Setenv("TARGET_SERVICES", "http://eject.test:8080")
+	t.Setenv("HEALTH_CHECK_PROBE", scriptedHealthProbe)
+	t.Setenv("HEALTH_CHECK_INTERVAL", "10s")
+	clock := newFakeClock()
+	lb, err := New(WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := lb.pool(defaultPoolName)
+	server := pool.Servers()[0]
+	resetScript(server.ID())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.HealthCheck(ctx)
+	// Probed right away, then on the ticker
+	clock.waitForWaiters(t, 1)
+	if probeCount(server.ID()) != 1 || !server.IsHealthy() {
+		t.Fatalf("after the first probe: %d probes, healthy %v", probeCount(server.ID()), server.IsHealthy())
+	}
+
+	setFailing(server.ID(), true)
+	clock.Advance(10 * time.Second)
+	eventually(t, func() bool { return !server.IsHealthy() })
+	if _, err := pool.Pick(ctx, nil); !errors.Is(err, ErrNoHealthyBackends) {
+		t.Fatalf("picking from a pool whose only server is down: %v, want ErrNoHealthyBackends", err)
+	}
+
+	setFailing(server.ID(), false)
+	clock.Advance(10 * time.Second)
+	eventually(t, server.IsHealthy)
+	picked, err := pool.Pick(ctx, nil)
+	if err != nil || picked != server {
+		t.Fatalf("picking after the server passed again: %v, %v", picked, err)
+	}
+	lb.releaseServer(picked)
+
+	if probes := probeCount(server.ID()); probes != 3 {
+		t.Errorf("%d probes after two intervals, want 3", probes)
+	}
+}
+
+func TestHealthProbeResultsAndClose(t *testing.T) {
+	t.Setenv("TARGET_SERVICES", "http://probe-a.test:8080,http://probe-b.test:8080")
+	t.Setenv("HEALTH_CHECK_PROBE", scriptedHealthProbe)
+	t.Setenv("HEALTH_CHECK_INTERVAL", "10s")
+	clock := newFakeClock()
+	lb, err := New(WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := lb.Servers()
+	a, b := servers[0], servers[1]
+	resetScript(a.ID())
+	resetScript(b.ID())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.HealthCheck(ctx)
+	clock.waitForWaiters(t, 2)
+
+	setFailing(b.ID(), true)
+	for _, test := range []struct {
+		server  *Server
+		healthy bool
+		err     string
+	}{
+		{a, true, ""},
+		{b, false, "scripted failure"},
+	} {
+		result := lb.checkServer(test.server)
+		if result.Server != test.server.ID() || result.Healthy != test.healthy || result.Error != test.err {
+			t.Errorf("checking %s: %+v, want healthy %v and error %q", test.server.ID(), result, test.healthy, test.err)
+		}
+		if test.server.IsHealthy() != test.healthy {
+			t.Errorf("%s healthy %v after its check, want %v", test.server.ID(), test.server.IsHealthy(), test.healthy)
+		}
+	}
+
+	// The removed server's probe is closed once its checks stop; the other
+	// one keeps being checked with its own
+	lb.RemoveServer(a)
+	eventually(t, func() bool { return closeCount(a.ID()) == 1 })
+	if closed := closeCount(b.ID()); closed != 0 {
+		t.Errorf("probe of %s closed %d times while it is still checked", b.ID(), closed)
+	}
+	probes := probeCount(b.ID())
+	clock.Advance(10 * time.Second)
+	eventually(t, func() bool { return probeCount(b.ID()) > probes })
+
+	cancel()
+	eventually(t, func() bool { return closeCount(b.ID()) == 1 })
+	if closed := closeCount(a.ID()); closed != 1 {
+		t.Errorf("probe of %s closed %d times, want once", a.ID(), closed)
+	}
+}
@@ -0,0 +1,99 @@
+package loadbalancer
+
+import (
+	"time"
+)
+
+// Health forced through the admin API regardless of what the probes find.
+// With a TTL it reverts to the probed health on its own, so an override
+// can't be forgotten.
+type HealthOverride struct {
+	Healthy bool       `json:"healthy"`
+	Until   *time.Time `json:"until,omitempty"`
+	timer   *time.Timer
+}
+
+func (s *Server) HealthOverride() *HealthOverride {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.healthOverride
+}
+
+// The override without its timer, for status reports
+func (o *HealthOverride) copy() *HealthOverride {
+	if o == nil {
+		return nil
+	}
+	return &HealthOverride{Healthy: o.Healthy, Until: o.Until}
+}
+
+// Replaces the override, nil going back to the probed health, and returns
+// the effective health before and after
+func (s *Server) setHealthOverride(override *HealthOverride) (bool, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.healthOverride != nil && s.healthOverride.timer != nil {
+		s.healthOverride.timer.Stop()
+	}
+	s.healthOverride = override
+
+	healthy := s.probedHealthy
+	if override != nil {
+		healthy = override.Healthy
+	}
+	if s.setFlag(serverHealthy, healthy) {
+		s.Availability.record(healthy)
+		return !healthy, healthy
+	}
+	return healthy, healthy
+}
+
+// Forces the server up or down until the override is cleared, or for ttl
+// if it is positive
+func (lb *LoadBalancer) overrideHealth(server *Server, healthy bool, ttl time.Duration) {
+	override := &HealthOverride{Healthy: healthy}
+	if ttl > 0 {
+		until := time.Now().Add(ttl)
+		override.Until = &until
+		override.timer = time.AfterFunc(ttl, func() {
+			// Unless it was replaced or cleared since
+			if server.HealthOverride() == override {
+				lb.clearHealthOverride(server, "override expired")
+			}
+		})
+	}
+
+	was, now := server.setHealthOverride(override)
+	expiry := "until cleared"
+	if ttl > 0 {
+		expiry = "for " + ttl.String()
+	}
+	infof("🔧 Forced server %s %s %s via admin API", server.rawURL, upOrDown(healthy), expiry)
+	lb.publishHealthChange(server, was, now, "admin override")
+}
+
+func (lb *LoadBalancer) clearHealthOverride(server *Server, reason string) {
+	if server.HealthOverride() == nil {
+		return
+	}
+	was, now := server.setHealthOverride(nil)
+	infof("🔧 Server %s back to probed health (%s): %s", server.rawURL, reason, upOrDown(now))
+	lb.publishHealthChange(server, was, now, reason)
+}
+
+func (lb *LoadBalancer) publishHealthChange(server *Server, was, now bool, reason string) {
+	switch {
+	case !was && now:
+		lb.healthChanged(server, true, reason)
+	case was && !now:
+		lb.healthChanged(server, false, reason)
+	}
+}
+
+func upOrDown(healthy bool) string {
+	if healthy {
+		return "up"
+	}
+	return "down"
+}
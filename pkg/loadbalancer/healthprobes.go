@@ -0,0 +1,161 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Built-in probes besides GET /health, selected by name like registered ones
+const (
+	tcpHealthProbe    = "tcp"
+	grpcHealthProbe   = "grpc"
+	scriptHealthProbe = "script"
+)
+
+// Whether the probe called name can be used: it is registered, and the
+// settings a built-in one needs are there
+func checkHealthProbe(name string) error {
+	if _, err := registered(plugins.healthProbes, "health probe", name); err != nil {
+		return err
+	}
+	if name == scriptHealthProbe && getEnv("HEALTH_CHECK_SCRIPT", "") == "" {
+		return errors.New("the script probe needs HEALTH_CHECK_SCRIPT")
+	}
+	return nil
+}
+
+// Closes the server's probe once it is no longer checked with it
+func (lb *LoadBalancer) closeHealthProbe(server *Server) {
+	server.mutex.Lock()
+	probe := server.probe
+	server.probe, server.probeName = nil, ""
+	server.mutex.Unlock()
+	closeProbe(probe)
+}
+
+func closeProbe(probe HealthProbe) {
+	if closer, ok := probe.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			warnf("⚠️  Closing health probe failed: %v", err)
+		}
+	}
+}
+
+// Healthy when the backend accepts a TCP connection
+type tcpProbe struct{}
+
+func (tcpProbe) Probe(ctx context.Context, server *Server) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", dialAddress(server.URL))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Healthy when the backend's grpc.health.v1.Health service reports
+// HEALTH_CHECK_GRPC_SERVICE as serving. The connection is kept between
+// probes.
+type grpcProbe struct {
+	service string
+	mutex   sync.Mutex
+	conn    *grpc.ClientConn
+}
+
+func newGRPCProbe() HealthProbe {
+	return &grpcProbe{service: getEnv("HEALTH_CHECK_GRPC_SERVICE", "")}
+}
+
+func (p *grpcProbe) Probe(ctx context.Context, server *Server) error {
+	conn, err := p.client(server)
+	if err != nil {
+		return err
+	}
+	res, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: p.service})
+	if err != nil {
+		return err
+	}
+	if res.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return fmt.Errorf("gRPC health status %s", res.Status)
+	}
+	return nil
+}
+
+// https backends are dialed with TLS, using UPSTREAM_TLS's certificates
+// when set
+func (p *grpcProbe) client(server *Server) (*grpc.ClientConn, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.conn != nil {
+		return p.conn, nil
+	}
+
+	creds := insecure.NewCredentials()
+	if server.URL.Scheme == "https" {
+		config := &tls.Config{}
+		if upstreamTLS != nil {
+			config = upstreamTLS.current.Load().Clone()
+		}
+		creds = credentials.NewTLS(config)
+	}
+	conn, err := grpc.NewClient(dialAddress(server.URL), grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	p.conn = conn
+	return conn, nil
+}
+
+func (p *grpcProbe) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn = nil
+	return err
+}
+
+// Healthy when HEALTH_CHECK_SCRIPT, run with the backend's URL as its last
+// argument, exits with 0; it is killed once the probe times out
+type scriptProbe struct {
+	command []string
+}
+
+func newScriptProbe() HealthProbe {
+	return scriptProbe{command: strings.Fields(getEnv("HEALTH_CHECK_SCRIPT", ""))}
+}
+
+func (p scriptProbe) Probe(ctx context.Context, server *Server) error {
+	if len(p.command) == 0 {
+		return errors.New("HEALTH_CHECK_SCRIPT is not set")
+	}
+	args := append(p.command[1:len(p.command):len(p.command)], server.rawURL)
+	output, err := exec.CommandContext(ctx, p.command[0], args...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	// The last line of output is usually the script's reason
+	lines := bytes.Split(bytes.TrimSpace(output), []byte("\n"))
+	if reason := strings.TrimSpace(string(lines[len(lines)-1])); reason != "" {
+		if len(reason) > 200 {
+			reason = reason[:200]
+		}
+		return fmt.Errorf("%v: %s", err, reason)
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package loadbalancer
+
+import "net/http"
+
+// Callbacks attached to what happens in the load balancer, e.g. for
+// alerting or bookkeeping. They run on the goroutine it happens on, a
+// request's or a health check's, so a slow one holds that up.
+type hooks struct {
+	requestRouted []func(r *http.Request, route *Route, server *Server)
+	backendDown   []func(server *Server, reason string)
+	backendUp     []func(server *Server, reason string)
+	retry         []func(r *http.Request, attempt int, failed *Server, err error)
+	configReload  []func(result ReloadResult)
+}
+
+// Calls hook whenever a request is sent to a backend, retries included,
+// with the route it matched. Hooks have to be attached before Start and
+// Handler are called.
+func (lb *LoadBalancer) OnRequestRouted(hook func(r *http.Request, route *Route, server *Server)) {
+	lb.hooks.requestRouted = append(lb.hooks.requestRouted, hook)
+}
+
+// Calls hook when a backend goes down: a health check or a request to it
+// failed, or the admin API forced it down. reason is the error or status.
+func (lb *LoadBalancer) OnBackendDown(hook func(server *Server, reason string)) {
+	lb.hooks.backendDown = append(lb.hooks.backendDown, hook)
+}
+
+// Calls hook when a backend comes back up
+func (lb *LoadBalancer) OnBackendUp(hook func(server *Server, reason string)) {
+	lb.hooks.backendUp = append(lb.hooks.backendUp, hook)
+}
+
+// Calls hook before a request that failed is retried, with the number of
+// the attempt about to be made, the backend that failed it and why
+func (lb *LoadBalancer) OnRetry(hook func(r *http.Request, attempt int, failed *Server, err error)) {
+	lb.hooks.retry = append(lb.hooks.retry, hook)
+}
+
+// Calls hook after CONFIG_FILE is reloaded, with what changed or, if
+// nothing was applied, the errors
+func (lb *LoadBalancer) OnConfigReload(hook func(result ReloadResult)) {
+	lb.hooks.configReload = append(lb.hooks.configReload, hook)
+}
+
+// Publishes that server went up or down and calls the hooks
+func (lb *LoadBalancer) healthChanged(server *Server, healthy bool, reason string) {
+	if healthy {
+		lb.events.Publish(serverEvent(EventServerUp, server, reason))
+		for _, hook := range lb.hooks.backendUp {
+			hook(server, reason)
+		}
+		return
+	}
+	lb.events.Publish(serverEvent(EventServerDown, server, reason))
+	for _, hook := range lb.hooks.backendDown {
+		hook(server, reason)
+	}
+}
+
+func (lb *LoadBalancer) requestRouted(r *http.Request, route *Route, server *Server) {
+	for _, hook := range lb.hooks.requestRouted {
+		hook(r, route, server)
+	}
+}
+
+func (lb *LoadBalancer) retrying(r *http.Request, attempt int, failed *Server, err error) {
+	for _, hook := range lb.hooks.retry {
+		hook(r, attempt, failed, err)
+	}
+}
+
+func (lb *LoadBalancer) configReloaded(result ReloadResult) {
+	for _, hook := range lb.hooks.configReload {
+		hook(result)
+	}
+}
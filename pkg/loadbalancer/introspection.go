@@ -0,0 +1,232 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tokens whose introspection result is cached at most; expired ones are
+// dropped first
+const introspectionMaxCached = 10000
+
+// Validates the bearer tokens of routes with the introspect option by
+// asking the authorization server at INTROSPECTION_URL (RFC 7662), for
+// opaque tokens the load balancer can't verify itself. Answers, inactive
+// tokens included, are cached for INTROSPECTION_CACHE_TTL but never past
+// the token's expiry, so most requests don't wait for the server.
+type TokenIntrospector struct {
+	url          string
+	clientID     string
+	clientSecret string
+	cacheTTL     time.Duration
+	// Fields of the answer copied to request headers, e.g. sub to
+	// X-Auth-Subject
+	claimHeaders []claimHeader
+	client       *http.Client
+
+	mutex sync.Mutex
+	// By the token's SHA-256, so tokens aren't kept in memory
+	cache map[[sha256.Size]byte]introspection
+}
+
+type introspection struct {
+	// nil for a token that isn't active
+	claims  map[string]any
+	expires time.Time
+}
+
+func getTokenIntrospectorEnv() (*TokenIntrospector, error) {
+	introspectionURL := getEnv("INTROSPECTION_URL", "")
+	if introspectionURL == "" {
+		return nil, nil
+	}
+
+	cacheTTL, err := getEnvDuration("INTROSPECTION_CACHE_TTL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	claimHeaders, err := getClaimHeadersEnv("INTROSPECTION_HEADERS", "sub=X-Auth-Subject,scope=X-Auth-Scope")
+	if err != nil {
+		return nil, err
+	}
+	return &TokenIntrospector{
+		url:          introspectionURL,
+		clientID:     getEnv("INTROSPECTION_CLIENT_ID", ""),
+		clientSecret: getEnv("INTROSPECTION_CLIENT_SECRET", ""),
+		cacheTTL:     cacheTTL,
+		claimHeaders: claimHeaders,
+		client:       &http.Client{Timeout: 5 * time.Second},
+		cache:        map[[sha256.Size]byte]introspection{},
+	}, nil
+}
+
+// Answers 401 and returns false unless the request carries an active token
+// for a route with the introspect option, or 403 when the token lacks one
+// of the route's scopes. Otherwise the configured fields are set as
+// headers for the backend.
+func (lb *LoadBalancer) introspectToken(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	if lb.introspection == nil || !route.Introspect {
+		return true
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="lb"`)
+		http.Error(w, "Unauthorized: bearer token required", http.StatusUnauthorized)
+		return false
+	}
+
+	claims, err := lb.introspection.Introspect(r.Context(), token)
+	if err != nil {
+		errorf("❌ Introspecting a token at %s failed: %v", lb.introspection.url, err)
+		http.Error(w, "Service Unavailable: token introspection failed", http.StatusServiceUnavailable)
+		return false
+	}
+	if claims == nil {
+		debugf("🔑 Rejected inactive token for %s %s", r.Method, r.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="lb", error="invalid_token", error_description="token is not active"`)
+		http.Error(w, "Unauthorized: token is not active", http.StatusUnauthorized)
+		return false
+	}
+	if !checkScopes(w, r, route, claims["scope"]) {
+		return false
+	}
+
+	for _, ch := range lb.introspection.claimHeaders {
+		if value, ok := claimString(claims[ch.claim]); ok {
+			r.Header.Set(ch.header, value)
+		}
+	}
+	return true
+}
+
+// The fields of an active token's introspection answer, or nil when the
+// token isn't active. An error means the server couldn't be asked.
+func (t *TokenIntrospector) Introspect(ctx context.Context, token string) (map[string]any, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	t.mutex.Lock()
+	cached, ok := t.cache[key]
+	t.mutex.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.claims, nil
+	}
+
+	claims, err := t.request(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	expires := now.Add(t.cacheTTL)
+	if exp, ok := claims["exp"].(json.Number); ok {
+		if expiry, err := exp.Int64(); err == nil && time.Unix(expiry, 0).Before(expires) {
+			expires = time.Unix(expiry, 0)
+		}
+	}
+	if active, _ := claims["active"].(bool); !active || !now.Before(expires) {
+		claims = nil
+	}
+
+	t.mutex.Lock()
+	if len(t.cache) >= introspectionMaxCached {
+		t.prune(now)
+	}
+	t.cache[key] = introspection{claims: claims, expires: expires}
+	t.mutex.Unlock()
+	return claims, nil
+}
+
+func (t *TokenIntrospector) request(ctx context.Context, token string) (map[string]any, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if t.clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(t.clientID), url.QueryEscape(t.clientSecret))
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("answered %s", resp.Status)
+	}
+
+	var claims map[string]any
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, err
+	}
+	if _, ok := claims["active"].(bool); !ok {
+		return nil, errors.New("answer has no active field")
+	}
+	return claims, nil
+}
+
+// Drops expired answers, or, if none are, half of the cache
+func (t *TokenIntrospector) prune(now time.Time) {
+	for key, cached := range t.cache {
+		if !now.Before(cached.expires) {
+			delete(t.cache, key)
+		}
+	}
+	for key := range t.cache {
+		if len(t.cache) < introspectionMaxCached/2 {
+			break
+		}
+		delete(t.cache, key)
+	}
+}
+
+// Answers 403 and returns false when the token's scopes lack one the
+// route requires
+func checkScopes(w http.ResponseWriter, r *http.Request, route *Route, scope any) bool {
+	missing := missingScopes(scope, route.Scopes)
+	if len(missing) == 0 {
+		return true
+	}
+	debugf("🔑 Rejected token without scope %s for %s %s", strings.Join(missing, " "), r.Method, r.URL.Path)
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="lb", error="insufficient_scope", scope=%q`, strings.Join(route.Scopes, " ")))
+	http.Error(w, "Forbidden: insufficient scope", http.StatusForbidden)
+	return false
+}
+
+// The required scopes missing from a scope claim, a space-separated string
+// or an array of them
+func missingScopes(scope any, required []string) []string {
+	granted := map[string]bool{}
+	switch value := scope.(type) {
+	case string:
+		for _, s := range strings.Fields(value) {
+			granted[s] = true
+		}
+	case []any:
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				granted[s] = true
+			}
+		}
+	}
+
+	missing := []string{}
+	for _, s := range required {
+		if !granted[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
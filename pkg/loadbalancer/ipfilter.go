@@ -0,0 +1,62 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Which clients may be proxied, by the address TRUSTED_PROXIES resolves
+// for them. IP_DENY wins over IP_ALLOW, so a range can be allowed with a
+// few addresses in it blocked.
+type IPFilter struct {
+	// Empty allows every client not denied
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func getIPFilterEnv() (*IPFilter, error) {
+	allow, err := getNetworksEnv("IP_ALLOW")
+	if err != nil {
+		return nil, err
+	}
+	deny, err := getNetworksEnv("IP_DENY")
+	if err != nil {
+		return nil, err
+	}
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	return &IPFilter{allow: allow, deny: deny}, nil
+}
+
+// The list that blocks the client, "deny" or "allow", or "" when it may
+// pass. A client whose address doesn't parse only passes without an allow
+// list.
+func (f *IPFilter) Check(client string) string {
+	ip := net.ParseIP(client)
+	switch {
+	case ip != nil && networksContain(f.deny, ip):
+		return "deny"
+	case len(f.allow) > 0 && (ip == nil || !networksContain(f.allow, ip)):
+		return "allow"
+	}
+	return ""
+}
+
+// Answers 403 to a blocked client
+func (lb *LoadBalancer) refuseBlockedClient(w http.ResponseWriter, r *http.Request) bool {
+	if lb.ipFilter == nil {
+		return false
+	}
+	client := lb.trustedProxies.ClientIP(r)
+	list := lb.ipFilter.Check(client)
+	if list == "" {
+		return false
+	}
+
+	debugf("🚫 Blocked %s by IP_%s: %s %s", client, strings.ToUpper(list), r.Method, r.URL.Path)
+	lb.metrics.observeBlockedClient(list)
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return true
+}
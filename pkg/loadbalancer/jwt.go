@@ -0,0 +1,442 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Least time between two JWKS fetches for a key ID that isn't known, so
+// tokens with made-up key IDs can't make the load balancer hammer the
+// identity provider
+const jwksMinRefetch = 10 * time.Second
+
+// Verifies the bearer tokens of routes with the jwt option against the
+// keys published at JWT_JWKS_URL, so requests without a valid token never
+// reach a backend. RS*, PS* and ES* signatures are supported; "none" and
+// shared-secret HS* tokens are refused.
+type JWTVerifier struct {
+	jwksURL  string
+	issuer   string
+	audience string
+	leeway   time.Duration
+	refresh  time.Duration
+	// Claims copied to request headers, e.g. sub to X-User-ID
+	claimHeaders []claimHeader
+	client       *http.Client
+	clock        Clock
+
+	mutex   sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	// One JWKS fetch at a time, shared by every request waiting for it
+	fetches singleflight.Group
+}
+
+type claimHeader struct {
+	claim  string
+	header string
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// A key of a JSON Web Key Set
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func getJWTVerifierEnv(clock Clock) (*JWTVerifier, error) {
+	jwksURL := getEnv("JWT_JWKS_URL", "")
+	if jwksURL == "" {
+		return nil, nil
+	}
+
+	var env envReader
+	v := &JWTVerifier{
+		jwksURL:  jwksURL,
+		issuer:   getEnv("JWT_ISSUER", ""),
+		audience: getEnv("JWT_AUDIENCE", ""),
+		leeway:   env.Duration("JWT_LEEWAY", 30*time.Second),
+		refresh:  env.Duration("JWT_JWKS_REFRESH", time.Hour),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		clock:    clock,
+	}
+	if env.err != nil {
+		return nil, env.err
+	}
+	var err error
+	v.claimHeaders, err = getClaimHeadersEnv("JWT_CLAIM_HEADERS", "")
+	return v, err
+}
+
+// A comma-separated list of claim=Header pairs, e.g. "sub=X-User-ID"
+func getClaimHeadersEnv(key, defaultValue string) ([]claimHeader, error) {
+	claimHeaders := []claimHeader{}
+	for _, entry := range strings.Split(getEnv(key, defaultValue), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		claim, header, ok := strings.Cut(entry, "=")
+		claim, header = strings.TrimSpace(claim), strings.TrimSpace(header)
+		if !ok || claim == "" || header == "" {
+			return nil, fmt.Errorf("invalid %s entry %q, want claim=Header", key, entry)
+		}
+		claimHeaders = append(claimHeaders, claimHeader{claim, http.CanonicalHeaderKey(header)})
+	}
+	return claimHeaders, nil
+}
+
+// Drops the headers JWT_CLAIM_HEADERS, INTROSPECTION_HEADERS and API keys
+// set from every request, so clients can't send them themselves
+func (lb *LoadBalancer) stripIdentityHeaders(r *http.Request) {
+	r.Header.Del(apiKeyNameHeader)
+	if lb.jwt != nil {
+		for _, ch := range lb.jwt.claimHeaders {
+			r.Header.Del(ch.header)
+		}
+	}
+	if lb.introspection != nil {
+		for _, ch := range lb.introspection.claimHeaders {
+			r.Header.Del(ch.header)
+		}
+	}
+}
+
+// Answers 401 and returns false unless the request carries a valid token
+// for the route, or 403 when the token lacks one of the route's scopes.
+// Otherwise the configured claims are set as headers for the backend.
+func (lb *LoadBalancer) authenticateJWT(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	if lb.jwt == nil || !route.JWT {
+		return true
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="lb"`)
+		http.Error(w, "Unauthorized: bearer token required", http.StatusUnauthorized)
+		return false
+	}
+
+	audience := route.JWTAudience
+	if audience == "" {
+		audience = lb.jwt.audience
+	}
+	claims, err := lb.jwt.Verify(r.Context(), token, audience)
+	if err != nil {
+		debugf("🔑 Rejected token for %s %s: %v", r.Method, r.URL.Path, err)
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="lb", error="invalid_token", error_description=%q`, err.Error()))
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	// Identity providers use either, Microsoft's an array in scp
+	scope := claims["scope"]
+	if scope == nil {
+		scope = claims["scp"]
+	}
+	if !checkScopes(w, r, route, scope) {
+		return false
+	}
+
+	for _, ch := range lb.jwt.claimHeaders {
+		if value, ok := claimString(claims[ch.claim]); ok {
+			r.Header.Set(ch.header, value)
+		}
+	}
+	return true
+}
+
+// The token's claims, if its signature, expiry, issuer and audience check
+// out; an empty audience isn't checked
+func (v *JWTVerifier) Verify(ctx context.Context, token, audience string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	hash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	keys, err := v.keysFor(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := hash.New()
+	digest.Write([]byte(parts[0] + "." + parts[1]))
+	verified := false
+	for _, key := range keys {
+		if verifySignature(header.Alg, key, hash, digest.Sum(nil), signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	now := v.clock.Now()
+	exp, ok := claims["exp"].(json.Number)
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if expiry, err := exp.Float64(); err != nil || now.After(time.Unix(int64(expiry), 0).Add(v.leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(json.Number); ok {
+		if notBefore, err := nbf.Float64(); err != nil || now.Add(v.leeway).Before(time.Unix(int64(notBefore), 0)) {
+			return nil, errors.New("token not valid yet")
+		}
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return nil, errors.New("wrong issuer")
+	}
+	if audience != "" && !hasAudience(claims["aud"], audience) {
+		return nil, errors.New("wrong audience")
+	}
+	return claims, nil
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+func verifySignature(alg string, key crypto.PublicKey, hash crypto.Hash, digest, signature []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+		case "PS":
+			return rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		// r and s, each as long as the curve's size
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// The key with the ID, or every key when the token names none. The keys
+// are fetched again when they are older than JWT_JWKS_REFRESH, or don't
+// have the ID, e.g. after the identity provider rotated them.
+func (v *JWTVerifier) keysFor(ctx context.Context, kid string) ([]crypto.PublicKey, error) {
+	keys, fetched := v.currentKeys()
+	_, known := keys[kid]
+	age := v.clock.Now().Sub(fetched)
+	stale := age > v.refresh
+	if stale || (kid != "" && !known && age > jwksMinRefetch) {
+		if keys != nil && (kid == "" || known) {
+			// The old keys still verify the token while new ones are fetched
+			go v.refreshKeys(ctx)
+		} else {
+			v.refreshKeys(ctx)
+			if keys, _ = v.currentKeys(); keys == nil {
+				return nil, errors.New("signing keys unavailable")
+			}
+		}
+	}
+
+	if kid != "" {
+		if key, ok := keys[kid]; ok {
+			return []crypto.PublicKey{key}, nil
+		}
+		return nil, errors.New("unknown signing key")
+	}
+	all := []crypto.PublicKey{}
+	for _, key := range keys {
+		all = append(all, key)
+	}
+	return all, nil
+}
+
+func (v *JWTVerifier) currentKeys() (map[string]crypto.PublicKey, time.Time) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.keys, v.fetched
+}
+
+// Fetches the keys, or waits for the fetch already running. The lock is
+// only held to swap the keys in, so requests aren't held up by the
+// identity provider.
+func (v *JWTVerifier) refreshKeys(ctx context.Context) {
+	v.fetches.Do(v.jwksURL, func() (any, error) {
+		keys, err := v.fetch(ctx)
+		if err != nil {
+			errorf("❌ Fetching JWKS from %s failed: %v", v.jwksURL, err)
+		}
+
+		v.mutex.Lock()
+		defer v.mutex.Unlock()
+		// Counted as an attempt either way, so a failing provider isn't
+		// asked on every request; a failed fetch keeps the old keys
+		v.fetched = v.clock.Now()
+		if err == nil {
+			v.keys = keys
+		}
+		return nil, nil
+	})
+}
+
+// The signing keys at the JWKS URL
+func (v *JWTVerifier) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", v.jwksURL, resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			warnf("⚠️  Skipping JWKS key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	debugf("🔑 Fetched %d signing keys from %s", len(keys), v.jwksURL)
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[jwk.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if errX != nil || errY != nil || !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// Decodes a base64url JSON segment of a token, keeping numbers as
+// json.Number so large ones stay exact
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// The aud claim is a string or an array of them
+func hasAudience(claim any, audience string) bool {
+	switch aud := claim.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A claim as a header value: strings as they are, arrays joined with
+// commas, anything else as JSON
+func claimString(claim any) (string, bool) {
+	switch value := claim.(type) {
+	case nil:
+		return "", false
+	case string:
+		return value, true
+	case []any:
+		values := []string{}
+		for _, item := range value {
+			if s, ok := claimString(item); ok {
+				values = append(values, s)
+			}
+		}
+		return strings.Join(values, ","), true
+	}
+	data, err := json.Marshal(claim)
+	return string(data), err == nil
+}
@@ -0,0 +1,464 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Where a pod finds its service account
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Asked of the API server for each watch, after which it is restarted
+const kubernetesWatchTimeout = 5 * time.Minute
+
+var errWatchExpired = errors.New("watch expired")
+
+// Keeps one server per ready endpoint of a Kubernetes Service, following
+// its EndpointSlices so pods join when they become ready and leave when
+// they terminate. Runs in-cluster with the pod's service account, or from
+// outside with a kubeconfig.
+type KubernetesDiscovery struct {
+	api       *kubernetesClient
+	namespace string
+	service   string
+	// Name of the Service port to use; the first one when empty
+	port    string
+	scheme  string
+	options string
+}
+
+// Part of an EndpointSlice of the discovery.k8s.io/v1 API
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name     string `json:"name"`
+		Port     int    `json:"port"`
+		Protocol string `json:"protocol"`
+	} `json:"ports"`
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []endpointSlice `json:"items"`
+}
+
+type endpointSliceEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// K8S_SERVICE is "name" or "namespace/name"
+func getKubernetesDiscoveryEnv() (*KubernetesDiscovery, error) {
+	service := getEnv("K8S_SERVICE", "")
+	if service == "" {
+		return nil, nil
+	}
+
+	api, namespace, err := newKubernetesClient(getEnv("KUBECONFIG", ""))
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes discovery: %v", err)
+	}
+
+	k := &KubernetesDiscovery{
+		api:       api,
+		namespace: namespace,
+		service:   service,
+		port:      getEnv("K8S_PORT", ""),
+		scheme:    getEnv("K8S_SCHEME", "http"),
+		options:   getEnv("K8S_SERVER_OPTIONS", ""),
+	}
+	if ns, name, ok := strings.Cut(service, "/"); ok {
+		k.namespace, k.service = ns, name
+	}
+	if k.scheme != "http" && k.scheme != "https" {
+		return nil, fmt.Errorf("invalid K8S_SCHEME %q, use http or https", k.scheme)
+	}
+	return k, nil
+}
+
+func (k *KubernetesDiscovery) source() string {
+	return "kubernetes:" + k.namespace + "/" + k.service
+}
+
+func (k *KubernetesDiscovery) Watch(ctx context.Context) (<-chan []Backend, error) {
+	updates := make(chan []Backend)
+	go func() {
+		defer close(updates)
+		for ctx.Err() == nil {
+			slices, version, err := k.list(ctx)
+			if err != nil {
+				errorf("❌ Listing EndpointSlices of %s failed, keeping current servers: %v", k.source(), err)
+				sleepContext(ctx, 5*time.Second)
+				continue
+			}
+			if !sendBackends(ctx, updates, k.backends(slices)) {
+				return
+			}
+
+			// Follows changes until the watch fails, then lists again
+			for err == nil && ctx.Err() == nil {
+				version, err = k.watch(ctx, slices, version, func() {
+					sendBackends(ctx, updates, k.backends(slices))
+				})
+			}
+			if err != nil && ctx.Err() == nil && !errors.Is(err, errWatchExpired) {
+				errorf("❌ Watching EndpointSlices of %s failed: %v", k.source(), err)
+				sleepContext(ctx, 5*time.Second)
+			}
+		}
+	}()
+	return updates, nil
+}
+
+func (k *KubernetesDiscovery) path() string {
+	return "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(k.namespace) + "/endpointslices"
+}
+
+func (k *KubernetesDiscovery) selector() string {
+	return "kubernetes.io/service-name=" + k.service
+}
+
+func (k *KubernetesDiscovery) list(ctx context.Context) (map[string]endpointSlice, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	query := url.Values{"labelSelector": {k.selector()}}
+	resp, err := k.api.get(ctx, k.path()+"?"+query.Encode())
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var list endpointSliceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", err
+	}
+	slices := map[string]endpointSlice{}
+	for _, slice := range list.Items {
+		slices[slice.Metadata.Name] = slice
+	}
+	return slices, list.Metadata.ResourceVersion, nil
+}
+
+// Applies changes after version to slices, calling changed after each,
+// until the watch ends; returns the version to resume from
+func (k *KubernetesDiscovery) watch(ctx context.Context, slices map[string]endpointSlice, version string, changed func()) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, kubernetesWatchTimeout+30*time.Second)
+	defer cancel()
+
+	query := url.Values{
+		"labelSelector":       {k.selector()},
+		"watch":               {"1"},
+		"resourceVersion":     {version},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {strconv.Itoa(int(kubernetesWatchTimeout.Seconds()))},
+	}
+	resp, err := k.api.get(ctx, k.path()+"?"+query.Encode())
+	if err != nil {
+		return version, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event endpointSliceEvent
+		if err := decoder.Decode(&event); err != nil {
+			// The server ended the watch at timeoutSeconds
+			if errors.Is(err, io.EOF) {
+				return version, nil
+			}
+			return version, err
+		}
+
+		if event.Type == "ERROR" {
+			// Usually 410 Gone: version is too old to resume from
+			return version, errWatchExpired
+		}
+
+		var slice endpointSlice
+		if err := json.Unmarshal(event.Object, &slice); err != nil {
+			return version, err
+		}
+		version = slice.Metadata.ResourceVersion
+
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			slices[slice.Metadata.Name] = slice
+		case "DELETED":
+			delete(slices, slice.Metadata.Name)
+		default:
+			// BOOKMARK only moves the version on
+			continue
+		}
+		changed()
+	}
+}
+
+// URLs and options of the ready endpoints
+func (k *KubernetesDiscovery) backends(slices map[string]endpointSlice) []Backend {
+	backends := []Backend{}
+	for _, slice := range slices {
+		port := 0
+		for _, p := range slice.Ports {
+			if (p.Protocol == "" || p.Protocol == "TCP") && (k.port == "" || p.Name == k.port) {
+				port = p.Port
+				break
+			}
+		}
+		if port == 0 {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			// Unknown readiness counts as ready, as for kube-proxy
+			if ready := endpoint.Conditions.Ready; ready != nil && !*ready {
+				continue
+			}
+			for _, address := range endpoint.Addresses {
+				backends = append(backends, Backend{
+					URL:     k.scheme + "://" + net.JoinHostPort(address, strconv.Itoa(port)),
+					Options: k.options,
+				})
+			}
+		}
+	}
+	return backends
+}
+
+// Minimal client of the Kubernetes API: bearer token or client
+// certificate authentication, no exec plugins
+type kubernetesClient struct {
+	server    string
+	client    *http.Client
+	token     string
+	tokenFile string
+}
+
+// From kubeconfig, or in-cluster when it is empty and the pod has a
+// service account, or else from ~/.kube/config. Also returns the default
+// namespace.
+func newKubernetesClient(kubeconfig string) (*kubernetesClient, string, error) {
+	if kubeconfig == "" {
+		if host := os.Getenv("KUBERNETES_SERVICE_HOST"); host != "" {
+			return inClusterClient(host, os.Getenv("KUBERNETES_SERVICE_PORT"))
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, "", err
+		}
+		kubeconfig = filepath.Join(home, ".kube", "config")
+	}
+	return kubeconfigClient(kubeconfig)
+}
+
+func inClusterClient(host, port string) (*kubernetesClient, string, error) {
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, "", err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, "", errors.New("no certificates in the service account's ca.crt")
+	}
+	namespace, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &kubernetesClient{
+		server: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}},
+		// Re-read for each request, as projected tokens are rotated
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+	}, strings.TrimSpace(string(namespace)), nil
+}
+
+// The parts of a kubeconfig file that are supported
+type kubeconfigFile struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string    `yaml:"token"`
+			TokenFile             string    `yaml:"tokenFile"`
+			ClientCertificate     string    `yaml:"client-certificate"`
+			ClientCertificateData string    `yaml:"client-certificate-data"`
+			ClientKey             string    `yaml:"client-key"`
+			ClientKeyData         string    `yaml:"client-key-data"`
+			Exec                  yaml.Node `yaml:"exec"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+func kubeconfigClient(path string) (*kubernetesClient, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	var config kubeconfigFile
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, "", fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Relative paths in a kubeconfig are relative to the file
+	dir := filepath.Dir(path)
+	readFile := func(name string) ([]byte, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		return os.ReadFile(name)
+	}
+	// Inline base64 data, or else a file
+	load := func(inline, file string) ([]byte, error) {
+		if inline != "" {
+			return base64.StdEncoding.DecodeString(inline)
+		}
+		if file != "" {
+			return readFile(file)
+		}
+		return nil, nil
+	}
+
+	namespace, cluster, user := "default", "", ""
+	for _, c := range config.Contexts {
+		if c.Name == config.CurrentContext {
+			cluster, user = c.Context.Cluster, c.Context.User
+			if c.Context.Namespace != "" {
+				namespace = c.Context.Namespace
+			}
+		}
+	}
+	if cluster == "" {
+		return nil, "", fmt.Errorf("%s: no current context", path)
+	}
+
+	k := &kubernetesClient{}
+	tlsConfig := &tls.Config{}
+	for _, c := range config.Clusters {
+		if c.Name != cluster {
+			continue
+		}
+		k.server = strings.TrimSuffix(c.Cluster.Server, "/")
+		tlsConfig.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		ca, err := load(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: certificate authority: %w", path, err)
+		}
+		if ca != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, "", fmt.Errorf("%s: no certificates in the certificate authority", path)
+			}
+		}
+	}
+	if k.server == "" {
+		return nil, "", fmt.Errorf("%s: cluster %q has no server", path, cluster)
+	}
+
+	for _, u := range config.Users {
+		if u.Name != user {
+			continue
+		}
+		if !u.User.Exec.IsZero() {
+			return nil, "", fmt.Errorf("%s: exec credential plugins are not supported, use a token or client certificate", path)
+		}
+		k.token = u.User.Token
+		if u.User.TokenFile != "" {
+			k.tokenFile = u.User.TokenFile
+			if !filepath.IsAbs(k.tokenFile) {
+				k.tokenFile = filepath.Join(dir, k.tokenFile)
+			}
+		}
+
+		cert, err := load(u.User.ClientCertificateData, u.User.ClientCertificate)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: client certificate: %w", path, err)
+		}
+		key, err := load(u.User.ClientKeyData, u.User.ClientKey)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: client key: %w", path, err)
+		}
+		if cert != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, "", fmt.Errorf("%s: client certificate: %w", path, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+
+	k.client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return k, namespace, nil
+}
+
+func (k *kubernetesClient) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.server+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := k.token
+	if k.tokenFile != "" {
+		data, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("kubernetes API answered %s for %s", resp.Status, path)
+	}
+	return resp, nil
+}
@@ -0,0 +1,64 @@
+package loadbalancer
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Latency histogram bucket layout: bucket i counts durations up to
+// latencyMin * latencyGrowth^i, so a reported quantile is off by at most 5%
+const (
+	latencyMin     = 100 * time.Microsecond
+	latencyGrowth  = 1.05
+	latencyBuckets = 280 // ~100µs to ~90s
+)
+
+// Streaming latency histogram with fixed log-scaled buckets. Recording is
+// lock-free and memory stays constant no matter how many samples come in.
+type LatencyHistogram struct {
+	counts [latencyBuckets]uint64
+}
+
+func (h *LatencyHistogram) Record(d time.Duration) {
+	atomic.AddUint64(&h.counts[latencyBucket(d)], 1)
+}
+
+// Upper bound of the bucket holding the q-th quantile, 0 without samples
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	var counts [latencyBuckets]uint64
+	var total uint64
+	for i := range h.counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i, count := range counts {
+		seen += count
+		if seen >= rank && count > 0 {
+			return latencyBucketBound(i)
+		}
+	}
+	return latencyBucketBound(latencyBuckets - 1)
+}
+
+func latencyBucket(d time.Duration) int {
+	if d <= latencyMin {
+		return 0
+	}
+
+	i := int(math.Ceil(math.Log(float64(d)/float64(latencyMin)) / math.Log(latencyGrowth)))
+	if i >= latencyBuckets {
+		return latencyBuckets - 1
+	}
+	return i
+}
+
+func latencyBucketBound(i int) time.Duration {
+	return time.Duration(float64(latencyMin) * math.Pow(latencyGrowth, float64(i)))
+}
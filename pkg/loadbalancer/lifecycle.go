@@ -0,0 +1,99 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Starts the work the load balancer does besides serving requests: health
+// checks, connection warm-up, discovery, registration expiry, fairness
+// sampling and statsd gauges, until ctx is done
+func (lb *LoadBalancer) Start(ctx context.Context) {
+	if upstreamTLS != nil {
+		go upstreamTLS.Watch(ctx)
+	}
+	go lb.HealthCheck(ctx)
+	for _, server := range lb.Servers() {
+		go lb.warmUp(server)
+	}
+	go lb.trackFairness(ctx)
+
+	for _, provider := range lb.discoveries {
+		go lb.runDiscovery(ctx, provider.source, provider.discovery)
+	}
+	if lb.admin.registry != nil {
+		go lb.admin.registry.expire(ctx)
+	}
+
+	if lb.metrics.statsd != nil {
+		go lb.reportStatsdGauges(ctx, lb.metrics.statsd.interval)
+	}
+}
+
+// Writes out what is still buffered, once no more requests are served
+func (lb *LoadBalancer) Close() {
+	lb.accessLog.Close()
+}
+
+// Adds a backend given in the TARGET_SERVICES syntax, e.g.
+// "http://api-4:8080;pool=heavy", to its pool
+func (lb *LoadBalancer) AddServer(target string) (*Server, error) {
+	rawURL, options, _ := strings.Cut(strings.TrimSpace(target), ";")
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	server, err := newServer(parsed, options)
+	if err != nil {
+		return nil, err
+	}
+	if server.resolve {
+		return nil, errors.New("resolve is only supported in TARGET_SERVICES")
+	}
+	if lb.findServer(server.ID()) != nil {
+		return nil, fmt.Errorf("%w: %s", ErrServerExists, server.ID())
+	}
+
+	if err := lb.addServer(server); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// Takes a backend out of rotation; requests already sent to it finish
+func (lb *LoadBalancer) RemoveServer(server *Server) {
+	lb.removeServer(server)
+}
+
+// The pool called name, nil if there is none
+func (lb *LoadBalancer) Pool(name string) *Pool {
+	return lb.pool(name)
+}
+
+// Creates an empty pool with options in the POOLS syntax, e.g.
+// "strategy=p2c;healthinterval=5s"; backends join it with the pool option
+// and routes send traffic to it with theirs
+func (lb *LoadBalancer) AddPool(name, options string) (*Pool, error) {
+	if !validPoolName(name) {
+		return nil, fmt.Errorf("invalid pool name %q", name)
+	}
+	return lb.addPool(name, options)
+}
+
+// Deletes a pool no server, route or other pool refers to anymore
+func (lb *LoadBalancer) RemovePool(pool *Pool) error {
+	return lb.removePool(pool)
+}
+
+// Reads the UPSTREAM_TLS_* files once per process, as every load balancer
+// in it dials backends through the same transports. Later calls return
+// the first one's error.
+var configureUpstreamTLSEnv = sync.OnceValue(func() error {
+	var err error
+	upstreamTLS, err = getUpstreamTLSFilesEnv()
+	return err
+})
@@ -0,0 +1,1206 @@
+// Package loadbalancer is the HTTP load balancer that cmd/lb runs, as a
+// library so other Go programs can embed it:
+//
+//	lb, err := loadbalancer.New(
+//		loadbalancer.WithTargetServices("http://api-1:8080", "http://api-2:8080"),
+//		loadbalancer.WithRoutes("/api/users;timeout=2s"),
+//	)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	ctx, stop := context.WithCancel(context.Background())
+//	defer stop()
+//	lb.Start(ctx)
+//	defer lb.Close()
+//	http.ListenAndServe(":8080", lb.Handler())
+//
+// Every setting is an environment variable, documented in the README, that
+// options can set from code instead.
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"load-balancer-demo/internal/config"
+)
+
+// Host header modes for requests forwarded to a backend. Any other value
+// is sent to the backend verbatim as the Host header.
+const (
+	HostPreserve = "preserve"
+	HostBackend  = "backend"
+)
+
+// Bits of Server.flags
+const (
+	serverHealthy uint32 = 1 << iota
+	serverMaintenance
+	serverDisabled
+)
+
+type Server struct {
+	URL *url.URL
+	// URL.String(), kept so log lines don't format it again
+	rawURL        string
+	Pool          string
+	HostHeader    string
+	MaxConns      int64
+	MaxQueueDepth int64
+	// How often it is health-checked, 0 for its pool's or
+	// HEALTH_CHECK_INTERVAL
+	HealthInterval time.Duration
+	// Whether probes reuse one kept-alive connection instead of dialing
+	HealthKeepAlives bool
+	// Registered probe it is health-checked with, "http" for GET /health,
+	// "" for its pool's or HEALTH_CHECK_PROBE
+	HealthProbe string
+	// Path the http probe requests, e.g. "/readyz", "" for its pool's or
+	// HEALTH_CHECK_PATH
+	HealthPath string
+	// Discovery source, empty for static servers
+	Source       string
+	Stats        ServerStats
+	Availability Availability
+	resolve      bool
+	options      string
+	active       int64
+	queueDepth   int64
+	queueDepthAt int64
+	penaltyUntil int64
+	weight       int64
+	// The load balancer's ADMISSION_SIGNAL_TTL
+	queueDepthTTL time.Duration
+	// The load balancer's, which retry penalties end by
+	clock Clock
+	// Health, maintenance and disabling packed into one word, so picking a
+	// server reads them without locking
+	flags atomic.Uint32
+	// Health found by the latest probe; the effective health differs while
+	// overridden
+	probedHealthy  bool
+	healthOverride *HealthOverride
+	// Other sources offering the same backend
+	alsoDiscoveredBy []string
+	proxy            *httputil.ReverseProxy
+	healthClient     *http.Client
+	probe            HealthProbe
+	probeName        string
+	mutex            sync.RWMutex
+}
+
+type LoadBalancer struct {
+	mutex             sync.RWMutex
+	servers           []*Server
+	disabled          map[string]bool
+	pools             map[string]*Pool
+	strategy          string // BALANCING_STRATEGY, for pools without their own
+	normalize         URLNormalization
+	errorPages        ErrorPages
+	fallback          *FallbackResponse
+	routes            Routes
+	rateLimit         *TokenBucket
+	clientRateLimit   *ClientRateLimiter
+	trustedProxies    TrustedProxies
+	ipFilter          *IPFilter
+	bans              *BanList
+	waf               *WAF
+	jwt               *JWTVerifier
+	introspection     *TokenIntrospector
+	apiKeys           *APIKeys
+	cors              *CORSPolicy
+	securityHeaders   *SecurityHeaders
+	queue             *RequestQueue
+	retryAttempts     int
+	retryBudget       *RetryBudget
+	retryBackoff      Backoff
+	retryPenalty      time.Duration
+	queueDepthTTL     time.Duration
+	retries           uint64
+	lastGood          *ResponseCache
+	cache             *ResponseCache
+	affinity          *AffinityCookies
+	coalescer         *Coalescer
+	inFlight          int64
+	brownoutThreshold int64
+	brownoutShed      uint64
+	drainingSince     int64 // Unix nanoseconds, 0 unless draining
+	drainRetryAfter   time.Duration
+	health            *HealthChecker
+	metrics           *Metrics
+	events            *EventBus
+	admin             *AdminAPI
+	accessLog         *AccessLog
+	bodyLog           *BodyLog
+	topPaths          *TopPaths
+	fairness          *FairnessTracker
+	// Whether requests are cleaned up, SANITIZE_HEADERS
+	sanitize bool
+	// Configured discovery providers, which Start runs
+	discoveries []discoveryProvider
+	// Latest valid backends of each discovery source
+	discovered     map[string][]discoveredBackend
+	discoveryMutex sync.Mutex
+	// Added with Use
+	middleware  []namedMiddleware
+	handler     http.Handler
+	handlerErr  error
+	handlerOnce sync.Once
+	hooks       hooks
+	// What pools send requests to backends through, unless capped by
+	// maxconns
+	transport *http.Transport
+	clock     Clock
+}
+
+type HealthCheckResponse struct {
+	Status     string    `json:"status"`
+	Instance   string    `json:"instance"`
+	Port       string    `json:"port"`
+	QueueDepth *int64    `json:"queueDepth,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// Records a probe's finding, which only takes effect once no health
+// override is set
+func (s *Server) SetHealth(healthy bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.probedHealthy = healthy
+	if s.healthOverride == nil {
+		s.setFlag(serverHealthy, healthy)
+	}
+	s.Availability.record(s.IsHealthy())
+}
+
+// Sets or clears one of the flags, reporting whether that changed it
+func (s *Server) setFlag(flag uint32, on bool) bool {
+	for {
+		old := s.flags.Load()
+		flags := old &^ flag
+		if on {
+			flags |= flag
+		}
+		if flags == old {
+			return false
+		}
+		if s.flags.CompareAndSwap(old, flags) {
+			serverStateChanged()
+			return true
+		}
+	}
+}
+
+// Share of its pool's traffic relative to the other servers' weights
+func (s *Server) Weight() int64 {
+	return atomic.LoadInt64(&s.weight)
+}
+
+// Requests in flight to the server
+func (s *Server) ActiveRequests() int64 {
+	return atomic.LoadInt64(&s.active)
+}
+
+func (s *Server) SetWeight(weight int64) {
+	atomic.StoreInt64(&s.weight, weight)
+	serverStateChanged()
+}
+
+// Identifies the server in the admin API: its host and port
+func (s *Server) ID() string {
+	return s.URL.Host
+}
+
+func (s *Server) AlsoDiscoveredBy() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.alsoDiscoveredBy
+}
+
+func (s *Server) setAlsoDiscoveredBy(sources []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.alsoDiscoveredBy = sources
+}
+
+func (s *Server) IsHealthy() bool {
+	return s.flags.Load()&serverHealthy != 0
+}
+
+// Servers in maintenance keep being health-checked but get no traffic
+func (s *Server) SetMaintenance(maintenance bool) {
+	s.setFlag(serverMaintenance, maintenance)
+}
+
+func (s *Server) InMaintenance() bool {
+	return s.flags.Load()&serverMaintenance != 0
+}
+
+// Disabled servers are excluded from selection by an operator through the
+// admin API, regardless of health and maintenance configuration
+func (s *Server) SetDisabled(disabled bool) {
+	s.setFlag(serverDisabled, disabled)
+}
+
+func (s *Server) IsDisabled() bool {
+	return s.flags.Load()&serverDisabled != 0
+}
+
+// Healthy, not in maintenance and not disabled
+func (s *Server) IsAvailable() bool {
+	return s.flags.Load() == serverHealthy
+}
+
+// Host header sent to the backend: the client's original host, the backend's
+// own host, or a fixed override
+func (s *Server) rewriteHost(req *http.Request) {
+	switch s.HostHeader {
+	case "", HostPreserve:
+	case HostBackend:
+		req.Host = s.URL.Host
+	default:
+		req.Host = s.HostHeader
+	}
+}
+
+// Reserves an in-flight slot, failing when the server is at its MaxConns cap
+// or reports a queue at its MaxQueueDepth
+func (s *Server) Acquire() bool {
+	if s.isOverloaded() {
+		return false
+	}
+
+	for {
+		active := atomic.LoadInt64(&s.active)
+		if s.MaxConns > 0 && active >= s.MaxConns {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&s.active, active, active+1) {
+			return true
+		}
+	}
+}
+
+func (s *Server) Release() {
+	atomic.AddInt64(&s.active, -1)
+}
+
+// Builds a load balancer from its settings, the environment variables
+// documented in the README, with options taking precedence. It serves
+// requests through Handler; Start runs its health checks and the rest of
+// its background work. Invalid settings are returned as an error.
+func New(options ...Option) (*LoadBalancer, error) {
+	var built buildOptions
+	for _, option := range options {
+		option(&built)
+	}
+	if err := configureUpstreamTLSEnv(); err != nil {
+		return nil, err
+	}
+	if _, err := upstreamDNSEnv(); err != nil {
+		return nil, err
+	}
+	if _, err := warmUpConnsEnv(); err != nil {
+		return nil, err
+	}
+	transport := built.transport
+	if transport == nil {
+		var err error
+		if transport, err = sharedTransport(); err != nil {
+			return nil, err
+		}
+	}
+	clock := built.clock
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	targets, err := parseTargetServices(targetServicesEnv())
+	if err != nil {
+		return nil, err
+	}
+	pools := buildPools(targets)
+	if err := configurePoolsEnv(pools, transport, clock); err != nil {
+		return nil, err
+	}
+	routes, err := parseRoutes(getEnv("ROUTES", ""), clock)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHealthProbe(getEnv("HEALTH_CHECK_PROBE", httpHealthProbe)); err != nil {
+		return nil, fmt.Errorf("invalid HEALTH_CHECK_PROBE: %v", err)
+	}
+	if err := checkHealthPath(getEnv("HEALTH_CHECK_PATH", defaultHealthPath)); err != nil {
+		return nil, fmt.Errorf("invalid HEALTH_CHECK_PATH: %v", err)
+	}
+
+	for _, route := range routes {
+		for _, name := range []string{route.Pool, route.timeoutPool()} {
+			if _, ok := pools[name]; name != "" && !ok {
+				return nil, fmt.Errorf("route %s references %w %q", route.Prefix, ErrPoolNotFound, name)
+			}
+		}
+	}
+
+	var env envReader
+	lb := &LoadBalancer{
+		transport:         transport,
+		clock:             clock,
+		pools:             pools,
+		routes:            routes,
+		sanitize:          env.Bool("SANITIZE_HEADERS", true),
+		retryAttempts:     env.Int("RETRY_ATTEMPTS", 0),
+		retryPenalty:      env.Duration("RETRY_PENALTY", 5*time.Second),
+		queueDepthTTL:     env.Duration("ADMISSION_SIGNAL_TTL", defaultQueueDepthTTL),
+		lastGood:          newCache(clock, env.Int("LAST_GOOD_MAX_ENTRIES", 1000)),
+		cache:             newCache(clock, env.Int("CACHE_MAX_ENTRIES", 1000)),
+		coalescer:         NewCoalescer(),
+		brownoutThreshold: int64(env.Int("BROWNOUT_THRESHOLD", 0)),
+		drainRetryAfter:   env.Duration("DRAIN_RETRY_AFTER", 30*time.Second),
+		events:            NewEventBus(env.Float("EVENTS_SAMPLE_RATE", 0.1)),
+		disabled:          map[string]bool{},
+		discovered:        map[string][]discoveredBackend{},
+	}
+	if env.err != nil {
+		return nil, env.err
+	}
+	if lb.strategy, _, err = defaultStrategyEnv(); err != nil {
+		return nil, err
+	}
+	if lb.normalize, err = getURLNormalizationEnv(); err != nil {
+		return nil, err
+	}
+	if lb.errorPages, err = getErrorPagesEnv(); err != nil {
+		return nil, err
+	}
+	if lb.fallback, err = getFallbackResponseEnv(); err != nil {
+		return nil, err
+	}
+	if lb.rateLimit, err = getGlobalRateLimitEnv(clock); err != nil {
+		return nil, err
+	}
+	if lb.clientRateLimit, err = getClientRateLimitEnv(clock); err != nil {
+		return nil, err
+	}
+	if lb.trustedProxies, err = getTrustedProxiesEnv(); err != nil {
+		return nil, err
+	}
+	if lb.ipFilter, err = getIPFilterEnv(); err != nil {
+		return nil, err
+	}
+	if lb.bans, err = getBanListEnv(clock); err != nil {
+		return nil, err
+	}
+	if lb.waf, err = getWAFEnv(); err != nil {
+		return nil, err
+	}
+	if lb.jwt, err = getJWTVerifierEnv(clock); err != nil {
+		return nil, err
+	}
+	if lb.introspection, err = getTokenIntrospectorEnv(); err != nil {
+		return nil, err
+	}
+	if lb.apiKeys, err = getAPIKeysEnv(); err != nil {
+		return nil, err
+	}
+	if lb.cors, err = getCORSPolicyEnv(); err != nil {
+		return nil, err
+	}
+	if lb.securityHeaders, err = getSecurityHeadersEnv(); err != nil {
+		return nil, err
+	}
+	if lb.queue, err = getRequestQueueEnv(clock); err != nil {
+		return nil, err
+	}
+	if lb.retryBudget, err = getRetryBudgetEnv(clock); err != nil {
+		return nil, err
+	}
+	if lb.retryBackoff, err = getRetryBackoffEnv(clock); err != nil {
+		return nil, err
+	}
+	if lb.affinity, err = getAffinityCookiesEnv(clock); err != nil {
+		return nil, err
+	}
+	if lb.health, err = getHealthCheckerEnv(clock); err != nil {
+		return nil, err
+	}
+	if lb.topPaths, err = getTopPathsEnv(); err != nil {
+		return nil, err
+	}
+	if lb.fairness, err = getFairnessEnv(); err != nil {
+		return nil, err
+	}
+	if lb.discoveries, err = discoveryProvidersEnv(); err != nil {
+		return nil, err
+	}
+	if lb.metrics, err = newMetrics(lb); err != nil {
+		return nil, err
+	}
+	if lb.admin, err = newAdminAPI(lb); err != nil {
+		return nil, err
+	}
+	if lb.accessLog, err = getAccessLogEnv(); err != nil {
+		return nil, err
+	}
+	if lb.bodyLog, err = getBodyLogEnv(); err != nil {
+		return nil, err
+	}
+
+	resolved := []*DNSDiscovery{}
+	for _, target := range targets {
+		if target.resolve {
+			dns, err := newDNSDiscovery(target)
+			if err != nil {
+				return nil, err
+			}
+			resolved = append(resolved, dns)
+		} else {
+			lb.adopt(target)
+			lb.servers = append(lb.servers, target)
+		}
+	}
+	for _, dns := range resolved {
+		go lb.runDiscovery(context.Background(), dns.source(), dns)
+	}
+
+	return lb, nil
+}
+
+// Snapshot of all servers across pools
+func (lb *LoadBalancer) Servers() []*Server {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+	return lb.servers
+}
+
+// Pool with the given name, or nil
+func (lb *LoadBalancer) pool(name string) *Pool {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+	return lb.pools[name]
+}
+
+// Snapshot of all pools, sorted by name
+func (lb *LoadBalancer) Pools() []*Pool {
+	lb.mutex.RLock()
+	pools := make([]*Pool, 0, len(lb.pools))
+	for _, pool := range lb.pools {
+		pools = append(pools, pool)
+	}
+	lb.mutex.RUnlock()
+
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name < pools[j].Name
+	})
+	return pools
+}
+
+// Snapshot of the routes, longest prefix first
+func (lb *LoadBalancer) Routes() Routes {
+	lb.mutex.RLock()
+	defer lb.mutex.RUnlock()
+	return lb.routes
+}
+
+// Disables or re-enables the server, and remembers the choice for servers
+// later added with the same ID
+func (lb *LoadBalancer) setDisabled(server *Server, disabled bool) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	if disabled {
+		lb.disabled[server.ID()] = true
+	} else {
+		delete(lb.disabled, server.ID())
+	}
+	server.SetDisabled(disabled)
+}
+
+// Server with the given ID, or nil
+func (lb *LoadBalancer) findServer(id string) *Server {
+	for _, server := range lb.Servers() {
+		if server.ID() == id {
+			return server
+		}
+	}
+	return nil
+}
+
+// Applies the load balancer's settings for its servers to server
+func (lb *LoadBalancer) adopt(server *Server) {
+	server.queueDepthTTL = lb.queueDepthTTL
+	server.clock = lb.clock
+}
+
+// Fails with ErrPoolNotFound when the server's pool was removed meanwhile
+func (lb *LoadBalancer) addServer(server *Server) error {
+	return lb.replaceServer(nil, server)
+}
+
+// Puts server in the place of replaced, or adds it when replaced is nil.
+// The server list and both pools change under one lock, so the pool can't
+// be removed halfway and no reader sees the server in only one of them.
+func (lb *LoadBalancer) replaceServer(replaced, server *Server) error {
+	lb.adopt(server)
+	lb.mutex.Lock()
+	pool := lb.pools[server.Pool]
+	switch {
+	case pool == nil:
+		lb.mutex.Unlock()
+		return fmt.Errorf("%w %s", ErrPoolNotFound, server.Pool)
+	case replaced != nil && !slices.Contains(lb.servers, replaced):
+		lb.mutex.Unlock()
+		return fmt.Errorf("server %s was removed meanwhile", replaced.ID())
+	}
+	if replaced != nil {
+		lb.servers = withoutServer(lb.servers, replaced)
+		lb.pools[replaced.Pool].remove(replaced)
+	}
+	// A server disabled through the admin API stays disabled when it is re-added
+	if lb.disabled[server.ID()] {
+		server.SetDisabled(true)
+	}
+	lb.servers = append(lb.servers[:len(lb.servers):len(lb.servers)], server)
+	pool.add(server)
+	lb.mutex.Unlock()
+
+	if replaced != nil {
+		lb.removed(replaced)
+	}
+	lb.health.notifyServersChanged()
+	upstreamDNS().prefetch(server.URL.Hostname())
+	go lb.warmUp(server)
+	lb.events.Publish(serverEvent(EventServerAdded, server, ""))
+	return nil
+}
+
+// Takes the server out of rotation; requests already sent to it finish
+func (lb *LoadBalancer) removeServer(server *Server) {
+	lb.mutex.Lock()
+	lb.servers = withoutServer(lb.servers, server)
+	// A pool with servers can't be removed, but the server may be gone too
+	if pool := lb.pools[server.Pool]; pool != nil {
+		pool.remove(server)
+	}
+	lb.mutex.Unlock()
+
+	lb.health.notifyServersChanged()
+	lb.removed(server)
+}
+
+func (lb *LoadBalancer) removed(server *Server) {
+	server.healthClient.CloseIdleConnections()
+	lb.events.Publish(serverEvent(EventServerRemoved, server, ""))
+}
+
+// Frees the slot reserved by Pool.Pick and wakes a queued request
+func (lb *LoadBalancer) releaseServer(server *Server) {
+	server.Release()
+	lb.queue.Notify()
+}
+
+// Outcome of one probe, as returned by POST /lb-admin/healthcheck
+type HealthCheckResult struct {
+	Server     string  `json:"server"`
+	Healthy    bool    `json:"healthy"`
+	Status     int     `json:"status,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"durationMs"`
+	// Whether the probe went over a kept-alive connection, and if not how
+	// long dialing and the TLS handshake took
+	Reused    bool    `json:"reused"`
+	ConnectMs float64 `json:"connectMs,omitempty"`
+}
+
+// Probes the server, by its health probe or else its health path, and
+// updates its health
+func (lb *LoadBalancer) checkServer(server *Server) HealthCheckResult {
+	if probe := lb.healthProbe(server); probe != nil {
+		return lb.checkServerWithProbe(server, probe)
+	}
+
+	probeStart := time.Now()
+	var conn probeConn
+	res, err := server.healthClient.Do(conn.request(server.rawURL + lb.healthPath(server)))
+	result := HealthCheckResult{Server: server.ID(), DurationMs: milliseconds(time.Since(probeStart))}
+	if conn.got {
+		lb.metrics.observeHealthCheckConn(server, conn.reused, conn.connect)
+		result.Reused, result.ConnectMs = conn.reused, milliseconds(conn.connect)
+	}
+
+	if err != nil {
+		lb.probed(server, false, probeStart, err.Error())
+		result.Error = err.Error()
+		return result
+	}
+
+	var health HealthCheckResponse
+	if json.NewDecoder(res.Body).Decode(&health) == nil && health.QueueDepth != nil {
+		server.reportQueueDepth(*health.QueueDepth)
+	}
+	// The connection is only kept for the next probe once the body is read
+	io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+	res.Body.Close()
+
+	healthy := res.StatusCode == http.StatusOK
+	lb.probed(server, healthy, probeStart, res.Status)
+	result.Healthy, result.Status = healthy, res.StatusCode
+	return result
+}
+
+// Health-checks the server with its registered probe, given as long as
+// /health requests are
+func (lb *LoadBalancer) checkServerWithProbe(server *Server, probe HealthProbe) HealthCheckResult {
+	probeStart := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), server.healthClient.Timeout)
+	defer cancel()
+	err := probe.Probe(ctx, server)
+	result := HealthCheckResult{Server: server.ID(), DurationMs: milliseconds(time.Since(probeStart))}
+
+	if err != nil {
+		lb.probed(server, false, probeStart, err.Error())
+		result.Error = err.Error()
+		return result
+	}
+	lb.probed(server, true, probeStart, "")
+	result.Healthy = true
+	return result
+}
+
+// Records a probe's outcome as the server's health, announcing when it
+// goes down, for reason, or comes back up
+func (lb *LoadBalancer) probed(server *Server, healthy bool, probeStart time.Time, reason string) {
+	wasHealthy := server.IsHealthy()
+	lb.metrics.observeHealthCheck(server, healthy, probeStart)
+	server.SetHealth(healthy)
+
+	if nowHealthy := server.IsHealthy(); !wasHealthy && nowHealthy {
+		infof("✅ Server %s is back up", server.rawURL)
+		go lb.warmUp(server)
+		lb.healthChanged(server, true, "health check passed")
+	} else if wasHealthy && !nowHealthy {
+		errorf("❌ Server %s is down: %s", server.rawURL, reason)
+		lb.healthChanged(server, false, reason)
+	} else if nowHealthy {
+		debugf("...Server %s is still up", server.rawURL)
+	}
+}
+
+// Serves the request through Handler, so it passes through the middleware
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lb.Handler().ServeHTTP(w, r)
+}
+
+// Sends the request, past the middleware, to a backend of its route's pool
+func (lb *LoadBalancer) proxyRequest(w http.ResponseWriter, r *http.Request) {
+	route := requestRoute(r)
+
+	atomic.AddInt64(&lb.inFlight, 1)
+	defer atomic.AddInt64(&lb.inFlight, -1)
+
+	if isCacheable(r, route) && lb.serveFromCache(w, r, route) {
+		return
+	}
+
+	if isCoalescable(r, route) {
+		recorder, served := lb.coalesce(w, r)
+		if served {
+			return
+		}
+		if recorder != nil {
+			defer func() {
+				p := recover()
+				recorder.land(r, p != nil)
+				if p != nil {
+					panic(p)
+				}
+			}()
+			w = recorder
+		}
+	}
+
+	if lb.shedForBrownout(w, r, route) {
+		return
+	}
+
+	lb.retryBudget.RecordRequest()
+
+	pool := lb.pool(route.Pool)
+	if !pool.enter() {
+		overflow := lb.spillover(pool)
+		if overflow == nil {
+			lb.errorPages.Write(w, r, http.StatusServiceUnavailable, "Service Unavailable: pool "+pool.Name+" is at capacity")
+			return
+		}
+		pool = overflow
+	}
+	defer func() { pool.leave() }()
+
+	server, err := lb.pick(r.Context(), r, pool)
+	if errors.Is(err, ErrAllBackendsBusy) {
+		if overflow := lb.spillover(pool); overflow != nil {
+			pool.leave()
+			pool = overflow
+		}
+		server, err = lb.pickServer(r.Context(), r, pool)
+	}
+	if err != nil {
+		if lb.serveStaleOnError(w, r, route) {
+			return
+		}
+
+		if lb.fallback != nil && !errors.Is(err, ErrAllBackendsBusy) {
+			warnf("⚠️  Serving fallback response: %v", err)
+			lb.fallback.Write(w)
+			return
+		}
+
+		lb.errorPages.Write(w, r, http.StatusServiceUnavailable, "Service Unavailable: "+err.Error())
+		return
+	}
+
+	var attempted []*Server
+	for attempt := 1; ; attempt++ {
+		err = lb.proxyTo(w, r, server, route, pool)
+		lb.releaseServer(server)
+		if err == nil {
+			return
+		}
+
+		if errors.Is(err, ErrBackendTimeout) {
+			if !lb.serveStaleOnError(w, r, route) {
+				lb.handleTimeout(w, r, route)
+			}
+			return
+		}
+
+		server.penalize(lb.retryPenalty)
+		if attempt > lb.retryAttempts || !isRetryable(r) || !isRetryableError(err) || !lb.retryBudget.TryRetry() {
+			break
+		}
+
+		// Never send the request back to a server that already failed it
+		attempted = append(attempted, server)
+
+		if !lb.retryBackoff.Wait(r.Context(), attempt) {
+			return
+		}
+		failed, failure := server, err
+		if server, err = lb.pickServer(withAttempted(r.Context(), attempted), r, pool); err != nil {
+			break
+		}
+		atomic.AddUint64(&lb.retries, 1)
+		lb.metrics.retries.WithLabelValues(server.URL.Host).Inc()
+		lb.retrying(r, attempt+1, failed, failure)
+		infof("🔁 Retrying request (attempt %d) on %s", attempt+1, server.rawURL)
+	}
+
+	if lb.serveStaleOnError(w, r, route) {
+		return
+	}
+	lb.errorPages.Write(w, r, http.StatusServiceUnavailable, "Service Temporarily Unavailable")
+}
+
+// Next server of the pool for r with a reserved slot, queueing while every
+// server not yet attempted is saturated
+func (lb *LoadBalancer) pickServer(ctx context.Context, r *http.Request, pool *Pool) (*Server, error) {
+	pick := func() (*Server, error) {
+		return lb.pick(ctx, r, pool)
+	}
+
+	server, err := pick()
+	if errors.Is(err, ErrAllBackendsBusy) && lb.queue != nil {
+		server, err = lb.queue.Wait(r.Context(), pick)
+		switch {
+		case errors.Is(err, errQueueFull):
+			lb.metrics.queueRejected.WithLabelValues("full").Inc()
+		case errors.Is(err, errQueueTimeout):
+			lb.metrics.queueRejected.WithLabelValues("timeout").Inc()
+		}
+	}
+	return server, err
+}
+
+// What serves requests: the balancer behind the middleware every request
+// passes through first, built on first use. Panics when MIDDLEWARE doesn't
+// fit the middleware added with Use, which Run returns as an error instead.
+func (lb *LoadBalancer) Handler() http.Handler {
+	handler, err := lb.buildHandlerOnce()
+	if err != nil {
+		panic(err)
+	}
+	return handler
+}
+
+func (lb *LoadBalancer) buildHandlerOnce() (http.Handler, error) {
+	lb.handlerOnce.Do(func() { lb.handler, lb.handlerErr = lb.buildHandler() })
+	return lb.handler, lb.handlerErr
+}
+
+// Proxies the request to server. A non-nil error means the backend couldn't
+// be reached or timed out and nothing was written to w, so the request may
+// be retried.
+func (lb *LoadBalancer) proxyTo(w http.ResponseWriter, r *http.Request, server *Server, route *Route, pool *Pool) error {
+	getRequestInfo(r.Context()).backend = server.URL.Host
+	lb.requestRouted(r, route, server)
+
+	parent := r.Context()
+	if route.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(parent, route.Timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	server.Stats.recordRequest()
+	pool.Stats.recordRequest()
+
+	attempt := &proxyAttempt{lb: lb, server: server, route: route, pool: pool, parent: parent, start: time.Now()}
+	r, span := startUpstreamSpan(r, server)
+	defer func() {
+		endSpan(span, attempt.status, attempt.err)
+	}()
+
+	attempt.request = r.WithContext(context.WithValue(r.Context(), proxyAttemptKey{}, attempt))
+	server.proxy.ServeHTTP(w, attempt.request)
+	return attempt.err
+}
+
+// What Run does besides serving
+type RunOptions struct {
+	// Show a live terminal view instead of logs
+	TUI bool
+	// Where log messages go instead of the standard logger, as with
+	// WithLogger; LOG_LEVEL still filters them
+	Logger *slog.Logger
+}
+
+// Runs the load balancer the way cmd/lb does: configured from the
+// environment and CONFIG_FILE, serving on port 9080 and the admin listener
+// until SIGINT or SIGTERM, or handing over to a new process on SIGUSR2.
+// Fails when a setting is invalid or the port can't be served.
+func Run(options RunOptions) error {
+	if err := loadConfigFile(); err != nil {
+		return err
+	}
+	if err := configureLogLevelEnv(); err != nil {
+		return err
+	}
+	if err := configureLogOutputEnv(); err != nil {
+		return err
+	}
+	if options.Logger != nil {
+		setLogger(options.Logger)
+	}
+	if options.TUI {
+		configureTUILogs()
+	}
+	if err := configureGOMAXPROCSEnv(); err != nil {
+		return err
+	}
+	shutdownLogExport, err := setupLogExport()
+	if err != nil {
+		return err
+	}
+	lb, err := New()
+	if err != nil {
+		return err
+	}
+	shutdownTracing, err := setupTracing(lb.Routes)
+	if err != nil {
+		return err
+	}
+
+	port := "9080"
+	var tlsConfig *tls.Config
+	scheme := "http"
+	tlsFiles, err := getTLSFilesEnv()
+	if err != nil {
+		return err
+	}
+	if tlsFiles != nil {
+		tlsConfig = tlsFiles.Config()
+		scheme = "https"
+	}
+	server := &http.Server{TLSConfig: tlsConfig}
+	if err := applyServerLimitsEnv(server); err != nil {
+		return err
+	}
+	consulRegister, err := getEnvBool("CONSUL_REGISTER", false)
+	if err != nil {
+		return err
+	}
+	adminAddr := getEnv("ADMIN_ADDR", "127.0.0.1:9091")
+	var adminServer *http.Server
+	if adminAddr != "" {
+		if adminServer, err = lb.newAdminServer(adminAddr); err != nil {
+			return err
+		}
+	}
+	var tui *TUI
+	if options.TUI {
+		if tui, err = newTUI(lb); err != nil {
+			return err
+		}
+	}
+
+	if server.Handler, err = lb.buildHandlerOnce(); err != nil {
+		return err
+	}
+
+	listener, err := listen(":" + port)
+	if err != nil {
+		return err
+	}
+	if tlsFiles != nil {
+		go tlsFiles.Watch(context.Background())
+	}
+
+	// Health checking and the rest of the background work, until shutdown
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	lb.Start(ctx)
+
+	infof("🚀 Go Load Balancer starting on port %s", port)
+	infof("🔍 Status endpoint: %s://localhost:%s/lb-status", scheme, port)
+	infof("🖥️  Dashboard: %s://localhost:%s/lb-dashboard", scheme, port)
+	infof("📡 Events stream: %s://localhost:%s/lb-events", scheme, port)
+
+	if adminServer != nil {
+		infof("📊 Metrics endpoint: http://%s%s", adminAddr, lb.metrics.Path)
+		infof("🔧 Admin API: http://%s%s/", adminAddr, adminPrefix)
+	}
+
+	server.RegisterOnShutdown(stop)
+	server.RegisterOnShutdown(lb.events.Close)
+	if adminServer != nil {
+		startAdminServer(adminServer)
+		server.RegisterOnShutdown(func() { adminServer.Close() })
+	}
+	var deregister func()
+	if consulRegister {
+		if deregister, err = registerInConsul(port); err != nil {
+			errorf("❌ Registering in Consul failed: %v", err)
+		}
+	}
+	if tui != nil {
+		tui.Start()
+		server.RegisterOnShutdown(tui.Stop)
+	}
+	restarted, err := serveUntilShutdown(server, listener)
+	lb.Close()
+
+	// After a graceful restart the new process holds the same registration
+	if deregister != nil && !restarted {
+		deregister()
+	}
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		warnf("⚠️  Failed to flush traces: %v", err)
+	}
+	if err := shutdownLogExport(flushCtx); err != nil {
+		log.Printf("⚠️  Failed to flush logs: %v", err)
+	}
+	return err
+}
+
+const defaultTargetServices = "http://localhost:8081,http://localhost:8082,http://localhost:8083"
+
+// TARGET_SERVICES, by default the local demo APIs unless backends are
+// discovered instead
+func targetServicesEnv() string {
+	if value := os.Getenv("TARGET_SERVICES"); value != "" || discoveryEnabled() {
+		return value
+	}
+	return defaultTargetServices
+}
+
+// Servers from a TARGET_SERVICES value: comma-separated URLs, each
+// optionally followed by ;key=value options
+func parseTargetServices(value string) ([]*Server, error) {
+	servers := []*Server{}
+
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		rawURL, options, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		target, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		server, err := newServer(target, options)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+
+	return servers, nil
+}
+
+func newServer(url *url.URL, options string) (*Server, error) {
+	var env envReader
+	server := &Server{
+		URL:              url,
+		rawURL:           url.String(),
+		Pool:             defaultPoolName,
+		HostHeader:       getEnv("HOST_HEADER", HostPreserve),
+		MaxConns:         int64(env.Int("BACKEND_MAX_CONNS", 0)),
+		MaxQueueDepth:    int64(env.Int("ADMISSION_MAX_QUEUE_DEPTH", 0)),
+		HealthKeepAlives: env.Bool("HEALTH_CHECK_KEEP_ALIVES", true),
+		options:          options,
+		weight:           1,
+		probedHealthy:    true,
+		queueDepthTTL:    defaultQueueDepthTTL,
+		clock:            realClock{},
+	}
+	if env.err != nil {
+		return nil, env.err
+	}
+	server.flags.Store(serverHealthy)
+	if err := parseServerOptions(server, options); err != nil {
+		return nil, err
+	}
+	server.proxy = newServerProxy(server)
+	server.healthClient = newHealthCheckClient(server.HealthKeepAlives)
+	server.Availability.start(server.IsHealthy())
+	return server, nil
+}
+
+// Per-backend options follow the URL, e.g. "http://api-1:8080;host=backend"
+func parseServerOptions(server *Server, options string) error {
+	if options == "" {
+		return nil
+	}
+
+	for _, option := range strings.Split(options, ";") {
+		key, value, _ := strings.Cut(option, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		switch key {
+		case "host":
+			server.HostHeader = value
+		case "pool":
+			server.Pool = value
+		case "maxconns":
+			maxConns, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || maxConns < 0 {
+				return fmt.Errorf("invalid maxconns %q for target service %s", value, server.rawURL)
+			}
+			server.MaxConns = maxConns
+		case "maxqueue":
+			maxQueueDepth, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || maxQueueDepth < 0 {
+				return fmt.Errorf("invalid maxqueue %q for target service %s", value, server.rawURL)
+			}
+			server.MaxQueueDepth = maxQueueDepth
+		case "healthinterval":
+			interval, err := time.ParseDuration(value)
+			if err != nil || interval <= 0 {
+				return fmt.Errorf("invalid healthinterval %q for target service %s", value, server.rawURL)
+			}
+			server.HealthInterval = interval
+		case "healthkeepalives":
+			keepAlives, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid healthkeepalives %q for target service %s", value, server.rawURL)
+			}
+			server.HealthKeepAlives = keepAlives
+		case "healthprobe":
+			if err := checkHealthProbe(value); err != nil {
+				return fmt.Errorf("invalid healthprobe for target service %s: %v", server.rawURL, err)
+			}
+			server.HealthProbe = value
+		case "healthpath":
+			if err := checkHealthPath(value); err != nil {
+				return fmt.Errorf("invalid healthpath for target service %s: %v", server.rawURL, err)
+			}
+			server.HealthPath = value
+		case "resolve":
+			resolve, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid resolve %q for target service %s", value, server.rawURL)
+			}
+			server.resolve = resolve
+		case "weight":
+			weight, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || weight < 0 {
+				return fmt.Errorf("invalid weight %q for target service %s", value, server.rawURL)
+			}
+			server.weight = weight
+		case "maintenance":
+			maintenance, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid maintenance %q for target service %s", value, server.rawURL)
+			}
+			server.SetMaintenance(maintenance)
+		default:
+			return fmt.Errorf("unknown option %q for target service %s", key, server.rawURL)
+		}
+	}
+	return nil
+}
+
+// Settings are read the way cmd/api reads its own
+var (
+	getEnv         = config.Get
+	getEnvBool     = config.Bool
+	getEnvInt      = config.Int
+	getEnvFloat    = config.Float
+	getEnvDuration = config.Duration
+)
+
+// Reads settings, keeping the first one that doesn't parse, so a parser
+// reading several returns the error once rather than checking each
+type envReader struct {
+	err error
+}
+
+func (e *envReader) Bool(key string, defaultValue bool) bool {
+	value, err := getEnvBool(key, defaultValue)
+	e.keep(err)
+	return value
+}
+
+func (e *envReader) Int(key string, defaultValue int) int {
+	value, err := getEnvInt(key, defaultValue)
+	e.keep(err)
+	return value
+}
+
+func (e *envReader) Float(key string, defaultValue float64) float64 {
+	value, err := getEnvFloat(key, defaultValue)
+	e.keep(err)
+	return value
+}
+
+func (e *envReader) Duration(key string, defaultValue time.Duration) time.Duration {
+	value, err := getEnvDuration(key, defaultValue)
+	e.keep(err)
+	return value
+}
+
+func (e *envReader) keep(err error) {
+	if e.err == nil {
+		e.err = err
+	}
+}
@@ -0,0 +1,65 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	otellog "go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+)
+
+// Receives the operational and access logs when they are exported over
+// OTLP; nil otherwise
+var otelLogger otellog.Logger
+
+// With OTEL_LOGS_EXPORTER=otlp, logs are also shipped to the OTLP endpoint
+// that receives traces, each record carrying the trace and span of its
+// request. The returned function flushes pending records on shutdown.
+func setupLogExport() (func(context.Context) error, error) {
+	switch exporter := getEnv("OTEL_LOGS_EXPORTER", "none"); exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+	default:
+		return nil, fmt.Errorf("invalid OTEL_LOGS_EXPORTER %q: must be otlp or none", exporter)
+	}
+
+	ctx := context.Background()
+	res, err := otelResource(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like the trace exporter, configured by the standard OTEL_EXPORTER_OTLP_* variables
+	exporter, err := otlploghttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP log exporter configuration: %v", err)
+	}
+
+	provider := sdklog.NewLoggerProvider(
+		sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter)),
+		sdklog.WithResource(res),
+	)
+	otelLogger = provider.Logger("load-balancer-demo/loadbalancer")
+
+	infof("🔭 Exporting logs over OTLP")
+	return provider.Shutdown, nil
+}
+
+func exportLog(ctx context.Context, level slog.Level, message string, attributes ...otellog.KeyValue) {
+	if otelLogger == nil {
+		return
+	}
+
+	var record otellog.Record
+	record.SetTimestamp(time.Now())
+	// slog levels are 4 apart like OpenTelemetry's severity ranges, with info at 0 rather than 9
+	record.SetSeverity(otellog.Severity(level + 9))
+	record.SetSeverityText(level.String())
+	record.SetBody(otellog.StringValue(message))
+	record.AddAttributes(attributes...)
+	otelLogger.Emit(ctx, record)
+}
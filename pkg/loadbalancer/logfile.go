@@ -0,0 +1,134 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Timestamp suffix of rotated log files; sorts in rotation order
+const rotatedLogSuffix = "20060102-150405.000"
+
+// Destination of both the access log and the operational log
+var logOutput io.Writer = os.Stdout
+
+// Log file that is rotated when it grows past maxSize or gets older than
+// interval, keeping at most maxBackups rotated files no older than maxAge
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	maxAge     time.Duration
+	file       *os.File
+	size       int64
+	openedAt   time.Time
+	mutex      sync.Mutex
+}
+
+func configureLogOutputEnv() error {
+	path := getEnv("LOG_FILE", "")
+	if path == "" {
+		return nil
+	}
+
+	var env envReader
+	file := &RotatingFile{
+		path:       path,
+		maxSize:    int64(env.Int("LOG_MAX_SIZE_MB", 100)) << 20,
+		interval:   env.Duration("LOG_ROTATE_INTERVAL", 0),
+		maxBackups: env.Int("LOG_MAX_BACKUPS", 7),
+		maxAge:     env.Duration("LOG_MAX_AGE", 0),
+	}
+	if env.err != nil {
+		return env.err
+	}
+	if err := file.open(); err != nil {
+		return fmt.Errorf("cannot open LOG_FILE: %v", err)
+	}
+
+	logOutput = file
+	log.SetOutput(file)
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.shouldRotate(len(p)) {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Log rotation failed: %v\n", err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) shouldRotate(next int) bool {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(next) > f.maxSize {
+		return true
+	}
+	return f.interval > 0 && time.Since(f.openedAt) >= f.interval
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	rotated := f.path + "." + time.Now().Format(rotatedLogSuffix)
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	go f.removeOldBackups()
+	return nil
+}
+
+func (f *RotatingFile) removeOldBackups() {
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	// Newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	for i, backup := range backups {
+		expired := false
+		if f.maxAge > 0 {
+			if info, err := os.Stat(backup); err == nil && time.Since(info.ModTime()) > f.maxAge {
+				expired = true
+			}
+		}
+		if (f.maxBackups > 0 && i >= f.maxBackups) || expired {
+			os.Remove(backup)
+		}
+	}
+}
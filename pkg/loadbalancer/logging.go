@@ -0,0 +1,65 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"load-balancer-demo/internal/logging"
+)
+
+// Minimum level of log output, shared by the access log
+var logLevel = new(slog.LevelVar)
+
+func configureLogLevelEnv() error {
+	level, err := logging.ParseLevel(getEnv("LOG_LEVEL", "info"))
+	if err != nil {
+		return fmt.Errorf("invalid LOG_LEVEL: %v", err)
+	}
+	logLevel.Set(level)
+	return nil
+}
+
+// Where log messages go when an embedding program set a logger, instead of
+// the standard logger
+var logger atomic.Pointer[slog.Logger]
+
+func setLogger(l *slog.Logger) {
+	logger.Store(l)
+}
+
+// The message is only formatted when something shows it, and then once
+func logf(level slog.Level, format string, args ...any) {
+	logged := logEnabled(level)
+	shown := level >= slog.LevelWarn && tuiErrors != nil
+	if !logged && !shown {
+		return
+	}
+
+	message := fmt.Sprintf(format, args...)
+	if logged {
+		if l := logger.Load(); l != nil {
+			l.Log(context.Background(), level, message)
+		} else {
+			log.Print(message)
+		}
+		exportLog(context.Background(), level, message)
+	}
+	if shown {
+		tuiErrors.Add(time.Now().Format("15:04:05 ") + message)
+	}
+}
+
+// Lets callers on the request path skip building a message's arguments,
+// which allocate even when the message is dropped
+func logEnabled(level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func debugf(format string, args ...any) { logf(slog.LevelDebug, format, args...) }
+func infof(format string, args ...any)  { logf(slog.LevelInfo, format, args...) }
+func warnf(format string, args ...any)  { logf(slog.LevelWarn, format, args...) }
+func errorf(format string, args ...any) { logf(slog.LevelError, format, args...) }
@@ -0,0 +1,111 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"load-balancer-demo/mdns"
+)
+
+const (
+	// How long each browse waits for answers
+	mdnsBrowseWait = time.Second
+	// Browses an instance may miss before it is removed, as mDNS runs over
+	// UDP and an answer can get lost
+	mdnsMaxMissed = 3
+)
+
+// Keeps one server per instance of a service advertised with multicast DNS
+// on the local network, e.g. the API services with MDNS_SERVICE set, so a
+// demo on one LAN or Docker network needs no list of backends
+type MDNSDiscovery struct {
+	// e.g. "_user-api._tcp"
+	service  string
+	interval time.Duration
+	options  string
+}
+
+func getMDNSDiscoveryEnv() (*MDNSDiscovery, error) {
+	service := getEnv("MDNS_SERVICE", "")
+	if service == "" {
+		return nil, nil
+	}
+	interval, err := getEnvDuration("MDNS_INTERVAL", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &MDNSDiscovery{
+		service:  strings.TrimSuffix(strings.TrimSuffix(service, "."), ".local"),
+		interval: interval,
+		options:  getEnv("MDNS_SERVER_OPTIONS", ""),
+	}, nil
+}
+
+func (m *MDNSDiscovery) source() string {
+	return "mdns:" + m.service
+}
+
+func (m *MDNSDiscovery) Watch(ctx context.Context) (<-chan []Backend, error) {
+	updates := make(chan []Backend)
+	go func() {
+		defer close(updates)
+		// Browses missed in a row, by backend URL
+		missed := map[string]int{}
+		options := map[string]string{}
+		for ; ; sleepContext(ctx, m.interval) {
+			if ctx.Err() != nil {
+				return
+			}
+			instances, err := mdns.Browse(ctx, m.service, mdnsBrowseWait)
+			if err != nil {
+				if ctx.Err() == nil {
+					errorf("❌ Browsing %s failed, keeping current servers: %v", m.source(), err)
+				}
+				continue
+			}
+
+			found := map[string]bool{}
+			for _, instance := range instances {
+				rawURL, instanceOptions := m.backend(instance)
+				found[rawURL] = true
+				missed[rawURL] = 0
+				options[rawURL] = instanceOptions
+			}
+			for rawURL := range missed {
+				if !found[rawURL] {
+					if missed[rawURL]++; missed[rawURL] >= mdnsMaxMissed {
+						delete(missed, rawURL)
+						delete(options, rawURL)
+					}
+				}
+			}
+
+			backends := []Backend{}
+			for rawURL := range missed {
+				backends = append(backends, Backend{URL: rawURL, Options: options[rawURL]})
+			}
+			if !sendBackends(ctx, updates, backends) {
+				return
+			}
+		}
+	}()
+	return updates, nil
+}
+
+// URL and options of an instance, at its first address. Options from its
+// TXT record's "options" key, e.g. "weight=2", go after MDNS_SERVER_OPTIONS
+// so they win.
+func (m *MDNSDiscovery) backend(instance mdns.Instance) (string, string) {
+	rawURL := "http://" + net.JoinHostPort(instance.Addrs[0].String(), strconv.Itoa(instance.Port))
+	options := m.options
+	if own := instance.Text["options"]; own != "" {
+		if options != "" {
+			options += ";"
+		}
+		options += own
+	}
+	return rawURL, options
+}
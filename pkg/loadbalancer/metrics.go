@@ -0,0 +1,390 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Prometheus metrics of the load balancer, served on METRICS_PATH, and
+// optionally pushed to StatsD
+type Metrics struct {
+	Path             string
+	statsd           *StatsdClient
+	handler          http.Handler
+	requests         *prometheus.CounterVec
+	duration         *prometheus.HistogramVec
+	upstreamRequests *prometheus.CounterVec
+	upstreamErrors   *prometheus.CounterVec
+	upstreamDuration *prometheus.HistogramVec
+	healthChecks     *prometheus.CounterVec
+	healthCheckTime  *prometheus.HistogramVec
+	blockedClients   *prometheus.CounterVec
+	bans             *prometheus.CounterVec
+	wafMatches       *prometheus.CounterVec
+	authFailures     *prometheus.CounterVec
+	coalesced        *prometheus.CounterVec
+	queueRejected    *prometheus.CounterVec
+	retries          *prometheus.CounterVec
+	healthCheckConns *prometheus.CounterVec
+	healthConnTime   *prometheus.HistogramVec
+}
+
+func newMetrics(lb *LoadBalancer) (*Metrics, error) {
+	statsd, err := getStatsdEnv()
+	if err != nil {
+		return nil, err
+	}
+	m := &Metrics{
+		Path:   getEnv("METRICS_PATH", "/metrics"),
+		statsd: statsd,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_http_requests_total",
+			Help: "Requests handled by the load balancer.",
+		}, []string{"route", "method", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lb_http_request_duration_seconds",
+			Help:    "Time to handle a request, including retries and queueing.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		upstreamRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_upstream_http_requests_total",
+			Help: "Responses received from backends.",
+		}, []string{"backend", "code"}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_upstream_errors_total",
+			Help: "Failed requests to backends by error class, including 5xx responses.",
+		}, []string{"backend", "class"}),
+		upstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lb_upstream_http_request_duration_seconds",
+			Help:    "Time until a backend returned response headers.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"backend"}),
+		healthChecks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_health_checks_total",
+			Help: "Health check probes by result (success or failure).",
+		}, []string{"backend", "result"}),
+		healthCheckTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lb_health_check_duration_seconds",
+			Help:    "Time a health check probe took, including failed ones.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"backend"}),
+		blockedClients: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_blocked_requests_total",
+			Help: "Requests refused with 403 by IP_ALLOW, IP_DENY or the ban list, by the list that blocked them.",
+		}, []string{"list"}),
+		bans: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_client_bans_total",
+			Help: "Clients banned automatically, by the violation that got them banned.",
+		}, []string{"reason"}),
+		wafMatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_waf_matches_total",
+			Help: "Requests matching a WAF rule, by rule and whether it blocked them (enforce) or only logged them (log).",
+		}, []string{"rule", "mode"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_auth_failures_total",
+			Help: "401 and 403 answers to proxied requests, by whether the balancer's checks or a backend refused them.",
+		}, []string{"source", "code"}),
+		healthCheckConns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_health_check_connections_total",
+			Help: "Connections health checks went over, by backend and whether the connection was reused or new.",
+		}, []string{"backend", "connection"}),
+		healthConnTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lb_health_check_connect_seconds",
+			Help:    "Time health checks spent dialing and handshaking new connections, by backend; saved by reused ones.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 12),
+		}, []string{"backend"}),
+		coalesced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_coalesced_requests_total",
+			Help: "Requests answered with the response of an identical request in flight, by route.",
+		}, []string{"route"}),
+		queueRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_queue_rejected_total",
+			Help: "Requests that got no server from the request queue, by whether it was full or they timed out waiting.",
+		}, []string{"reason"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_retries_total",
+			Help: "Requests retried after a failed attempt, by the backend the retry went to.",
+		}, []string{"backend"}),
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.duration, m.upstreamRequests, m.upstreamErrors, m.upstreamDuration,
+		m.healthChecks, m.healthCheckTime, m.blockedClients, m.bans, m.wafMatches, m.authFailures,
+		m.coalesced, m.healthCheckConns, m.healthConnTime, m.queueRejected, m.retries,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "lb_http_requests_in_flight",
+			Help: "Requests currently being handled by the load balancer.",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&lb.inFlight))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "lb_queue_depth",
+			Help: "Requests waiting in the request queue for a server to free up.",
+		}, func() float64 {
+			return float64(lb.queue.Depth())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "lb_client_connections",
+			Help: "Client connections open to the traffic listener.",
+		}, func() float64 {
+			return float64(clientConns.open.Load())
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "lb_client_connections_waited_total",
+			Help: "Client connections that waited in the accept backlog because MAX_CONNECTIONS were open.",
+		}, func() float64 {
+			return float64(clientConns.waited.Load())
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "lb_access_log_dropped_total",
+			Help: "Access log lines dropped because writing them fell ACCESS_LOG_BUFFER lines behind.",
+		}, func() float64 {
+			return float64(lb.accessLog.Dropped())
+		}),
+		&backendCollector{lb: lb},
+	)
+	// Exemplars are only part of the OpenMetrics format, which Prometheus
+	// negotiates when exemplar storage is enabled
+	m.handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+
+	return m, nil
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
+
+// Requests are labeled with the configured route prefix they matched, so
+// the label set stays bounded whatever paths clients send
+func (m *Metrics) observeRequest(r *http.Request, route string, status int, duration time.Duration) {
+	if route == "" {
+		route = internalRouteLabel
+	}
+	method := metricMethod(r.Method)
+
+	m.requests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+	observeWithTrace(r.Context(), m.duration.WithLabelValues(route, method), duration.Seconds())
+
+	// Building the tags costs allocations on every request
+	if m.statsd != nil {
+		tags := []string{"route:" + route, "method:" + method, "code:" + strconv.Itoa(status)}
+		m.statsd.Count("requests", 1, tags...)
+		m.statsd.Timing("request.duration", duration, tags...)
+	}
+}
+
+func (m *Metrics) observeUpstream(ctx context.Context, server *Server, status int, start time.Time) {
+	backend := server.URL.Host
+	m.upstreamRequests.WithLabelValues(backend, strconv.Itoa(status)).Inc()
+	observeWithTrace(ctx, m.upstreamDuration.WithLabelValues(backend), time.Since(start).Seconds())
+
+	if m.statsd != nil {
+		m.statsd.Count("upstream.requests", 1, "backend:"+backend, "code:"+strconv.Itoa(status))
+		m.statsd.Timing("upstream.duration", time.Since(start), "backend:"+backend)
+	}
+
+	if status >= 500 {
+		m.observeUpstreamError(server, ErrorClassHTTP5xx)
+	}
+}
+
+func (m *Metrics) observeUpstreamError(server *Server, class string) {
+	m.upstreamErrors.WithLabelValues(server.URL.Host, class).Inc()
+	m.statsd.Count("upstream.errors", 1, "backend:"+server.URL.Host, "class:"+class)
+}
+
+// Attaches the trace ID of a sampled request as an exemplar, so a latency
+// spike in Grafana links straight to a trace of it
+func observeWithTrace(ctx context.Context, observer prometheus.Observer, value float64) {
+	span := trace.SpanContextFromContext(ctx)
+	if exemplars, ok := observer.(prometheus.ExemplarObserver); ok && span.IsSampled() {
+		exemplars.ObserveWithExemplar(value, prometheus.Labels{"trace_id": span.TraceID().String()})
+		return
+	}
+	observer.Observe(value)
+}
+
+// Route label of the load balancer's own endpoints
+const internalRouteLabel = "internal"
+
+// Clients can send any method, so unknown ones share a label
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+func (m *Metrics) observeHealthCheck(server *Server, healthy bool, start time.Time) {
+	backend := server.URL.Host
+	result := "failure"
+	if healthy {
+		result = "success"
+	}
+
+	m.healthChecks.WithLabelValues(backend, result).Inc()
+	m.healthCheckTime.WithLabelValues(backend).Observe(time.Since(start).Seconds())
+
+	m.statsd.Count("health_checks", 1, "backend:"+backend, "result:"+result)
+	m.statsd.Timing("health_check.duration", time.Since(start), "backend:"+backend)
+}
+
+func (m *Metrics) observeBlockedClient(list string) {
+	m.blockedClients.WithLabelValues(list).Inc()
+	m.statsd.Count("blocked_requests", 1, "list:"+list)
+}
+
+func (m *Metrics) observeHealthCheckConn(server *Server, reused bool, connect time.Duration) {
+	backend := server.URL.Host
+	connection := "new"
+	if reused {
+		connection = "reused"
+	} else {
+		m.healthConnTime.WithLabelValues(backend).Observe(connect.Seconds())
+	}
+	m.healthCheckConns.WithLabelValues(backend, connection).Inc()
+	m.statsd.Count("health_check_connections", 1, "backend:"+backend, "connection:"+connection)
+}
+
+func (m *Metrics) observeCoalesced(route string) {
+	m.coalesced.WithLabelValues(route).Inc()
+	m.statsd.Count("coalesced_requests", 1, "route:"+route)
+}
+
+func (m *Metrics) observeBan(reason string) {
+	m.bans.WithLabelValues(reason).Inc()
+	m.statsd.Count("client_bans", 1, "reason:"+reason)
+}
+
+func (m *Metrics) observeAuthFailure(source string, status int) {
+	code := strconv.Itoa(status)
+	m.authFailures.WithLabelValues(source, code).Inc()
+	m.statsd.Count("auth_failures", 1, "source:"+source, "code:"+code)
+}
+
+func (m *Metrics) observeWAFMatch(rule, mode string) {
+	m.wafMatches.WithLabelValues(rule, mode).Inc()
+	m.statsd.Count("waf_matches", 1, "rule:"+rule, "mode:"+mode)
+}
+
+var (
+	backendHealthyDesc = prometheus.NewDesc(
+		"lb_backend_healthy", "Whether the backend passes health checks (1) or is down (0).",
+		[]string{"backend", "pool"}, nil)
+	backendMaintenanceDesc = prometheus.NewDesc(
+		"lb_backend_maintenance", "Whether the backend is in maintenance mode.",
+		[]string{"backend", "pool"}, nil)
+	backendDisabledDesc = prometheus.NewDesc(
+		"lb_backend_disabled", "Whether the backend was disabled through the admin API.",
+		[]string{"backend", "pool"}, nil)
+	backendActiveDesc = prometheus.NewDesc(
+		"lb_backend_http_requests_in_flight", "Requests currently proxied to the backend.",
+		[]string{"backend", "pool"}, nil)
+	backendConnsDesc = prometheus.NewDesc(
+		"lb_backend_upstream_connections", "Connections open to the backend, by whether they serve a request (active) or wait for one (idle).",
+		[]string{"backend", "pool", "state"}, nil)
+	backendDialsDesc = prometheus.NewDesc(
+		"lb_backend_upstream_dials_total", "Connections dialed to the backend; a fast rise next to steady traffic means they aren't reused.",
+		[]string{"backend", "pool"}, nil)
+	backendLatencyDesc = prometheus.NewDesc(
+		"lb_backend_latency_seconds", "Upstream latency quantiles of the backend since start.",
+		[]string{"backend", "pool", "quantile"}, nil)
+)
+
+var latencyQuantiles = []float64{0.5, 0.95, 0.99}
+
+// Reports per-backend state at scrape time, so backends added or removed
+// at runtime show up without bookkeeping
+type backendCollector struct {
+	lb *LoadBalancer
+}
+
+func (c *backendCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backendHealthyDesc
+	ch <- backendMaintenanceDesc
+	ch <- backendDisabledDesc
+	ch <- backendActiveDesc
+	ch <- backendConnsDesc
+	ch <- backendDialsDesc
+	ch <- backendLatencyDesc
+}
+
+func (c *backendCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, server := range c.lb.Servers() {
+		labels := []string{server.URL.Host, server.Pool}
+		ch <- prometheus.MustNewConstMetric(backendHealthyDesc, prometheus.GaugeValue, boolToFloat(server.IsHealthy()), labels...)
+		ch <- prometheus.MustNewConstMetric(backendMaintenanceDesc, prometheus.GaugeValue, boolToFloat(server.InMaintenance()), labels...)
+		ch <- prometheus.MustNewConstMetric(backendDisabledDesc, prometheus.GaugeValue, boolToFloat(server.IsDisabled()), labels...)
+		ch <- prometheus.MustNewConstMetric(backendActiveDesc, prometheus.GaugeValue, float64(atomic.LoadInt64(&server.active)), labels...)
+		active, idle, dials := server.upstreamConns()
+		ch <- prometheus.MustNewConstMetric(backendConnsDesc, prometheus.GaugeValue, float64(active), append(labels, "active")...)
+		ch <- prometheus.MustNewConstMetric(backendConnsDesc, prometheus.GaugeValue, float64(idle), append(labels, "idle")...)
+		ch <- prometheus.MustNewConstMetric(backendDialsDesc, prometheus.CounterValue, float64(dials), labels...)
+
+		for _, q := range latencyQuantiles {
+			latency := server.Stats.latency.Quantile(q)
+			ch <- prometheus.MustNewConstMetric(backendLatencyDesc, prometheus.GaugeValue, latency.Seconds(),
+				append(labels, strconv.FormatFloat(q, 'g', -1, 64))...)
+		}
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Captures the status code and body size written through it, and the
+// start of the body when it is body-logged
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	body   *cappedBuffer
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	if s.body != nil {
+		s.body.Write(b[:n])
+	}
+	return n, err
+}
+
+// Lets http.ResponseController reach Flush and friends of the wrapped writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Lets WebSocket upgrades take over the connection; the upgrader asserts
+// http.Hijacker instead of going through http.ResponseController
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(s.ResponseWriter).Hijack()
+	if err == nil {
+		s.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
@@ -0,0 +1,265 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"load-balancer-demo/requestid"
+)
+
+// Wraps the next step of handling a request, as net/http middleware does
+type Middleware func(next http.Handler) http.Handler
+
+// Steps every request passes through before it is proxied, in their
+// default order; MIDDLEWARE may reorder them and place middleware added
+// with Use between them
+var builtinMiddleware = []string{
+	"sanitize", "requestid", "instrument", "normalize", "identity", "internal", "drain",
+	"route", "filter", "cors", "auth", "ratelimit",
+}
+
+// Steps that only work after others, e.g. auth needs the route matched
+var middlewareDependencies = map[string][]string{
+	"instrument": {"requestid"},
+	"route":      {"instrument", "normalize"},
+	"internal":   {"normalize"},
+	"filter":     {"sanitize"},
+	"cors":       {"route"},
+	"auth":       {"route", "identity", "sanitize"},
+	"ratelimit":  {"route"},
+}
+
+type namedMiddleware struct {
+	name       string
+	middleware Middleware
+}
+
+// Adds middleware that requests pass through after the built-in steps,
+// right before they are proxied, unless MIDDLEWARE lists name elsewhere.
+// Has to be called before Handler.
+func (lb *LoadBalancer) Use(name string, middleware Middleware) {
+	lb.middleware = append(lb.middleware, namedMiddleware{name, middleware})
+}
+
+func (lb *LoadBalancer) middlewareByName() (map[string]Middleware, error) {
+	steps := map[string]Middleware{
+		"sanitize":   lb.sanitizeHeaders,
+		"requestid":  requestid.Middleware,
+		"instrument": lb.instrument,
+		"normalize":  lb.normalizeStep,
+		"identity":   lb.identityStep,
+		"internal":   lb.internalStep,
+		"drain":      lb.drainStep,
+		"route":      lb.routeStep,
+		"filter":     lb.filterStep,
+		"cors":       lb.corsStep,
+		"auth":       lb.authStep,
+		"ratelimit":  lb.rateLimitStep,
+	}
+	for _, m := range lb.middleware {
+		if _, ok := steps[m.name]; ok {
+			return nil, fmt.Errorf("middleware %q is already defined", m.name)
+		}
+		steps[m.name] = m.middleware
+	}
+	return steps, nil
+}
+
+// MIDDLEWARE, the built-in steps and added middleware in the order requests
+// pass through them; every built-in step has to be listed, and middleware
+// added with Use but not listed comes last
+func (lb *LoadBalancer) middlewareOrderEnv(steps map[string]Middleware) ([]string, error) {
+	order := builtinMiddleware
+	if value := getEnv("MIDDLEWARE", ""); value != "" {
+		order = nil
+		for _, name := range strings.Split(value, ",") {
+			order = append(order, strings.TrimSpace(name))
+		}
+	} else {
+		order = slices.Clone(order)
+	}
+	for _, m := range lb.middleware {
+		if !slices.Contains(order, m.name) {
+			order = append(order, m.name)
+		}
+	}
+
+	for i, name := range order {
+		if steps[name] == nil {
+			return nil, fmt.Errorf("invalid MIDDLEWARE: unknown middleware %q", name)
+		}
+		if slices.Contains(order[:i], name) {
+			return nil, fmt.Errorf("invalid MIDDLEWARE: %q is listed twice", name)
+		}
+		for _, dependency := range middlewareDependencies[name] {
+			if !slices.Contains(order[:i], dependency) {
+				return nil, fmt.Errorf("invalid MIDDLEWARE: %q has to come after %q", name, dependency)
+			}
+		}
+	}
+	for _, name := range builtinMiddleware {
+		if !slices.Contains(order, name) {
+			return nil, fmt.Errorf("invalid MIDDLEWARE: %q is missing", name)
+		}
+	}
+	return order, nil
+}
+
+// Wraps the proxying in the middleware chain
+func (lb *LoadBalancer) buildHandler() (http.Handler, error) {
+	steps, err := lb.middlewareByName()
+	if err != nil {
+		return nil, err
+	}
+	order, err := lb.middlewareOrderEnv(steps)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := http.Handler(http.HandlerFunc(lb.proxyRequest))
+	for i := len(order) - 1; i >= 0; i-- {
+		handler = steps[order[i]](handler)
+	}
+	return handler, nil
+}
+
+// Runs next unless handle answered the request itself
+func step(next http.Handler, handle func(w http.ResponseWriter, r *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !handle(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Normalizes the URL before any path-based routing, so sloppy URLs can't
+// bypass it
+func (lb *LoadBalancer) normalizeStep(next http.Handler) http.Handler {
+	return step(next, lb.normalize.Apply)
+}
+
+// Replaces the identity headers clients could forge with the verified
+// client certificate's
+func (lb *LoadBalancer) identityStep(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setClientIdentity(r)
+		lb.stripIdentityHeaders(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Answers the load balancer's own endpoints: probes, status, dashboard and
+// events
+func (lb *LoadBalancer) internalStep(next http.Handler) http.Handler {
+	return step(next, func(w http.ResponseWriter, r *http.Request) bool {
+		switch r.URL.Path {
+		case "/livez":
+			handleLivez(w, r)
+			return true
+		case "/readyz":
+			lb.handleReadyz(w, r)
+			return true
+		}
+
+		if lb.admin.isProtectedStatus(r.URL.Path) && !lb.admin.authorizeStatus(w, r) {
+			return true
+		}
+		switch r.URL.Path {
+		case "/lb-status":
+			lb.handleStatus(w, r)
+		case "/lb-status/top":
+			lb.topPaths.ServeHTTP(w, r)
+		case "/lb-status/fairness":
+			lb.handleFairness(w, r)
+		case "/lb-status/schema":
+			handleStatusSchema(w, r)
+		case "/lb-dashboard":
+			handleDashboard(w, r)
+		case "/lb-events":
+			lb.events.ServeHTTP(w, r)
+		default:
+			return false
+		}
+		return true
+	})
+}
+
+func (lb *LoadBalancer) drainStep(next http.Handler) http.Handler {
+	return step(next, lb.refuseWhileDraining)
+}
+
+// Matches the request to its route, which the later steps apply
+func (lb *LoadBalancer) routeStep(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := lb.Routes().Match(r.URL.Path)
+		info := getRequestInfo(r.Context())
+		info.route, info.matched = route.Prefix, route
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The route matched by the route step
+func requestRoute(r *http.Request) *Route {
+	return getRequestInfo(r.Context()).matched
+}
+
+// Refuses blocked and banned clients and requests the WAF rules match
+func (lb *LoadBalancer) filterStep(next http.Handler) http.Handler {
+	return step(next, func(w http.ResponseWriter, r *http.Request) bool {
+		return lb.refuseBlockedClient(w, r) || lb.refuseBannedClient(w, r) || lb.refuseWAFMatch(w, r)
+	})
+}
+
+// Preflights carry no token, so they are answered before it is checked
+func (lb *LoadBalancer) corsStep(next http.Handler) http.Handler {
+	return step(next, func(w http.ResponseWriter, r *http.Request) bool {
+		return lb.handleCORS(w, r, requestRoute(r))
+	})
+}
+
+// A route's policies all apply, e.g. an API key for the calling service and
+// a token for the user. Public routes skip the recorder.
+func (lb *LoadBalancer) authStep(next http.Handler) http.Handler {
+	return step(next, func(w http.ResponseWriter, r *http.Request) bool {
+		route := requestRoute(r)
+		if !route.APIKey && !route.JWT && !route.Introspect {
+			return false
+		}
+		auth := &statusRecorder{ResponseWriter: w}
+		if !lb.authenticateAPIKey(auth, r, route) || !lb.authenticateJWT(auth, r, route) || !lb.introspectToken(auth, r, route) {
+			lb.observeAuthFailure(r, auth.status, "balancer")
+			return true
+		}
+		return false
+	})
+}
+
+// Applies the per-client, global and route rate limits
+func (lb *LoadBalancer) rateLimitStep(next http.Handler) http.Handler {
+	return step(next, func(w http.ResponseWriter, r *http.Request) bool {
+		if lb.clientRateLimit != nil {
+			if ok, retryAfter := lb.clientRateLimit.Allow(lb.trustedProxies.ClientIP(r)); !ok {
+				lb.recordViolation(r, "rate_limited")
+				writeTooManyRequests(w, retryAfter)
+				return true
+			}
+		}
+
+		if lb.rateLimit != nil {
+			if ok, retryAfter := lb.rateLimit.Allow(); !ok {
+				writeTooManyRequests(w, retryAfter)
+				return true
+			}
+		}
+
+		if route := requestRoute(r); route.rateLimit != nil {
+			if ok, retryAfter := route.rateLimit.Allow(); !ok {
+				writeTooManyRequests(w, retryAfter)
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,116 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Trailing-slash redirect modes
+const (
+	TrailingSlashStrip = "strip"
+	TrailingSlashAdd   = "add"
+)
+
+type URLNormalization struct {
+	CollapseSlashes    bool
+	ResolveDotSegments bool
+	TrailingSlash      string
+}
+
+func getURLNormalizationEnv() (URLNormalization, error) {
+	var env envReader
+	normalization := URLNormalization{
+		CollapseSlashes:    env.Bool("NORMALIZE_SLASHES", true),
+		ResolveDotSegments: env.Bool("NORMALIZE_DOT_SEGMENTS", true),
+		TrailingSlash:      getEnv("TRAILING_SLASH_REDIRECT", ""),
+	}
+	return normalization, env.err
+}
+
+// Normalizes the request path in place before routing. Returns true when a
+// trailing-slash redirect was written and the request must not be proxied.
+func (n URLNormalization) Apply(w http.ResponseWriter, r *http.Request) bool {
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	if n.CollapseSlashes {
+		path = collapseSlashes(path)
+	}
+	if n.ResolveDotSegments {
+		path = resolveDotSegments(path)
+	}
+
+	if path != r.URL.Path {
+		r.URL.Path = path
+		r.URL.RawPath = ""
+	}
+
+	redirect := ""
+	switch n.TrailingSlash {
+	case TrailingSlashStrip:
+		if path != "/" && strings.HasSuffix(path, "/") {
+			redirect = strings.TrimRight(path, "/")
+		}
+	case TrailingSlashAdd:
+		if !strings.HasSuffix(path, "/") {
+			redirect = path + "/"
+		}
+	}
+
+	if redirect == "" {
+		return false
+	}
+
+	target := *r.URL
+	target.Path = redirect
+	target.RawPath = ""
+	http.Redirect(w, r, target.RequestURI(), http.StatusPermanentRedirect)
+	return true
+}
+
+func collapseSlashes(path string) string {
+	for strings.Contains(path, "//") {
+		path = strings.ReplaceAll(path, "//", "/")
+	}
+	return path
+}
+
+// RFC 3986 section 5.2.4, applied to an absolute path. Unlike path.Clean it
+// keeps empty segments and the trailing slash intact.
+func resolveDotSegments(path string) string {
+	if !strings.Contains(path, ".") {
+		return path
+	}
+
+	segments := strings.Split(path, "/")
+	output := make([]string, 0, len(segments))
+
+	for i, segment := range segments {
+		last := i == len(segments)-1
+
+		switch segment {
+		case ".":
+			if last {
+				output = append(output, "")
+			}
+		case "..":
+			// Never climb above the root segment
+			if len(output) > 1 {
+				output = output[:len(output)-1]
+			}
+			if last {
+				output = append(output, "")
+			}
+		default:
+			output = append(output, segment)
+		}
+	}
+
+	resolved := strings.Join(output, "/")
+	if !strings.HasPrefix(resolved, "/") {
+		resolved = "/" + resolved
+	}
+	return resolved
+}
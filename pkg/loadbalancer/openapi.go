@@ -0,0 +1,14 @@
+package loadbalancer
+
+import (
+	"net/http"
+)
+
+// OpenAPI description of the admin and status endpoints. The Go client in
+// adminclient is generated from it, so keep it in step with the handlers.
+var openAPISpec = asset("openapi.json")
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// A setting given to New instead of through the environment
+type Option func(*buildOptions)
+
+// What options set besides environment variables
+type buildOptions struct {
+	transport *http.Transport
+	clock     Clock
+}
+
+// Sets the setting of an environment variable, e.g.
+// WithSetting("RETRY_ATTEMPTS", "2"). Like CONFIG_FILE's, settings are
+// process-wide, so load balancers built later see them too.
+func WithSetting(key, value string) Option {
+	return func(*buildOptions) {
+		os.Setenv(key, value)
+	}
+}
+
+// Backends in the TARGET_SERVICES syntax, e.g. "http://api-1:8080;pool=heavy"
+func WithTargetServices(targets ...string) Option {
+	return WithSetting("TARGET_SERVICES", strings.Join(targets, ","))
+}
+
+// Backends as discovery providers report them, in place of TARGET_SERVICES
+func WithBackends(backends ...Backend) Option {
+	targets := make([]string, 0, len(backends))
+	for _, backend := range backends {
+		target := backend.URL
+		if backend.Options != "" {
+			target += ";" + backend.Options
+		}
+		targets = append(targets, target)
+	}
+	return WithTargetServices(targets...)
+}
+
+// Path prefixes in the ROUTES syntax, e.g. "/api/users;timeout=2s"
+func WithRoutes(routes ...string) Option {
+	return WithSetting("ROUTES", strings.Join(routes, ","))
+}
+
+// The strategy pools pick their servers by, "roundrobin" or one registered
+// with RegisterStrategy, see BALANCING_STRATEGY
+func WithStrategy(name string) Option {
+	return WithSetting("BALANCING_STRATEGY", name)
+}
+
+// How backends are health-checked: with probe, "http" or one registered
+// with RegisterHealthProbe, every interval
+func WithHealthCheck(probe string, interval time.Duration) Option {
+	return func(o *buildOptions) {
+		WithSetting("HEALTH_CHECK_PROBE", probe)(o)
+		WithHealthCheckInterval(interval)(o)
+	}
+}
+
+func WithHealthCheckInterval(interval time.Duration) Option {
+	return WithSetting("HEALTH_CHECK_INTERVAL", interval.String())
+}
+
+// Sends the load balancer's log messages to logger, at their level,
+// instead of the standard logger. Like settings, logging is process-wide.
+func WithLogger(logger *slog.Logger) Option {
+	return func(*buildOptions) {
+		setLogger(logger)
+	}
+}
+
+// The transport requests are sent to backends through, in place of one
+// built from the UPSTREAM_* settings; pools with a maxconns cap use a copy
+// of it. It is used as is, so connections it dials aren't counted in the
+// upstream connection metrics.
+func WithTransport(transport *http.Transport) Option {
+	return func(o *buildOptions) {
+		o.transport = transport
+	}
+}
+
+// The clock health checks, retries, the request queue, rate limits, bans,
+// JWT checks and the response cache go by, e.g. a fake one tests advance by hand
+func WithClock(clock Clock) Option {
+	return func(o *buildOptions) {
+		o.clock = clock
+	}
+}
@@ -0,0 +1,167 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Picks the backend for a request among a pool's servers, all available,
+// e.g. by power of two choices, least connections or a header or cookie.
+// ctx is the request's, with its deadline and AttemptedBackends; r is nil
+// for Pool.GetNextServer. A server at its concurrency cap is left out and
+// Pick called again, so Pick returning nil means none of servers will do.
+type Strategy interface {
+	Pick(ctx context.Context, r *http.Request, servers []*Server) *Server
+}
+
+// Checks a backend's health in place of GET /health, e.g. with a TCP
+// connect or a gRPC health check; ctx ends after the probe timeout. A probe
+// may be called concurrently, e.g. by POST /lb-admin/healthcheck. One that
+// also implements io.Closer, e.g. to keep a connection between probes, is
+// closed once its backend is no longer checked with it: it was removed, the
+// load balancer stopped or its backend switched to another probe.
+type HealthProbe interface {
+	Probe(ctx context.Context, server *Server) error
+}
+
+// Built in and selected by default: weighted round-robin and GET /health
+const (
+	roundRobinStrategy = "roundrobin"
+	httpHealthProbe    = "http"
+)
+
+// Implementations other packages contribute, usually from init, by the
+// name config selects them by. The built-in ones map to nil.
+var plugins = struct {
+	mutex        sync.RWMutex
+	strategies   map[string]func() Strategy
+	healthProbes map[string]func() HealthProbe
+	discoveries  map[string]func() (Discovery, error)
+}{
+	strategies: map[string]func() Strategy{roundRobinStrategy: nil},
+	healthProbes: map[string]func() HealthProbe{
+		httpHealthProbe:   nil,
+		tcpHealthProbe:    func() HealthProbe { return tcpProbe{} },
+		grpcHealthProbe:   newGRPCProbe,
+		scriptHealthProbe: newScriptProbe,
+	},
+	discoveries: map[string]func() (Discovery, error){},
+}
+
+// Sources of servers that aren't discovered by a registered provider
+var reservedSources = []string{staticSource, dockerSource, registrationSource}
+
+// Makes a strategy available to the strategy option of POOLS and to
+// BALANCING_STRATEGY. newStrategy is called once per pool, so a strategy
+// may keep state such as a counter.
+func RegisterStrategy(name string, newStrategy func() Strategy) {
+	plugins.mutex.Lock()
+	defer plugins.mutex.Unlock()
+	register(plugins.strategies, "strategy", name, newStrategy)
+}
+
+// Makes a probe available to the healthprobe option of TARGET_SERVICES
+// and to HEALTH_CHECK_PROBE. newProbe is called once per backend.
+func RegisterHealthProbe(name string, newProbe func() HealthProbe) {
+	plugins.mutex.Lock()
+	defer plugins.mutex.Unlock()
+	register(plugins.healthProbes, "health probe", name, newProbe)
+}
+
+// Makes a discovery provider available to DISCOVERY. newDiscovery is
+// called when the load balancer is created and reads its own settings; name
+// is the source of the servers it finds in /lb-status.
+func RegisterDiscovery(name string, newDiscovery func() (Discovery, error)) {
+	if strings.Contains(name, ":") || slices.Contains(reservedSources, name) {
+		panic(fmt.Sprintf("discovery provider name %q is reserved", name))
+	}
+	plugins.mutex.Lock()
+	defer plugins.mutex.Unlock()
+	register(plugins.discoveries, "discovery provider", name, newDiscovery)
+}
+
+func register[T any](registry map[string]T, kind, name string, factory T) {
+	if name == "" {
+		panic(kind + " registered without a name")
+	}
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("%s %q is already registered", kind, name))
+	}
+	registry[name] = factory
+}
+
+func registered[T any](registry map[string]T, kind, name string) (T, error) {
+	plugins.mutex.RLock()
+	defer plugins.mutex.RUnlock()
+	factory, ok := registry[name]
+	if !ok {
+		names := make([]string, 0, len(registry))
+		for known := range registry {
+			names = append(names, known)
+		}
+		sort.Strings(names)
+		return factory, fmt.Errorf("unknown %s %q, expected one of %s", kind, name, strings.Join(names, ", "))
+	}
+	return factory, nil
+}
+
+// BALANCING_STRATEGY, the strategy of pools without a strategy option
+func defaultStrategyEnv() (string, Strategy, error) {
+	name := getEnv("BALANCING_STRATEGY", roundRobinStrategy)
+	strategy, err := newStrategy(name)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid BALANCING_STRATEGY: %v", err)
+	}
+	return name, strategy, nil
+}
+
+// The strategy called name; nil for round-robin, which pools pick by
+// without one
+func newStrategy(name string) (Strategy, error) {
+	newStrategy, err := registered(plugins.strategies, "strategy", name)
+	if err != nil || newStrategy == nil {
+		return nil, err
+	}
+	return newStrategy(), nil
+}
+
+// The probe called name; nil for GET /health, which servers are probed
+// with without one
+func newHealthProbe(name string) (HealthProbe, error) {
+	newProbe, err := registered(plugins.healthProbes, "health probe", name)
+	if err != nil || newProbe == nil {
+		return nil, err
+	}
+	return newProbe(), nil
+}
+
+// DISCOVERY, a comma-separated list of registered discovery providers to
+// run besides the built-in ones
+func registeredDiscoveryEnv() ([]discoveryProvider, error) {
+	var providers []discoveryProvider
+	var names []string
+	for _, name := range strings.Split(getEnv("DISCOVERY", ""), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if slices.Contains(names, name) {
+			return nil, fmt.Errorf("invalid DISCOVERY: %q is listed twice", name)
+		}
+		names = append(names, name)
+		newDiscovery, err := registered(plugins.discoveries, "discovery provider", name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DISCOVERY: %v", err)
+		}
+		discovery, err := newDiscovery()
+		if err != nil {
+			return nil, fmt.Errorf("invalid DISCOVERY: %s: %v", name, err)
+		}
+		providers = append(providers, discoveryProvider{name, discovery})
+	}
+	return providers, nil
+}
@@ -0,0 +1,616 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultPoolName = "default"
+
+// Named group of servers that routes send traffic to. Backends join a pool
+// with the "pool" option in TARGET_SERVICES; unlabeled ones are in "default".
+// A pool picks its servers by its own strategy, may health-check them its
+// own way and counts the traffic it is sent.
+type Pool struct {
+	Name        string
+	MaxRequests int64
+	MaxConns    int
+	Overflow    string
+	Strategy    string
+	Affinity    string
+	Stats       ServerStats
+	strategy    Strategy
+	servers     []*Server
+	available   atomic.Pointer[poolSnapshot]
+	current     uint64
+	inFlight    int64
+	spilled     uint64
+	transport   *http.Transport
+	// The load balancer's, which retry penalties end by
+	clock   Clock
+	options string
+	mutex   sync.RWMutex
+
+	// Health checks of members without a healthinterval, healthprobe or
+	// healthpath option of their own; zero values leave them to
+	// HEALTH_CHECK_INTERVAL, HEALTH_CHECK_PROBE and HEALTH_CHECK_PATH
+	HealthInterval time.Duration
+	HealthProbe    string
+	HealthPath     string
+}
+
+// Pools named by the given servers, plus the default pool. Servers that are
+// templates for DNS resolution name pools but aren't members themselves.
+func buildPools(servers []*Server) map[string]*Pool {
+	pools := map[string]*Pool{
+		defaultPoolName: {Name: defaultPoolName},
+	}
+
+	for _, server := range servers {
+		pool, ok := pools[server.Pool]
+		if !ok {
+			pool = &Pool{Name: server.Pool}
+			pools[server.Pool] = pool
+		}
+		if !server.resolve {
+			pool.servers = append(pool.servers, server)
+		}
+	}
+
+	return pools
+}
+
+func (p *Pool) Servers() []*Server {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.servers
+}
+
+func (p *Pool) add(server *Server) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.servers = append(p.servers[:len(p.servers):len(p.servers)], server)
+	serverStateChanged()
+}
+
+func (p *Pool) remove(server *Server) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.servers = withoutServer(p.servers, server)
+	serverStateChanged()
+}
+
+// Copy of servers without server, leaving the original slice intact for
+// readers still holding it
+func withoutServer(servers []*Server, server *Server) []*Server {
+	remaining := make([]*Server, 0, len(servers))
+	for _, s := range servers {
+		if s != server {
+			remaining = append(remaining, s)
+		}
+	}
+	return remaining
+}
+
+// Pick without a request
+func (p *Pool) GetNextServer() (*Server, error) {
+	return p.Pick(context.Background(), nil)
+}
+
+type attemptedKey struct{}
+
+// The servers a request was already sent to and failed on, in order;
+// Pool.Pick leaves them out so retries go elsewhere
+func AttemptedBackends(ctx context.Context) []*Server {
+	attempted, _ := ctx.Value(attemptedKey{}).([]*Server)
+	return attempted
+}
+
+func withAttempted(ctx context.Context, attempted []*Server) context.Context {
+	return context.WithValue(ctx, attemptedKey{}, slices.Clip(attempted))
+}
+
+// Picks the server for r, nil for none, by the pool's strategy or else
+// weighted round-robin: out of every total-weight requests, a server gets
+// as many as its weight. Servers that are unavailable, at their
+// concurrency cap or among AttemptedBackends(ctx) are skipped; those in a
+// retry penalty window are only used when nothing else is available. The
+// returned server has an in-flight slot reserved and must be released.
+// Fails with ErrNoHealthyBackends or ErrAllBackendsBusy.
+func (p *Pool) Pick(ctx context.Context, r *http.Request) (*Server, error) {
+	available := p.snapshot()
+	if attempted := AttemptedBackends(ctx); len(attempted) > 0 {
+		// Retries are rare enough to filter the servers afresh
+		available = newPoolSnapshot(p.Servers(), attempted, 0, p.clock.Now())
+	}
+	if len(available.servers) == 0 {
+		return nil, ErrNoHealthyBackends
+	}
+	if p.strategy != nil {
+		return pickByStrategy(ctx, p.strategy, r, available.weighted)
+	}
+
+	weights := available.weights
+	start, position := 0, atomic.AddUint64(&p.current, 1)%available.total
+	for position >= weights[start] {
+		position -= weights[start]
+		start++
+	}
+
+	for i := range available.servers {
+		index := (start + i) % len(available.servers)
+		if weights[index] == 0 {
+			continue
+		}
+		if server := available.servers[index]; server.Acquire() {
+			return server, nil
+		}
+	}
+
+	return nil, ErrAllBackendsBusy
+}
+
+// Asks strategy for a server until one has a slot free, leaving out those
+// that don't
+func pickByStrategy(ctx context.Context, strategy Strategy, r *http.Request, servers []*Server) (*Server, error) {
+	for candidates := servers; len(candidates) > 0; {
+		server := strategy.Pick(ctx, r, candidates)
+		if server == nil {
+			break
+		}
+		if server.Acquire() {
+			return server, nil
+		}
+		candidates = withoutServer(candidates, server)
+	}
+	return nil, ErrAllBackendsBusy
+}
+
+// Bumped by every change to whether or how much traffic a server gets:
+// health, maintenance, disabling, weight, retry penalties and pool
+// membership. Pools rebuild their snapshot when it moves on.
+var serverStateVersion atomic.Uint64
+
+func serverStateChanged() {
+	serverStateVersion.Add(1)
+}
+
+// The servers a pool picks from and their weights, as of a
+// serverStateVersion, so picking one doesn't lock or allocate
+type poolSnapshot struct {
+	version uint64
+	servers []*Server
+	weights []uint64
+	total   uint64
+	// The servers weighted above 0, what strategies pick among
+	weighted []*Server
+	// When the first retry penalty among the servers ends, in Unix
+	// nanoseconds, 0 for none; the snapshot is stale from then on
+	expires int64
+}
+
+func newPoolSnapshot(servers []*Server, exclude []*Server, version uint64, at time.Time) *poolSnapshot {
+	now := at.UnixNano()
+	snapshot := &poolSnapshot{version: version}
+	penalized := []*Server{}
+	for _, server := range servers {
+		if !server.IsAvailable() || slices.Contains(exclude, server) {
+			continue
+		}
+		if until := atomic.LoadInt64(&server.penaltyUntil); now < until {
+			penalized = append(penalized, server)
+			if snapshot.expires == 0 || until < snapshot.expires {
+				snapshot.expires = until
+			}
+			continue
+		}
+		snapshot.servers = append(snapshot.servers, server)
+	}
+	if len(snapshot.servers) == 0 {
+		snapshot.servers = penalized
+	}
+
+	snapshot.weights = make([]uint64, len(snapshot.servers))
+	for i, server := range snapshot.servers {
+		snapshot.weights[i] = uint64(server.Weight())
+		snapshot.total += snapshot.weights[i]
+	}
+	// Weight 0 drains a server, unless no other server is left
+	if snapshot.total == 0 {
+		for i := range snapshot.weights {
+			snapshot.weights[i] = 1
+		}
+		snapshot.total = uint64(len(snapshot.weights))
+	}
+	for i, server := range snapshot.servers {
+		if snapshot.weights[i] > 0 {
+			snapshot.weighted = append(snapshot.weighted, server)
+		}
+	}
+	return snapshot
+}
+
+// The pool's current snapshot, rebuilt first when servers changed since
+func (p *Pool) snapshot() *poolSnapshot {
+	version := serverStateVersion.Load()
+	snapshot := p.available.Load()
+	now := p.clock.Now()
+	if snapshot != nil && snapshot.version == version &&
+		(snapshot.expires == 0 || now.UnixNano() < snapshot.expires) {
+		return snapshot
+	}
+
+	// Built from the version read before the servers, so a change racing
+	// with the rebuild still makes the next request rebuild
+	snapshot = newPoolSnapshot(p.Servers(), nil, version, now)
+	p.available.Store(snapshot)
+	return snapshot
+}
+
+// Bulkhead: admits a request into the pool unless it is at MaxRequests, so
+// runaway traffic to one pool can't starve the others
+func (p *Pool) enter() bool {
+	for {
+		inFlight := atomic.LoadInt64(&p.inFlight)
+		if p.MaxRequests > 0 && inFlight >= p.MaxRequests {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&p.inFlight, inFlight, inFlight+1) {
+			return true
+		}
+	}
+}
+
+func (p *Pool) leave() {
+	atomic.AddInt64(&p.inFlight, -1)
+}
+
+// Enters the overflow pool of a saturated pool, nil if it has none or the
+// overflow pool is at capacity too
+func (lb *LoadBalancer) spillover(pool *Pool) *Pool {
+	overflow := lb.pool(pool.Overflow)
+	if overflow == nil || !overflow.enter() {
+		return nil
+	}
+
+	atomic.AddUint64(&pool.spilled, 1)
+	infof("🌊 Pool %s is saturated, spilling over to %s", pool.Name, overflow.Name)
+	return overflow
+}
+
+type PoolStatus struct {
+	Name        string `json:"name"`
+	Servers     int    `json:"servers"`
+	InFlight    int64  `json:"inFlight"`
+	MaxRequests int64  `json:"maxRequests,omitempty"`
+	MaxConns    int    `json:"maxConns,omitempty"`
+	Overflow    string `json:"overflow,omitempty"`
+	Strategy    string `json:"strategy"`
+	Affinity    string `json:"affinity,omitempty"`
+	Spilled     uint64 `json:"spilled"`
+	// Traffic sent to the pool's servers, including those since removed
+	Stats          *StatsSnapshot `json:"stats"`
+	HealthInterval time.Duration  `json:"healthInterval,omitempty"`
+	HealthProbe    string         `json:"healthProbe,omitempty"`
+	HealthPath     string         `json:"healthPath,omitempty"`
+}
+
+func (p *Pool) Status() PoolStatus {
+	stats := p.Stats.Snapshot()
+	return PoolStatus{
+		Name:           p.Name,
+		Servers:        len(p.Servers()),
+		InFlight:       atomic.LoadInt64(&p.inFlight),
+		MaxRequests:    p.MaxRequests,
+		MaxConns:       p.MaxConns,
+		Overflow:       p.Overflow,
+		Strategy:       p.Strategy,
+		Affinity:       p.Affinity,
+		Spilled:        atomic.LoadUint64(&p.spilled),
+		Stats:          &stats,
+		HealthInterval: p.HealthInterval,
+		HealthProbe:    p.HealthProbe,
+		HealthPath:     p.HealthPath,
+	}
+}
+
+var (
+	errRouteExists  = errors.New("route already exists")
+	errRouteMissing = errors.New("route not found")
+)
+
+// A pool as listed by the admin API, with its members and the routes that
+// send traffic to it
+type PoolDetail struct {
+	PoolStatus
+	Members []string `json:"members"`
+	Routes  []string `json:"routes"`
+}
+
+func (lb *LoadBalancer) poolDetail(pool *Pool) PoolDetail {
+	detail := PoolDetail{PoolStatus: pool.Status(), Members: []string{}, Routes: []string{}}
+	for _, server := range pool.Servers() {
+		detail.Members = append(detail.Members, server.ID())
+	}
+	for _, route := range lb.Routes() {
+		if route.Pool == pool.Name {
+			detail.Routes = append(detail.Routes, route.Prefix)
+		}
+	}
+	return detail
+}
+
+// Pool names are used in option lists, so they can't contain what
+// separates options
+func validPoolName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, ",;= \t")
+}
+
+// Creates an empty pool at runtime; options use the POOLS syntax
+func (lb *LoadBalancer) addPool(name, options string) (*Pool, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	if _, ok := lb.pools[name]; ok {
+		return nil, ErrPoolExists
+	}
+	pool := &Pool{Name: name, options: options}
+	if err := parsePoolOptions(pool, options, lb.pools); err != nil {
+		return nil, err
+	}
+	if err := pool.configure(lb.transport, lb.clock); err != nil {
+		return nil, err
+	}
+
+	lb.pools[name] = pool
+	return pool, nil
+}
+
+// Deletes a pool nothing refers to anymore: it has no servers, no route
+// sends traffic or timeouts to it, and it is no other pool's overflow
+func (lb *LoadBalancer) removePool(pool *Pool) error {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	switch {
+	case pool.Name == defaultPoolName:
+		return fmt.Errorf("%w: the default pool can't be removed", ErrPoolInUse)
+	case len(pool.Servers()) > 0:
+		return fmt.Errorf("%w: it still has servers", ErrPoolInUse)
+	}
+	// Validated at startup
+	targets, _ := parseTargetServices(targetServicesEnv())
+	for _, target := range targets {
+		if target.resolve && target.Pool == pool.Name {
+			return fmt.Errorf("%w: servers resolved from %s join it", ErrPoolInUse, target.URL.Host)
+		}
+	}
+	for _, route := range lb.routes {
+		if route.Pool == pool.Name || route.timeoutPool() == pool.Name {
+			return fmt.Errorf("%w: route %s refers to it", ErrPoolInUse, route.Prefix)
+		}
+	}
+	for _, other := range lb.pools {
+		if other.Overflow == pool.Name {
+			return fmt.Errorf("%w: it is the overflow of pool %s", ErrPoolInUse, other.Name)
+		}
+	}
+
+	delete(lb.pools, pool.Name)
+	if pool.transport != lb.transport {
+		pool.transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+// Starts routing a path prefix; the routes are replaced as a whole so
+// requests matching concurrently see either the old or the new set
+func (lb *LoadBalancer) addRoute(route *Route) error {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	for _, name := range []string{route.Pool, route.timeoutPool()} {
+		if _, ok := lb.pools[name]; name != "" && !ok {
+			return fmt.Errorf("route %s references %w %q", route.Prefix, ErrPoolNotFound, name)
+		}
+	}
+	for _, existing := range lb.routes {
+		if existing.Prefix == route.Prefix {
+			return errRouteExists
+		}
+	}
+
+	routes := append(Routes{route}, lb.routes...)
+	routes.sort()
+	lb.routes = routes
+	return nil
+}
+
+func (lb *LoadBalancer) removeRoute(prefix string) error {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	routes := Routes{}
+	for _, route := range lb.routes {
+		if route.Prefix != prefix {
+			routes = append(routes, route)
+		}
+	}
+	if len(routes) == len(lb.routes) {
+		return errRouteMissing
+	}
+	lb.routes = routes
+	return nil
+}
+
+// Copy of the server with the pool option set to pool, to replace it with.
+// The copy is probed and keeps the weight.
+func (lb *LoadBalancer) serverInPool(server *Server, pool *Pool) (*Server, error) {
+	moved, err := newServer(server.URL, setOption(server.options, "pool", pool.Name))
+	if err != nil {
+		return nil, err
+	}
+	moved.SetWeight(server.Weight())
+
+	lb.checkServer(moved)
+	return moved, nil
+}
+
+// Options with key set to value, replacing any earlier value
+func setOption(options, key, value string) string {
+	if options = withoutOption(options, key); options != "" {
+		options += ";"
+	}
+	return options + key + "=" + value
+}
+
+// Options without any value of key
+func withoutOption(options, key string) string {
+	kept := []string{}
+	for _, option := range strings.Split(options, ";") {
+		name, _, _ := strings.Cut(option, "=")
+		if option != "" && strings.TrimSpace(name) != key {
+			kept = append(kept, option)
+		}
+	}
+	return strings.Join(kept, ";")
+}
+
+// POOLS is a comma-separated list of pool names with ";key=value" options,
+// e.g. "heavy;maxrequests=20;maxconns=10"
+func configurePoolsEnv(pools map[string]*Pool, transport *http.Transport, clock Clock) error {
+	for _, value := range strings.Split(getEnv("POOLS", ""), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		name, options, _ := strings.Cut(value, ";")
+		pool, ok := pools[strings.TrimSpace(name)]
+		if !ok {
+			return fmt.Errorf("POOLS configures %w %q", ErrPoolNotFound, name)
+		}
+		if err := parsePoolOptions(pool, options, pools); err != nil {
+			return err
+		}
+		pool.options = options
+	}
+
+	for _, pool := range pools {
+		if err := pool.configure(transport, clock); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies ";key=value" pool options; an overflow pool must be one of pools
+func parsePoolOptions(pool *Pool, options string, pools map[string]*Pool) error {
+	for _, option := range strings.Split(options, ";") {
+		key, value, _ := strings.Cut(option, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if key == "" {
+			continue
+		}
+
+		if key == "strategy" {
+			strategy, err := newStrategy(value)
+			if err != nil {
+				return fmt.Errorf("invalid strategy for pool %s: %v", pool.Name, err)
+			}
+			pool.Strategy, pool.strategy = value, strategy
+			continue
+		}
+
+		if key == "healthinterval" {
+			interval, err := time.ParseDuration(value)
+			if err != nil || interval <= 0 {
+				return fmt.Errorf("invalid healthinterval %q for pool %s", value, pool.Name)
+			}
+			pool.HealthInterval = interval
+			continue
+		}
+
+		if key == "healthprobe" {
+			if err := checkHealthProbe(value); err != nil {
+				return fmt.Errorf("invalid healthprobe for pool %s: %v", pool.Name, err)
+			}
+			pool.HealthProbe = value
+			continue
+		}
+
+		if key == "healthpath" {
+			if err := checkHealthPath(value); err != nil {
+				return fmt.Errorf("invalid healthpath for pool %s: %v", pool.Name, err)
+			}
+			pool.HealthPath = value
+			continue
+		}
+
+		if key == "affinity" {
+			if value != affinityCookie {
+				return fmt.Errorf("invalid affinity %q for pool %s, want %s", value, pool.Name, affinityCookie)
+			}
+			pool.Affinity = value
+			continue
+		}
+
+		if key == "overflow" {
+			if _, ok := pools[value]; !ok || value == pool.Name {
+				return fmt.Errorf("invalid overflow pool %q for pool %s", value, pool.Name)
+			}
+			pool.Overflow = value
+			continue
+		}
+
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return fmt.Errorf("invalid %s %q for pool %s", key, value, pool.Name)
+		}
+
+		switch key {
+		case "maxrequests":
+			pool.MaxRequests = int64(limit)
+		case "maxconns":
+			pool.MaxConns = limit
+		default:
+			return fmt.Errorf("unknown option %q for pool %s", key, pool.Name)
+		}
+	}
+	return nil
+}
+
+// Readies a pool once its options are applied: its transport, transport or
+// a capped copy, its clock, and BALANCING_STRATEGY's strategy unless an
+// option picked one
+func (p *Pool) configure(transport *http.Transport, clock Clock) error {
+	p.transport = newPoolTransport(transport, p.MaxConns)
+	p.clock = clock
+	if p.Strategy == "" {
+		var err error
+		if p.Strategy, p.strategy, err = defaultStrategyEnv(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pools with a maxconns cap dial through their own transport, so their
+// upstream connections are capped and kept apart from every other pool's;
+// the others share shared
+func newPoolTransport(shared *http.Transport, maxConns int) *http.Transport {
+	if maxConns == 0 {
+		return shared
+	}
+	transport := shared.Clone()
+	transport.MaxConnsPerHost = maxConns
+	return transport
+}
@@ -0,0 +1,30 @@
+package loadbalancer
+
+import (
+	"net/http"
+)
+
+// Kubernetes probe endpoints for the load balancer itself. A bad config is
+// fatal at startup, so serving at all means it loaded; /readyz additionally
+// needs a backend that can take traffic, so a balancer with nothing healthy
+// behind it is taken out of rotation instead of answering 503s, as is one
+// that is draining.
+func handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+func (lb *LoadBalancer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if lb.draining() {
+		http.Error(w, "Draining", http.StatusServiceUnavailable)
+		return
+	}
+	for _, server := range lb.Servers() {
+		if server.IsAvailable() {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte("ok\n"))
+			return
+		}
+	}
+	http.Error(w, "No healthy backend available", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,161 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"load-balancer-demo/requestid"
+)
+
+// Body copies of every backend's proxy share these buffers
+var proxyBuffers = newBufferPool()
+
+// The files connections to HTTPS backends use, nil for Go's defaults
+var upstreamTLS *TLSFiles
+
+// What pools without a maxconns cap dial through, so backends' idle
+// connections are kept and reused across requests. Go's default of two idle
+// connections per host would make busy backends redial constantly.
+var sharedTransport = sync.OnceValues(func() (*http.Transport, error) {
+	var env envReader
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = env.Int("UPSTREAM_MAX_IDLE_CONNS", 1024)
+	transport.MaxIdleConnsPerHost = env.Int("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", 256)
+	transport.MaxConnsPerHost = env.Int("UPSTREAM_MAX_CONNS_PER_HOST", 0)
+	transport.IdleConnTimeout = env.Duration("UPSTREAM_IDLE_CONN_TIMEOUT", 90*time.Second)
+	transport.DialContext = dialUpstream
+	if upstreamTLS != nil {
+		transport.DialTLSContext = upstreamTLS.DialTLSContext
+	}
+	return transport, env.err
+})
+
+// One request's trip to a backend, handed to the server's prebuilt proxy
+// through the request context
+type proxyAttempt struct {
+	lb     *LoadBalancer
+	server *Server
+	route  *Route
+	pool   *Pool
+	// The request as proxied, with the route timeout
+	request *http.Request
+	// The context without the route timeout, to tell timeouts from clients
+	// going away
+	parent context.Context
+	start  time.Time
+	status int
+	err    error
+}
+
+type proxyAttemptKey struct{}
+
+func attemptFrom(ctx context.Context) *proxyAttempt {
+	return ctx.Value(proxyAttemptKey{}).(*proxyAttempt)
+}
+
+// Built once per backend by newServer; everything that differs between
+// requests comes from their proxyAttempt
+func newServerProxy(server *Server) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(server.URL)
+	proxy.BufferPool = proxyBuffers
+	proxy.Transport = poolTransport{}
+
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		server.rewriteHost(req)
+		injectTraceContext(req)
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		attemptFrom(req.Context()).handleError(err)
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		return attemptFrom(resp.Request.Context()).modifyResponse(resp)
+	}
+	return proxy
+}
+
+// Sends the request through the transport of the pool it was picked from
+type poolTransport struct{}
+
+func (poolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return attemptFrom(req.Context()).pool.transport.RoundTrip(req)
+}
+
+func (a *proxyAttempt) handleError(err error) {
+	lb, server := a.lb, a.server
+
+	// A slow backend isn't a dead one, so route timeouts don't mark it down
+	if errors.Is(err, context.DeadlineExceeded) && a.parent.Err() == nil {
+		warnf("⌛ Upstream timeout after %v for %s", a.route.Timeout, server.rawURL)
+		lb.metrics.observeUpstreamError(server, ErrorClassTimeout)
+		server.Stats.recordProxyError()
+		a.pool.Stats.recordProxyError()
+		a.err = &BackendError{Server: server, Class: ErrorClassTimeout, Err: ErrBackendTimeout}
+		return
+	}
+
+	// The client went away, which says nothing about the backend
+	if a.parent.Err() != nil {
+		if logEnabled(slog.LevelDebug) {
+			debugf("🚫 Client canceled request to %s", server.rawURL)
+		}
+		lb.metrics.observeUpstreamError(server, ErrorClassCanceled)
+		a.err = err
+		return
+	}
+
+	class := classifyProxyError(err)
+	errorf("❌ Proxy error (%s) for %s: %v", class, server.rawURL, err)
+	lb.metrics.observeUpstreamError(server, class)
+	server.Stats.recordProxyError()
+	a.pool.Stats.recordProxyError()
+	wasHealthy := server.IsHealthy()
+	server.SetHealth(false)
+	if wasHealthy && !server.IsHealthy() {
+		lb.healthChanged(server, false, err.Error())
+	}
+	a.err = &BackendError{Server: server, Class: class, Err: err}
+}
+
+func (a *proxyAttempt) modifyResponse(resp *http.Response) error {
+	lb, server, route, r := a.lb, a.server, a.route, a.request
+
+	a.status = resp.StatusCode
+	lb.metrics.observeUpstream(resp.Request.Context(), server, resp.StatusCode, a.start)
+	latency := time.Since(a.start)
+	server.Stats.recordStatus(resp.StatusCode)
+	server.Stats.recordLatency(latency)
+	a.pool.Stats.recordStatus(resp.StatusCode)
+	a.pool.Stats.recordLatency(latency)
+	server.recordQueueDepthHeader(resp.Header)
+	lb.observeAuthFailure(r, resp.StatusCode, "backend")
+	// Already set by requestid.Middleware; backends echo the same ID
+	resp.Header.Del(requestid.Header)
+	if lb.corsPolicy(route) != nil {
+		dropCORSHeaders(resp.Header)
+	}
+	if lb.securityHeaders != nil {
+		lb.securityHeaders.apply(resp.Header, r)
+	}
+
+	if route.Redirects == RedirectFollow {
+		lb.followRedirects(resp, a.pool)
+	}
+	if a.pool.Affinity == affinityCookie {
+		lb.stick(resp, r, a.pool, server)
+	}
+	if route.TimeoutFallback == TimeoutFallbackCached && r.Method == http.MethodGet {
+		lb.lastGood.Record(r, resp)
+	}
+	if isCacheable(resp.Request, route) {
+		lb.cache.Record(r, resp)
+		resp.Header.Set("X-Cache", "MISS")
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Compares proxying through a backend's prebuilt proxy and the shared
+// transport with what proxyTo used to do: build the ReverseProxy and its
+// hooks for every request, on a transport with Go's default of two idle
+// connections per backend. Run with
+//
+//	go test -run - -bench Proxy -benchmem ./pkg/loadbalancer
+
+// Goroutines per CPU, enough that more requests are in flight than Go's
+// default transport keeps idle connections for
+const benchmarkParallelism = 8
+
+func newBenchmarkBackend(tb testing.TB) *url.URL {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"status":"ok"}`)
+	}))
+	tb.Cleanup(backend.Close)
+	target, err := url.Parse(backend.URL)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return target
+}
+
+// New with the settings the test set, failing it when they are invalid
+func newTestBalancer(tb testing.TB) *LoadBalancer {
+	tb.Helper()
+	lb, err := New()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return lb
+}
+
+func BenchmarkProxyPrebuilt(b *testing.B) {
+	target := newBenchmarkBackend(b)
+	b.Setenv("TARGET_SERVICES", target.String())
+	lb := newTestBalancer(b)
+	pool := lb.pool(defaultPoolName)
+	server := pool.Servers()[0]
+
+	b.ReportAllocs()
+	b.SetParallelism(benchmarkParallelism)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+			if err := lb.proxyTo(w, r, server, defaultRoute, pool); err != nil || w.Code != http.StatusOK {
+				b.Fatalf("proxying failed: %v, status %d", err, w.Code)
+			}
+		}
+	})
+}
+
+func BenchmarkProxyPerRequest(b *testing.B) {
+	target := newBenchmarkBackend(b)
+	b.Setenv("TARGET_SERVICES", target.String())
+	lb := newTestBalancer(b)
+	pool := lb.pool(defaultPoolName)
+	pool.transport = http.DefaultTransport.(*http.Transport).Clone()
+	server := pool.Servers()[0]
+
+	b.ReportAllocs()
+	b.SetParallelism(benchmarkParallelism)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+			attempt := &proxyAttempt{lb: lb, server: server, route: defaultRoute, pool: pool, parent: r.Context(), start: time.Now()}
+			r = r.WithContext(context.WithValue(r.Context(), proxyAttemptKey{}, attempt))
+			newServerProxy(server).ServeHTTP(w, r)
+			if attempt.err != nil || w.Code != http.StatusOK {
+				b.Fatalf("proxying failed: %v, status %d", attempt.err, w.Code)
+			}
+		}
+	})
+}
+
+// Throughput of a large response, with and without a Content-Length,
+// copied through ReverseProxy's default 32KiB buffers and through the
+// pooled proxyBufferSize ones. Run with
+//
+//	go test -run - -bench LargeResponse ./pkg/loadbalancer
+func BenchmarkProxyLargeResponse(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 8<<20)
+	for _, chunked := range []bool{false, true} {
+		name := "length"
+		if chunked {
+			name = "chunked"
+		}
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !chunked {
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			}
+			w.Write(body)
+		}))
+		b.Cleanup(backend.Close)
+		b.Setenv("TARGET_SERVICES", backend.URL)
+		output := logOutput
+		logOutput = io.Discard
+		b.Cleanup(func() { logOutput = output })
+		lb := newTestBalancer(b)
+		front := httptest.NewServer(lb.Handler())
+		b.Cleanup(front.Close)
+		proxy := lb.pool(defaultPoolName).Servers()[0].proxy
+
+		for _, pool := range []struct {
+			name string
+			pool httputil.BufferPool
+		}{
+			{"default", allocatingBufferPool(32 << 10)},
+			{"pooled", proxyBuffers},
+		} {
+			proxy.BufferPool = pool.pool
+			b.Run(name+"/"+pool.name, func(b *testing.B) {
+				b.SetBytes(int64(len(body)))
+				for i := 0; i < b.N; i++ {
+					resp, err := http.Get(front.URL + "/download")
+					if err != nil {
+						b.Fatal(err)
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			})
+		}
+	}
+}
+
+// What ReverseProxy does without a BufferPool
+type allocatingBufferPool int
+
+func (p allocatingBufferPool) Get() []byte { return make([]byte, p) }
+func (allocatingBufferPool) Put([]byte)    {}
@@ -0,0 +1,89 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Both wrap ErrAllBackendsBusy, so a queued request that got no server is
+// answered the way a busy pool is, never with the fallback response
+var (
+	errQueueFull    = fmt.Errorf("%w: request queue is full", ErrAllBackendsBusy)
+	errQueueTimeout = fmt.Errorf("%w: timed out waiting for a free server", ErrAllBackendsBusy)
+)
+
+// Holds requests while every backend is at its concurrency cap, up to
+// maxDepth waiters for at most maxWait each
+type RequestQueue struct {
+	maxDepth int64
+	maxWait  time.Duration
+	depth    int64
+	freed    chan struct{}
+	clock    Clock
+}
+
+// QUEUE_MAX_DEPTH enables queueing; QUEUE_MAX_WAIT bounds each wait
+func getRequestQueueEnv(clock Clock) (*RequestQueue, error) {
+	var env envReader
+	maxDepth := env.Int("QUEUE_MAX_DEPTH", 0)
+	if maxDepth <= 0 {
+		return nil, env.err
+	}
+
+	queue := &RequestQueue{
+		maxDepth: int64(maxDepth),
+		maxWait:  env.Duration("QUEUE_MAX_WAIT", 5*time.Second),
+		freed:    make(chan struct{}, maxDepth),
+		clock:    clock,
+	}
+	return queue, env.err
+}
+
+func (q *RequestQueue) Depth() int64 {
+	if q == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&q.depth)
+}
+
+// Wakes one waiter after a server slot was released
+func (q *RequestQueue) Notify() {
+	if q == nil {
+		return
+	}
+
+	select {
+	case q.freed <- struct{}{}:
+	default:
+	}
+}
+
+// Retries pick each time a slot is freed until it stops reporting busy
+// servers, the wait times out, or the client goes away
+func (q *RequestQueue) Wait(ctx context.Context, pick func() (*Server, error)) (*Server, error) {
+	if atomic.AddInt64(&q.depth, 1) > q.maxDepth {
+		atomic.AddInt64(&q.depth, -1)
+		return nil, errQueueFull
+	}
+	defer atomic.AddInt64(&q.depth, -1)
+
+	timer := q.clock.NewTimer(q.maxWait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-q.freed:
+			server, err := pick()
+			if !errors.Is(err, ErrAllBackendsBusy) {
+				return server, err
+			}
+		case <-timer.C():
+			return nil, errQueueTimeout
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %w", ErrAllBackendsBusy, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type queueResult struct {
+	server *Server
+	err    error
+}
+
+func TestRequestQueue(t *testing.T) {
+	t.Setenv("QUEUE_MAX_DEPTH", "2")
+	t.Setenv("QUEUE_MAX_WAIT", "1s")
+	clock := newFakeClock()
+	queue, err := getRequestQueueEnv(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every server stays busy until one is freed
+	free := &Server{}
+	var freed atomic.Bool
+	pick := func() (*Server, error) {
+		if freed.Load() {
+			return free, nil
+		}
+		return nil, ErrAllBackendsBusy
+	}
+	wait := func(ctx context.Context) <-chan queueResult {
+		done := make(chan queueResult, 1)
+		go func() {
+			server, err := queue.Wait(ctx, pick)
+			done <- queueResult{server, err}
+		}()
+		return done
+	}
+	result := func(done <-chan queueResult) queueResult {
+		t.Helper()
+		select {
+		case result := <-done:
+			return result
+		case <-time.After(time.Second):
+			t.Fatal("still waiting")
+			return queueResult{}
+		}
+	}
+
+	// Past QUEUE_MAX_DEPTH requests are turned away without waiting
+	first, second := wait(context.Background()), wait(context.Background())
+	clock.waitForWaiters(t, 2)
+	if depth := queue.Depth(); depth != 2 {
+		t.Errorf("depth %d, want 2", depth)
+	}
+	if got := result(wait(context.Background())); !errors.Is(got.err, errQueueFull) || !errors.Is(got.err, ErrAllBackendsBusy) {
+		t.Errorf("over the depth limit: %v, want %v", got.err, errQueueFull)
+	}
+
+	// Each release wakes one waiter, which picks the freed server
+	freed.Store(true)
+	queue.Notify()
+	queue.Notify()
+	for _, done := range []<-chan queueResult{first, second} {
+		if got := result(done); got.server != free || got.err != nil {
+			t.Errorf("after a release: %v, %v, want the freed server", got.server, got.err)
+		}
+	}
+	if depth := queue.Depth(); depth != 0 {
+		t.Errorf("depth %d after both were served, want 0", depth)
+	}
+
+	// Without a release, a waiter gives up after QUEUE_MAX_WAIT
+	freed.Store(false)
+	done := wait(context.Background())
+	clock.waitForWaiters(t, 1)
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case got := <-done:
+		t.Fatalf("gave up early: %v", got.err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	if got := result(done); !errors.Is(got.err, errQueueTimeout) || !errors.Is(got.err, ErrAllBackendsBusy) {
+		t.Errorf("after QUEUE_MAX_WAIT: %v, want %v", got.err, errQueueTimeout)
+	}
+
+	// Nor does a client that went away wait
+	ctx, cancel := context.WithCancel(context.Background())
+	done = wait(ctx)
+	clock.waitForWaiters(t, 1)
+	cancel()
+	if got := result(done); !errors.Is(got.err, context.Canceled) || !errors.Is(got.err, ErrAllBackendsBusy) {
+		t.Errorf("after canceling: %v, want %v", got.err, context.Canceled)
+	}
+}
@@ -0,0 +1,159 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Token bucket refilled continuously at rate tokens per second, holding at
+// most burst tokens
+type TokenBucket struct {
+	mutex  sync.Mutex
+	clock  Clock
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return newTokenBucket(realClock{}, rate, burst)
+}
+
+func newTokenBucket(clock Clock, rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		clock:  clock,
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   clock.Now(),
+	}
+}
+
+// Takes a token if one is available, otherwise reports how long until one is
+func (b *TokenBucket) Allow() (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.clock.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
+
+// RATE_LIMIT_RPS enables the global limit; RATE_LIMIT_BURST defaults to one
+// second worth of requests
+func getGlobalRateLimitEnv(clock Clock) (*TokenBucket, error) {
+	var env envReader
+	rps := env.Float("RATE_LIMIT_RPS", 0)
+	if rps <= 0 {
+		return nil, env.err
+	}
+
+	burst := env.Int("RATE_LIMIT_BURST", int(math.Ceil(rps)))
+	if env.err != nil {
+		return nil, env.err
+	}
+	if burst < 1 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_BURST: %d", burst)
+	}
+
+	return newTokenBucket(clock, rps, burst), nil
+}
+
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
+
+// Per-client token buckets, keeping only the most recently seen clients so
+// memory stays bounded no matter how many addresses show up
+type ClientRateLimiter struct {
+	mutex      sync.Mutex
+	clock      Clock
+	rate       float64
+	burst      int
+	maxClients int
+	clients    map[string]*list.Element
+	recent     *list.List
+}
+
+type clientBucket struct {
+	client string
+	bucket *TokenBucket
+}
+
+func NewClientRateLimiter(rate float64, burst, maxClients int) *ClientRateLimiter {
+	return newClientRateLimiter(realClock{}, rate, burst, maxClients)
+}
+
+func newClientRateLimiter(clock Clock, rate float64, burst, maxClients int) *ClientRateLimiter {
+	return &ClientRateLimiter{
+		clock:      clock,
+		rate:       rate,
+		burst:      burst,
+		maxClients: maxClients,
+		clients:    map[string]*list.Element{},
+		recent:     list.New(),
+	}
+}
+
+func (l *ClientRateLimiter) Allow(client string) (bool, time.Duration) {
+	return l.bucket(client).Allow()
+}
+
+func (l *ClientRateLimiter) bucket(client string) *TokenBucket {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if element, ok := l.clients[client]; ok {
+		l.recent.MoveToFront(element)
+		return element.Value.(*clientBucket).bucket
+	}
+
+	if l.recent.Len() >= l.maxClients {
+		oldest := l.recent.Back()
+		l.recent.Remove(oldest)
+		delete(l.clients, oldest.Value.(*clientBucket).client)
+	}
+
+	entry := &clientBucket{client: client, bucket: newTokenBucket(l.clock, l.rate, l.burst)}
+	l.clients[client] = l.recent.PushFront(entry)
+	return entry.bucket
+}
+
+func getClientRateLimitEnv(clock Clock) (*ClientRateLimiter, error) {
+	var env envReader
+	rps := env.Float("CLIENT_RATE_LIMIT_RPS", 0)
+	if rps <= 0 {
+		return nil, env.err
+	}
+
+	burst := env.Int("CLIENT_RATE_LIMIT_BURST", int(math.Ceil(rps)))
+	maxClients := env.Int("CLIENT_RATE_LIMIT_MAX_CLIENTS", 10000)
+	if env.err != nil {
+		return nil, env.err
+	}
+	if burst < 1 || maxClients < 1 {
+		return nil, fmt.Errorf("invalid CLIENT_RATE_LIMIT_BURST (%d) or CLIENT_RATE_LIMIT_MAX_CLIENTS (%d)", burst, maxClients)
+	}
+
+	return newClientRateLimiter(clock, rps, burst, maxClients), nil
+}
@@ -0,0 +1,72 @@
+package loadbalancer
+
+import (
+	"net/http"
+)
+
+const maxFollowedRedirects = 5
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// Follows backend redirects internally against the route's pool, replacing resp with
+// the final response. Only bodiless GET/HEAD requests are followed; anything
+// else, or a redirect that can't be followed, is passed through untouched.
+func (lb *LoadBalancer) followRedirects(resp *http.Response, pool *Pool) {
+	for hops := 0; isRedirect(resp.StatusCode); hops++ {
+		original := resp.Request
+		if original.Method != http.MethodGet && original.Method != http.MethodHead {
+			return
+		}
+
+		if hops == maxFollowedRedirects {
+			warnf("⚠️  Stopped following redirects after %d hops", maxFollowedRedirects)
+			return
+		}
+
+		location, err := resp.Location()
+		if err != nil {
+			return
+		}
+
+		server, err := pool.Pick(original.Context(), original)
+		if err != nil {
+			warnf("⚠️  Cannot follow redirect: %v", err)
+			return
+		}
+
+		// The redirect may name the backend's internal hostname; only the
+		// path and query are kept and resolved against the pool
+		target := *server.URL
+		target.Path = location.Path
+		target.RawPath = location.RawPath
+		target.RawQuery = location.RawQuery
+
+		req, err := http.NewRequestWithContext(original.Context(), original.Method, target.String(), nil)
+		if err != nil {
+			lb.releaseServer(server)
+			return
+		}
+		req.Header = original.Header.Clone()
+		req.Host = original.Host
+		server.rewriteHost(req)
+
+		debugf("↪️  Following redirect %d -> %s", resp.StatusCode, target.String())
+
+		next, err := pool.transport.RoundTrip(req)
+		lb.releaseServer(server)
+		if err != nil {
+			errorf("❌ Redirect to %s failed: %v", target.String(), err)
+			return
+		}
+
+		resp.Body.Close()
+		*resp = *next
+	}
+}
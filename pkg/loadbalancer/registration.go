@@ -0,0 +1,132 @@
+package loadbalancer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Source of the servers that registered themselves
+const registrationSource = "register"
+
+// Backends that announce themselves with POST /lb-admin/register, using
+// REGISTRATION_SECRET as their token, and repeat it as a heartbeat. One
+// that misses heartbeats for the TTL is removed, so instances that crash
+// or are killed leave without anyone cleaning up after them.
+type Registry struct {
+	lb     *LoadBalancer
+	secret string
+	ttl    time.Duration
+	// By backend URL
+	entries map[string]*registration
+	mutex   sync.Mutex
+}
+
+type registration struct {
+	options  string
+	lastSeen time.Time
+}
+
+// Answer to POST /lb-admin/register; the backend should send its next
+// heartbeat well before expiresAt, e.g. every third of the TTL
+type RegisterResponse struct {
+	Server    ServerStatus `json:"server"`
+	TTL       string       `json:"ttl"`
+	ExpiresAt time.Time    `json:"expiresAt"`
+}
+
+func getRegistryEnv(lb *LoadBalancer) (*Registry, error) {
+	secret := getEnv("REGISTRATION_SECRET", "")
+	if secret == "" {
+		return nil, nil
+	}
+	ttl, err := getEnvDuration("REGISTRATION_TTL", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &Registry{
+		lb:      lb,
+		secret:  secret,
+		ttl:     ttl,
+		entries: map[string]*registration{},
+	}, nil
+}
+
+// Registers the backend, or renews its registration. Returns false when
+// its server ID is already taken by a server from another source.
+func (r *Registry) Register(server *Server) (*RegisterResponse, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if existing := r.lb.findServer(server.ID()); existing != nil && existing.Source != registrationSource {
+		return nil, false
+	}
+
+	rawURL := server.rawURL
+	entry, ok := r.entries[rawURL]
+	if !ok || entry.options != server.options {
+		r.entries[rawURL] = &registration{options: server.options}
+		r.sync()
+		entry = r.entries[rawURL]
+	}
+	entry.lastSeen = time.Now()
+
+	response := &RegisterResponse{
+		TTL:       r.ttl.String(),
+		ExpiresAt: entry.lastSeen.Add(r.ttl),
+	}
+	if registered := r.lb.findServer(server.ID()); registered != nil {
+		response.Server = registered.Status(true)
+	}
+	return response, true
+}
+
+// Removes the backend right away, e.g. when it shuts down; false when it
+// isn't registered
+func (r *Registry) Deregister(rawURL string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.entries[rawURL]; !ok {
+		return false
+	}
+	delete(r.entries, rawURL)
+	r.sync()
+	return true
+}
+
+// Removes backends whose last heartbeat is older than the TTL, until ctx
+// is done
+func (r *Registry) expire(ctx context.Context) {
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.mutex.Lock()
+		expired := false
+		for rawURL, entry := range r.entries {
+			if time.Since(entry.lastSeen) > r.ttl {
+				warnf("⚠️  %s missed heartbeats for %s, removing it", rawURL, r.ttl)
+				delete(r.entries, rawURL)
+				expired = true
+			}
+		}
+		if expired {
+			r.sync()
+		}
+		r.mutex.Unlock()
+	}
+}
+
+func (r *Registry) sync() {
+	backends := []Backend{}
+	for rawURL, entry := range r.entries {
+		backends = append(backends, Backend{URL: rawURL, Options: entry.options})
+	}
+	r.lb.syncDiscovered(registrationSource, backends)
+}
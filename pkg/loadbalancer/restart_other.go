@@ -0,0 +1,21 @@
+//go:build !unix
+
+package loadbalancer
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+func restartSignals() []os.Signal {
+	return nil
+}
+
+func reloadSignals() []os.Signal {
+	return nil
+}
+
+func startChild(listener net.Listener) error {
+	return errors.New("graceful restart is not supported on this platform")
+}
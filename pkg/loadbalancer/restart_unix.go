@@ -0,0 +1,46 @@
+//go:build unix
+
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func restartSignals() []os.Signal {
+	return []os.Signal{syscall.SIGUSR2}
+}
+
+func reloadSignals() []os.Signal {
+	return []os.Signal{syscall.SIGHUP}
+}
+
+// Starts the (possibly upgraded) binary with the listening socket as fd 3
+func startChild(listener net.Listener) error {
+	tcp, ok := listener.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("cannot pass %T to a child process", listener)
+	}
+
+	file, err := tcp.File()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{file}
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3")
+
+	return cmd.Start()
+}
@@ -0,0 +1,180 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const retryBudgetBuckets = 10
+
+// Limits retries to a fraction of the requests seen over a sliding window,
+// so a widespread backend failure can't turn into a retry storm. minRetries
+// keeps retries possible while traffic is low.
+type RetryBudget struct {
+	mutex       sync.Mutex
+	clock       Clock
+	ratio       float64
+	minRetries  int
+	bucketWidth time.Duration
+	buckets     [retryBudgetBuckets]retryBucket
+}
+
+type retryBucket struct {
+	slot     int64
+	requests int
+	retries  int
+}
+
+func getRetryBudgetEnv(clock Clock) (*RetryBudget, error) {
+	var env envReader
+	window := env.Duration("RETRY_BUDGET_WINDOW", 10*time.Second)
+	if window < time.Second {
+		return nil, fmt.Errorf("invalid RETRY_BUDGET_WINDOW: %v", window)
+	}
+
+	budget := newRetryBudget(clock, env.Float("RETRY_BUDGET_RATIO", 0.2), env.Int("RETRY_BUDGET_MIN", 10), window)
+	return budget, env.err
+}
+
+func NewRetryBudget(ratio float64, minRetries int, window time.Duration) *RetryBudget {
+	return newRetryBudget(realClock{}, ratio, minRetries, window)
+}
+
+func newRetryBudget(clock Clock, ratio float64, minRetries int, window time.Duration) *RetryBudget {
+	return &RetryBudget{
+		clock:       clock,
+		ratio:       ratio,
+		minRetries:  minRetries,
+		bucketWidth: window / retryBudgetBuckets,
+	}
+}
+
+func (b *RetryBudget) RecordRequest() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.current().requests++
+}
+
+// Reports whether a retry fits in the budget, counting it if it does
+func (b *RetryBudget) TryRetry() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	bucket := b.current()
+	requests, retries := b.totals()
+
+	allowed := math.Max(float64(b.minRetries), b.ratio*float64(requests))
+	if float64(retries) >= allowed {
+		return false
+	}
+
+	bucket.retries++
+	return true
+}
+
+func (b *RetryBudget) current() *retryBucket {
+	slot := b.clock.Now().UnixNano() / int64(b.bucketWidth)
+	bucket := &b.buckets[slot%retryBudgetBuckets]
+	if bucket.slot != slot {
+		*bucket = retryBucket{slot: slot}
+	}
+	return bucket
+}
+
+// Sums the buckets still inside the window
+func (b *RetryBudget) totals() (requests, retries int) {
+	oldest := b.clock.Now().UnixNano()/int64(b.bucketWidth) - retryBudgetBuckets
+	for _, bucket := range b.buckets {
+		if bucket.slot > oldest {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	return requests, retries
+}
+
+// Exponential backoff with full jitter: attempt n waits a random duration
+// up to min(Max, Base * 2^(n-1))
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+
+	// What Wait waits with, the real clock if nil
+	clock Clock
+}
+
+func getRetryBackoffEnv(clock Clock) (Backoff, error) {
+	var env envReader
+	backoff := Backoff{
+		Base:  env.Duration("RETRY_BACKOFF_BASE", 50*time.Millisecond),
+		Max:   env.Duration("RETRY_BACKOFF_MAX", time.Second),
+		clock: clock,
+	}
+	return backoff, env.err
+}
+
+func (b Backoff) Delay(attempt int) time.Duration {
+	if b.Base <= 0 {
+		return 0
+	}
+
+	ceiling := b.Max
+	if shift := attempt - 1; shift < 32 && b.Base<<shift < b.Max {
+		ceiling = b.Base << shift
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// Sleeps before the next attempt; false if the client gave up meanwhile
+func (b Backoff) Wait(ctx context.Context, attempt int) bool {
+	clock := b.clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	timer := clock.NewTimer(b.Delay(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Keeps a server that just failed a request out of selection for a while,
+// unless no other server is left
+func (s *Server) penalize(penalty time.Duration) {
+	if penalty > 0 {
+		atomic.StoreInt64(&s.penaltyUntil, s.clock.Now().Add(penalty).UnixNano())
+		serverStateChanged()
+	}
+}
+
+func (s *Server) isPenalized() bool {
+	return s.clock.Now().UnixNano() < atomic.LoadInt64(&s.penaltyUntil)
+}
+
+// Connection refused/reset means the request never reached a backend or was
+// cut off, so another backend can safely get it
+func isRetryableError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// Only bodiless requests with idempotent methods are safe to send again
+func isRetryable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+		return r.Body == nil || r.Body == http.NoBody
+	}
+	return false
+}
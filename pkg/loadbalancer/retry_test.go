@@ -0,0 +1,139 @@
+package loadbalancer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRetryPenaltySkipsBackend(t *testing.T) {
+	t.Setenv("TARGET_SERVICES", "http://penalty-a.test:8080,http://penalty-b.test:8080")
+	t.Setenv("RETRY_PENALTY", "5s")
+	clock := newFakeClock()
+	lb, err := New(WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := lb.pool(defaultPoolName)
+	a, b := pool.Servers()[0], pool.Servers()[1]
+	a.penalize(lb.retryPenalty)
+
+	elapsed := time.Duration(0)
+	for _, step := range []struct {
+		advance   time.Duration
+		penalized bool
+		// Whether a is among the next two picks; while it is penalized both
+		// go to b
+		picksA bool
+	}{
+		{0, true, false},
+		{4 * time.Second, true, false},
+		{999 * time.Millisecond, true, false},
+		{time.Millisecond, false, true},
+		{time.Minute, false, true},
+	} {
+		clock.Advance(step.advance)
+		elapsed += step.advance
+		if until := a.Detail().PenalizedUntil; (until != nil) != step.penalized {
+			t.Errorf("at %v: penalized until %v, want penalized %v", elapsed, until, step.penalized)
+		}
+
+		pickedA := false
+		for i := 0; i < 2; i++ {
+			server, err := pool.Pick(context.Background(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pickedA = pickedA || server == a
+			if server != a && server != b {
+				t.Fatalf("picked %s, which isn't in the pool", server.ID())
+			}
+			lb.releaseServer(server)
+		}
+		if pickedA != step.picksA {
+			t.Errorf("at %v: picked %s %v, want %v", elapsed, a.ID(), pickedA, step.picksA)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	clock := newFakeClock()
+	// A tenth of the window per bucket, 1s
+	budget := newRetryBudget(clock, 0.5, 2, 10*time.Second)
+
+	for _, step := range []struct {
+		advance  time.Duration
+		requests int
+		retries  int
+		allowed  int
+	}{
+		// Half of the requests in the window
+		{0, 10, 10, 5},
+		{5 * time.Second, 0, 1, 0},
+		{4 * time.Second, 4, 3, 2},
+		// The first second's requests and retries left the window; the 4
+		// left allow minRetries' 2, which the last step took
+		{time.Second, 0, 1, 0},
+		// Nothing left in the window
+		{10 * time.Second, 0, 3, 2},
+	} {
+		clock.Advance(step.advance)
+		for i := 0; i < step.requests; i++ {
+			budget.RecordRequest()
+		}
+		allowed := 0
+		for i := 0; i < step.retries; i++ {
+			if budget.TryRetry() {
+				allowed++
+			}
+		}
+		if allowed != step.allowed {
+			t.Errorf("after %v more and %d requests: %d of %d retries allowed, want %d",
+				step.advance, step.requests, allowed, step.retries, step.allowed)
+		}
+	}
+}
+
+func TestBackoffWait(t *testing.T) {
+	for _, test := range []struct {
+		attempt int
+		// The longest the attempt may wait
+		ceiling time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{40, time.Second},
+	} {
+		clock := newFakeClock()
+		backoff := Backoff{Base: 100 * time.Millisecond, Max: time.Second, clock: clock}
+		for i := 0; i < 100; i++ {
+			if delay := backoff.Delay(test.attempt); delay < 0 || delay > test.ceiling {
+				t.Fatalf("attempt %d: delay %v, want at most %v", test.attempt, delay, test.ceiling)
+			}
+		}
+
+		done := make(chan bool)
+		go func() { done <- backoff.Wait(context.Background(), test.attempt) }()
+		clock.waitForWaiters(t, 1)
+		clock.Advance(test.ceiling)
+		select {
+		case waited := <-done:
+			if !waited {
+				t.Errorf("attempt %d: Wait returned false without being canceled", test.attempt)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("attempt %d: still waiting %v later", test.attempt, test.ceiling)
+		}
+	}
+
+	// Canceling gives up on the retry; the fake timer doesn't fire until
+	// the clock is advanced
+	backoff := Backoff{Base: time.Second, Max: time.Second, clock: newFakeClock()}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if backoff.Wait(ctx, 1) {
+		t.Error("Wait went ahead after its context was canceled")
+	}
+}
@@ -0,0 +1,247 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redirect handling policies
+const (
+	RedirectPass   = "pass"
+	RedirectFollow = "follow"
+)
+
+type Route struct {
+	Prefix               string        `json:"prefix"`
+	Pool                 string        `json:"pool"`
+	Redirects            string        `json:"redirects"`
+	RateLimitRPS         float64       `json:"rateLimitRps,omitempty"`
+	RateBurst            int           `json:"rateBurst,omitempty"`
+	Timeout              time.Duration `json:"timeout,omitempty"`
+	TimeoutFallback      string        `json:"timeoutFallback,omitempty"`
+	CacheTTL             time.Duration `json:"cacheTtl,omitempty"`
+	StaleWhileRevalidate time.Duration `json:"staleWhileRevalidate,omitempty"`
+	StaleIfError         time.Duration `json:"staleIfError,omitempty"`
+	Coalesce             bool          `json:"coalesce,omitempty"`
+	BrownoutFraction     float64       `json:"brownoutFraction,omitempty"`
+	BrownoutMode         string        `json:"brownoutMode,omitempty"`
+	TraceSampleRatio     *float64      `json:"traceSampleRatio,omitempty"`
+	JWT                  bool          `json:"jwt,omitempty"`
+	JWTAudience          string        `json:"jwtAudience,omitempty"`
+	Introspect           bool          `json:"introspect,omitempty"`
+	APIKey               bool          `json:"apiKey,omitempty"`
+	APIKeyNames          []string      `json:"apiKeyNames,omitempty"`
+	Scopes               []string      `json:"scopes,omitempty"`
+	CORSOrigins          []string      `json:"corsOrigins,omitempty"`
+	CORSMethods          []string      `json:"corsMethods,omitempty"`
+	CORSHeaders          []string      `json:"corsHeaders,omitempty"`
+	CORSDisabled         bool          `json:"corsDisabled,omitempty"`
+	rateLimit            *TokenBucket
+	options              string
+}
+
+// Routes sorted by descending prefix length, so the first match is the longest
+type Routes []*Route
+
+var defaultRoute = &Route{Prefix: "/", Pool: defaultPoolName, Redirects: RedirectPass}
+
+// ROUTES is a comma-separated list of path prefixes, each followed by
+// ";key=value" options, e.g. "/api/users;redirects=follow". Rate limits
+// refill by clock.
+func parseRoutes(value string, clock Clock) (Routes, error) {
+	routes := Routes{}
+
+	for _, value := range strings.Split(value, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		prefix, options, _ := strings.Cut(value, ";")
+		route := &Route{Prefix: strings.TrimSpace(prefix), Pool: defaultPoolName, Redirects: RedirectPass, options: options}
+		if err := parseRouteOptions(route, options, clock); err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+
+	routes.sort()
+	return routes, nil
+}
+
+func (routes Routes) sort() {
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].Prefix) > len(routes[j].Prefix)
+	})
+}
+
+func parseRouteOptions(route *Route, options string, clock Clock) error {
+	if options == "" {
+		return nil
+	}
+
+	for _, option := range strings.Split(options, ";") {
+		key, value, _ := strings.Cut(option, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		switch key {
+		case "pool":
+			route.Pool = value
+		case "redirects":
+			if value != RedirectPass && value != RedirectFollow {
+				return fmt.Errorf("invalid redirects policy %q for route %s", value, route.Prefix)
+			}
+			route.Redirects = value
+		case "rate":
+			rps, err := strconv.ParseFloat(value, 64)
+			if err != nil || rps <= 0 {
+				return fmt.Errorf("invalid rate %q for route %s", value, route.Prefix)
+			}
+			route.RateLimitRPS = rps
+		case "burst":
+			burst, err := strconv.Atoi(value)
+			if err != nil || burst < 1 {
+				return fmt.Errorf("invalid burst %q for route %s", value, route.Prefix)
+			}
+			route.RateBurst = burst
+		case "timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid timeout %q for route %s", value, route.Prefix)
+			}
+			route.Timeout = timeout
+		case "ontimeout":
+			if value != TimeoutFallbackStatic && value != TimeoutFallbackCached && !strings.HasPrefix(value, timeoutFallbackPoolPrefix) {
+				return fmt.Errorf("invalid ontimeout fallback %q for route %s", value, route.Prefix)
+			}
+			route.TimeoutFallback = value
+		case "brownout":
+			fraction, err := strconv.ParseFloat(value, 64)
+			if err != nil || fraction < 0 || fraction > 1 {
+				return fmt.Errorf("invalid brownout fraction %q for route %s", value, route.Prefix)
+			}
+			route.BrownoutFraction = fraction
+		case "brownoutmode":
+			if value != BrownoutReject && value != BrownoutPlaceholder {
+				return fmt.Errorf("invalid brownoutmode %q for route %s", value, route.Prefix)
+			}
+			route.BrownoutMode = value
+		case "tracesample":
+			ratio, err := strconv.ParseFloat(value, 64)
+			if err != nil || ratio < 0 || ratio > 1 {
+				return fmt.Errorf("invalid tracesample ratio %q for route %s", value, route.Prefix)
+			}
+			route.TraceSampleRatio = &ratio
+		case "jwt":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid jwt %q for route %s", value, route.Prefix)
+			}
+			if enabled && getEnv("JWT_JWKS_URL", "") == "" {
+				return fmt.Errorf("route %s requires a JWT but JWT_JWKS_URL is not set", route.Prefix)
+			}
+			route.JWT = enabled
+		case "audience":
+			route.JWTAudience = value
+		case "introspect":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid introspect %q for route %s", value, route.Prefix)
+			}
+			if enabled && getEnv("INTROSPECTION_URL", "") == "" {
+				return fmt.Errorf("route %s requires token introspection but INTROSPECTION_URL is not set", route.Prefix)
+			}
+			route.Introspect = enabled
+		case "scope":
+			route.Scopes = splitList(value, "|")
+		case "apikey":
+			// true for any key of API_KEYS, or the names of the ones allowed
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				enabled = true
+				if route.APIKeyNames = splitList(value, "|"); len(route.APIKeyNames) == 0 {
+					return fmt.Errorf("invalid apikey %q for route %s", value, route.Prefix)
+				}
+			}
+			if enabled && getEnv("API_KEYS", "") == "" {
+				return fmt.Errorf("route %s requires an API key but API_KEYS is not set", route.Prefix)
+			}
+			route.APIKey = enabled
+		case "cors":
+			// Origins separated by |, as commas separate routes
+			if value == "false" {
+				route.CORSDisabled = true
+			} else if route.CORSOrigins = splitList(value, "|"); len(route.CORSOrigins) == 0 {
+				return fmt.Errorf("invalid cors %q for route %s", value, route.Prefix)
+			}
+		case "corsmethods":
+			route.CORSMethods = splitList(value, "|")
+		case "corsheaders":
+			route.CORSHeaders = splitList(value, "|")
+		case "cache", "stale", "staleiferror":
+			duration, err := time.ParseDuration(value)
+			if err != nil || duration < 0 {
+				return fmt.Errorf("invalid %s %q for route %s", key, value, route.Prefix)
+			}
+			switch key {
+			case "cache":
+				route.CacheTTL = duration
+			case "stale":
+				route.StaleWhileRevalidate = duration
+			case "staleiferror":
+				route.StaleIfError = duration
+			}
+		case "coalesce":
+			coalesce, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid coalesce %q for route %s", value, route.Prefix)
+			}
+			route.Coalesce = coalesce
+		default:
+			return fmt.Errorf("unknown option %q for route %s", key, route.Prefix)
+		}
+	}
+
+	if len(route.Scopes) > 0 && !route.JWT && !route.Introspect {
+		return fmt.Errorf("route %s has scope but neither jwt=true nor introspect=true", route.Prefix)
+	}
+	if route.RateLimitRPS > 0 {
+		if route.RateBurst == 0 {
+			route.RateBurst = int(math.Ceil(route.RateLimitRPS))
+		}
+		route.rateLimit = newTokenBucket(clock, route.RateLimitRPS, route.RateBurst)
+	}
+	return nil
+}
+
+func (routes Routes) Match(path string) *Route {
+	for _, route := range routes {
+		if route.matches(path) {
+			return route
+		}
+	}
+	return defaultRoute
+}
+
+// Prefixes match whole path segments: "/api/users" matches "/api/users/1"
+// but not "/api/usersx"
+func (route *Route) matches(path string) bool {
+	if !strings.HasPrefix(path, route.Prefix) {
+		return false
+	}
+	return len(path) == len(route.Prefix) ||
+		strings.HasSuffix(route.Prefix, "/") ||
+		path[len(route.Prefix)] == '/'
+}
+
+// Name of the secondary pool used when the route times out, if any
+func (route *Route) timeoutPool() string {
+	if !strings.HasPrefix(route.TimeoutFallback, timeoutFallbackPoolPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(route.TimeoutFallback, timeoutFallbackPoolPrefix)
+}
@@ -0,0 +1,111 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Headers that only describe the connection to the load balancer, and must
+// not be passed on (RFC 9110, section 7.6.1)
+var hopByHopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// Headers that proxies set about the client, which a client could send
+// itself to pose as someone else
+var forwardingHeaders = []string{
+	"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Forwarded-Port",
+	"X-Forwarded-Prefix", "X-Real-Ip", "X-Request-Id",
+}
+
+// Headers that hold a single value, so several different ones leave it up
+// to each backend which one counts
+var singletonHeaders = []string{
+	"Authorization", "Content-Type", "Content-Length", "Origin", "Referer", "User-Agent", "Range",
+	"If-Modified-Since", "If-Unmodified-Since", "If-Range", "Max-Forwards", "X-Request-Id",
+}
+
+// Cleans up requests before anything else sees them, unless
+// SANITIZE_HEADERS is false: hop-by-hop headers are dropped, forwarding
+// headers and X-Request-ID are only kept from TRUSTED_PROXIES, and repeated
+// headers are merged into one. Requests with conflicting values of a
+// single-valued header get 400.
+func (lb *LoadBalancer) sanitizeHeaders(next http.Handler) http.Handler {
+	if !lb.sanitize {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header
+
+		// WebSocket handshakes need Connection and Upgrade to get through
+		if !websocket.IsWebSocketUpgrade(r) {
+			for _, name := range header.Values("Connection") {
+				for _, listed := range strings.Split(name, ",") {
+					if listed = textproto.TrimString(listed); listed != "" {
+						header.Del(listed)
+					}
+				}
+			}
+			for _, name := range hopByHopHeaders {
+				header.Del(name)
+			}
+		}
+
+		if !lb.fromTrustedProxy(r) {
+			for _, name := range forwardingHeaders {
+				header.Del(name)
+			}
+		}
+		if header.Get("X-Forwarded-Host") == "" {
+			header.Set("X-Forwarded-Host", r.Host)
+		}
+		if header.Get("X-Forwarded-Proto") == "" {
+			proto := "http"
+			if r.TLS != nil {
+				proto = "https"
+			}
+			header.Set("X-Forwarded-Proto", proto)
+		}
+
+		for _, name := range singletonHeaders {
+			if values := header.Values(name); len(values) > 1 {
+				for _, value := range values[1:] {
+					if value != values[0] {
+						debugf("🧹 Refused %s %s with conflicting %s headers", r.Method, r.URL.Path, name)
+						http.Error(w, "Bad Request: conflicting "+name+" headers", http.StatusBadRequest)
+						return
+					}
+				}
+				header.Set(name, values[0])
+			}
+		}
+		for name, values := range header {
+			if len(values) < 2 {
+				continue
+			}
+			// HTTP/2 clients send each cookie on its own
+			separator := ", "
+			if name == "Cookie" {
+				separator = "; "
+			}
+			header[name] = []string{strings.Join(values, separator)}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (lb *LoadBalancer) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	return peer != nil && lb.trustedProxies.Contains(peer)
+}
@@ -0,0 +1,63 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Response headers that harden browsers against common attacks, added to
+// proxied responses with SECURITY_HEADERS so backends don't each set them.
+// A header the backend sets itself is left alone.
+type SecurityHeaders struct {
+	// Strict-Transport-Security, only sent on HTTPS as browsers ignore it
+	// otherwise; empty to leave it out
+	hsts         string
+	frameOptions string
+	csp          string
+}
+
+func getSecurityHeadersEnv() (*SecurityHeaders, error) {
+	var env envReader
+	if !env.Bool("SECURITY_HEADERS", false) {
+		return nil, env.err
+	}
+
+	h := &SecurityHeaders{
+		frameOptions: strings.ToUpper(getEnv("FRAME_OPTIONS", "DENY")),
+		csp:          getEnv("CONTENT_SECURITY_POLICY", ""),
+	}
+	if h.frameOptions != "DENY" && h.frameOptions != "SAMEORIGIN" && h.frameOptions != "NONE" {
+		return nil, fmt.Errorf("invalid FRAME_OPTIONS %q, want DENY, SAMEORIGIN or none", h.frameOptions)
+	}
+	if maxAge := env.Duration("HSTS_MAX_AGE", 365*24*time.Hour); maxAge > 0 {
+		h.hsts = "max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+		if env.Bool("HSTS_INCLUDE_SUBDOMAINS", true) {
+			h.hsts += "; includeSubDomains"
+		}
+		if env.Bool("HSTS_PRELOAD", false) {
+			h.hsts += "; preload"
+		}
+	}
+	return h, env.err
+}
+
+// Adds the headers the backend's response to r lacks
+func (h *SecurityHeaders) apply(header http.Header, r *http.Request) {
+	setMissing := func(key, value string) {
+		if value != "" && header.Get(key) == "" {
+			header.Set(key, value)
+		}
+	}
+
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		setMissing("Strict-Transport-Security", h.hsts)
+	}
+	setMissing("X-Content-Type-Options", "nosniff")
+	if h.frameOptions != "NONE" {
+		setMissing("X-Frame-Options", h.frameOptions)
+	}
+	setMissing("Content-Security-Policy", h.csp)
+}
@@ -0,0 +1,56 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Allocations a proxied request may make through the whole handler chain,
+// counting both ends of the upstream round trip, as the backend runs in the
+// test process. Raise it only for allocations a change can't do without. Run the benchmark with
+//
+//	go test -run - -bench ServeHTTP -benchmem ./pkg/loadbalancer
+const maxAllocsPerRequest = 130
+
+// Access log lines are still formatted, only not printed
+func newBenchmarkBalancer(tb testing.TB) http.Handler {
+	target := newBenchmarkBackend(tb)
+	tb.Setenv("TARGET_SERVICES", target.String())
+	output := logOutput
+	logOutput = io.Discard
+	tb.Cleanup(func() { logOutput = output })
+	lb := newTestBalancer(tb)
+	tb.Cleanup(lb.accessLog.Close)
+	return lb.Handler()
+}
+
+func serveBenchmarkRequest(tb testing.TB, handler http.Handler) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/users", nil))
+	if w.Code != http.StatusOK {
+		tb.Fatalf("status %d, want 200", w.Code)
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	handler := newBenchmarkBalancer(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		serveBenchmarkRequest(b, handler)
+	}
+}
+
+func TestServeHTTPAllocs(t *testing.T) {
+	handler := newBenchmarkBalancer(t)
+	// Warms up the upstream connection
+	serveBenchmarkRequest(t, handler)
+
+	allocs := testing.AllocsPerRun(100, func() { serveBenchmarkRequest(t, handler) })
+	t.Logf("%.0f allocations per request", allocs)
+	if allocs > maxAllocsPerRequest {
+		t.Errorf("%.0f allocations per request, want at most %d", allocs, maxAllocsPerRequest)
+	}
+}
@@ -0,0 +1,24 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"time"
+)
+
+// Bounds how long a client may take to send a request and how large its
+// headers may be, so slow-drip (slowloris) clients can't hold connections
+// open indefinitely. Applied to the traffic and admin listeners alike.
+func applyServerLimitsEnv(server *http.Server) error {
+	var env envReader
+	server.ReadHeaderTimeout = env.Duration("READ_HEADER_TIMEOUT", 10*time.Second)
+	// Off by default, as they would cut off large uploads and slow
+	// downloads, or streams like /lb-events
+	server.ReadTimeout = env.Duration("READ_TIMEOUT", 0)
+	server.WriteTimeout = env.Duration("WRITE_TIMEOUT", 0)
+	server.IdleTimeout = env.Duration("IDLE_TIMEOUT", 2*time.Minute)
+	server.MaxHeaderBytes = env.Int("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes)
+	// Without keep-alives every request gets its own connection, e.g. so an
+	// L4 balancer in front spreads clients evenly across instances
+	server.SetKeepAlivesEnabled(env.Bool("KEEP_ALIVES", true))
+	return env.err
+}
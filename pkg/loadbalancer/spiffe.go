@@ -0,0 +1,54 @@
+package loadbalancer
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// SPIFFE IDs or trust domains, e.g. spiffe://example.org/ns/prod/sa/web or
+// spiffe://example.org for every workload in it
+func getSPIFFEIDsEnv(key string) ([]string, error) {
+	ids := []string{}
+	for _, entry := range strings.Split(getEnv(key, ""), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		id, err := url.Parse(entry)
+		if err != nil || id.Scheme != "spiffe" || id.Host == "" || id.RawQuery != "" || id.Fragment != "" {
+			return nil, fmt.Errorf("invalid %s entry %q, want spiffe://<trust domain>[/<path>]", key, entry)
+		}
+		ids = append(ids, strings.TrimSuffix(entry, "/"))
+	}
+	return ids, nil
+}
+
+// The SPIFFE ID of an X.509 SVID, its one spiffe URI SAN, or "" for other
+// certificates
+func spiffeID(certificate *x509.Certificate) string {
+	for _, uri := range certificate.URIs {
+		if uri.Scheme == "spiffe" {
+			return uri.String()
+		}
+	}
+	return ""
+}
+
+// Whether the ID is one of the allowed ones or in one of their trust
+// domains
+func matchSPIFFEID(allowed []string, id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, entry := range allowed {
+		if id == entry {
+			return true
+		}
+		// A trust domain alone has no path after spiffe://
+		if !strings.Contains(strings.TrimPrefix(entry, "spiffe://"), "/") && strings.HasPrefix(id, entry+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Version of the runtime state document; restoring another version fails
+const stateVersion = 1
+
+// Everything changed at runtime through the admin API: servers with their
+// weights, pools, routes and disabled servers. Exported before a restart
+// and restored afterwards, so manual changes aren't lost. Servers resolved
+// from DNS come back on their own and are left out.
+type RuntimeState struct {
+	Version  int           `json:"version"`
+	TakenAt  time.Time     `json:"takenAt"`
+	Pools    []PoolState   `json:"pools"`
+	Routes   []RouteState  `json:"routes"`
+	Servers  []ServerState `json:"servers"`
+	Disabled []string      `json:"disabled"`
+}
+
+type PoolState struct {
+	Name    string `json:"name"`
+	Options string `json:"options,omitempty"`
+}
+
+type RouteState struct {
+	Prefix  string `json:"prefix"`
+	Pool    string `json:"pool"`
+	Options string `json:"options,omitempty"`
+}
+
+type ServerState struct {
+	URL     string `json:"url"`
+	Options string `json:"options,omitempty"`
+	Weight  int64  `json:"weight"`
+}
+
+func (lb *LoadBalancer) snapshot() RuntimeState {
+	state := RuntimeState{
+		Version:  stateVersion,
+		TakenAt:  time.Now(),
+		Pools:    []PoolState{},
+		Routes:   []RouteState{},
+		Servers:  []ServerState{},
+		Disabled: []string{},
+	}
+
+	for _, pool := range lb.Pools() {
+		state.Pools = append(state.Pools, PoolState{Name: pool.Name, Options: pool.options})
+	}
+	for _, route := range lb.Routes() {
+		state.Routes = append(state.Routes, RouteState{Prefix: route.Prefix, Pool: route.Pool, Options: route.options})
+	}
+	for _, server := range lb.Servers() {
+		if server.Source == "" {
+			state.Servers = append(state.Servers, ServerState{URL: server.rawURL, Options: server.options, Weight: server.Weight()})
+		}
+	}
+
+	lb.mutex.RLock()
+	for id := range lb.disabled {
+		state.Disabled = append(state.Disabled, id)
+	}
+	lb.mutex.RUnlock()
+	sort.Strings(state.Disabled)
+
+	return state
+}
+
+// Brings the load balancer in line with state. Everything is validated
+// before anything changes: missing pools are created, the routes are
+// replaced as a whole, servers are synced like a reload and get their
+// weights back. Pools that already exist keep their options.
+func (lb *LoadBalancer) restore(state RuntimeState) ReloadResult {
+	result := ReloadResult{Added: []string{}, Removed: []string{}, Changed: []string{}, RestartRequired: []string{}}
+	fail := func(format string, args ...any) {
+		result.Errors = append(result.Errors, fmt.Sprintf(format, args...))
+	}
+	if state.Version != stateVersion {
+		fail("unsupported state version %d, expected %d", state.Version, stateVersion)
+		return result
+	}
+
+	// Pools of the state together with the existing ones, so overflow and
+	// route references can point at either
+	known := map[string]*Pool{}
+	for _, pool := range lb.Pools() {
+		known[pool.Name] = pool
+	}
+	created := []*Pool{}
+	for _, ps := range state.Pools {
+		if _, ok := known[ps.Name]; !ok {
+			pool := &Pool{Name: ps.Name, options: ps.Options}
+			known[ps.Name] = pool
+			created = append(created, pool)
+		}
+	}
+	for _, pool := range created {
+		if err := parsePoolOptions(pool, pool.options, known); err != nil {
+			fail("%v", err)
+		}
+		if err := pool.configure(lb.transport, lb.clock); err != nil {
+			fail("%v", err)
+		}
+	}
+
+	routes := Routes{}
+	prefixes := map[string]bool{}
+	for _, rs := range state.Routes {
+		route := &Route{Prefix: rs.Prefix, Pool: rs.Pool, Redirects: RedirectPass, options: rs.Options}
+		if err := parseRouteOptions(route, rs.Options, lb.clock); err != nil {
+			fail("%v", err)
+			continue
+		}
+		for _, name := range []string{route.Pool, route.timeoutPool()} {
+			if _, ok := known[name]; name != "" && !ok {
+				fail("route %s references unknown pool %q", route.Prefix, name)
+			}
+		}
+		if prefixes[route.Prefix] {
+			fail("duplicate route %s", route.Prefix)
+		}
+		prefixes[route.Prefix] = true
+		routes = append(routes, route)
+	}
+	routes.sort()
+
+	wanted := map[string]*Server{}
+	weights := map[string]int64{}
+	for _, ss := range state.Servers {
+		target, err := url.Parse(ss.URL)
+		if err != nil {
+			fail("%v", err)
+			continue
+		}
+		server, err := newServer(target, ss.Options)
+		switch {
+		case err != nil:
+			fail("%v", err)
+			continue
+		case server.resolve:
+			fail("server %s has the resolve option, which is only supported in TARGET_SERVICES", ss.URL)
+		case known[server.Pool] == nil:
+			fail("unknown pool %q for %s", server.Pool, ss.URL)
+		case ss.Weight < 0:
+			fail("invalid weight %d for %s", ss.Weight, ss.URL)
+		case wanted[server.ID()] != nil:
+			fail("duplicate server %s", server.ID())
+		}
+		wanted[server.ID()] = server
+		weights[server.ID()] = ss.Weight
+	}
+	if len(result.Errors) > 0 {
+		return result
+	}
+
+	lb.mutex.Lock()
+	for _, pool := range created {
+		lb.pools[pool.Name] = pool
+	}
+	lb.routes = routes
+	lb.disabled = map[string]bool{}
+	for _, id := range state.Disabled {
+		lb.disabled[id] = true
+	}
+	lb.mutex.Unlock()
+
+	lb.syncServers(wanted, &result)
+	for _, server := range lb.Servers() {
+		if weight, ok := weights[server.ID()]; ok {
+			server.SetWeight(weight)
+		}
+		server.SetDisabled(state.disabledContains(server.ID()))
+	}
+
+	infof("📥 Restored runtime state from %s: %d added, %d removed, %d changed",
+		state.TakenAt.Format(time.RFC3339), len(result.Added), len(result.Removed), len(result.Changed))
+	return result
+}
+
+func (state RuntimeState) disabledContains(id string) bool {
+	for _, disabled := range state.Disabled {
+		if disabled == id {
+			return true
+		}
+	}
+	return false
+}
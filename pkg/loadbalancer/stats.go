@@ -0,0 +1,97 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// Traffic totals of a backend, or of a pool's backends together, since the
+// load balancer started, counted in shards as every request updates them
+type ServerStats struct {
+	requests    shardedCounter
+	status2xx   shardedCounter
+	status3xx   shardedCounter
+	status4xx   shardedCounter
+	status5xx   shardedCounter
+	proxyErrors shardedCounter
+	lastUsed    int64
+	latency     LatencyHistogram
+}
+
+// ServerStats at one point in time, as /lb-status reports them
+type StatsSnapshot struct {
+	Requests uint64 `json:"requests"`
+	// Responses by status class; requests the backend never answered are
+	// ProxyErrors instead
+	Status2xx   uint64 `json:"status2xx"`
+	Status3xx   uint64 `json:"status3xx"`
+	Status4xx   uint64 `json:"status4xx"`
+	Status5xx   uint64 `json:"status5xx"`
+	ProxyErrors uint64 `json:"proxyErrors"`
+	// When a request was last sent, nil for never
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	// Time to response headers in milliseconds, by quantile
+	LatencyP50 float64 `json:"latencyP50Ms"`
+	LatencyP95 float64 `json:"latencyP95Ms"`
+	LatencyP99 float64 `json:"latencyP99Ms"`
+}
+
+func (s *ServerStats) recordRequest() {
+	s.requests.Add(1)
+	// Rewritten at most once a millisecond, so busy backends don't bounce
+	// its cache line between cores on every request
+	now := time.Now().UnixNano()
+	if now-atomic.LoadInt64(&s.lastUsed) >= int64(time.Millisecond) {
+		atomic.StoreInt64(&s.lastUsed, now)
+	}
+}
+
+func (s *ServerStats) recordStatus(status int) {
+	switch {
+	case status >= 500:
+		s.status5xx.Add(1)
+	case status >= 400:
+		s.status4xx.Add(1)
+	case status >= 300:
+		s.status3xx.Add(1)
+	case status >= 200:
+		s.status2xx.Add(1)
+	}
+}
+
+// Time until the backend returned response headers
+func (s *ServerStats) recordLatency(d time.Duration) {
+	s.latency.Record(d)
+}
+
+func (s *ServerStats) recordProxyError() {
+	s.proxyErrors.Add(1)
+}
+
+func (s *ServerStats) Snapshot() StatsSnapshot {
+	stats := StatsSnapshot{
+		Requests:    s.requests.Load(),
+		Status2xx:   s.status2xx.Load(),
+		Status3xx:   s.status3xx.Load(),
+		Status4xx:   s.status4xx.Load(),
+		Status5xx:   s.status5xx.Load(),
+		ProxyErrors: s.proxyErrors.Load(),
+		LatencyP50:  milliseconds(s.latency.Quantile(0.50)),
+		LatencyP95:  milliseconds(s.latency.Quantile(0.95)),
+		LatencyP99:  milliseconds(s.latency.Quantile(0.99)),
+	}
+	if lastUsed := atomic.LoadInt64(&s.lastUsed); lastUsed != 0 {
+		t := time.Unix(0, lastUsed)
+		stats.LastUsed = &t
+	}
+	return stats
+}
+
+func (s *ServerStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Snapshot())
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,163 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Largest UDP payload that fits a typical MTU without fragmenting
+const statsdMaxPacket = 1432
+
+// Pushes counters, timers and gauges to a StatsD or DogStatsD agent. Lines
+// are batched into packets and sent from one goroutine; when the agent
+// can't keep up, lines are dropped rather than slowing down requests.
+type StatsdClient struct {
+	prefix    string
+	dogstatsd bool
+	tags      []string
+	lines     chan string
+	conn      net.Conn
+	// STATSD_FLUSH_INTERVAL, which gauges are reported at too
+	interval time.Duration
+}
+
+func getStatsdEnv() (*StatsdClient, error) {
+	addr := getEnv("STATSD_ADDR", "")
+	if addr == "" {
+		return nil, nil
+	}
+
+	var env envReader
+	client := &StatsdClient{
+		prefix:    getEnv("STATSD_PREFIX", "lb."),
+		dogstatsd: env.Bool("STATSD_DOGSTATSD", true),
+		interval:  env.Duration("STATSD_FLUSH_INTERVAL", time.Second),
+		lines:     make(chan string, 4096),
+	}
+	if env.err != nil {
+		return nil, env.err
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid STATSD_ADDR %q: %v", addr, err)
+	}
+	client.conn = conn
+	for _, tag := range strings.Split(getEnv("STATSD_TAGS", ""), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			client.tags = append(client.tags, tag)
+		}
+	}
+
+	go client.run(client.interval)
+	return client, nil
+}
+
+func (c *StatsdClient) Count(name string, value int64, tags ...string) {
+	if c != nil {
+		c.send(name, strconv.FormatInt(value, 10), "c", tags)
+	}
+}
+
+func (c *StatsdClient) Timing(name string, d time.Duration, tags ...string) {
+	if c != nil {
+		c.send(name, strconv.FormatFloat(milliseconds(d), 'f', 3, 64), "ms", tags)
+	}
+}
+
+func (c *StatsdClient) Gauge(name string, value float64, tags ...string) {
+	if c != nil {
+		c.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", tags)
+	}
+}
+
+// Tags are "key:value" pairs; plain StatsD has no tags, so their values
+// become part of the metric name instead
+func (c *StatsdClient) send(name, value, kind string, tags []string) {
+	var line strings.Builder
+	line.WriteString(c.prefix)
+	line.WriteString(name)
+	if !c.dogstatsd {
+		for _, tag := range tags {
+			_, tagValue, _ := strings.Cut(tag, ":")
+			line.WriteString("." + statsdSanitize(tagValue))
+		}
+	}
+	line.WriteString(":" + value + "|" + kind)
+	if c.dogstatsd {
+		if allTags := append(c.tags[:len(c.tags):len(c.tags)], tags...); len(allTags) > 0 {
+			line.WriteString("|#" + strings.Join(allTags, ","))
+		}
+	}
+
+	select {
+	case c.lines <- line.String():
+	default:
+	}
+}
+
+func (c *StatsdClient) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var packet []byte
+	flush := func() {
+		if len(packet) > 0 {
+			c.conn.Write(packet)
+			packet = packet[:0]
+		}
+	}
+
+	for {
+		select {
+		case line := <-c.lines:
+			if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacket {
+				flush()
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Reports load balancer and per-backend gauges every interval, until ctx
+// is done
+func (lb *LoadBalancer) reportStatsdGauges(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		lb.metrics.statsd.Gauge("in_flight", float64(atomic.LoadInt64(&lb.inFlight)))
+		for _, server := range lb.Servers() {
+			tags := []string{"backend:" + server.URL.Host, "pool:" + server.Pool}
+			lb.metrics.statsd.Gauge("backend.healthy", boolToFloat(server.IsHealthy()), tags...)
+			lb.metrics.statsd.Gauge("backend.active", float64(atomic.LoadInt64(&server.active)), tags...)
+			active, idle, _ := server.upstreamConns()
+			lb.metrics.statsd.Gauge("backend.connections", float64(active), append(tags, "state:active")...)
+			lb.metrics.statsd.Gauge("backend.connections", float64(idle), append(tags, "state:idle")...)
+		}
+	}
+}
+
+func statsdSanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', ',':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,229 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Version of the /lb-status JSON schema. Fields are only ever added within
+// a version; renaming or removing one bumps it.
+const statusSchemaVersion = 1
+
+// What /lb-status reports: plain values copied from the load balancer's
+// state, safe to keep, compare and marshal. GET /lb-status/schema has its
+// JSON schema.
+type StatusResponse struct {
+	SchemaVersion int            `json:"schemaVersion"`
+	LoadBalancer  string         `json:"loadBalancer"`
+	Servers       []ServerStatus `json:"servers"`
+	Pools         []PoolStatus   `json:"pools"`
+	Algorithm     string         `json:"algorithm"`
+	QueueDepth    int64          `json:"queueDepth"`
+	Retries       uint64         `json:"retries"`
+	InFlight      int64          `json:"inFlight"`
+	Brownout      bool           `json:"brownout"`
+	BrownoutShed  uint64         `json:"brownoutShed"`
+	Draining      bool           `json:"draining"`
+	Timestamp     time.Time      `json:"timestamp"`
+}
+
+// Source label of servers from TARGET_SERVICES or the admin API
+const staticSource = "static"
+
+// A backend as reported by /lb-status, copied from its Server.
+// Configuration and availability history are only included with
+// ?verbose=true.
+type ServerStatus struct {
+	ID               string              `json:"id"`
+	URL              string              `json:"url"`
+	Host             string              `json:"host"`
+	Pool             string              `json:"pool"`
+	State            string              `json:"state"`
+	Healthy          bool                `json:"healthy"`
+	Maintenance      bool                `json:"maintenance"`
+	Disabled         bool                `json:"disabled"`
+	Weight           int64               `json:"weight"`
+	ActiveRequests   int64               `json:"activeRequests"`
+	Stats            *StatsSnapshot      `json:"stats"`
+	HostHeader       string              `json:"hostHeader,omitempty"`
+	MaxConns         int64               `json:"maxConns,omitempty"`
+	MaxQueueDepth    int64               `json:"maxQueueDepth,omitempty"`
+	Source           string              `json:"source,omitempty"`
+	Penalized        bool                `json:"penalized,omitempty"`
+	HealthOverride   *HealthOverride     `json:"healthOverride,omitempty"`
+	Availability     *AvailabilityStatus `json:"availability,omitempty"`
+	AlsoDiscoveredBy []string            `json:"alsoDiscoveredBy,omitempty"`
+}
+
+// A Server marshals as its status rather than its internal state
+func (s *Server) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Status(false))
+}
+
+func (s *Server) Status(verbose bool) ServerStatus {
+	stats := s.Stats.Snapshot()
+	status := ServerStatus{
+		ID:               s.ID(),
+		URL:              s.rawURL,
+		Host:             s.URL.Host,
+		Pool:             s.Pool,
+		State:            "up",
+		Healthy:          s.IsHealthy(),
+		Maintenance:      s.InMaintenance(),
+		Disabled:         s.IsDisabled(),
+		Weight:           s.Weight(),
+		ActiveRequests:   atomic.LoadInt64(&s.active),
+		Stats:            &stats,
+		Source:           s.Source,
+		HealthOverride:   s.HealthOverride().copy(),
+		AlsoDiscoveredBy: s.AlsoDiscoveredBy(),
+	}
+	if status.Source == "" {
+		status.Source = staticSource
+	}
+	switch {
+	case status.Disabled:
+		status.State = "disabled"
+	case status.Maintenance:
+		status.State = "maintenance"
+	case !status.Healthy:
+		status.State = "down"
+	}
+
+	if verbose {
+		status.HostHeader = s.HostHeader
+		status.MaxConns = s.MaxConns
+		status.MaxQueueDepth = s.MaxQueueDepth
+		status.Penalized = s.isPenalized()
+		availability := s.Availability.Snapshot()
+		status.Availability = &availability
+	}
+	return status
+}
+
+// Everything known about one backend, for GET /lb-admin/servers/{id}
+type ServerDetail struct {
+	ServerStatus
+	HealthHistory []HealthChange `json:"healthHistory"`
+	// When the RETRY_PENALTY of the last request the backend failed ends,
+	// unset when it isn't penalized. Until then it's skipped while other
+	// backends are available, and still picked when none are.
+	PenalizedUntil *time.Time `json:"penalizedUntil,omitempty"`
+}
+
+func (s *Server) Detail() ServerDetail {
+	detail := ServerDetail{
+		ServerStatus:  s.Status(true),
+		HealthHistory: s.Availability.History(),
+	}
+	if s.isPenalized() {
+		until := time.Unix(0, atomic.LoadInt64(&s.penaltyUntil))
+		detail.PenalizedUntil = &until
+	}
+	return detail
+}
+
+func (lb *LoadBalancer) status(verbose bool) StatusResponse {
+	servers := lb.Servers()
+	status := StatusResponse{
+		SchemaVersion: statusSchemaVersion,
+		LoadBalancer:  "active",
+		Servers:       make([]ServerStatus, 0, len(servers)),
+		Pools:         lb.poolStatuses(),
+		Algorithm:     lb.strategy,
+		QueueDepth:    lb.queue.Depth(),
+		Retries:       atomic.LoadUint64(&lb.retries),
+		InFlight:      atomic.LoadInt64(&lb.inFlight),
+		Brownout:      lb.inBrownout(),
+		BrownoutShed:  atomic.LoadUint64(&lb.brownoutShed),
+		Draining:      lb.draining(),
+		Timestamp:     time.Now(),
+	}
+	for _, server := range servers {
+		status.Servers = append(status.Servers, server.Status(verbose))
+	}
+	return status
+}
+
+func (lb *LoadBalancer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	status := lb.status(query.Get("verbose") == "true")
+
+	switch query.Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		encodeJSON(w, status)
+	case "prometheus":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writePrometheusStatus(w, status)
+	default:
+		http.Error(w, "Unknown format, use json or prometheus", http.StatusBadRequest)
+	}
+}
+
+func (lb *LoadBalancer) poolStatuses() []PoolStatus {
+	statuses := []PoolStatus{}
+	for _, pool := range lb.Pools() {
+		statuses = append(statuses, pool.Status())
+	}
+	return statuses
+}
+
+// The status snapshot in the Prometheus text format, for scrapers that
+// only need the current state rather than the full /metrics histograms
+func writePrometheusStatus(w http.ResponseWriter, status StatusResponse) {
+	var out strings.Builder
+	gauge := func(name, help string) {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	counter := func(name, help string) {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	}
+
+	gauge("lb_status_info", "Schema version of the status snapshot.")
+	fmt.Fprintf(&out, "lb_status_info{schema_version=\"%d\",algorithm=%q} 1\n", status.SchemaVersion, status.Algorithm)
+	gauge("lb_status_in_flight", "Requests being handled.")
+	fmt.Fprintf(&out, "lb_status_in_flight %d\n", status.InFlight)
+	gauge("lb_status_queue_depth", "Requests waiting for a free backend.")
+	fmt.Fprintf(&out, "lb_status_queue_depth %d\n", status.QueueDepth)
+	gauge("lb_status_brownout", "Whether the load balancer is shedding traffic.")
+	fmt.Fprintf(&out, "lb_status_brownout %g\n", boolToFloat(status.Brownout))
+	gauge("lb_status_draining", "Whether the load balancer is refusing new requests to drain.")
+	fmt.Fprintf(&out, "lb_status_draining %g\n", boolToFloat(status.Draining))
+	counter("lb_status_retries_total", "Requests retried on another backend.")
+	fmt.Fprintf(&out, "lb_status_retries_total %d\n", status.Retries)
+	counter("lb_status_brownout_shed_total", "Requests shed during brownout.")
+	fmt.Fprintf(&out, "lb_status_brownout_shed_total %d\n", status.BrownoutShed)
+
+	gauge("lb_status_pool_in_flight", "Requests being handled by the pool.")
+	for _, pool := range status.Pools {
+		fmt.Fprintf(&out, "lb_status_pool_in_flight{pool=%q} %d\n", pool.Name, pool.InFlight)
+	}
+	counter("lb_status_pool_spilled_total", "Requests the pool spilled over to its overflow pool.")
+	for _, pool := range status.Pools {
+		fmt.Fprintf(&out, "lb_status_pool_spilled_total{pool=%q} %d\n", pool.Name, pool.Spilled)
+	}
+
+	gauge("lb_status_backend_state", "Whether the backend is in the state: up, down, maintenance or disabled.")
+	for _, server := range status.Servers {
+		for _, state := range []string{"up", "down", "maintenance", "disabled"} {
+			fmt.Fprintf(&out, "lb_status_backend_state{backend=%q,pool=%q,state=%q} %g\n",
+				server.Host, server.Pool, state, boolToFloat(server.State == state))
+		}
+	}
+	gauge("lb_status_backend_active_requests", "Requests in flight to the backend.")
+	for _, server := range status.Servers {
+		fmt.Fprintf(&out, "lb_status_backend_active_requests{backend=%q,pool=%q} %d\n", server.Host, server.Pool, server.ActiveRequests)
+	}
+	counter("lb_status_backend_requests_total", "Requests sent to the backend.")
+	for _, server := range status.Servers {
+		fmt.Fprintf(&out, "lb_status_backend_requests_total{backend=%q,pool=%q} %d\n",
+			server.Host, server.Pool, server.Stats.Requests)
+	}
+
+	w.Write([]byte(out.String()))
+}
@@ -0,0 +1,70 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JSON schema of what /lb-status returns, cut from the OpenAPI description
+// so the two can't drift apart: StatusResponse and the schemas it refers
+// to, as $defs
+var statusSchema = sync.OnceValue(func() []byte {
+	var spec struct {
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		panic(err)
+	}
+
+	defs := map[string]any{}
+	var collect func(name string)
+	collect = func(name string) {
+		if _, ok := defs[name]; ok {
+			return
+		}
+		schema := spec.Components.Schemas[name]
+		defs[name] = schema
+		for _, ref := range schemaRefs(schema) {
+			collect(ref)
+		}
+	}
+	collect("StatusResponse")
+
+	schema, _ := json.MarshalIndent(map[string]any{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   "Load balancer status, schema version " + strconv.Itoa(statusSchemaVersion),
+		"$ref":    "#/$defs/StatusResponse",
+		"$defs":   defs,
+	}, "", "  ")
+	return []byte(strings.ReplaceAll(string(schema), "#/components/schemas/", "#/$defs/"))
+})
+
+// Names of the component schemas value refers to
+func schemaRefs(value any) []string {
+	var refs []string
+	switch value := value.(type) {
+	case map[string]any:
+		for key, field := range value {
+			if ref, ok := field.(string); ok && key == "$ref" {
+				refs = append(refs, strings.TrimPrefix(ref, "#/components/schemas/"))
+			} else {
+				refs = append(refs, schemaRefs(field)...)
+			}
+		}
+	case []any:
+		for _, item := range value {
+			refs = append(refs, schemaRefs(item)...)
+		}
+	}
+	return refs
+}
+
+func handleStatusSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(statusSchema())
+}
@@ -0,0 +1,91 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Route timeout fallbacks, set with the "ontimeout" route option. Without
+// one, a timed out request gets a 504.
+const (
+	TimeoutFallbackStatic     = "static"
+	TimeoutFallbackCached     = "cached"
+	timeoutFallbackPoolPrefix = "pool:"
+)
+
+// Largest response body remembered as a route's last good response
+const maxCachedBodySize = 1 << 20
+
+func (lb *LoadBalancer) handleTimeout(w http.ResponseWriter, r *http.Request, route *Route) {
+	fallback := route.TimeoutFallback
+
+	switch {
+	case fallback == TimeoutFallbackStatic && lb.fallback != nil:
+		warnf("⚠️  Serving fallback response for timed out %s", r.URL.Path)
+		lb.fallback.Write(w)
+		return
+
+	case fallback == TimeoutFallbackCached:
+		if cached, _ := lb.lastGood.Get(r); cached != nil {
+			warnf("⚠️  Serving last good response for timed out %s", r.URL.Path)
+			cached.Write(w)
+			return
+		}
+
+	case strings.HasPrefix(fallback, timeoutFallbackPoolPrefix) && isRetryable(r):
+		pool := lb.pool(route.timeoutPool())
+		if !pool.enter() {
+			errorf("❌ Timeout fallback pool %s is at capacity", pool.Name)
+			break
+		}
+		defer pool.leave()
+
+		server, err := lb.pickServer(r.Context(), r, pool)
+		if err != nil {
+			errorf("❌ Timeout fallback pool %s unavailable: %v", pool.Name, err)
+			break
+		}
+
+		warnf("⚠️  Sending timed out %s to pool %s", r.URL.Path, pool.Name)
+		// Without a route timeout of its own, the secondary pool gets as long
+		// as the client is willing to wait
+		secondary := &Route{Prefix: route.Prefix, Pool: pool.Name, Redirects: route.Redirects}
+		err = lb.proxyTo(w, r, server, secondary, pool)
+		lb.releaseServer(server)
+		if err == nil {
+			return
+		}
+	}
+
+	lb.errorPages.Write(w, r, http.StatusGatewayTimeout, "Gateway Timeout")
+}
+
+// Copies the body as it streams to the client, handing it over on EOF
+type recordingBody struct {
+	io.ReadCloser
+	buffer   bytes.Buffer
+	overflow bool
+	done     func(body []byte)
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	if !b.overflow {
+		if b.buffer.Len()+n > maxCachedBodySize {
+			b.overflow = true
+			b.buffer = bytes.Buffer{}
+		} else {
+			b.buffer.Write(p[:n])
+		}
+	}
+
+	if err == io.EOF && !b.overflow && b.done != nil {
+		b.done(b.buffer.Bytes())
+		b.done = nil
+	}
+
+	return n, err
+}
@@ -0,0 +1,365 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Client certificate policies of TLS_CLIENT_AUTH
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+// Headers telling backends who the client is, set from its verified
+// certificate and removed from every other request. Spelled canonically,
+// so removing them doesn't allocate.
+const (
+	clientCertSubjectHeader     = "X-Client-Cert-Subject"
+	clientCertFingerprintHeader = "X-Client-Cert-Fingerprint"
+	clientSPIFFEIDHeader        = "X-Client-Spiffe-Id"
+)
+
+// TLS termination on the public listener, enabled by TLS_CERT_FILE and
+// TLS_KEY_FILE. With TLS_CLIENT_CA_FILE clients authenticate with
+// certificates issued by that CA (mutual TLS); TLS_CLIENT_AUTH decides
+// whether they must. The files are read again when they change or on
+// SIGHUP, so certificates can be rotated without a restart, like the
+// short-lived ones a SPIRE agent issues.
+//
+// The UPSTREAM_TLS_* files are watched the same way and present a client
+// certificate to backends, verifying theirs against their CA.
+type TLSFiles struct {
+	// Prefix of the variables the files come from, for errors
+	env        string
+	upstream   bool
+	certFile   string
+	keyFile    string
+	caFile     string
+	clientAuth tls.ClientAuthType
+	policy     TLSPolicy
+	// SPIFFE IDs peers' certificates must have, any when empty
+	spiffeIDs []string
+	interval  time.Duration
+	// What new handshakes use; connections keep what they started with
+	current atomic.Pointer[tls.Config]
+	// Modification times and sizes of the files last loaded
+	stamps  []fileStamp
+	failing bool
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func getTLSFilesEnv() (*TLSFiles, error) {
+	certFile, keyFile := getEnv("TLS_CERT_FILE", ""), getEnv("TLS_KEY_FILE", "")
+	caFile := getEnv("TLS_CLIENT_CA_FILE", "")
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return nil, errors.New("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE to be set")
+		}
+		return nil, nil
+	}
+
+	policy, err := getTLSPolicyEnv()
+	if err != nil {
+		return nil, err
+	}
+	spiffeIDs, err := getSPIFFEIDsEnv("TLS_CLIENT_SPIFFE_IDS")
+	if err != nil {
+		return nil, err
+	}
+	interval, err := getEnvDuration("TLS_RELOAD_INTERVAL", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	t := &TLSFiles{
+		env:       "TLS",
+		certFile:  certFile,
+		keyFile:   keyFile,
+		caFile:    caFile,
+		policy:    policy,
+		spiffeIDs: spiffeIDs,
+		interval:  interval,
+	}
+	defaultClientAuth := ClientAuthNone
+	if caFile != "" {
+		defaultClientAuth = ClientAuthRequire
+	}
+	clientAuth := getEnv("TLS_CLIENT_AUTH", defaultClientAuth)
+	switch clientAuth {
+	case ClientAuthNone:
+		t.clientAuth = tls.NoClientCert
+	case ClientAuthOptional:
+		t.clientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		t.clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid TLS_CLIENT_AUTH %q, want %s, %s or %s", clientAuth, ClientAuthNone, ClientAuthOptional, ClientAuthRequire)
+	}
+	if t.clientAuth != tls.NoClientCert && caFile == "" {
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH=%s needs TLS_CLIENT_CA_FILE to be set", clientAuth)
+	}
+	if len(t.spiffeIDs) > 0 && t.clientAuth == tls.NoClientCert {
+		return nil, errors.New("TLS_CLIENT_SPIFFE_IDS needs TLS_CLIENT_AUTH to be optional or require")
+	}
+
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// The listener's config, handing each handshake the files last loaded
+func (t *TLSFiles) Config() *tls.Config {
+	config := &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.current.Load(), nil
+		},
+	}
+	t.policy.apply(config)
+	return config
+}
+
+// Backend mutual TLS, enabled by UPSTREAM_TLS_CERT_FILE and
+// UPSTREAM_TLS_KEY_FILE, or UPSTREAM_TLS_CA_FILE alone to only verify
+// backends with a private CA
+func getUpstreamTLSFilesEnv() (*TLSFiles, error) {
+	spiffeIDs, err := getSPIFFEIDsEnv("UPSTREAM_SPIFFE_IDS")
+	if err != nil {
+		return nil, err
+	}
+	interval, err := getEnvDuration("TLS_RELOAD_INTERVAL", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	t := &TLSFiles{
+		env:       "UPSTREAM_TLS",
+		upstream:  true,
+		certFile:  getEnv("UPSTREAM_TLS_CERT_FILE", ""),
+		keyFile:   getEnv("UPSTREAM_TLS_KEY_FILE", ""),
+		caFile:    getEnv("UPSTREAM_TLS_CA_FILE", ""),
+		spiffeIDs: spiffeIDs,
+		interval:  interval,
+	}
+	if t.certFile == "" && t.keyFile == "" && t.caFile == "" {
+		if len(t.spiffeIDs) > 0 {
+			return nil, errors.New("UPSTREAM_SPIFFE_IDS needs UPSTREAM_TLS_CA_FILE to be set")
+		}
+		return nil, nil
+	}
+	if (t.certFile == "") != (t.keyFile == "") {
+		return nil, errors.New("UPSTREAM_TLS_CERT_FILE and UPSTREAM_TLS_KEY_FILE must be set together")
+	}
+	if len(t.spiffeIDs) > 0 && t.caFile == "" {
+		return nil, errors.New("UPSTREAM_SPIFFE_IDS needs UPSTREAM_TLS_CA_FILE to be set")
+	}
+
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Dials backends with the files last loaded: presenting the certificate
+// and verifying theirs against the CA, by SPIFFE ID with
+// UPSTREAM_SPIFFE_IDS, as SVIDs have no host names, otherwise by host name
+func (t *TLSFiles) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	config := t.current.Load().Clone()
+	config.ServerName, _, _ = net.SplitHostPort(addr)
+	if len(t.spiffeIDs) > 0 {
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = t.verifyBackend
+	}
+	raw, err := dialUpstream(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (t *TLSFiles) verifyBackend(state tls.ConnectionState) error {
+	options := x509.VerifyOptions{
+		Roots:         t.current.Load().RootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, certificate := range state.PeerCertificates[1:] {
+		options.Intermediates.AddCert(certificate)
+	}
+	if _, err := state.PeerCertificates[0].Verify(options); err != nil {
+		return err
+	}
+	return t.checkSPIFFEID(state.PeerCertificates[0])
+}
+
+// Refuses verified clients whose certificate lacks one of
+// TLS_CLIENT_SPIFFE_IDS
+func (t *TLSFiles) verifyClient(state tls.ConnectionState) error {
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return t.checkSPIFFEID(state.VerifiedChains[0][0])
+}
+
+func (t *TLSFiles) checkSPIFFEID(certificate *x509.Certificate) error {
+	if len(t.spiffeIDs) == 0 {
+		return nil
+	}
+	id := spiffeID(certificate)
+	if !matchSPIFFEID(t.spiffeIDs, id) {
+		return fmt.Errorf("SPIFFE ID %q is not allowed", id)
+	}
+	return nil
+}
+
+// Reads the files and swaps them in; on failure the current ones stay
+func (t *TLSFiles) load() error {
+	stamps := t.stat()
+
+	config := &tls.Config{}
+	if t.certFile != "" {
+		certificate, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+		if err != nil {
+			return fmt.Errorf("invalid %s_CERT_FILE or %s_KEY_FILE: %v", t.env, t.env, err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	var pool *x509.CertPool
+	if t.caFile != "" {
+		caEnv := t.env + "_CLIENT_CA_FILE"
+		if t.upstream {
+			caEnv = t.env + "_CA_FILE"
+		}
+		pem, err := os.ReadFile(t.caFile)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", caEnv, err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("invalid %s: no certificates in %s", caEnv, t.caFile)
+		}
+	}
+	// What http.Server.ServeTLS and http.Transport set, which they can't
+	// for configs returned per handshake or dial
+	config.NextProtos = []string{"h2", "http/1.1"}
+	if t.upstream {
+		config.RootCAs = pool
+	} else {
+		config.ClientAuth = t.clientAuth
+		config.ClientCAs = pool
+		if len(t.spiffeIDs) > 0 {
+			config.VerifyConnection = t.verifyClient
+		}
+		t.policy.apply(config)
+	}
+
+	t.current.Store(config)
+	t.stamps = stamps
+	if len(config.Certificates) > 0 {
+		if leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0]); err == nil {
+			name := leaf.Subject.CommonName
+			if id := spiffeID(leaf); id != "" {
+				name = id
+			}
+			infof("🔐 Loaded %s certificate for %s, valid until %s", t.env, name, leaf.NotAfter.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+func (t *TLSFiles) stat() []fileStamp {
+	stamps := []fileStamp{}
+	for _, path := range []string{t.certFile, t.keyFile, t.caFile} {
+		if path == "" {
+			continue
+		}
+		stamp := fileStamp{}
+		if info, err := os.Stat(path); err == nil {
+			stamp = fileStamp{info.ModTime(), info.Size()}
+		}
+		stamps = append(stamps, stamp)
+	}
+	return stamps
+}
+
+// Reloads the files on a reload signal, and when they change, checked
+// every TLS_RELOAD_INTERVAL unless it is 0
+func (t *TLSFiles) Watch(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	if len(reloadSignals()) > 0 {
+		signal.Notify(signals, reloadSignals()...)
+		defer signal.Stop(signals)
+	}
+	var tick <-chan time.Time
+	if t.interval > 0 {
+		ticker := time.NewTicker(t.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			infof("🔐 Reloading %s files on signal", t.env)
+			t.reload()
+		case <-tick:
+			if !slices.Equal(t.stat(), t.stamps) {
+				t.reload()
+			}
+		}
+	}
+}
+
+func (t *TLSFiles) reload() {
+	if err := t.load(); err != nil {
+		// Logged once, not on every check, as a certificate and key being
+		// replaced one after the other don't match for a moment
+		if !t.failing {
+			errorf("❌ Reloading %s files failed, keeping the current ones: %v", t.env, err)
+		}
+		t.failing = true
+		return
+	}
+	t.failing = false
+}
+
+// Passes the verified client certificate's subject, SHA-256 fingerprint
+// and SPIFFE ID to the backend. Clients can't set these headers themselves.
+func setClientIdentity(r *http.Request) {
+	r.Header.Del(clientCertSubjectHeader)
+	r.Header.Del(clientCertFingerprintHeader)
+	r.Header.Del(clientSPIFFEIDHeader)
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return
+	}
+
+	certificate := r.TLS.VerifiedChains[0][0]
+	fingerprint := sha256.Sum256(certificate.Raw)
+	r.Header.Set(clientCertSubjectHeader, certificate.Subject.String())
+	r.Header.Set(clientCertFingerprintHeader, hex.EncodeToString(fingerprint[:]))
+	if id := spiffeID(certificate); id != "" {
+		r.Header.Set(clientSPIFFEIDHeader, id)
+	}
+}
@@ -0,0 +1,161 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Presets of TLS_PROFILE, after Mozilla's server side TLS guidelines
+const (
+	TLSProfileModern       = "modern"
+	TLSProfileIntermediate = "intermediate"
+	TLSProfileOld          = "old"
+)
+
+// Protocol versions, cipher suites and curves the listener accepts.
+// TLS_PROFILE picks a preset that TLS_MIN_VERSION, TLS_MAX_VERSION,
+// TLS_CIPHER_SUITES and TLS_CURVES override one by one, for deployments
+// whose compliance rules prescribe them.
+type TLSPolicy struct {
+	minVersion uint16
+	// 0 for the newest Go supports
+	maxVersion uint16
+	// TLS 1.0 to 1.2 only, as Go doesn't let TLS 1.3's be configured; nil
+	// for Go's defaults
+	cipherSuites []uint16
+	curves       []tls.CurveID
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// Forward secret AEAD suites, what the intermediate profile allows
+var intermediateCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// What the old profile adds for clients as old as Windows XP and Java 6
+var oldCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+}
+
+func getTLSPolicyEnv() (TLSPolicy, error) {
+	curves := []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}
+	var p TLSPolicy
+	switch profile := strings.ToLower(getEnv("TLS_PROFILE", TLSProfileIntermediate)); profile {
+	case TLSProfileModern:
+		p = TLSPolicy{minVersion: tls.VersionTLS13, curves: curves}
+	case TLSProfileIntermediate:
+		p = TLSPolicy{minVersion: tls.VersionTLS12, cipherSuites: intermediateCipherSuites, curves: curves}
+	case TLSProfileOld:
+		p = TLSPolicy{
+			minVersion:   tls.VersionTLS10,
+			cipherSuites: append(slices.Clone(intermediateCipherSuites), oldCipherSuites...),
+		}
+	default:
+		return TLSPolicy{}, fmt.Errorf("invalid TLS_PROFILE %q, want %s, %s or %s", profile, TLSProfileModern, TLSProfileIntermediate, TLSProfileOld)
+	}
+
+	var err error
+	if value := getEnv("TLS_MIN_VERSION", ""); value != "" {
+		if p.minVersion, err = parseTLSVersion("TLS_MIN_VERSION", value); err != nil {
+			return TLSPolicy{}, err
+		}
+	}
+	if value := getEnv("TLS_MAX_VERSION", ""); value != "" {
+		if p.maxVersion, err = parseTLSVersion("TLS_MAX_VERSION", value); err != nil {
+			return TLSPolicy{}, err
+		}
+	}
+	if p.maxVersion != 0 && p.maxVersion < p.minVersion {
+		return TLSPolicy{}, fmt.Errorf("TLS_MAX_VERSION %s is older than TLS_MIN_VERSION %s", tls.VersionName(p.maxVersion), tls.VersionName(p.minVersion))
+	}
+	if value := getEnv("TLS_CIPHER_SUITES", ""); value != "" {
+		if p.cipherSuites, err = parseCipherSuites(value); err != nil {
+			return TLSPolicy{}, err
+		}
+		// Otherwise the HTTP/2 server refuses to start
+		if !slices.Contains(p.cipherSuites, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) &&
+			!slices.Contains(p.cipherSuites, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256) {
+			return TLSPolicy{}, errors.New("TLS_CIPHER_SUITES needs TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, which HTTP/2 requires")
+		}
+	}
+	if value := getEnv("TLS_CURVES", ""); value != "" {
+		p.curves = nil
+		for _, name := range strings.Split(value, ",") {
+			curve, ok := tlsCurves[strings.ToUpper(strings.TrimSpace(name))]
+			if !ok {
+				return TLSPolicy{}, fmt.Errorf("invalid TLS_CURVES entry %q, want X25519, P256, P384 or P521", name)
+			}
+			p.curves = append(p.curves, curve)
+		}
+	}
+	return p, nil
+}
+
+func parseTLSVersion(key, value string) (uint16, error) {
+	version, ok := tlsVersions[strings.TrimPrefix(strings.ToUpper(value), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("invalid %s %q, want 1.0, 1.1, 1.2 or 1.3", key, value)
+	}
+	return version, nil
+}
+
+// Suites by their IANA names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+func parseCipherSuites(value string) ([]uint16, error) {
+	byName := map[string]*tls.CipherSuite{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		byName[suite.Name] = suite
+	}
+
+	suites := []uint16{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		suite, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS_CIPHER_SUITES entry %q", name)
+		}
+		if !slices.ContainsFunc(suite.SupportedVersions, func(v uint16) bool { return v < tls.VersionTLS13 }) {
+			return nil, fmt.Errorf("invalid TLS_CIPHER_SUITES entry %s: TLS 1.3 suites can't be configured", name)
+		}
+		suites = append(suites, suite.ID)
+	}
+	return suites, nil
+}
+
+func (p TLSPolicy) apply(config *tls.Config) {
+	config.MinVersion = p.minVersion
+	config.MaxVersion = p.maxVersion
+	config.CipherSuites = p.cipherSuites
+	config.CurvePreferences = p.curves
+}
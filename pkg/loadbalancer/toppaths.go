@@ -0,0 +1,171 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sub-windows of the sliding window, each with its own sketch
+const topPathBuckets = 6
+
+// Paths need this many requests in the window to rank as slowest, so a
+// single slow outlier doesn't top the list
+const topPathMinSamples = 5
+
+// Busiest and slowest request paths over a sliding window. Memory is
+// bounded by the space-saving algorithm: each sub-window tracks at most
+// capacity paths, and a new path replaces the least frequent one,
+// inheriting its count as an error bound.
+type TopPaths struct {
+	capacity    int
+	bucketWidth time.Duration
+	buckets     [topPathBuckets]*spaceSaving
+	current     int
+	rotatedAt   time.Time
+	mutex       sync.Mutex
+}
+
+type spaceSaving struct {
+	entries map[string]*topPathEntry
+}
+
+type topPathEntry struct {
+	count   uint64
+	err     uint64 // Upper bound of how much count overestimates the path
+	latency time.Duration
+}
+
+type TopPath struct {
+	Path         string  `json:"path"`
+	Count        uint64  `json:"count"`
+	MaxOvercount uint64  `json:"maxOvercount,omitempty"`
+	AvgLatencyMs float64 `json:"avgLatencyMs"`
+}
+
+type TopPathsResponse struct {
+	Window  string    `json:"window"`
+	Busiest []TopPath `json:"busiest"`
+	Slowest []TopPath `json:"slowest"`
+}
+
+func getTopPathsEnv() (*TopPaths, error) {
+	var env envReader
+	window := env.Duration("TOP_PATHS_WINDOW", time.Minute)
+	t := &TopPaths{
+		capacity:    env.Int("TOP_PATHS_CAPACITY", 100),
+		bucketWidth: window / topPathBuckets,
+		rotatedAt:   time.Now(),
+	}
+	for i := range t.buckets {
+		t.buckets[i] = &spaceSaving{entries: map[string]*topPathEntry{}}
+	}
+	return t, env.err
+}
+
+func (t *TopPaths) Record(path string, latency time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.rotate()
+	t.buckets[t.current].add(path, latency, t.capacity)
+}
+
+// Moves to a fresh sub-window for each bucketWidth that passed
+func (t *TopPaths) rotate() {
+	for i := 0; i < topPathBuckets && time.Since(t.rotatedAt) >= t.bucketWidth; i++ {
+		t.current = (t.current + 1) % topPathBuckets
+		t.buckets[t.current] = &spaceSaving{entries: map[string]*topPathEntry{}}
+		t.rotatedAt = t.rotatedAt.Add(t.bucketWidth)
+	}
+	if time.Since(t.rotatedAt) >= t.bucketWidth {
+		t.rotatedAt = time.Now()
+	}
+}
+
+func (s *spaceSaving) add(path string, latency time.Duration, capacity int) {
+	if entry, ok := s.entries[path]; ok {
+		entry.count++
+		entry.latency += latency
+		return
+	}
+
+	if len(s.entries) < capacity {
+		s.entries[path] = &topPathEntry{count: 1, latency: latency}
+		return
+	}
+
+	minPath, minEntry := "", (*topPathEntry)(nil)
+	for p, entry := range s.entries {
+		if minEntry == nil || entry.count < minEntry.count {
+			minPath, minEntry = p, entry
+		}
+	}
+	delete(s.entries, minPath)
+	s.entries[path] = &topPathEntry{count: minEntry.count + 1, err: minEntry.count, latency: latency}
+}
+
+// Busiest and slowest n paths across the whole window
+func (t *TopPaths) Top(n int) ([]TopPath, []TopPath) {
+	t.mutex.Lock()
+	t.rotate()
+
+	merged := map[string]*topPathEntry{}
+	for _, bucket := range t.buckets {
+		for path, entry := range bucket.entries {
+			total, ok := merged[path]
+			if !ok {
+				total = &topPathEntry{}
+				merged[path] = total
+			}
+			total.count += entry.count
+			total.err += entry.err
+			total.latency += entry.latency
+		}
+	}
+	t.mutex.Unlock()
+
+	paths := make([]TopPath, 0, len(merged))
+	for path, entry := range merged {
+		paths = append(paths, TopPath{
+			Path:         path,
+			Count:        entry.count,
+			MaxOvercount: entry.err,
+			// Inherited counts have no latency, so average over the real samples
+			AvgLatencyMs: milliseconds(entry.latency) / float64(entry.count-entry.err),
+		})
+	}
+
+	sort.Slice(paths, func(i, j int) bool { return paths[i].Count > paths[j].Count })
+	busiest := paths[:min(n, len(paths))]
+
+	slowest := []TopPath{}
+	for _, path := range paths {
+		if path.Count-path.MaxOvercount >= topPathMinSamples {
+			slowest = append(slowest, path)
+		}
+	}
+	sort.Slice(slowest, func(i, j int) bool { return slowest[i].AvgLatencyMs > slowest[j].AvgLatencyMs })
+	slowest = slowest[:min(n, len(slowest))]
+
+	return busiest, slowest
+}
+
+func (t *TopPaths) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil || n <= 0 {
+		n = 10
+	}
+
+	busiest, slowest := t.Top(n)
+	response := TopPathsResponse{
+		Window:  (t.bucketWidth * topPathBuckets).String(),
+		Busiest: busiest,
+		Slowest: slowest,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encodeJSON(w, response)
+}
@@ -0,0 +1,178 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("load-balancer-demo/loadbalancer")
+
+// Whether spans are exported; without an exporter none are started, and
+// requests only pass their callers' trace context on
+var tracingEnabled bool
+
+// Sets up W3C trace context propagation and, when an OTLP endpoint is
+// configured, exports spans to it. The returned function flushes pending
+// spans on shutdown.
+func setupTracing(routes func() Routes) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	ctx := context.Background()
+	res, err := otelResource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	options := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	// The standard OTEL_TRACES_SAMPLER / OTEL_TRACES_SAMPLER_ARG take precedence
+	if os.Getenv("OTEL_TRACES_SAMPLER") == "" {
+		sampler, err := getSamplerEnv(routes)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, sdktrace.WithSampler(sampler))
+	}
+
+	// The exporter reads its endpoint, headers and timeout from the standard OTEL_EXPORTER_OTLP_* variables
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP exporter configuration: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(append(options, sdktrace.WithBatcher(exporter))...)
+	otel.SetTracerProvider(provider)
+	tracingEnabled = true
+
+	infof("🔭 Exporting traces over OTLP")
+	return provider.Shutdown, nil
+}
+
+// Identifies the load balancer in exported traces and logs
+func otelResource(ctx context.Context) (*resource.Resource, error) {
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("load-balancer")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTEL resource attributes: %v", err)
+	}
+	return res, nil
+}
+
+// TRACE_SAMPLE_RATIO of new traces are sampled, or a route's tracesample
+// ratio. With TRACE_SAMPLE_PARENT_BASED, requests that arrive with a trace
+// context keep the caller's decision instead.
+func getSamplerEnv(routes func() Routes) (sdktrace.Sampler, error) {
+	var env envReader
+	ratio := env.Float("TRACE_SAMPLE_RATIO", 1)
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("invalid TRACE_SAMPLE_RATIO %v: must be between 0 and 1", ratio)
+	}
+	parentBased := env.Bool("TRACE_SAMPLE_PARENT_BASED", true)
+	if env.err != nil {
+		return nil, env.err
+	}
+
+	root := &routeSampler{routes: routes, fallback: sdktrace.TraceIDRatioBased(ratio)}
+
+	if parentBased {
+		return sdktrace.ParentBased(root), nil
+	}
+	// Spans within the load balancer still follow their local parent, so a
+	// request's upstream spans are sampled along with it
+	return sdktrace.ParentBased(root,
+		sdktrace.WithRemoteParentSampled(root),
+		sdktrace.WithRemoteParentNotSampled(root)), nil
+}
+
+// Samples a new trace at the ratio of the route its request path matches.
+// Routes are looked up per span, so routes attached at runtime apply too.
+type routeSampler struct {
+	routes   func() Routes
+	fallback sdktrace.Sampler
+}
+
+func (s *routeSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	for _, attribute := range p.Attributes {
+		if attribute.Key != semconv.URLPathKey {
+			continue
+		}
+		if ratio := s.routes().Match(attribute.Value.AsString()).TraceSampleRatio; ratio != nil {
+			return sdktrace.TraceIDRatioBased(*ratio).ShouldSample(p)
+		}
+	}
+	return s.fallback.ShouldSample(p)
+}
+
+func (s *routeSampler) Description() string {
+	return "RouteSampler{" + s.fallback.Description() + "}"
+}
+
+// Starts the load balancer span of a request, continuing the client's trace
+func startServerSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	if !tracingEnabled {
+		if ctx != r.Context() {
+			r = r.WithContext(ctx)
+		}
+		return r, trace.SpanFromContext(ctx)
+	}
+	ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+		))
+	return r.WithContext(ctx), span
+}
+
+// Starts the span of one attempt against a backend
+func startUpstreamSpan(r *http.Request, server *Server) (*http.Request, trace.Span) {
+	if !tracingEnabled {
+		return r, trace.SpanFromContext(r.Context())
+	}
+	ctx, span := tracer.Start(r.Context(), r.Method+" "+server.URL.Host,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.ServerAddress(server.URL.Host),
+		))
+	return r.WithContext(ctx), span
+}
+
+// Passes the current span to the backend in a traceparent header
+func injectTraceContext(req *http.Request) {
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+}
+
+func endSpan(span trace.Span, status int, err error) {
+	if !span.IsRecording() {
+		return
+	}
+	if status != 0 {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
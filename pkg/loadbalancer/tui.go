@@ -0,0 +1,163 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Warnings and errors kept for the TUI's "Recent errors" panel
+const tuiRecentErrors = 8
+
+// Set in --tui mode; logf copies warnings and errors here
+var tuiErrors *recentLines
+
+// Live terminal view of backend health, requests per second and recent
+// errors, redrawn every interval on the alternate screen
+type TUI struct {
+	lb       *LoadBalancer
+	out      io.Writer
+	interval time.Duration
+	previous map[*Server]uint64
+	sampled  time.Time
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Mutes operational and access logs unless they go to LOG_FILE, so they
+// don't scroll the view away; warnings and errors still reach the TUI
+func configureTUILogs() {
+	tuiErrors = &recentLines{max: tuiRecentErrors}
+	if logOutput == os.Stdout {
+		logOutput = io.Discard
+		log.SetOutput(io.Discard)
+	}
+}
+
+func newTUI(lb *LoadBalancer) (*TUI, error) {
+	interval, err := getEnvDuration("TUI_REFRESH_INTERVAL", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	t := &TUI{
+		lb:       lb,
+		out:      os.Stdout,
+		interval: interval,
+		previous: map[*Server]uint64{},
+		sampled:  time.Now(),
+		done:     make(chan struct{}),
+	}
+	return t, nil
+}
+
+func (t *TUI) Start() {
+	fmt.Fprint(t.out, "\033[?1049h\033[?25l")
+	go t.run()
+}
+
+func (t *TUI) run() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	t.draw()
+	for {
+		select {
+		case <-ticker.C:
+			t.draw()
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// Restores the terminal
+func (t *TUI) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.done)
+		fmt.Fprint(t.out, "\033[?25h\033[?1049l")
+	})
+}
+
+func (t *TUI) draw() {
+	now := time.Now()
+	elapsed := now.Sub(t.sampled).Seconds()
+	t.sampled = now
+
+	var screen strings.Builder
+	screen.WriteString("\033[H\033[2J")
+	fmt.Fprintf(&screen, "🚀 Go Load Balancer    %s    in flight: %d    retries: %d",
+		now.Format("15:04:05"), atomic.LoadInt64(&t.lb.inFlight), atomic.LoadUint64(&t.lb.retries))
+	if t.lb.inBrownout() {
+		screen.WriteString("    \033[33mBROWNOUT\033[0m")
+	}
+	screen.WriteString("\n\n")
+
+	fmt.Fprintf(&screen, "  %-6s %-28s %-10s %8s %8s %10s %8s %8s\n",
+		"HEALTH", "BACKEND", "POOL", "RPS", "ACTIVE", "REQUESTS", "5XX", "P95 MS")
+	var totalRPS float64
+	for _, server := range t.lb.Servers() {
+		requests := server.Stats.requests.Load()
+		rps := 0.0
+		if previous, ok := t.previous[server]; ok && elapsed > 0 {
+			rps = float64(requests-previous) / elapsed
+		}
+		t.previous[server] = requests
+		totalRPS += rps
+
+		health := "\033[32m  UP  \033[0m"
+		switch {
+		case server.IsDisabled():
+			health = "\033[90m OFF  \033[0m"
+		case server.InMaintenance():
+			health = "\033[33m MAINT\033[0m"
+		case !server.IsHealthy():
+			health = "\033[31m DOWN \033[0m"
+		}
+		fmt.Fprintf(&screen, "  %s %-28s %-10s %8.1f %8d %10d %8d %8.1f\n",
+			health, server.URL.Host, server.Pool, rps, atomic.LoadInt64(&server.active), requests,
+			server.Stats.status5xx.Load()+server.Stats.proxyErrors.Load(),
+			milliseconds(server.Stats.latency.Quantile(0.95)))
+	}
+	fmt.Fprintf(&screen, "  %-6s %-28s %-10s %8.1f\n\n", "", "total", "", totalRPS)
+
+	screen.WriteString("  Recent errors\n")
+	errors := tuiErrors.Lines()
+	if len(errors) == 0 {
+		screen.WriteString("  -\n")
+	}
+	for _, line := range errors {
+		fmt.Fprintf(&screen, "  %s\n", line)
+	}
+	screen.WriteString("\n  Ctrl-C to stop\n")
+
+	io.WriteString(t.out, screen.String())
+}
+
+// The last max lines added
+type recentLines struct {
+	max   int
+	lines []string
+	mutex sync.Mutex
+}
+
+func (r *recentLines) Add(line string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.lines = append(r.lines, line)
+	if len(r.lines) > r.max {
+		r.lines = r.lines[len(r.lines)-r.max:]
+	}
+}
+
+func (r *recentLines) Lines() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]string(nil), r.lines...)
+}
@@ -0,0 +1,78 @@
+package loadbalancer
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connections open to each backend address and how many were dialed,
+// counted as the transports dial and close them, so metrics show whether
+// connections are being reused
+type upstreamConnCounter struct {
+	mutex sync.Mutex
+	open  map[string]int64
+	dials map[string]uint64
+}
+
+var upstreamConns = &upstreamConnCounter{open: map[string]int64{}, dials: map[string]uint64{}}
+
+var upstreamDialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+// What the transports dial backends with
+func dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := upstreamDNS().dial(ctx, upstreamDialer, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamConns.mutex.Lock()
+	upstreamConns.open[addr]++
+	upstreamConns.dials[addr]++
+	upstreamConns.mutex.Unlock()
+	return &countedConn{Conn: conn, addr: addr}, nil
+}
+
+type countedConn struct {
+	net.Conn
+	addr string
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		upstreamConns.mutex.Lock()
+		upstreamConns.open[c.addr]--
+		upstreamConns.mutex.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// Open connections to the server, split into those serving a request and
+// idle ones, and all it was ever dialed. A connection per request is
+// assumed, as HTTP/1.1 uses; multiplexed HTTP/2 ones count as active.
+func (s *Server) upstreamConns() (active, idle int64, dials uint64) {
+	addr := dialAddress(s.URL)
+	upstreamConns.mutex.Lock()
+	open, dials := upstreamConns.open[addr], upstreamConns.dials[addr]
+	upstreamConns.mutex.Unlock()
+
+	active = min(atomic.LoadInt64(&s.active), open)
+	return active, open - active, dials
+}
+
+// The host:port the transports dial for a URL, with the scheme's default
+// port when it has none
+func dialAddress(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
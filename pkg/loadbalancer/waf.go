@@ -0,0 +1,270 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// What a WAF rule does when it matches, set for all rules with WAF_MODE
+// or per rule
+const (
+	WAFModeEnforce = "enforce"
+	WAFModeLog     = "log"
+)
+
+// A request-blocking rule of WAF_RULES_FILE. Every condition that is set
+// must match; regular expressions use RE2 syntax and match anywhere unless
+// anchored.
+type WAFRule struct {
+	ID      string   `json:"id"`
+	Methods []string `json:"methods"`
+	Path    string   `json:"path"`
+	// Matched against the decoded query string
+	Query string `json:"query"`
+	// Header name to a pattern one of its values must match; an empty
+	// pattern only requires the header
+	Headers map[string]string `json:"headers"`
+	// Matched against the first WAF_BODY_LIMIT bytes of the body
+	Body string `json:"body"`
+	// Largest body in bytes; larger ones match
+	MaxBody int64 `json:"maxBody"`
+	// enforce or log; WAF_MODE when empty
+	Mode string `json:"mode"`
+
+	path    *regexp.Regexp
+	query   *regexp.Regexp
+	headers map[string]*regexp.Regexp
+	body    *regexp.Regexp
+}
+
+// Stops obviously malicious requests at the load balancer. Rules are
+// checked in order: those in log mode only report what they would block,
+// and the first matching enforced rule refuses the request with 403 and
+// counts as a violation for the ban list.
+type WAF struct {
+	rules     []*WAFRule
+	bodyLimit int64
+}
+
+func getWAFEnv() (*WAF, error) {
+	path := getEnv("WAF_RULES_FILE", "")
+	if path == "" {
+		return nil, nil
+	}
+
+	mode := getEnv("WAF_MODE", WAFModeEnforce)
+	if mode != WAFModeEnforce && mode != WAFModeLog {
+		return nil, fmt.Errorf("invalid WAF_MODE %q, want %s or %s", mode, WAFModeEnforce, WAFModeLog)
+	}
+	rules, err := readWAFRules(path, mode)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WAF_RULES_FILE: %v", err)
+	}
+	bodyLimit, err := getEnvInt("WAF_BODY_LIMIT", 64*1024)
+	if err != nil {
+		return nil, err
+	}
+	if bodyLimit < 0 {
+		return nil, fmt.Errorf("invalid WAF_BODY_LIMIT: %d", bodyLimit)
+	}
+	return &WAF{rules: rules, bodyLimit: int64(bodyLimit)}, nil
+}
+
+// Parses a JSON array of rules, compiling their patterns
+func readWAFRules(path, mode string) ([]*WAFRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*WAFRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	ids := map[string]bool{}
+	for i, rule := range rules {
+		if rule.ID == "" {
+			rule.ID = fmt.Sprintf("rule-%d", i+1)
+		}
+		if ids[rule.ID] {
+			return nil, fmt.Errorf("rule %s: duplicate id", rule.ID)
+		}
+		ids[rule.ID] = true
+		if err := rule.compile(mode); err != nil {
+			return nil, fmt.Errorf("rule %s: %v", rule.ID, err)
+		}
+	}
+	return rules, nil
+}
+
+func (rule *WAFRule) compile(mode string) error {
+	if rule.Mode == "" {
+		rule.Mode = mode
+	}
+	if rule.Mode != WAFModeEnforce && rule.Mode != WAFModeLog {
+		return fmt.Errorf("invalid mode %q, want %s or %s", rule.Mode, WAFModeEnforce, WAFModeLog)
+	}
+	if len(rule.Methods) == 0 && rule.Path == "" && rule.Query == "" && len(rule.Headers) == 0 &&
+		rule.Body == "" && rule.MaxBody <= 0 {
+		return fmt.Errorf("no conditions, it would match every request")
+	}
+
+	var err error
+	compile := func(field, pattern string) *regexp.Regexp {
+		if pattern == "" || err != nil {
+			return nil
+		}
+		re, compileErr := regexp.Compile(pattern)
+		if compileErr != nil {
+			err = fmt.Errorf("invalid %s: %v", field, compileErr)
+		}
+		return re
+	}
+	rule.path = compile("path", rule.Path)
+	rule.query = compile("query", rule.Query)
+	rule.body = compile("body", rule.Body)
+	rule.headers = map[string]*regexp.Regexp{}
+	for name, pattern := range rule.Headers {
+		rule.headers[name] = compile("header "+name, pattern)
+	}
+	return err
+}
+
+// The parts of a request rules look at; the body is only read when a rule
+// gets to it
+type wafRequest struct {
+	r         *http.Request
+	query     string
+	bodyLimit int64
+	body      []byte
+	bodyRead  bool
+}
+
+func (in *wafRequest) bodyPrefix() []byte {
+	if in.bodyRead {
+		return in.body
+	}
+	in.bodyRead = true
+	r := in.r
+	if r.Body == nil || r.Body == http.NoBody || in.bodyLimit == 0 {
+		return nil
+	}
+
+	// Reads one byte past the limit, so bodies of unknown length that are
+	// larger still match maxBody
+	in.body, _ = io.ReadAll(io.LimitReader(r.Body, in.bodyLimit+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(in.body), r.Body), r.Body}
+	if int64(len(in.body)) > in.bodyLimit {
+		return in.body[:in.bodyLimit]
+	}
+	return in.body
+}
+
+func (rule *WAFRule) matches(in *wafRequest) bool {
+	r := in.r
+	if len(rule.Methods) > 0 && !containsFold(rule.Methods, r.Method) {
+		return false
+	}
+	if rule.path != nil && !rule.path.MatchString(r.URL.Path) {
+		return false
+	}
+	if rule.query != nil && !rule.query.MatchString(in.query) {
+		return false
+	}
+	for name, pattern := range rule.headers {
+		values := r.Header.Values(name)
+		if len(values) == 0 || (pattern != nil && !anyMatch(pattern, values)) {
+			return false
+		}
+	}
+	if rule.MaxBody > 0 {
+		size := r.ContentLength
+		if size < 0 {
+			in.bodyPrefix()
+			size = int64(len(in.body))
+		}
+		if size <= rule.MaxBody {
+			return false
+		}
+	}
+	if rule.body != nil && !rule.body.Match(in.bodyPrefix()) {
+		return false
+	}
+	return true
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyMatch(pattern *regexp.Regexp, values []string) bool {
+	for _, value := range values {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// The first enforced rule the request matches, nil when it may pass, and
+// the rules in log mode it matched before that
+func (waf *WAF) Check(r *http.Request) (*WAFRule, []*WAFRule) {
+	query, err := url.QueryUnescape(r.URL.RawQuery)
+	if err != nil {
+		query = r.URL.RawQuery
+	}
+	in := &wafRequest{r: r, query: query, bodyLimit: waf.bodyLimit}
+
+	var logged []*WAFRule
+	for _, rule := range waf.rules {
+		if !rule.matches(in) {
+			continue
+		}
+		if rule.Mode == WAFModeEnforce {
+			return rule, logged
+		}
+		logged = append(logged, rule)
+	}
+	return nil, logged
+}
+
+// Answers 403 to a request an enforced WAF rule matches
+func (lb *LoadBalancer) refuseWAFMatch(w http.ResponseWriter, r *http.Request) bool {
+	if lb.waf == nil {
+		return false
+	}
+	rule, logged := lb.waf.Check(r)
+	if rule == nil && len(logged) == 0 {
+		return false
+	}
+
+	client := lb.trustedProxies.ClientIP(r)
+	for _, match := range logged {
+		warnf("🛡️ WAF rule %s would block %s: %s %s", match.ID, client, r.Method, r.URL.Path)
+		lb.metrics.observeWAFMatch(match.ID, match.Mode)
+	}
+	if rule == nil {
+		return false
+	}
+
+	warnf("🛡️ WAF rule %s blocked %s: %s %s", rule.ID, client, r.Method, r.URL.Path)
+	lb.metrics.observeWAFMatch(rule.ID, rule.Mode)
+	lb.recordViolation(r, "waf")
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return true
+}
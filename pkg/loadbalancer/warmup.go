@@ -0,0 +1,64 @@
+package loadbalancer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connections opened to each backend ahead of traffic, 0 to open them on
+// demand. New reads it first, so an invalid value fails there.
+var warmUpConnsEnv = sync.OnceValues(func() (int, error) {
+	return getEnvInt("UPSTREAM_WARMUP_CONNS", 0)
+})
+
+// Opens connections to the server through its pool's transport and leaves
+// them idle, so the first burst after startup or recovery doesn't wait for
+// dials and TLS handshakes. Sends that many /health requests at once, as
+// each one in flight needs a connection of its own.
+func (lb *LoadBalancer) warmUp(server *Server) {
+	pool := lb.pool(server.Pool)
+	n, _ := warmUpConnsEnv()
+	if n <= 0 || pool == nil {
+		return
+	}
+	transport := pool.transport
+	// More than are kept idle would be closed right away
+	idle := transport.MaxIdleConnsPerHost
+	if idle <= 0 {
+		idle = http.DefaultMaxIdleConnsPerHost
+	}
+	n = min(n, idle)
+	if pool.MaxConns > 0 {
+		n = min(n, pool.MaxConns)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var opened atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.rawURL+"/health", nil)
+			if err != nil {
+				return
+			}
+			res, err := transport.RoundTrip(req)
+			if err != nil {
+				return
+			}
+			// Read to the end, so the connection goes back to the idle ones
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			opened.Add(1)
+		}()
+	}
+	wg.Wait()
+	debugf("🔥 Warmed up %d of %d connections to %s", opened.Load(), n, server.rawURL)
+}
@@ -0,0 +1,65 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How long a WebSocket client gets to take a message or answer a ping
+const webSocketWriteTimeout = 10 * time.Second
+
+var eventsUpgrader = websocket.Upgrader{
+	// The token authenticates the feed, not cookies, so a page on another
+	// origin, such as the dashboard on the public port, can't abuse a
+	// visitor's session to read it
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Pushes every event, including admin actions, as JSON text messages over
+// a WebSocket, for the dashboard and lbctl watch
+func (b *EventBus) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := eventsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already answered the client
+		return
+	}
+	defer conn.Close()
+
+	events, unsubscribe := b.Subscribe()
+	defer unsubscribe()
+
+	// Reading handles pings and the close handshake; anything the client
+	// sends otherwise is ignored
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+		select {
+		case event := <-events:
+			err = conn.WriteJSON(event)
+		case <-keepAlive.C:
+			err = conn.WriteMessage(websocket.PingMessage, nil)
+		case <-closed:
+			return
+		case <-b.done:
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"))
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
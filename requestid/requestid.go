@@ -0,0 +1,48 @@
+// Package requestid ties the log lines of one request together across the
+// load balancer and the API services. The load balancer assigns an ID (or
+// keeps the client's), forwards it in the X-Request-ID header, and every
+// service logs it and returns it in its response.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const Header = "X-Request-ID"
+
+type contextKey struct{}
+
+// Random 128-bit ID in hex
+func New() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// ID of the request being handled, empty outside of Middleware
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Reuses the incoming X-Request-ID or assigns a new one, keeps it on the
+// request for proxying, echoes it in the response and puts it in the context
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if id == "" {
+			id = New()
+			r.Header.Set(Header, id)
+		}
+		w.Header().Set(Header, id)
+
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}